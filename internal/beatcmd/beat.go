@@ -32,6 +32,7 @@ import (
 	"time"
 
 	"github.com/gofrs/uuid"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.uber.org/zap"
 	"golang.org/x/sync/errgroup"
 
@@ -308,6 +309,11 @@ func (b *Beat) Run(ctx context.Context) error {
 				return fmt.Errorf("failed to attach http handlers for pprof: %w", err)
 			}
 		}
+		// Serve metrics registered with the default Prometheus registry,
+		// such as those of the tail-sampling storage, for scraping.
+		if err := apiServer.AttachHandler("/metrics", promhttp.Handler()); err != nil {
+			return fmt.Errorf("failed to attach http handler for prometheus metrics: %w", err)
+		}
 	}
 
 	monitoringReporter, err := b.setupMonitoring()
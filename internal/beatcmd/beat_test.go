@@ -20,11 +20,16 @@ package beatcmd
 import (
 	"context"
 	"fmt"
+	"io"
+	"net"
+	"net/http"
 	"os"
+	"path/filepath"
 	"strconv"
 	"testing"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"golang.org/x/sync/errgroup"
@@ -116,6 +121,36 @@ func TestRunnerParams(t *testing.T) {
 	}, m)
 }
 
+func TestRunPrometheusMetrics(t *testing.T) {
+	gauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "beatcmd_test_gauge", Help: "Test gauge."})
+	gauge.Set(123)
+	prometheus.MustRegister(gauge)
+	t.Cleanup(func() { prometheus.Unregister(gauge) })
+
+	socket := filepath.Join(t.TempDir(), "http.sock")
+	beat := newNopBeat(t, fmt.Sprintf("output.console.enabled: true\nhttp.enabled: true\nhttp.host: unix://%s", socket))
+	stop := runBeat(t, beat)
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socket)
+		},
+	}}
+	var body []byte
+	require.Eventually(t, func() bool {
+		resp, err := client.Get("http://localhost/metrics")
+		if err != nil {
+			return false
+		}
+		defer resp.Body.Close()
+		body, err = io.ReadAll(resp.Body)
+		return err == nil && resp.StatusCode == http.StatusOK
+	}, 10*time.Second, 10*time.Millisecond)
+	assert.Contains(t, string(body), "beatcmd_test_gauge 123")
+	assert.NoError(t, stop())
+}
+
 func TestUnmanagedOutputRequired(t *testing.T) {
 	b := newBeat(t, "", func(args RunnerParams) (Runner, error) {
 		panic("unreachable")
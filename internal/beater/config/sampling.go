@@ -18,10 +18,15 @@
 package config
 
 import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/dustin/go-humanize"
 	"github.com/pkg/errors"
+	"github.com/ryanuber/go-glob"
 
 	"github.com/elastic/apm-server/internal/elasticsearch"
 	"github.com/elastic/apm-server/internal/logs"
@@ -53,25 +58,398 @@ type TailSamplingConfig struct {
 	StorageLimit          string                `config:"storage_limit"`
 	StorageLimitParsed    uint64
 
+	// MinTTL and MaxTTL optionally bound TTL, guarding against a TTL so
+	// short that traces expire before a sampling decision is made, or so
+	// long that it exhausts the storage shared by all services. If zero,
+	// TTL is not bounded below or above, respectively.
+	MinTTL time.Duration `config:"min_ttl"`
+	MaxTTL time.Duration `config:"max_ttl"`
+
+	// StorageEnvironmentLimits optionally holds storage limits for the
+	// events of each service environment, such as "2GB", preventing one
+	// environment from using all of StorageLimit. Events of environments
+	// over their limit are handled as when StorageLimit is reached. The
+	// limits must not sum to more than StorageLimit.
+	StorageEnvironmentLimits       map[string]string `config:"storage_environment_limits"`
+	StorageEnvironmentLimitsParsed map[string]uint64
+
+	// StorageMaxTransactionSize holds the maximum size of a storage
+	// transaction, after which pending writes are flushed. If empty,
+	// the database's maximum batch size is used.
+	StorageMaxTransactionSize       string `config:"storage_max_transaction_size"`
+	StorageMaxTransactionSizeParsed uint64
+
+	// StorageMaxEventSize holds the maximum encoded size of a trace event
+	// buffered in storage. Larger events are not buffered, and are handled
+	// as for other storage write failures. If empty, the size of events is
+	// unlimited.
+	StorageMaxEventSize       string `config:"storage_max_event_size"`
+	StorageMaxEventSizeParsed uint64
+
+	// SlidingTTL optionally holds the mode in which the expiry of a
+	// trace's buffered events slides with the trace's activity. If empty,
+	// each event expires TTL after it was received. If "events", all of a
+	// trace's buffered events expire TTL after the trace's most recent
+	// event: each event received rewrites all of the trace's buffered
+	// events, so the cost of buffering a trace grows quadratically with its
+	// number of events. Sampling decisions are not refreshed, as events
+	// are buffered only until their trace is decided.
+	SlidingTTL string `config:"sliding_ttl"`
+
+	// StorageOnLimit holds the strategy for handling buffered events once
+	// the storage limit is reached: "fail_flush" rejects new events,
+	// "drop_oldest" deletes the events closest to expiring,
+	// "drop_unsampled_events" deletes the events of unsampled traces, and
+	// "drop_over_fair_share" deletes the oldest traces of the tenant using
+	// the most storage; see StorageTenantLabel. If empty, "fail_flush" is
+	// used.
+	StorageOnLimit string `config:"storage_on_limit"`
+
+	// StorageTenantLabel and StorageTenantServiceNameSeparator optionally
+	// define the tenant of buffered events, for reporting the storage used
+	// by each tenant and for the "drop_over_fair_share" storage_on_limit
+	// strategy: either the value of the label StorageTenantLabel, or the
+	// prefix of the service name before StorageTenantServiceNameSeparator,
+	// such as "acme" for the service "acme-checkout" with "-". At most one
+	// may be specified. Without either, all events belong to one tenant.
+	// Each trace belongs to the tenant of the first of its events received.
+	// At most 1000 tenants are tracked at a time; traces of further tenants
+	// are attributed to the tenant "_overflow".
+	StorageTenantLabel                string `config:"storage_tenant_label"`
+	StorageTenantServiceNameSeparator string `config:"storage_tenant_service_name_separator"`
+
+	// DecisionConflict holds the policy for handling sampling decisions
+	// made for traces which already have one, such as when a trace sampled
+	// by another APM Server was sampled out locally: "overwrite" keeps the
+	// most recent decision, "prefer_sampled" upgrades unsampled traces to
+	// sampled, and "keep_first" keeps the first decision made. Policies
+	// other than "overwrite" cost a storage read per decision. If empty,
+	// "overwrite" is used.
+	DecisionConflict string `config:"decision_conflict"`
+
+	// StorageDeltaEncoding, if true, stores the events of a trace received
+	// together as deltas against the first of them, omitting shared fields
+	// such as service and agent metadata.
+	StorageDeltaEncoding bool `config:"storage_delta_encoding"`
+
+	// StorageTraceSummaries, if true, maintains a summary of each trace's
+	// buffered events, which is used for matching policies on span total
+	// duration and destination service rather than reading all of the
+	// trace's events. This roughly doubles the number of storage writes.
+	// Summaries record when each trace's first event was written, so the
+	// decision latency metrics are only reported when this is enabled.
+	StorageTraceSummaries bool `config:"storage_trace_summaries"`
+
+	// StorageEventIDIndex, if true, maintains an index from the IDs of
+	// buffered events to their trace IDs, so that buffered events may be
+	// looked up by their ID alone. This doubles the number of storage
+	// writes of events.
+	StorageEventIDIndex bool `config:"storage_event_id_index"`
+
+	// StorageChronologicalKeys, if true, keys buffered events by their
+	// timestamp, so that the events of each sampled trace are published in
+	// chronological order. Deleting individual buffered events then scans
+	// the keys of their trace.
+	StorageChronologicalKeys bool `config:"storage_chronological_keys"`
+
+	// ExpirySweepInterval holds the interval at which storage is scanned
+	// for traces whose buffered events expired before a sampling decision
+	// was made. Detection is best effort. If zero, storage is not scanned.
+	ExpirySweepInterval time.Duration `config:"expiry_sweep_interval"`
+
+	// StorageDecisionFilterCapacity, if positive, enables an in-memory
+	// bloom filter of the traces with sampling decisions, sized for this
+	// many decisions, so that lookups of traces without a decision do not
+	// read the storage. The filter is rebuilt from the storage every TTL.
+	// It must not be enabled when the storage is shared by servers, such
+	// as with storage_node_id.
+	StorageDecisionFilterCapacity int `config:"storage_decision_filter_capacity"`
+
+	// StorageGCUtilizationTrigger, if non-zero, holds the ratio of the
+	// storage's size to storage_limit, in the range (0,1], at or above
+	// which storage garbage collection is run in addition to every
+	// storage_gc_interval, such as 0.7 to collect promptly during bursts.
+	// Utilization is checked every 10 seconds, and runs are triggered at
+	// most once a minute. It has no effect without a storage_limit.
+	StorageGCUtilizationTrigger float64 `config:"storage_gc_utilization_trigger"`
+
+	// StoragePersistSamplerState, if true, persists the ingest rates and
+	// effective sample rates learned by tail-sampling policies to storage
+	// at every interval, and restores them on startup, so that the rates
+	// need not be relearned after a restart. Persisted rates expire after
+	// the TTL, and are discarded for policies which have changed.
+	StoragePersistSamplerState bool `config:"storage_persist_sampler_state"`
+
+	// StorageLogLevel holds the minimum level of the storage database's
+	// log messages to log, e.g. "warning". If empty, "info" is used.
+	StorageLogLevel logp.Level `config:"storage_log_level"`
+
+	// StorageCoalesceWrites, if true, counts repeated writes of the same
+	// event before they are flushed, such as when an agent retries, as a
+	// single write. This reduces flushes for clients which retry often, at
+	// the cost of tracking the keys of unflushed writes in memory.
+	StorageCoalesceWrites bool `config:"storage_coalesce_writes"`
+
+	// StorageValueLogFileSize holds the size of the storage database's
+	// value log files, such as "256MB". If empty, 64MB is used.
+	StorageValueLogFileSize       string `config:"storage_value_log_file_size"`
+	StorageValueLogFileSizeParsed uint64
+
+	// StorageMinFreeDisk holds the minimum free space to maintain on the
+	// filesystem containing the storage database, either in bytes, such
+	// as "10GB", or as a percentage of the filesystem's size, such as
+	// "5%". While free space is below the minimum, events are dropped
+	// rather than buffered, as when StorageLimit is reached, but sampling
+	// decisions are still recorded. If empty, free space is not checked.
+	StorageMinFreeDisk              string `config:"storage_min_free_disk"`
+	StorageMinFreeDiskBytesParsed   uint64
+	StorageMinFreeDiskPercentParsed float64
+
+	// StorageMaxLevels and StorageLevelSizeMultiplier hold the maximum
+	// number of levels of the storage database's LSM tree, and the ratio
+	// between the sizes of consecutive levels. If zero, the database's
+	// defaults of 7 and 10 are used.
+	StorageMaxLevels           int `config:"storage_max_levels"`
+	StorageLevelSizeMultiplier int `config:"storage_level_size_multiplier"`
+
+	// StorageDisableConflictDetection, if true, disables the storage
+	// database's detection of conflicting transactions. Each trace's events
+	// are written by a single storage writer, so conflicts only arise from
+	// background deletions racing with writes; with detection disabled,
+	// the last write wins rather than the write failing.
+	StorageDisableConflictDetection bool `config:"storage_disable_conflict_detection"`
+
+	// StorageNamespace, if non-empty, prefixes the keys of all entries in
+	// the storage database, so that multiple logical stores may share it.
+	// It must not contain ':'.
+	StorageNamespace string `config:"storage_namespace"`
+
+	// StorageNodeID, if non-empty, identifies this server in the keys of
+	// the trace events it buffers, so that servers sharing the storage
+	// database do not replace each other's events. Sampling decisions
+	// remain shared by all servers. It must not contain ':' or '/'.
+	StorageNodeID string `config:"storage_node_id"`
+
+	// VerifyElasticsearch, if true, checks at startup that the Elasticsearch
+	// cluster used for sharing sampling decisions is reachable with the
+	// configured credentials, failing startup otherwise. This is disabled
+	// by default, so the server may start before Elasticsearch is available.
+	VerifyElasticsearch bool `config:"verify_elasticsearch"`
+
+	// MaxConcurrentTraces, if positive, limits the number of traces whose
+	// events are buffered awaiting a sampling decision. Once reached, new
+	// traces are decided immediately using the default policy's sample
+	// rate. Zero, the default, means no limit.
+	MaxConcurrentTraces int `config:"max_concurrent_traces"`
+
+	// AllowedSampleRates, if non-empty, holds the sample rates to which
+	// effective sample rates are snapped, in descending order, such as
+	// [1, 0.5, 0.1, 0.01]. Empty, the default, means rates are not snapped.
+	AllowedSampleRates []float64 `config:"allowed_sample_rates"`
+
 	esConfigured bool
 }
 
 // TailSamplingPolicy holds a tail-sampling policy.
 type TailSamplingPolicy struct {
-	// Service holds attributes of the service which this policy matches.
+	// Name optionally holds a name for identifying the policy in logs and
+	// error messages. If specified, it must be unique across all policies.
+	Name string `config:"name"`
+
+	TailSamplingCriteria `config:",inline"`
+
+	// Conditions optionally holds a tree of conditions which this policy
+	// matches, for criteria which cannot be expressed by the flat service,
+	// cloud, and trace criteria, such as "service X and (failure or slow)".
+	// If specified, it supersedes the flat criteria, which must then be
+	// empty.
+	Conditions *TailSamplingCondition `config:"conditions"`
+
+	// SampleRate holds the sample rate applied for this policy.
+	SampleRate float64 `config:"sample_rate" validate:"min=0, max=1"`
+
+	// ErrorRateScaling, if true, scales SampleRate up in proportion to
+	// the fraction of failed root transactions observed for each service
+	// matching this policy, over the last sampling interval.
+	ErrorRateScaling bool `config:"error_rate_scaling"`
+
+	// ErrorRateMultiplier holds the multiplier applied to the observed
+	// error fraction when ErrorRateScaling is enabled.
+	ErrorRateMultiplier float64 `config:"error_rate_multiplier"`
+
+	// ErrorRateDeadBand holds the minimum change in the error-scaled
+	// sample rate for the applied rate to be changed, damping small
+	// fluctuations when ErrorRateScaling is enabled.
+	ErrorRateDeadBand float64 `config:"error_rate_dead_band"`
+
+	// ErrorRateMinHold holds the minimum duration for which the applied
+	// sample rate is held after changing, when ErrorRateScaling is enabled.
+	ErrorRateMinHold time.Duration `config:"error_rate_min_hold"`
+}
+
+// TailSamplingCriteria holds the criteria which a tail-sampling policy or
+// condition matches. Empty criteria match all traces.
+type TailSamplingCriteria struct {
+	// Service holds attributes of the service which this policy or
+	// condition matches.
 	Service struct {
 		Name        string `config:"name"`
 		Environment string `config:"environment"`
 	} `config:"service"`
 
-	// Trace holds attributes of the trace which this policy matches.
+	// Cloud holds attributes of the cloud in which the trace originated,
+	// which this policy or condition matches. Region may be a glob pattern,
+	// where "*" matches any sequence of characters. Traces without the
+	// cloud fields do not match.
+	Cloud struct {
+		Provider string `config:"provider"`
+		Region   string `config:"region"`
+	} `config:"cloud"`
+
+	// User holds glob patterns matched against the user.id and user.email
+	// fields of the root transaction, where "*" matches any sequence of
+	// characters. Traces without the user fields do not match.
+	//
+	// User identifiers are personal data: patterns are held in the
+	// configuration in plain text, and may be logged with it. Matching
+	// on them does not affect what is stored with sampled events.
+	User struct {
+		ID    string `config:"id"`
+		Email string `config:"email"`
+	} `config:"user"`
+
+	// Trace holds attributes of the trace which this policy or condition
+	// matches.
 	Trace struct {
 		Name    string `config:"name"`
 		Outcome string `config:"outcome"`
+
+		// URLPath holds a glob pattern matched against the root
+		// transaction's url.path, where "*" matches any sequence of
+		// characters. Traces without a URL path do not match.
+		URLPath string `config:"url_path"`
+
+		// Result holds a glob pattern matched against the root
+		// transaction's result, such as "HTTP 2xx" or "Error", where
+		// "*" matches any sequence of characters. Traces without a
+		// result do not match.
+		Result string `config:"result"`
+
+		// TransactionType holds a glob pattern matched against the root
+		// transaction's type, such as "request" or "messaging", where
+		// "*" matches any sequence of characters. Traces whose root
+		// transaction has no type do not match.
+		TransactionType string `config:"transaction_type"`
+
+		// UpstreamSampled, if specified, holds the sampling decision
+		// propagated to the root transaction from upstream, such as with
+		// the W3C traceparent sampled flag. Transactions without the
+		// flag are treated as unsampled. Head-unsampled transactions are
+		// not tail-sampled, so only true is useful in practice.
+		UpstreamSampled *bool `config:"upstream_sampled"`
+
+		// SpanTotalDuration matches traces by the total duration of their
+		// spans of a given type, such as "db", received before the root
+		// transaction. Spans' full durations are summed, rather than their
+		// self time excluding child spans.
+		SpanTotalDuration struct {
+			Type string        `config:"type"`
+			Min  time.Duration `config:"min"`
+		} `config:"span_total_duration"`
+
+		// DestinationService holds a glob pattern matched against the
+		// span.destination.service.resource of the trace's spans
+		// received before the root transaction, where "*" matches any
+		// sequence of characters. Traces match if any such span matches;
+		// traces without spans with a destination do not match.
+		DestinationService string `config:"destination_service"`
+
+		// SpanDurationRatio holds the minimum ratio of the total duration
+		// of the trace's spans received before the root transaction to
+		// the root transaction's duration, such as 2 for traces whose
+		// spans took at least twice as long in total as the root. This
+		// matches traces with concurrent or asynchronous fan-out. Root
+		// transactions without a duration do not match.
+		SpanDurationRatio float64 `config:"span_duration_ratio"`
+
+		// SpanLabels holds string labels matched against the labels of
+		// the trace's spans received before the root transaction.
+		// Traces match if any such span has all of the labels with the
+		// given values; labels of transactions are not considered.
+		SpanLabels map[string]string `config:"span_labels"`
+
+		// DBStatement holds a glob pattern matched against the
+		// span.db.statement of the trace's spans received before the
+		// root transaction, such as "SELECT * FROM orders*", where "*"
+		// matches any sequence of characters. Traces match if any such
+		// span's statement matches; matching is case-sensitive, and only
+		// the first 10000 bytes of each statement are matched.
+		//
+		// Matching statements requires reading and decoding all of the
+		// trace's buffered events for each root transaction, even with
+		// storage_trace_summaries, and scanning each statement, which can
+		// add significantly to CPU usage for traces with many spans.
+		DBStatement string `config:"db_statement"`
+
+		// TimeWindows holds windows of the time of day, in TimeZone,
+		// such as {start: "22:00", end: "06:00"}, matched against the
+		// start time of the trace's root transaction. Windows include
+		// their start and exclude their end, may span midnight, and
+		// must not overlap.
+		TimeWindows []TailSamplingTimeWindow `config:"time_windows"`
+
+		// TimeZone holds the IANA name of the time zone in which
+		// TimeWindows are evaluated, such as "Europe/Berlin". If empty,
+		// UTC is used.
+		TimeZone string `config:"time_zone"`
 	} `config:"trace"`
+}
 
-	// SampleRate holds the sample rate applied for this policy.
-	SampleRate float64 `config:"sample_rate" validate:"min=0, max=1"`
+// TailSamplingTimeWindow holds a window of the time of day matched by a
+// tail-sampling policy or condition.
+type TailSamplingTimeWindow struct {
+	Start TimeOfDay `config:"start"`
+	End   TimeOfDay `config:"end"`
+}
+
+// contains reports whether the window contains the time of day t.
+func (w TailSamplingTimeWindow) contains(t TimeOfDay) bool {
+	if w.Start < w.End {
+		return t >= w.Start && t < w.End
+	}
+	return t >= w.Start || t < w.End
+}
+
+// TimeOfDay holds a time of day as the duration since midnight, unpacked
+// from a string formatted as "HH:MM".
+type TimeOfDay time.Duration
+
+// Unpack parses s as a time of day formatted as "HH:MM".
+func (t *TimeOfDay) Unpack(s string) error {
+	parsed, err := time.Parse("15:04", s)
+	if err != nil {
+		return errors.Errorf("invalid time of day %q: must be formatted as HH:MM", s)
+	}
+	*t = TimeOfDay(time.Duration(parsed.Hour())*time.Hour + time.Duration(parsed.Minute())*time.Minute)
+	return nil
+}
+
+// isZero reports whether no criteria are specified.
+func (c TailSamplingCriteria) isZero() bool {
+	return reflect.DeepEqual(c, TailSamplingCriteria{})
+}
+
+// TailSamplingCondition holds a node in a tree of tail-sampling policy
+// conditions. A condition matches a trace if its criteria match, all of
+// the conditions in And match, at least one of the conditions in Or match
+// (if any are specified), and the condition in Not does not match (if
+// specified). A condition must specify at least one of these.
+type TailSamplingCondition struct {
+	TailSamplingCriteria `config:",inline"`
+
+	And []TailSamplingCondition `config:"and"`
+	Or  []TailSamplingCondition `config:"or"`
+	Not *TailSamplingCondition  `config:"not"`
 }
 
 func (c *TailSamplingConfig) Unpack(in *config.C) error {
@@ -95,11 +473,66 @@ func (c *TailSamplingConfig) Unpack(in *config.C) error {
 		return err
 	}
 	cfg.StorageLimitParsed = limit
+	if cfg.StorageMaxTransactionSize != "" {
+		cfg.StorageMaxTransactionSizeParsed, err = humanize.ParseBytes(cfg.StorageMaxTransactionSize)
+		if err != nil {
+			return err
+		}
+	}
+	if cfg.StorageMaxEventSize != "" {
+		cfg.StorageMaxEventSizeParsed, err = humanize.ParseBytes(cfg.StorageMaxEventSize)
+		if err != nil {
+			return err
+		}
+		if cfg.StorageMaxEventSizeParsed == 0 {
+			err = errors.New("storage_max_event_size must be positive")
+			return err
+		}
+	}
+	if cfg.StorageMinFreeDisk != "" {
+		if err = parseMinFreeDisk((*TailSamplingConfig)(&cfg)); err != nil {
+			return err
+		}
+	}
+	if cfg.StorageValueLogFileSize != "" {
+		cfg.StorageValueLogFileSizeParsed, err = humanize.ParseBytes(cfg.StorageValueLogFileSize)
+		if err != nil {
+			return err
+		}
+	}
+	if len(cfg.StorageEnvironmentLimits) > 0 {
+		cfg.StorageEnvironmentLimitsParsed = make(map[string]uint64, len(cfg.StorageEnvironmentLimits))
+		for env, envLimit := range cfg.StorageEnvironmentLimits {
+			var parsed uint64
+			if parsed, err = humanize.ParseBytes(envLimit); err != nil {
+				err = errors.Wrapf(err, "invalid storage_environment_limits for %q", env)
+				return err
+			}
+			cfg.StorageEnvironmentLimitsParsed[env] = parsed
+		}
+	}
 	cfg.Enabled = in.Enabled()
 	*c = TailSamplingConfig(cfg)
 	c.esConfigured = in.HasField("elasticsearch")
 	c.StorageLimitParsed = limit
 	err = errors.Wrap(c.Validate(), "invalid config")
+	if err == nil && c.Enabled {
+		logger := logp.NewLogger(logs.Config)
+		for _, s := range c.shadowedPolicies() {
+			logger.Warnf(
+				"tail sampling %s will never match: all matching traces are matched first by %s",
+				c.Policies[s.shadowed].describe(s.shadowed), c.Policies[s.by].describe(s.by),
+			)
+		}
+		for i, policy := range c.Policies {
+			if sampled := policy.Trace.UpstreamSampled; sampled != nil && !*sampled {
+				logger.Warnf(
+					"tail sampling %s will never match: head-unsampled transactions are not tail-sampled",
+					policy.describe(i),
+				)
+			}
+		}
+	}
 	return nil
 }
 
@@ -111,19 +544,377 @@ func (c *TailSamplingConfig) Validate() error {
 		return errors.New("no policies specified")
 	}
 	var anyDefaultPolicy bool
-	for _, policy := range c.Policies {
-		if policy == (TailSamplingPolicy{SampleRate: policy.SampleRate}) {
+	names := make(map[string]int)
+	for i, policy := range c.Policies {
+		if policy.isDefault() {
 			// We have at least one default policy.
 			anyDefaultPolicy = true
-			break
+		}
+		if policy.Name != "" {
+			if j, ok := names[policy.Name]; ok {
+				return errors.Errorf("%s: name is not unique, also used by policy %d", policy.describe(i), j)
+			}
+			names[policy.Name] = i
+		}
+		if policy.ErrorRateScaling && policy.ErrorRateMultiplier <= 0 {
+			return errors.Errorf("%s: error_rate_multiplier must be positive when error_rate_scaling is enabled", policy.describe(i))
+		}
+		if policy.ErrorRateDeadBand < 0 || policy.ErrorRateDeadBand >= 1 {
+			return errors.Errorf("%s: error_rate_dead_band must be in the range [0,1)", policy.describe(i))
+		}
+		if policy.ErrorRateMinHold < 0 {
+			return errors.Errorf("%s: error_rate_min_hold must not be negative", policy.describe(i))
+		}
+		if err := policy.TailSamplingCriteria.validate(); err != nil {
+			return errors.Wrap(err, policy.describe(i))
+		}
+		if policy.Conditions != nil {
+			if !policy.TailSamplingCriteria.isZero() {
+				return errors.Errorf("%s: conditions cannot be combined with service, cloud, user, or trace criteria", policy.describe(i))
+			}
+			if err := policy.Conditions.validate("conditions"); err != nil {
+				return errors.Wrap(err, policy.describe(i))
+			}
 		}
 	}
 	if !anyDefaultPolicy {
 		return errors.New("no default (empty criteria) policy specified")
 	}
+	if c.ExpirySweepInterval < 0 {
+		return errors.New("expiry_sweep_interval must not be negative")
+	}
+	if c.StorageDecisionFilterCapacity < 0 {
+		return errors.New("storage_decision_filter_capacity must not be negative")
+	}
+	if c.StorageGCUtilizationTrigger < 0 || c.StorageGCUtilizationTrigger > 1 {
+		return errors.New("storage_gc_utilization_trigger must be between 0 and 1")
+	}
+	if c.MaxConcurrentTraces < 0 {
+		return errors.New("max_concurrent_traces must not be negative")
+	}
+	for i, rate := range c.AllowedSampleRates {
+		if rate < 0 || rate > 1 {
+			return errors.New("allowed_sample_rates values must be between 0 and 1")
+		}
+		if i > 0 && rate >= c.AllowedSampleRates[i-1] {
+			return errors.New("allowed_sample_rates must be sorted in descending order")
+		}
+	}
+	if err := c.validateTTL(); err != nil {
+		return err
+	}
+	if c.StorageLimitParsed > 0 {
+		var total uint64
+		for _, envLimit := range c.StorageEnvironmentLimitsParsed {
+			total += envLimit
+		}
+		if total > c.StorageLimitParsed {
+			return errors.Errorf(
+				"storage_environment_limits total %s exceeds storage_limit %s",
+				humanize.Bytes(total), humanize.Bytes(c.StorageLimitParsed),
+			)
+		}
+	}
+	if strings.Contains(c.StorageNamespace, ":") {
+		return errors.Errorf("storage_namespace %q must not contain ':'", c.StorageNamespace)
+	}
+	if strings.ContainsAny(c.StorageNodeID, ":/") {
+		return errors.Errorf("storage_node_id %q must not contain ':' or '/'", c.StorageNodeID)
+	}
+	if c.StorageDecisionFilterCapacity > 0 && c.StorageNodeID != "" {
+		return errors.New("storage_decision_filter_capacity must not be specified with storage_node_id")
+	}
+	switch c.SlidingTTL {
+	case "", "events":
+	default:
+		return errors.Errorf("sliding_ttl %q must be events, or empty", c.SlidingTTL)
+	}
+	switch c.StorageOnLimit {
+	case "", "fail_flush", "drop_oldest", "drop_unsampled_events", "drop_over_fair_share":
+	default:
+		return errors.Errorf(
+			"storage_on_limit %q must be one of fail_flush, drop_oldest, drop_unsampled_events, or drop_over_fair_share",
+			c.StorageOnLimit,
+		)
+	}
+	if c.StorageTenantLabel != "" && c.StorageTenantServiceNameSeparator != "" {
+		return errors.New("only one of storage_tenant_label or storage_tenant_service_name_separator may be specified")
+	}
+	switch c.DecisionConflict {
+	case "", "overwrite", "prefer_sampled", "keep_first":
+	default:
+		return errors.Errorf(
+			"decision_conflict %q must be one of overwrite, prefer_sampled, or keep_first",
+			c.DecisionConflict,
+		)
+	}
+	for j, later := range c.Policies {
+		for i, earlier := range c.Policies[:j] {
+			if earlier.sameCriteria(later) && earlier.SampleRate != later.SampleRate {
+				return errors.Errorf(
+					"%s and %s have identical criteria but different sample rates",
+					earlier.describe(i), later.describe(j),
+				)
+			}
+		}
+	}
 	return nil
 }
 
+// maxDBStatementPatternLength holds the maximum length in bytes of the
+// trace.db_statement pattern. Only this many bytes of each statement are
+// matched, so longer patterns could never match.
+const maxDBStatementPatternLength = 10000
+
+// validate validates the criteria, returning an error which describes
+// the first invalid criterion.
+func (c TailSamplingCriteria) validate() error {
+	if p := c.Trace.URLPath; p != "" && !strings.HasPrefix(p, "/") && !strings.HasPrefix(p, "*") {
+		// Glob patterns cannot be malformed, as "*" is the only special
+		// character, but a pattern can only match a path if it begins
+		// with "/" or a wildcard.
+		return errors.Errorf("trace.url_path pattern %q must begin with '/' or '*'", p)
+	}
+	if err := validateGlob(c.Trace.Result); err != nil {
+		return errors.Wrap(err, "invalid trace.result")
+	}
+	if err := validateGlob(c.Trace.TransactionType); err != nil {
+		return errors.Wrap(err, "invalid trace.transaction_type")
+	}
+	if err := validateGlob(c.Cloud.Region); err != nil {
+		return errors.Wrap(err, "invalid cloud.region")
+	}
+	if err := validateGlob(c.User.ID); err != nil {
+		return errors.Wrap(err, "invalid user.id")
+	}
+	if err := validateGlob(c.User.Email); err != nil {
+		return errors.Wrap(err, "invalid user.email")
+	}
+	if err := validateGlob(c.Trace.DestinationService); err != nil {
+		return errors.Wrap(err, "invalid trace.destination_service")
+	}
+	if c.Trace.SpanTotalDuration.Min < 0 {
+		return errors.New("trace.span_total_duration.min must not be negative")
+	}
+	if c.Trace.SpanTotalDuration.Min > 0 && c.Trace.SpanTotalDuration.Type == "" {
+		return errors.New("trace.span_total_duration.type must be specified with trace.span_total_duration.min")
+	}
+	if c.Trace.SpanDurationRatio < 0 {
+		return errors.New("trace.span_duration_ratio must not be negative")
+	}
+	if _, ok := c.Trace.SpanLabels[""]; ok {
+		return errors.New("trace.span_labels keys must not be empty")
+	}
+	if err := validateGlob(c.Trace.DBStatement); err != nil {
+		return errors.Wrap(err, "invalid trace.db_statement")
+	}
+	if len(c.Trace.DBStatement) > maxDBStatementPatternLength {
+		return errors.Errorf("trace.db_statement must not be longer than %d bytes", maxDBStatementPatternLength)
+	}
+	for i, w := range c.Trace.TimeWindows {
+		if w.Start == w.End {
+			return errors.Errorf("trace.time_windows %d start and end must differ", i)
+		}
+		for j, other := range c.Trace.TimeWindows[:i] {
+			if w.contains(other.Start) || other.contains(w.Start) {
+				return errors.Errorf("trace.time_windows %d and %d overlap", j, i)
+			}
+		}
+	}
+	if c.Trace.TimeZone != "" {
+		if len(c.Trace.TimeWindows) == 0 {
+			return errors.New("trace.time_zone must be specified with trace.time_windows")
+		}
+		if _, err := time.LoadLocation(c.Trace.TimeZone); err != nil {
+			return errors.Wrap(err, "invalid trace.time_zone")
+		}
+	}
+	return nil
+}
+
+// validateTTL validates MinTTL and MaxTTL, and that TTL is within them.
+func (c *TailSamplingConfig) validateTTL() error {
+	if c.MinTTL < 0 {
+		return errors.New("min_ttl must not be negative")
+	}
+	if c.MaxTTL < 0 {
+		return errors.New("max_ttl must not be negative")
+	}
+	if c.MaxTTL > 0 && c.MinTTL > c.MaxTTL {
+		return errors.Errorf("min_ttl %s exceeds max_ttl %s", c.MinTTL, c.MaxTTL)
+	}
+	if c.TTL < c.MinTTL {
+		return errors.Errorf("ttl %s is less than min_ttl %s", c.TTL, c.MinTTL)
+	}
+	if c.MaxTTL > 0 && c.TTL > c.MaxTTL {
+		return errors.Errorf("ttl %s exceeds max_ttl %s", c.TTL, c.MaxTTL)
+	}
+	return nil
+}
+
+// validate validates the condition and the conditions nested within it.
+// path holds the condition's config path, for use in error messages.
+func (c *TailSamplingCondition) validate(path string) error {
+	if c.TailSamplingCriteria.isZero() && len(c.And) == 0 && len(c.Or) == 0 && c.Not == nil {
+		return errors.Errorf("%s: condition must specify criteria, and, or, or not", path)
+	}
+	if err := c.TailSamplingCriteria.validate(); err != nil {
+		return errors.Wrap(err, path)
+	}
+	for i := range c.And {
+		if err := c.And[i].validate(fmt.Sprintf("%s.and.%d", path, i)); err != nil {
+			return err
+		}
+	}
+	for i := range c.Or {
+		if err := c.Or[i].validate(fmt.Sprintf("%s.or.%d", path, i)); err != nil {
+			return err
+		}
+	}
+	if c.Not != nil {
+		return c.Not.validate(path + ".not")
+	}
+	return nil
+}
+
+// describe returns a description of the policy at index i, for use in
+// logs and error messages.
+func (p TailSamplingPolicy) describe(i int) string {
+	if p.Name != "" {
+		return fmt.Sprintf("policy %d (%q)", i, p.Name)
+	}
+	return fmt.Sprintf("policy %d", i)
+}
+
+// sameCriteria reports whether p and other have identical criteria,
+// and so match exactly the same traces.
+func (p TailSamplingPolicy) sameCriteria(other TailSamplingPolicy) bool {
+	return reflect.DeepEqual(p.TailSamplingCriteria, other.TailSamplingCriteria) && reflect.DeepEqual(p.Conditions, other.Conditions)
+}
+
+// isDefault reports whether the policy has empty criteria, and so matches
+// all traces.
+func (p TailSamplingPolicy) isDefault() bool {
+	return p.sameCriteria(TailSamplingPolicy{})
+}
+
+// policyShadowing records that the policy at index shadowed can never match,
+// due to the earlier policy at index by matching all traces it would match.
+type policyShadowing struct {
+	shadowed int
+	by       int
+}
+
+// shadowedPolicies returns, in order, the policies which can never match.
+//
+// Policies are evaluated in order, and the first matching policy wins, so a
+// policy can never match if an earlier policy matches every trace it would
+// match. This is determined by covers, criterion by criterion, and is
+// conservative: a policy may be reported as not shadowed when it is.
+func (c *TailSamplingConfig) shadowedPolicies() []policyShadowing {
+	var result []policyShadowing
+	for j, later := range c.Policies {
+		for i, earlier := range c.Policies[:j] {
+			if earlier.covers(later) {
+				result = append(result, policyShadowing{shadowed: j, by: i})
+				break
+			}
+		}
+	}
+	return result
+}
+
+// covers reports whether p matches every trace that other matches: that
+// is, whether each of p's criteria is empty, matching any trace, or matches
+// every value that the same criterion of other matches. How one criterion
+// covers another depends on its kind, such as exact values, glob patterns,
+// or minimum thresholds; see the *CriterionCovers functions.
+//
+// This is conservative for policies with conditions: a policy with
+// conditions is only reported as covering a policy with the same
+// conditions, and is only covered by a default policy.
+func (p TailSamplingPolicy) covers(other TailSamplingPolicy) bool {
+	if p.Conditions != nil || other.Conditions != nil {
+		return p.isDefault() || p.sameCriteria(other)
+	}
+	return criterionCovers(p.Service.Name, other.Service.Name) &&
+		criterionCovers(p.Service.Environment, other.Service.Environment) &&
+		criterionCovers(p.Trace.Name, other.Trace.Name) &&
+		criterionCovers(p.Trace.Outcome, other.Trace.Outcome) &&
+		globCriterionCovers(p.Trace.URLPath, other.Trace.URLPath) &&
+		globCriterionCovers(p.Trace.Result, other.Trace.Result) &&
+		globCriterionCovers(p.Trace.TransactionType, other.Trace.TransactionType) &&
+		boolCriterionCovers(p.Trace.UpstreamSampled, other.Trace.UpstreamSampled) &&
+		criterionCovers(p.Cloud.Provider, other.Cloud.Provider) &&
+		globCriterionCovers(p.Cloud.Region, other.Cloud.Region) &&
+		globCriterionCovers(p.User.ID, other.User.ID) &&
+		globCriterionCovers(p.User.Email, other.User.Email) &&
+		globCriterionCovers(p.Trace.DestinationService, other.Trace.DestinationService) &&
+		labelsCriterionCovers(p.Trace.SpanLabels, other.Trace.SpanLabels) &&
+		globCriterionCovers(p.Trace.DBStatement, other.Trace.DBStatement) &&
+		(len(p.Trace.TimeWindows) == 0 ||
+			p.Trace.TimeZone == other.Trace.TimeZone &&
+				reflect.DeepEqual(p.Trace.TimeWindows, other.Trace.TimeWindows)) &&
+		p.Trace.SpanDurationRatio <= other.Trace.SpanDurationRatio &&
+		(p.Trace.SpanTotalDuration.Type == "" ||
+			p.Trace.SpanTotalDuration.Type == other.Trace.SpanTotalDuration.Type &&
+				p.Trace.SpanTotalDuration.Min <= other.Trace.SpanTotalDuration.Min)
+}
+
+// labelsCriterionCovers reports whether the policy labels criterion a
+// matches every span that the policy labels criterion b matches: that is,
+// whether a requires a subset of the labels that b requires.
+func labelsCriterionCovers(a, b map[string]string) bool {
+	for k, v := range a {
+		if bv, ok := b[k]; !ok || bv != v {
+			return false
+		}
+	}
+	return true
+}
+
+// criterionCovers reports whether the policy criterion a matches every
+// value that the policy criterion b matches.
+func criterionCovers(a, b string) bool {
+	return a == "" || a == b
+}
+
+// boolCriterionCovers reports whether the optional boolean policy criterion
+// a matches every value that the optional boolean policy criterion b matches.
+func boolCriterionCovers(a, b *bool) bool {
+	return a == nil || b != nil && *a == *b
+}
+
+// validateGlob validates a glob pattern policy criterion. Patterns cannot
+// be malformed, as "*" is the only special character, but patterns with
+// leading or trailing whitespace are rejected as they are almost certainly
+// unintentional, and would not match the trimmed values reported by agents.
+func validateGlob(pattern string) error {
+	if pattern != strings.TrimSpace(pattern) {
+		return errors.Errorf("glob pattern %q has leading or trailing whitespace", pattern)
+	}
+	return nil
+}
+
+// globCriterionCovers reports whether the glob pattern policy criterion a
+// matches every value that the glob pattern policy criterion b matches.
+// This is conservative: it may report false for some patterns where a
+// does cover b, such as when both contain wildcards.
+func globCriterionCovers(a, b string) bool {
+	switch {
+	case a == "" || a == b:
+		return true
+	case b == "":
+		// b matches everything, including traces without a value.
+		return false
+	case a == "*":
+		return true
+	case !strings.Contains(b, "*"):
+		return glob.Glob(a, b)
+	}
+	return false
+}
+
 func (c *TailSamplingConfig) setup(log *logp.Logger, outputESCfg *config.C) error {
 	if !c.Enabled {
 		return nil
@@ -161,3 +952,22 @@ func defaultTailSamplingConfig() TailSamplingConfig {
 	cfg.StorageLimitParsed = parsed
 	return cfg
 }
+
+// parseMinFreeDisk parses c.StorageMinFreeDisk as either a percentage or a
+// number of bytes.
+func parseMinFreeDisk(c *TailSamplingConfig) error {
+	if percent, ok := strings.CutSuffix(c.StorageMinFreeDisk, "%"); ok {
+		parsed, err := strconv.ParseFloat(strings.TrimSpace(percent), 64)
+		if err != nil || parsed < 0 || parsed > 100 {
+			return errors.Errorf("invalid storage_min_free_disk %q: percentage must be between 0 and 100", c.StorageMinFreeDisk)
+		}
+		c.StorageMinFreeDiskPercentParsed = parsed
+		return nil
+	}
+	parsed, err := humanize.ParseBytes(c.StorageMinFreeDisk)
+	if err != nil {
+		return errors.Wrap(err, "invalid storage_min_free_disk")
+	}
+	c.StorageMinFreeDiskBytesParsed = parsed
+	return nil
+}
@@ -18,11 +18,15 @@
 package config
 
 import (
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
 	"github.com/elastic/elastic-agent-libs/config"
+	"github.com/elastic/elastic-agent-libs/logp"
 )
 
 func TestSamplingPoliciesValidation(t *testing.T) {
@@ -51,4 +55,867 @@ func TestSamplingPoliciesValidation(t *testing.T) {
 		assert.NoError(t, err)
 		assert.False(t, c.Sampling.Tail.Enabled)
 	})
+	t.Run("UniqueNames", func(t *testing.T) {
+		c, err := NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+			"sampling.tail.policies": []map[string]interface{}{
+				{"name": "foo", "service.name": "foo", "sample_rate": 0.5},
+				{"name": "bar", "sample_rate": 0.1},
+				{"sample_rate": 0.1},
+				{"sample_rate": 0.1},
+			},
+		}), nil)
+		assert.NoError(t, err)
+		assert.True(t, c.Sampling.Tail.Enabled)
+		assert.Equal(t, "foo", c.Sampling.Tail.Policies[0].Name)
+	})
+	t.Run("DuplicateNames", func(t *testing.T) {
+		cfg := TailSamplingConfig{Enabled: true, Policies: []TailSamplingPolicy{
+			{Name: "foo", SampleRate: 0.5},
+			{Name: "foo", SampleRate: 0.1},
+		}}
+		assert.EqualError(t, cfg.Validate(), `policy 1 ("foo"): name is not unique, also used by policy 0`)
+	})
+	t.Run("URLPath", func(t *testing.T) {
+		for pattern, valid := range map[string]bool{
+			"/api/*":   true,
+			"*/health": true,
+			"api/*":    false,
+		} {
+			c, err := NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+				"sampling.tail.policies": []map[string]interface{}{
+					{"trace.url_path": pattern, "sample_rate": 1},
+					{"sample_rate": 0.1},
+				},
+			}), nil)
+			assert.NoError(t, err)
+			assert.Equal(t, valid, c.Sampling.Tail.Enabled, pattern)
+		}
+	})
+	t.Run("Result", func(t *testing.T) {
+		for pattern, valid := range map[string]bool{
+			"HTTP 5*":  true,
+			"Error":    true,
+			" HTTP 5*": false,
+		} {
+			c, err := NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+				"sampling.tail.policies": []map[string]interface{}{
+					{"trace.result": pattern, "sample_rate": 1},
+					{"sample_rate": 0.1},
+				},
+			}), nil)
+			assert.NoError(t, err)
+			assert.Equal(t, valid, c.Sampling.Tail.Enabled, pattern)
+		}
+	})
+	t.Run("TransactionType", func(t *testing.T) {
+		for pattern, valid := range map[string]bool{
+			"request":  true,
+			"messag*":  true,
+			"request ": false,
+		} {
+			c, err := NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+				"sampling.tail.policies": []map[string]interface{}{
+					{"trace.transaction_type": pattern, "sample_rate": 1},
+					{"sample_rate": 0.1},
+				},
+			}), nil)
+			assert.NoError(t, err)
+			assert.Equal(t, valid, c.Sampling.Tail.Enabled, pattern)
+		}
+	})
+	t.Run("Conditions", func(t *testing.T) {
+		c, err := NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+			"sampling.tail.policies": []map[string]interface{}{{
+				"conditions": map[string]interface{}{
+					"service.name": "foo",
+					"or": []map[string]interface{}{
+						{"trace.outcome": "failure"},
+						{"trace.span_total_duration": map[string]interface{}{"type": "db", "min": "1s"}},
+					},
+					"not.trace.name": "GET /health",
+				},
+				"sample_rate": 1,
+			}, {
+				"sample_rate": 0.1,
+			}},
+		}), nil)
+		require.NoError(t, err)
+		require.True(t, c.Sampling.Tail.Enabled)
+		conditions := c.Sampling.Tail.Policies[0].Conditions
+		require.NotNil(t, conditions)
+		assert.Equal(t, "foo", conditions.Service.Name)
+		require.Len(t, conditions.Or, 2)
+		assert.Equal(t, "failure", conditions.Or[0].Trace.Outcome)
+		assert.Equal(t, "db", conditions.Or[1].Trace.SpanTotalDuration.Type)
+		assert.Equal(t, time.Second, conditions.Or[1].Trace.SpanTotalDuration.Min)
+		require.NotNil(t, conditions.Not)
+		assert.Equal(t, "GET /health", conditions.Not.Trace.Name)
+		assert.False(t, c.Sampling.Tail.Policies[0].isDefault())
+	})
+	t.Run("ConditionsInvalid", func(t *testing.T) {
+		newPolicy := func(conditions TailSamplingCondition) TailSamplingPolicy {
+			return TailSamplingPolicy{Conditions: &conditions, SampleRate: 0.5}
+		}
+		var invalidGlob TailSamplingCondition
+		invalidGlob.Cloud.Region = " us-*"
+		cfg := TailSamplingConfig{Enabled: true, Policies: []TailSamplingPolicy{
+			newPolicy(TailSamplingCondition{And: []TailSamplingCondition{
+				{Not: &TailSamplingCondition{}},
+			}}),
+			{SampleRate: 0.1},
+		}}
+		assert.EqualError(t, cfg.Validate(), `policy 0: conditions.and.0.not: condition must specify criteria, and, or, or not`)
+
+		cfg.Policies[0] = newPolicy(TailSamplingCondition{Or: []TailSamplingCondition{{}, invalidGlob}})
+		assert.EqualError(t, cfg.Validate(), `policy 0: conditions.or.0: condition must specify criteria, and, or, or not`)
+		cfg.Policies[0].Conditions.Or[0].Service.Name = "foo"
+		assert.EqualError(t, cfg.Validate(), `policy 0: conditions.or.1: invalid cloud.region: glob pattern " us-*" has leading or trailing whitespace`)
+		cfg.Policies[0].Conditions.Or[1].Cloud.Region = "us-*"
+		assert.NoError(t, cfg.Validate())
+
+		cfg.Policies[0].Service.Name = "foo"
+		assert.EqualError(t, cfg.Validate(), `policy 0: conditions cannot be combined with service, cloud, user, or trace criteria`)
+	})
+	t.Run("Cloud", func(t *testing.T) {
+		for region, valid := range map[string]bool{
+			"us-*":  true,
+			"us-* ": false,
+		} {
+			c, err := NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+				"sampling.tail.policies": []map[string]interface{}{
+					{"cloud.provider": "aws", "cloud.region": region, "sample_rate": 1},
+					{"sample_rate": 0.1},
+				},
+			}), nil)
+			assert.NoError(t, err)
+			assert.Equal(t, valid, c.Sampling.Tail.Enabled, region)
+			if valid {
+				assert.Equal(t, "aws", c.Sampling.Tail.Policies[0].Cloud.Provider)
+			}
+		}
+	})
+	t.Run("User", func(t *testing.T) {
+		c, err := NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+			"sampling.tail.policies": []map[string]interface{}{
+				{"user.id": "vip-*", "sample_rate": 1},
+				{"user.email": "*@example.com", "sample_rate": 1},
+				{"sample_rate": 0.1},
+			},
+		}), nil)
+		require.NoError(t, err)
+		require.True(t, c.Sampling.Tail.Enabled)
+		assert.Equal(t, "vip-*", c.Sampling.Tail.Policies[0].User.ID)
+		assert.Equal(t, "*@example.com", c.Sampling.Tail.Policies[1].User.Email)
+
+		cfg := TailSamplingConfig{Enabled: true, Policies: []TailSamplingPolicy{{SampleRate: 1}, {SampleRate: 0.1}}}
+		cfg.Policies[0].User.Email = "*@example.com "
+		assert.EqualError(t, cfg.Validate(), `policy 0: invalid user.email: glob pattern "*@example.com " has leading or trailing whitespace`)
+	})
+	t.Run("DestinationService", func(t *testing.T) {
+		c, err := NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+			"sampling.tail.policies": []map[string]interface{}{
+				{"trace.destination_service": "payment-*", "sample_rate": 1},
+				{"sample_rate": 0.1},
+			},
+		}), nil)
+		require.NoError(t, err)
+		require.True(t, c.Sampling.Tail.Enabled)
+		assert.Equal(t, "payment-*", c.Sampling.Tail.Policies[0].Trace.DestinationService)
+
+		cfg := TailSamplingConfig{Enabled: true, Policies: []TailSamplingPolicy{{SampleRate: 1}, {SampleRate: 0.1}}}
+		cfg.Policies[0].Trace.DestinationService = " payment-*"
+		assert.EqualError(t, cfg.Validate(), `policy 0: invalid trace.destination_service: glob pattern " payment-*" has leading or trailing whitespace`)
+	})
+	t.Run("SpanLabels", func(t *testing.T) {
+		c, err := NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+			"sampling.tail.policies": []map[string]interface{}{
+				{"trace.span_labels": map[string]interface{}{"feature_flag": "new_checkout", "region": "eu"}, "sample_rate": 1},
+				{"trace.span_labels": map[string]interface{}{"feature_flag": "new_checkout"}, "sample_rate": 0.5},
+				{"sample_rate": 0.1},
+			},
+		}), nil)
+		require.NoError(t, err)
+		require.True(t, c.Sampling.Tail.Enabled)
+		assert.Equal(t, map[string]string{"feature_flag": "new_checkout", "region": "eu"}, c.Sampling.Tail.Policies[0].Trace.SpanLabels)
+
+		// A policy requiring a subset of the labels covers the policy.
+		assert.True(t, c.Sampling.Tail.Policies[1].covers(c.Sampling.Tail.Policies[0]))
+		assert.False(t, c.Sampling.Tail.Policies[0].covers(c.Sampling.Tail.Policies[1]))
+
+		cfg := TailSamplingConfig{Enabled: true, Policies: []TailSamplingPolicy{{SampleRate: 1}, {SampleRate: 0.1}}}
+		cfg.Policies[0].Trace.SpanLabels = map[string]string{"": "value"}
+		assert.EqualError(t, cfg.Validate(), `policy 0: trace.span_labels keys must not be empty`)
+	})
+	t.Run("DBStatement", func(t *testing.T) {
+		c, err := NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+			"sampling.tail.policies": []map[string]interface{}{
+				{"trace.db_statement": "SELECT * FROM orders*", "sample_rate": 1},
+				{"sample_rate": 0.1},
+			},
+		}), nil)
+		require.NoError(t, err)
+		require.True(t, c.Sampling.Tail.Enabled)
+		assert.Equal(t, "SELECT * FROM orders*", c.Sampling.Tail.Policies[0].Trace.DBStatement)
+
+		cfg := TailSamplingConfig{Enabled: true, Policies: []TailSamplingPolicy{{SampleRate: 1}, {SampleRate: 0.1}}}
+		cfg.Policies[0].Trace.DBStatement = "SELECT * "
+		assert.EqualError(t, cfg.Validate(), `policy 0: invalid trace.db_statement: glob pattern "SELECT * " has leading or trailing whitespace`)
+		cfg.Policies[0].Trace.DBStatement = strings.Repeat("x", 10001)
+		assert.EqualError(t, cfg.Validate(), `policy 0: trace.db_statement must not be longer than 10000 bytes`)
+	})
+	t.Run("TimeWindows", func(t *testing.T) {
+		c, err := NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+			"sampling.tail.policies": []map[string]interface{}{{
+				"trace.time_windows": []map[string]interface{}{
+					{"start": "22:00", "end": "06:00"},
+					{"start": "12:00", "end": "13:30"},
+				},
+				"trace.time_zone": "Europe/Berlin",
+				"sample_rate":     0.1,
+			}, {
+				"sample_rate": 0.5,
+			}},
+		}), nil)
+		require.NoError(t, err)
+		require.True(t, c.Sampling.Tail.Enabled)
+		assert.Equal(t, []TailSamplingTimeWindow{
+			{Start: TimeOfDay(22 * time.Hour), End: TimeOfDay(6 * time.Hour)},
+			{Start: TimeOfDay(12 * time.Hour), End: TimeOfDay(13*time.Hour + 30*time.Minute)},
+		}, c.Sampling.Tail.Policies[0].Trace.TimeWindows)
+		assert.Equal(t, "Europe/Berlin", c.Sampling.Tail.Policies[0].Trace.TimeZone)
+		assert.False(t, c.Sampling.Tail.Policies[0].covers(c.Sampling.Tail.Policies[1]))
+
+		// Invalid times of day disable tail sampling.
+		c, err = NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+			"sampling.tail.policies": []map[string]interface{}{{
+				"trace.time_windows": []map[string]interface{}{{"start": "25:00", "end": "06:00"}},
+				"sample_rate":        0.1,
+			}, {
+				"sample_rate": 0.5,
+			}},
+		}), nil)
+		require.NoError(t, err)
+		assert.False(t, c.Sampling.Tail.Enabled)
+		var tod TimeOfDay
+		assert.EqualError(t, tod.Unpack("25:00"), `invalid time of day "25:00": must be formatted as HH:MM`)
+
+		cfg := TailSamplingConfig{Enabled: true, Policies: []TailSamplingPolicy{{SampleRate: 1}, {SampleRate: 0.1}}}
+		cfg.Policies[0].Trace.TimeWindows = []TailSamplingTimeWindow{{Start: TimeOfDay(time.Hour), End: TimeOfDay(time.Hour)}}
+		assert.EqualError(t, cfg.Validate(), `policy 0: trace.time_windows 0 start and end must differ`)
+		cfg.Policies[0].Trace.TimeWindows = []TailSamplingTimeWindow{
+			{Start: TimeOfDay(22 * time.Hour), End: TimeOfDay(6 * time.Hour)},
+			{Start: TimeOfDay(5 * time.Hour), End: TimeOfDay(7 * time.Hour)},
+		}
+		assert.EqualError(t, cfg.Validate(), `policy 0: trace.time_windows 0 and 1 overlap`)
+		cfg.Policies[0].Trace.TimeWindows = cfg.Policies[0].Trace.TimeWindows[:1]
+		cfg.Policies[0].Trace.TimeZone = "Mars/Olympus_Mons"
+		assert.ErrorContains(t, cfg.Validate(), `policy 0: invalid trace.time_zone`)
+		cfg.Policies[0].Trace.TimeWindows = nil
+		assert.EqualError(t, cfg.Validate(), `policy 0: trace.time_zone must be specified with trace.time_windows`)
+	})
+	t.Run("UpstreamSampled", func(t *testing.T) {
+		for value, expected := range map[interface{}]*bool{
+			true:    newBool(true),
+			"false": newBool(false),
+			"maybe": nil,
+		} {
+			c, err := NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+				"sampling.tail.policies": []map[string]interface{}{
+					{"trace.upstream_sampled": value, "sample_rate": 1},
+					{"sample_rate": 0.1},
+				},
+			}), nil)
+			assert.NoError(t, err)
+			assert.Equal(t, expected != nil, c.Sampling.Tail.Enabled, value)
+			if expected != nil {
+				assert.Equal(t, expected, c.Sampling.Tail.Policies[0].Trace.UpstreamSampled)
+			}
+		}
+
+		// Policies with equal, but distinct, upstream_sampled values
+		// have identical criteria.
+		cfg := TailSamplingConfig{Enabled: true, Policies: []TailSamplingPolicy{
+			{SampleRate: 0.5}, {SampleRate: 0.2}, {SampleRate: 0.1},
+		}}
+		cfg.Policies[0].Trace.UpstreamSampled = newBool(true)
+		cfg.Policies[1].Trace.UpstreamSampled = newBool(true)
+		assert.EqualError(t, cfg.Validate(), `policy 0 and policy 1 have identical criteria but different sample rates`)
+		assert.Equal(t, []policyShadowing{{shadowed: 1, by: 0}}, cfg.shadowedPolicies())
+	})
+	t.Run("SpanTotalDuration", func(t *testing.T) {
+		c, err := NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+			"sampling.tail.policies": []map[string]interface{}{
+				{"trace.span_total_duration": map[string]interface{}{"type": "db", "min": "500ms"}, "sample_rate": 1},
+				{"sample_rate": 0.1},
+			},
+		}), nil)
+		assert.NoError(t, err)
+		assert.True(t, c.Sampling.Tail.Enabled)
+		assert.Equal(t, "db", c.Sampling.Tail.Policies[0].Trace.SpanTotalDuration.Type)
+		assert.Equal(t, 500*time.Millisecond, c.Sampling.Tail.Policies[0].Trace.SpanTotalDuration.Min)
+	})
+	t.Run("SpanTotalDurationInvalid", func(t *testing.T) {
+		for _, spanDurations := range []map[string]interface{}{
+			{"type": "db", "min": "-1s"},
+			{"min": "1s"},
+		} {
+			c, err := NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+				"sampling.tail.policies": []map[string]interface{}{
+					{"trace.span_total_duration": spanDurations, "sample_rate": 1},
+					{"sample_rate": 0.1},
+				},
+			}), nil)
+			assert.NoError(t, err)
+			assert.False(t, c.Sampling.Tail.Enabled)
+		}
+	})
+	t.Run("SpanDurationRatio", func(t *testing.T) {
+		c, err := NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+			"sampling.tail.policies": []map[string]interface{}{
+				{"trace.span_duration_ratio": 2.5, "sample_rate": 1},
+				{"sample_rate": 0.1},
+			},
+		}), nil)
+		assert.NoError(t, err)
+		assert.True(t, c.Sampling.Tail.Enabled)
+		assert.Equal(t, 2.5, c.Sampling.Tail.Policies[0].Trace.SpanDurationRatio)
+
+		cfg := TailSamplingConfig{Enabled: true, Policies: []TailSamplingPolicy{{SampleRate: 1}, {SampleRate: 0.1}}}
+		cfg.Policies[0].Trace.SpanDurationRatio = -1
+		assert.EqualError(t, cfg.Validate(), "policy 0: trace.span_duration_ratio must not be negative")
+	})
+	t.Run("IdenticalCriteria", func(t *testing.T) {
+		cfg := TailSamplingConfig{Enabled: true, Policies: []TailSamplingPolicy{
+			{SampleRate: 0.5},
+			{SampleRate: 0.5},
+		}}
+		cfg.Policies[0].Service.Name = "foo"
+		cfg.Policies[1].Service.Name = "foo"
+		cfg.Policies = append(cfg.Policies, TailSamplingPolicy{SampleRate: 0.1})
+		assert.NoError(t, cfg.Validate()) // same sample rate: redundant, but not ambiguous
+
+		cfg.Policies[1].SampleRate = 0.2
+		cfg.Policies[1].Name = "bar"
+		assert.EqualError(t, cfg.Validate(), `policy 0 and policy 1 ("bar") have identical criteria but different sample rates`)
+
+		cfg.Policies[1].Service.Environment = "production"
+		assert.NoError(t, cfg.Validate())
+	})
+	t.Run("ErrorRateMultiplierUnspecified", func(t *testing.T) {
+		c, err := NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+			"sampling.tail.policies": []map[string]interface{}{{
+				"sample_rate":        0.5,
+				"error_rate_scaling": true,
+			}},
+		}), nil)
+		assert.NoError(t, err)
+		assert.False(t, c.Sampling.Tail.Enabled)
+	})
+	t.Run("ErrorRateScaling", func(t *testing.T) {
+		c, err := NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+			"sampling.tail.policies": []map[string]interface{}{{
+				"sample_rate":           0.5,
+				"error_rate_scaling":    true,
+				"error_rate_multiplier": 2,
+			}},
+		}), nil)
+		assert.NoError(t, err)
+		assert.True(t, c.Sampling.Tail.Enabled)
+	})
+	t.Run("ErrorRateHysteresis", func(t *testing.T) {
+		for _, tc := range []struct {
+			deadBand float64
+			minHold  string
+			valid    bool
+		}{
+			{deadBand: 0.05, minHold: "5m", valid: true},
+			{deadBand: -0.1, minHold: "5m", valid: false},
+			{deadBand: 1, minHold: "5m", valid: false},
+			{deadBand: 0.05, minHold: "-5m", valid: false},
+		} {
+			c, err := NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+				"sampling.tail.policies": []map[string]interface{}{{
+					"sample_rate":           0.5,
+					"error_rate_scaling":    true,
+					"error_rate_multiplier": 2,
+					"error_rate_dead_band":  tc.deadBand,
+					"error_rate_min_hold":   tc.minHold,
+				}},
+			}), nil)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.valid, c.Sampling.Tail.Enabled, tc)
+		}
+	})
+}
+
+func TestGlobCriterionCovers(t *testing.T) {
+	assert.True(t, globCriterionCovers("", ""))
+	assert.True(t, globCriterionCovers("", "/foo"))
+	assert.False(t, globCriterionCovers("/foo", ""))
+	assert.True(t, globCriterionCovers("/foo/*", "/foo/*"))
+	assert.True(t, globCriterionCovers("*", "/foo/*"))
+	assert.True(t, globCriterionCovers("/foo/*", "/foo/bar"))
+	assert.False(t, globCriterionCovers("/foo/*", "/bar"))
+	assert.False(t, globCriterionCovers("/foo/*", "/foo/bar/*")) // conservative
+}
+
+func TestBoolCriterionCovers(t *testing.T) {
+	assert.True(t, boolCriterionCovers(nil, nil))
+	assert.True(t, boolCriterionCovers(nil, newBool(false)))
+	assert.True(t, boolCriterionCovers(newBool(true), newBool(true)))
+	assert.False(t, boolCriterionCovers(newBool(true), newBool(false)))
+	assert.False(t, boolCriterionCovers(newBool(true), nil))
+}
+
+func TestSamplingPoliciesShadowing(t *testing.T) {
+	policy := func(serviceName, serviceEnvironment, traceName, traceOutcome string) TailSamplingPolicy {
+		var p TailSamplingPolicy
+		p.Service.Name = serviceName
+		p.Service.Environment = serviceEnvironment
+		p.Trace.Name = traceName
+		p.Trace.Outcome = traceOutcome
+		p.SampleRate = 0.5
+		return p
+	}
+	cfg := TailSamplingConfig{Policies: []TailSamplingPolicy{
+		policy("foo", "", "", ""),
+		policy("foo", "production", "", ""),        // shadowed by 0
+		policy("bar", "production", "", ""),        // not shadowed
+		policy("bar", "", "GET /", "failure"),      // not shadowed
+		policy("bar", "production", "", "success"), // shadowed by 2
+		policy("", "", "", ""),                     // not shadowed
+		policy("baz", "", "", ""),                  // shadowed by 5
+	}}
+	assert.Equal(t, []policyShadowing{
+		{shadowed: 1, by: 0},
+		{shadowed: 4, by: 2},
+		{shadowed: 6, by: 5},
+	}, cfg.shadowedPolicies())
+}
+
+func TestTailSamplingStorageMaxTransactionSize(t *testing.T) {
+	c, err := NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+		"sampling.tail.policies":                     []map[string]interface{}{{"sample_rate": 0.5}},
+		"sampling.tail.storage_max_transaction_size": "1MB",
+	}), nil)
+	assert.NoError(t, err)
+	assert.True(t, c.Sampling.Tail.Enabled)
+	assert.Equal(t, uint64(1000000), c.Sampling.Tail.StorageMaxTransactionSizeParsed)
+
+	c, err = NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+		"sampling.tail.policies": []map[string]interface{}{{"sample_rate": 0.5}},
+	}), nil)
+	assert.NoError(t, err)
+	assert.Zero(t, c.Sampling.Tail.StorageMaxTransactionSizeParsed)
+}
+
+func TestTailSamplingStorageMaxEventSize(t *testing.T) {
+	c, err := NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+		"sampling.tail.policies":               []map[string]interface{}{{"sample_rate": 0.5}},
+		"sampling.tail.storage_max_event_size": "64KB",
+	}), nil)
+	assert.NoError(t, err)
+	assert.True(t, c.Sampling.Tail.Enabled)
+	assert.Equal(t, uint64(64000), c.Sampling.Tail.StorageMaxEventSizeParsed)
+
+	_, err = NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+		"sampling.tail.enabled":                true,
+		"sampling.tail.policies":               []map[string]interface{}{{"sample_rate": 0.5}},
+		"sampling.tail.storage_max_event_size": "0",
+	}), nil)
+	assert.ErrorContains(t, err, "storage_max_event_size must be positive")
+}
+
+func TestTailSamplingStorageMinFreeDisk(t *testing.T) {
+	c, err := NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+		"sampling.tail.policies":              []map[string]interface{}{{"sample_rate": 0.5}},
+		"sampling.tail.storage_min_free_disk": "10GB",
+	}), nil)
+	assert.NoError(t, err)
+	assert.True(t, c.Sampling.Tail.Enabled)
+	assert.Equal(t, uint64(10000000000), c.Sampling.Tail.StorageMinFreeDiskBytesParsed)
+	assert.Zero(t, c.Sampling.Tail.StorageMinFreeDiskPercentParsed)
+
+	c, err = NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+		"sampling.tail.policies":              []map[string]interface{}{{"sample_rate": 0.5}},
+		"sampling.tail.storage_min_free_disk": "5%",
+	}), nil)
+	assert.NoError(t, err)
+	assert.True(t, c.Sampling.Tail.Enabled)
+	assert.Zero(t, c.Sampling.Tail.StorageMinFreeDiskBytesParsed)
+	assert.Equal(t, 5.0, c.Sampling.Tail.StorageMinFreeDiskPercentParsed)
+
+	for _, invalid := range []string{"101%", "x%", "lots"} {
+		_, err = NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+			"sampling.tail.policies":              []map[string]interface{}{{"sample_rate": 0.5}},
+			"sampling.tail.storage_min_free_disk": invalid,
+		}), nil)
+		assert.ErrorContains(t, err, "invalid storage_min_free_disk", invalid)
+	}
+}
+
+func TestTailSamplingSlidingTTL(t *testing.T) {
+	c, err := NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+		"sampling.tail.policies":    []map[string]interface{}{{"sample_rate": 0.5}},
+		"sampling.tail.sliding_ttl": "events",
+	}), nil)
+	assert.NoError(t, err)
+	assert.True(t, c.Sampling.Tail.Enabled)
+	assert.Equal(t, "events", c.Sampling.Tail.SlidingTTL)
+
+	c, err = NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+		"sampling.tail.policies":    []map[string]interface{}{{"sample_rate": 0.5}},
+		"sampling.tail.sliding_ttl": "decision",
+	}), nil)
+	assert.NoError(t, err)
+	assert.False(t, c.Sampling.Tail.Enabled)
+}
+
+func TestTailSamplingStorageOnLimit(t *testing.T) {
+	c, err := NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+		"sampling.tail.policies":         []map[string]interface{}{{"sample_rate": 0.5}},
+		"sampling.tail.storage_on_limit": "drop_oldest",
+	}), nil)
+	assert.NoError(t, err)
+	assert.True(t, c.Sampling.Tail.Enabled)
+	assert.Equal(t, "drop_oldest", c.Sampling.Tail.StorageOnLimit)
+
+	c, err = NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+		"sampling.tail.policies":         []map[string]interface{}{{"sample_rate": 0.5}},
+		"sampling.tail.storage_on_limit": "drop_everything",
+	}), nil)
+	assert.NoError(t, err)
+	assert.False(t, c.Sampling.Tail.Enabled)
+}
+
+func TestTailSamplingStorageTenants(t *testing.T) {
+	c, err := NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+		"sampling.tail.policies":                              []map[string]interface{}{{"sample_rate": 0.5}},
+		"sampling.tail.storage_on_limit":                      "drop_over_fair_share",
+		"sampling.tail.storage_tenant_service_name_separator": "-",
+	}), nil)
+	assert.NoError(t, err)
+	assert.True(t, c.Sampling.Tail.Enabled)
+	assert.Equal(t, "drop_over_fair_share", c.Sampling.Tail.StorageOnLimit)
+	assert.Equal(t, "-", c.Sampling.Tail.StorageTenantServiceNameSeparator)
+
+	c, err = NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+		"sampling.tail.policies":                              []map[string]interface{}{{"sample_rate": 0.5}},
+		"sampling.tail.storage_tenant_label":                  "tenant",
+		"sampling.tail.storage_tenant_service_name_separator": "-",
+	}), nil)
+	assert.NoError(t, err)
+	assert.False(t, c.Sampling.Tail.Enabled)
+}
+
+func TestTailSamplingDecisionConflict(t *testing.T) {
+	c, err := NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+		"sampling.tail.policies":          []map[string]interface{}{{"sample_rate": 0.5}},
+		"sampling.tail.decision_conflict": "keep_first",
+	}), nil)
+	assert.NoError(t, err)
+	assert.True(t, c.Sampling.Tail.Enabled)
+	assert.Equal(t, "keep_first", c.Sampling.Tail.DecisionConflict)
+
+	c, err = NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+		"sampling.tail.policies":          []map[string]interface{}{{"sample_rate": 0.5}},
+		"sampling.tail.decision_conflict": "keep_last",
+	}), nil)
+	assert.NoError(t, err)
+	assert.False(t, c.Sampling.Tail.Enabled)
+}
+
+func TestTailSamplingStorageDeltaEncoding(t *testing.T) {
+	c, err := NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+		"sampling.tail.policies":               []map[string]interface{}{{"sample_rate": 0.5}},
+		"sampling.tail.storage_delta_encoding": true,
+	}), nil)
+	assert.NoError(t, err)
+	assert.True(t, c.Sampling.Tail.StorageDeltaEncoding)
+}
+
+func TestTailSamplingStorageTraceSummaries(t *testing.T) {
+	c, err := NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+		"sampling.tail.policies":                []map[string]interface{}{{"sample_rate": 0.5}},
+		"sampling.tail.storage_trace_summaries": true,
+	}), nil)
+	assert.NoError(t, err)
+	assert.True(t, c.Sampling.Tail.StorageTraceSummaries)
+}
+
+func TestTailSamplingStorageEventIDIndex(t *testing.T) {
+	c, err := NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+		"sampling.tail.policies":               []map[string]interface{}{{"sample_rate": 0.5}},
+		"sampling.tail.storage_event_id_index": true,
+	}), nil)
+	assert.NoError(t, err)
+	assert.True(t, c.Sampling.Tail.StorageEventIDIndex)
+}
+
+func TestTailSamplingStorageChronologicalKeys(t *testing.T) {
+	c, err := NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+		"sampling.tail.policies":                   []map[string]interface{}{{"sample_rate": 0.5}},
+		"sampling.tail.storage_chronological_keys": true,
+	}), nil)
+	assert.NoError(t, err)
+	assert.True(t, c.Sampling.Tail.StorageChronologicalKeys)
+}
+
+func TestTailSamplingExpirySweepInterval(t *testing.T) {
+	c, err := NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+		"sampling.tail.policies":              []map[string]interface{}{{"sample_rate": 0.5}},
+		"sampling.tail.expiry_sweep_interval": "1m",
+	}), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Minute, c.Sampling.Tail.ExpirySweepInterval)
+
+	c, err = NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+		"sampling.tail.policies":              []map[string]interface{}{{"sample_rate": 0.5}},
+		"sampling.tail.expiry_sweep_interval": "-1m",
+	}), nil)
+	assert.NoError(t, err)
+	assert.False(t, c.Sampling.Tail.Enabled)
+}
+
+func TestTailSamplingStorageDecisionFilterCapacity(t *testing.T) {
+	c, err := NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+		"sampling.tail.policies":                         []map[string]interface{}{{"sample_rate": 0.5}},
+		"sampling.tail.storage_decision_filter_capacity": 100000,
+	}), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 100000, c.Sampling.Tail.StorageDecisionFilterCapacity)
+
+	c, err = NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+		"sampling.tail.policies":                         []map[string]interface{}{{"sample_rate": 0.5}},
+		"sampling.tail.storage_decision_filter_capacity": -1,
+	}), nil)
+	assert.NoError(t, err)
+	assert.False(t, c.Sampling.Tail.Enabled)
+}
+
+func TestTailSamplingStoragePersistSamplerState(t *testing.T) {
+	c, err := NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+		"sampling.tail.policies":                      []map[string]interface{}{{"sample_rate": 0.5}},
+		"sampling.tail.storage_persist_sampler_state": true,
+	}), nil)
+	assert.NoError(t, err)
+	assert.True(t, c.Sampling.Tail.StoragePersistSamplerState)
+}
+
+func TestTailSamplingStorageGCUtilizationTrigger(t *testing.T) {
+	c, err := NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+		"sampling.tail.policies":                       []map[string]interface{}{{"sample_rate": 0.5}},
+		"sampling.tail.storage_gc_utilization_trigger": 0.7,
+	}), nil)
+	assert.NoError(t, err)
+	assert.True(t, c.Sampling.Tail.Enabled)
+	assert.Equal(t, 0.7, c.Sampling.Tail.StorageGCUtilizationTrigger)
+
+	for _, invalid := range []float64{-0.1, 1.5} {
+		c, err = NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+			"sampling.tail.policies":                       []map[string]interface{}{{"sample_rate": 0.5}},
+			"sampling.tail.storage_gc_utilization_trigger": invalid,
+		}), nil)
+		assert.NoError(t, err)
+		assert.False(t, c.Sampling.Tail.Enabled, invalid)
+	}
+}
+
+func TestTailSamplingStorageLogLevel(t *testing.T) {
+	c, err := NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+		"sampling.tail.policies":          []map[string]interface{}{{"sample_rate": 0.5}},
+		"sampling.tail.storage_log_level": "warning",
+	}), nil)
+	assert.NoError(t, err)
+	assert.True(t, c.Sampling.Tail.Enabled)
+	assert.Equal(t, logp.WarnLevel, c.Sampling.Tail.StorageLogLevel)
+
+	c, err = NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+		"sampling.tail.policies":          []map[string]interface{}{{"sample_rate": 0.5}},
+		"sampling.tail.storage_log_level": "loud",
+	}), nil)
+	assert.NoError(t, err)
+	assert.False(t, c.Sampling.Tail.Enabled)
+}
+
+func TestTailSamplingStorageCoalesceWrites(t *testing.T) {
+	c, err := NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+		"sampling.tail.policies":                []map[string]interface{}{{"sample_rate": 0.5}},
+		"sampling.tail.storage_coalesce_writes": true,
+	}), nil)
+	assert.NoError(t, err)
+	assert.True(t, c.Sampling.Tail.StorageCoalesceWrites)
+}
+
+func TestTailSamplingStorageEnvironmentLimits(t *testing.T) {
+	c, err := NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+		"sampling.tail.policies":                   []map[string]interface{}{{"sample_rate": 0.5}},
+		"sampling.tail.storage_limit":              "3GB",
+		"sampling.tail.storage_environment_limits": map[string]interface{}{"production": "2GB", "staging": "500MB"},
+	}), nil)
+	assert.NoError(t, err)
+	assert.True(t, c.Sampling.Tail.Enabled)
+	assert.Equal(t, map[string]uint64{
+		"production": 2000000000,
+		"staging":    500000000,
+	}, c.Sampling.Tail.StorageEnvironmentLimitsParsed)
+
+	// The environment limits must not exceed the storage limit.
+	c, err = NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+		"sampling.tail.policies":                   []map[string]interface{}{{"sample_rate": 0.5}},
+		"sampling.tail.storage_limit":              "3GB",
+		"sampling.tail.storage_environment_limits": map[string]interface{}{"production": "2GB", "staging": "2GB"},
+	}), nil)
+	assert.NoError(t, err)
+	assert.False(t, c.Sampling.Tail.Enabled)
+
+	cfg := TailSamplingConfig{
+		Enabled:                        true,
+		Policies:                       []TailSamplingPolicy{{SampleRate: 0.5}},
+		StorageLimitParsed:             3000000000,
+		StorageEnvironmentLimitsParsed: map[string]uint64{"production": 2000000000, "staging": 2000000000},
+	}
+	assert.EqualError(t, cfg.Validate(), "storage_environment_limits total 4.0 GB exceeds storage_limit 3.0 GB")
+}
+
+func TestTailSamplingStorageNamespace(t *testing.T) {
+	c, err := NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+		"sampling.tail.policies":          []map[string]interface{}{{"sample_rate": 0.5}},
+		"sampling.tail.storage_namespace": "pipeline-1",
+	}), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "pipeline-1", c.Sampling.Tail.StorageNamespace)
+
+	cfg := TailSamplingConfig{
+		Enabled:          true,
+		Policies:         []TailSamplingPolicy{{SampleRate: 0.5}},
+		StorageNamespace: "pipeline:1",
+	}
+	assert.EqualError(t, cfg.Validate(), `storage_namespace "pipeline:1" must not contain ':'`)
+}
+
+func TestTailSamplingStorageNodeID(t *testing.T) {
+	c, err := NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+		"sampling.tail.policies":        []map[string]interface{}{{"sample_rate": 0.5}},
+		"sampling.tail.storage_node_id": "node-1",
+	}), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "node-1", c.Sampling.Tail.StorageNodeID)
+
+	cfg := TailSamplingConfig{
+		Enabled:       true,
+		Policies:      []TailSamplingPolicy{{SampleRate: 0.5}},
+		StorageNodeID: "node/1",
+	}
+	assert.EqualError(t, cfg.Validate(), `storage_node_id "node/1" must not contain ':' or '/'`)
+
+	cfg.StorageNodeID = "node-1"
+	cfg.StorageDecisionFilterCapacity = 100000
+	assert.EqualError(t, cfg.Validate(), "storage_decision_filter_capacity must not be specified with storage_node_id")
+}
+
+func TestTailSamplingTTLBounds(t *testing.T) {
+	c, err := NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+		"sampling.tail.policies": []map[string]interface{}{{"sample_rate": 0.5}},
+		"sampling.tail.ttl":      "1h",
+		"sampling.tail.min_ttl":  "10m",
+		"sampling.tail.max_ttl":  "2h",
+	}), nil)
+	assert.NoError(t, err)
+	assert.True(t, c.Sampling.Tail.Enabled)
+	assert.Equal(t, 10*time.Minute, c.Sampling.Tail.MinTTL)
+	assert.Equal(t, 2*time.Hour, c.Sampling.Tail.MaxTTL)
+
+	// A TTL outside the bounds disables tail-sampling.
+	c, err = NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+		"sampling.tail.policies": []map[string]interface{}{{"sample_rate": 0.5}},
+		"sampling.tail.ttl":      "24h",
+		"sampling.tail.max_ttl":  "2h",
+	}), nil)
+	assert.NoError(t, err)
+	assert.False(t, c.Sampling.Tail.Enabled)
+
+	cfg := TailSamplingConfig{
+		Enabled:  true,
+		Policies: []TailSamplingPolicy{{SampleRate: 0.5}},
+		TTL:      24 * time.Hour,
+		MaxTTL:   2 * time.Hour,
+	}
+	assert.EqualError(t, cfg.Validate(), "ttl 24h0m0s exceeds max_ttl 2h0m0s")
+	cfg.TTL = time.Minute
+	cfg.MinTTL = 10 * time.Minute
+	assert.EqualError(t, cfg.Validate(), "ttl 1m0s is less than min_ttl 10m0s")
+	cfg.MinTTL = 3 * time.Hour
+	assert.EqualError(t, cfg.Validate(), "min_ttl 3h0m0s exceeds max_ttl 2h0m0s")
+	cfg.MinTTL = -time.Minute
+	assert.EqualError(t, cfg.Validate(), "min_ttl must not be negative")
+	cfg.MinTTL = 0
+	assert.NoError(t, cfg.Validate())
+}
+
+func TestTailSamplingStorageTuning(t *testing.T) {
+	c, err := NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+		"sampling.tail.policies":                           []map[string]interface{}{{"sample_rate": 0.5}},
+		"sampling.tail.storage_value_log_file_size":        "256MB",
+		"sampling.tail.storage_max_levels":                 5,
+		"sampling.tail.storage_level_size_multiplier":      8,
+		"sampling.tail.storage_disable_conflict_detection": true,
+	}), nil)
+	assert.NoError(t, err)
+	assert.True(t, c.Sampling.Tail.Enabled)
+	assert.Equal(t, uint64(256000000), c.Sampling.Tail.StorageValueLogFileSizeParsed)
+	assert.Equal(t, 5, c.Sampling.Tail.StorageMaxLevels)
+	assert.Equal(t, 8, c.Sampling.Tail.StorageLevelSizeMultiplier)
+	assert.True(t, c.Sampling.Tail.StorageDisableConflictDetection)
+}
+
+func TestTailSamplingVerifyElasticsearch(t *testing.T) {
+	c, err := NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+		"sampling.tail.policies":             []map[string]interface{}{{"sample_rate": 0.5}},
+		"sampling.tail.verify_elasticsearch": true,
+	}), nil)
+	assert.NoError(t, err)
+	assert.True(t, c.Sampling.Tail.VerifyElasticsearch)
+
+	c, err = NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+		"sampling.tail.policies": []map[string]interface{}{{"sample_rate": 0.5}},
+	}), nil)
+	assert.NoError(t, err)
+	assert.False(t, c.Sampling.Tail.VerifyElasticsearch)
+}
+
+func TestTailSamplingMaxConcurrentTraces(t *testing.T) {
+	c, err := NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+		"sampling.tail.policies":              []map[string]interface{}{{"sample_rate": 0.5}},
+		"sampling.tail.max_concurrent_traces": 1000,
+	}), nil)
+	assert.NoError(t, err)
+	assert.True(t, c.Sampling.Tail.Enabled)
+	assert.Equal(t, 1000, c.Sampling.Tail.MaxConcurrentTraces)
+
+	c, err = NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+		"sampling.tail.policies":              []map[string]interface{}{{"sample_rate": 0.5}},
+		"sampling.tail.max_concurrent_traces": -1,
+	}), nil)
+	assert.NoError(t, err)
+	assert.False(t, c.Sampling.Tail.Enabled)
+}
+
+func TestTailSamplingAllowedSampleRates(t *testing.T) {
+	c, err := NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+		"sampling.tail.policies":             []map[string]interface{}{{"sample_rate": 0.5}},
+		"sampling.tail.allowed_sample_rates": []float64{1, 0.5, 0.1},
+	}), nil)
+	assert.NoError(t, err)
+	assert.True(t, c.Sampling.Tail.Enabled)
+	assert.Equal(t, []float64{1, 0.5, 0.1}, c.Sampling.Tail.AllowedSampleRates)
+
+	for _, invalid := range [][]float64{{1, 2}, {-0.5}, {0.1, 0.5}, {0.5, 0.5}} {
+		c, err = NewConfig(config.MustNewConfigFrom(map[string]interface{}{
+			"sampling.tail.policies":             []map[string]interface{}{{"sample_rate": 0.5}},
+			"sampling.tail.allowed_sample_rates": invalid,
+		}), nil)
+		assert.NoError(t, err)
+		assert.False(t, c.Sampling.Tail.Enabled, "%v", invalid)
+	}
 }
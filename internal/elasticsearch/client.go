@@ -118,6 +118,14 @@ func NewClientParams(args ClientParams) (*Client, error) {
 	})
 }
 
+// Ping checks that the Elasticsearch cluster is reachable with the client's
+// configuration, including credentials, by requesting the cluster info.
+// An *Error is returned if the request is serviced but fails, such as due
+// to invalid credentials.
+func Ping(ctx context.Context, client *Client) error {
+	return doRequest(ctx, client, esapiv8.InfoRequest{}, nil)
+}
+
 func doRequest(ctx context.Context, transport esapiv8.Transport, req esapiv8.Request, out interface{}) error {
 	resp, err := req.Do(ctx, transport)
 	if err != nil {
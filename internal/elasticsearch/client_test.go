@@ -86,3 +86,26 @@ func TestClientCustomUserAgent(t *testing.T) {
 		t.Fatal("timed out while waiting for request")
 	}
 }
+
+func TestPing(t *testing.T) {
+	var status int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/", r.URL.Path)
+		w.Header().Set("X-Elastic-Product", "Elasticsearch")
+		w.WriteHeader(status)
+		fmt.Fprint(w, `{}`)
+	}))
+	defer srv.Close()
+
+	client, err := NewClient(&Config{Hosts: Hosts{srv.URL}})
+	require.NoError(t, err)
+
+	status = http.StatusOK
+	assert.NoError(t, Ping(context.Background(), client))
+
+	status = http.StatusUnauthorized
+	err = Ping(context.Background(), client)
+	var esErr *Error
+	require.ErrorAs(t, err, &esErr)
+	assert.Equal(t, http.StatusUnauthorized, esErr.StatusCode)
+}
@@ -8,11 +8,13 @@ import (
 	"context"
 	"os"
 	"sync"
+	"time"
 
 	"github.com/dgraph-io/badger/v2"
 	"github.com/gofrs/uuid"
 	"github.com/hashicorp/go-multierror"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
 	"golang.org/x/sync/errgroup"
 
 	"github.com/elastic/beats/v7/libbeat/common/reload"
@@ -28,12 +30,24 @@ import (
 	"github.com/elastic/apm-data/model/modelprocessor"
 	"github.com/elastic/apm-server/internal/beatcmd"
 	"github.com/elastic/apm-server/internal/beater"
+	beaterconfig "github.com/elastic/apm-server/internal/beater/config"
+	"github.com/elastic/apm-server/internal/elasticsearch"
 	"github.com/elastic/apm-server/x-pack/apm-server/sampling"
 	"github.com/elastic/apm-server/x-pack/apm-server/sampling/eventstorage"
+	"github.com/elastic/apm-server/x-pack/apm-server/sampling/eventstorage/eventstorageprom"
 )
 
 const (
 	tailSamplingStorageDir = "tail_sampling"
+
+	// verifyElasticsearchTimeout bounds the time spent checking that the
+	// tail-sampling Elasticsearch cluster is reachable at startup.
+	verifyElasticsearchTimeout = 30 * time.Second
+
+	// storageGCUtilizationCheckInterval holds the interval at which the
+	// tail-sampling storage utilization is checked, if garbage collection
+	// is configured to be triggered by it.
+	storageGCUtilizationCheckInterval = 10 * time.Second
 )
 
 var (
@@ -116,24 +130,86 @@ func newTailSamplingProcessor(args beater.ServerParams) (*sampling.Processor, er
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to create Elasticsearch client for tail-sampling")
 	}
+	if tailSamplingConfig.VerifyElasticsearch {
+		ctx, cancel := context.WithTimeout(context.Background(), verifyElasticsearchTimeout)
+		defer cancel()
+		if err := elasticsearch.Ping(ctx, es); err != nil {
+			return nil, errors.Wrap(err, "failed to connect to Elasticsearch for tail-sampling")
+		}
+	}
 
 	storageDir := paths.Resolve(paths.Data, tailSamplingStorageDir)
-	badgerDB, err = getBadgerDB(storageDir)
+	badgerDB, err = getBadgerDB(storageDir, eventstorage.BadgerConfig{
+		ValueLogFileSize:    int64(tailSamplingConfig.StorageValueLogFileSizeParsed),
+		MaxLevels:           tailSamplingConfig.StorageMaxLevels,
+		LevelSizeMultiplier: tailSamplingConfig.StorageLevelSizeMultiplier,
+		LogLevel:            tailSamplingConfig.StorageLogLevel,
+
+		DisableConflictDetection: tailSamplingConfig.StorageDisableConflictDetection,
+	})
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to get Badger database")
 	}
-	readWriters := getStorage(badgerDB)
+	onLimit := eventstorage.FailFlush
+	if tailSamplingConfig.StorageOnLimit != "" {
+		onLimit, err = eventstorage.ParseLimitStrategy(tailSamplingConfig.StorageOnLimit)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid tail-sampling storage_on_limit")
+		}
+	}
+	decisionConflict := eventstorage.Overwrite
+	if tailSamplingConfig.DecisionConflict != "" {
+		decisionConflict, err = eventstorage.ParseDecisionConflict(tailSamplingConfig.DecisionConflict)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid tail-sampling decision_conflict")
+		}
+	}
+	// The namespace is validated with the config, but WithNamespace panics
+	// if it is invalid, so check it again rather than crash.
+	if err := eventstorage.ValidateNamespace(tailSamplingConfig.StorageNamespace); err != nil {
+		return nil, errors.Wrap(err, "invalid tail-sampling storage_namespace")
+	}
+	storageOpts := []eventstorage.StorageOption{
+		eventstorage.WithMaxTransactionSize(int64(tailSamplingConfig.StorageMaxTransactionSizeParsed)),
+		eventstorage.WithTTL(tailSamplingConfig.TTL),
+		eventstorage.WithCoalesceWrites(tailSamplingConfig.StorageCoalesceWrites),
+		eventstorage.WithTraceEventSummaries(tailSamplingConfig.StorageTraceSummaries),
+		eventstorage.WithEventIDIndex(tailSamplingConfig.StorageEventIDIndex),
+		eventstorage.WithChronologicalKeys(tailSamplingConfig.StorageChronologicalKeys),
+		eventstorage.WithNamespace(tailSamplingConfig.StorageNamespace),
+		eventstorage.WithNodeID(tailSamplingConfig.StorageNodeID),
+		eventstorage.WithStorageLimit(int64(tailSamplingConfig.StorageLimitParsed)),
+		eventstorage.WithMaxEventSize(int64(tailSamplingConfig.StorageMaxEventSizeParsed)),
+		eventstorage.WithMinFreeDisk(storageDir, eventstorage.MinFreeDisk{
+			Bytes:   tailSamplingConfig.StorageMinFreeDiskBytesParsed,
+			Percent: tailSamplingConfig.StorageMinFreeDiskPercentParsed,
+		}),
+	}
+	if tailSamplingConfig.StorageTenantLabel != "" || tailSamplingConfig.StorageTenantServiceNameSeparator != "" {
+		storageOpts = append(storageOpts, eventstorage.WithTenantKey(eventstorage.TenantKey{
+			Label:                tailSamplingConfig.StorageTenantLabel,
+			ServiceNameSeparator: tailSamplingConfig.StorageTenantServiceNameSeparator,
+		}))
+	}
+	var decisionFilterRebuildInterval time.Duration
+	if capacity := tailSamplingConfig.StorageDecisionFilterCapacity; capacity > 0 {
+		const decisionFilterFalsePositiveRate = 0.01
+		storageOpts = append(storageOpts, eventstorage.WithDecisionFilter(capacity, decisionFilterFalsePositiveRate))
+		decisionFilterRebuildInterval = tailSamplingConfig.TTL
+	}
+	readWriters := getStorage(badgerDB, int64(tailSamplingConfig.StorageLimitParsed), storageOpts...)
 
 	policies := make([]sampling.Policy, len(tailSamplingConfig.Policies))
 	for i, in := range tailSamplingConfig.Policies {
 		policies[i] = sampling.Policy{
-			PolicyCriteria: sampling.PolicyCriteria{
-				ServiceName:        in.Service.Name,
-				ServiceEnvironment: in.Service.Environment,
-				TraceName:          in.Trace.Name,
-				TraceOutcome:       in.Trace.Outcome,
-			},
-			SampleRate: in.SampleRate,
+			PolicyCriteria:      samplingPolicyCriteria(in.TailSamplingCriteria),
+			Conditions:          samplingCondition(in.Conditions),
+			Name:                in.Name,
+			SampleRate:          in.SampleRate,
+			ErrorRateScaling:    in.ErrorRateScaling,
+			ErrorRateMultiplier: in.ErrorRateMultiplier,
+			ErrorRateDeadBand:   in.ErrorRateDeadBand,
+			ErrorRateMinHold:    in.ErrorRateMinHold,
 		}
 	}
 
@@ -144,6 +220,8 @@ func newTailSamplingProcessor(args beater.ServerParams) (*sampling.Processor, er
 			MaxDynamicServices:    1000,
 			Policies:              policies,
 			IngestRateDecayFactor: tailSamplingConfig.IngestRateDecayFactor,
+			MaxConcurrentTraces:   tailSamplingConfig.MaxConcurrentTraces,
+			AllowedSampleRates:    tailSamplingConfig.AllowedSampleRates,
 		},
 		RemoteSamplingConfig: sampling.RemoteSamplingConfig{
 			CompressionLevel: tailSamplingConfig.ESConfig.CompressionLevel,
@@ -156,21 +234,102 @@ func newTailSamplingProcessor(args beater.ServerParams) (*sampling.Processor, er
 			UUID: samplerUUID.String(),
 		},
 		StorageConfig: sampling.StorageConfig{
-			DB:                badgerDB,
-			Storage:           readWriters,
-			StorageDir:        storageDir,
-			StorageGCInterval: tailSamplingConfig.StorageGCInterval,
-			StorageLimit:      tailSamplingConfig.StorageLimitParsed,
-			TTL:               tailSamplingConfig.TTL,
+			DB:                       badgerDB,
+			Storage:                  readWriters,
+			StorageDir:               storageDir,
+			StorageGCInterval:        tailSamplingConfig.StorageGCInterval,
+			StorageLimit:             tailSamplingConfig.StorageLimitParsed,
+			EnvironmentStorageLimits: tailSamplingConfig.StorageEnvironmentLimitsParsed,
+			TTL:                      tailSamplingConfig.TTL,
+			SlidingTTLEvents:         tailSamplingConfig.SlidingTTL == "events",
+
+			StorageLimitStrategy: onLimit,
+			DecisionConflict:     decisionConflict,
+			DeltaEncoding:        tailSamplingConfig.StorageDeltaEncoding,
+			TraceEventSummaries:  tailSamplingConfig.StorageTraceSummaries,
+			ExpirySweepInterval:  tailSamplingConfig.ExpirySweepInterval,
+
+			DecisionFilterRebuildInterval: decisionFilterRebuildInterval,
+
+			StorageGCUtilizationTrigger:       tailSamplingConfig.StorageGCUtilizationTrigger,
+			StorageGCUtilizationCheckInterval: storageGCUtilizationCheckInterval,
+
+			PersistSamplerState: tailSamplingConfig.StoragePersistSamplerState,
 		},
 	})
 }
 
-func getBadgerDB(storageDir string) (*badger.DB, error) {
+func samplingPolicyCriteria(in beaterconfig.TailSamplingCriteria) sampling.PolicyCriteria {
+	return sampling.PolicyCriteria{
+		ServiceName:           in.Service.Name,
+		ServiceEnvironment:    in.Service.Environment,
+		TraceName:             in.Trace.Name,
+		TraceOutcome:          in.Trace.Outcome,
+		TraceURLPath:          in.Trace.URLPath,
+		TraceResult:           in.Trace.Result,
+		TransactionType:       in.Trace.TransactionType,
+		UpstreamSampled:       in.Trace.UpstreamSampled,
+		CloudProvider:         in.Cloud.Provider,
+		CloudRegion:           in.Cloud.Region,
+		UserID:                in.User.ID,
+		UserEmail:             in.User.Email,
+		SpanTotalDurationType: in.Trace.SpanTotalDuration.Type,
+		SpanTotalDurationMin:  in.Trace.SpanTotalDuration.Min,
+		DestinationService:    in.Trace.DestinationService,
+		SpanDurationRatio:     in.Trace.SpanDurationRatio,
+		SpanLabels:            in.Trace.SpanLabels,
+		DBStatement:           in.Trace.DBStatement,
+		TimeWindows:           samplingTimeWindows(in.Trace.TimeWindows),
+		TimeZone:              samplingTimeZone(in.Trace.TimeZone),
+	}
+}
+
+func samplingTimeWindows(in []beaterconfig.TailSamplingTimeWindow) []sampling.TimeWindow {
+	if len(in) == 0 {
+		return nil
+	}
+	out := make([]sampling.TimeWindow, len(in))
+	for i, w := range in {
+		out[i] = sampling.TimeWindow{Start: time.Duration(w.Start), End: time.Duration(w.End)}
+	}
+	return out
+}
+
+// samplingTimeZone returns the time zone with the given name, which has
+// been validated with the config, or nil if name is empty.
+func samplingTimeZone(name string) *time.Location {
+	if name == "" {
+		return nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil
+	}
+	return loc
+}
+
+func samplingCondition(in *beaterconfig.TailSamplingCondition) *sampling.Condition {
+	if in == nil {
+		return nil
+	}
+	out := &sampling.Condition{
+		PolicyCriteria: samplingPolicyCriteria(in.TailSamplingCriteria),
+		Not:            samplingCondition(in.Not),
+	}
+	for i := range in.And {
+		out.And = append(out.And, *samplingCondition(&in.And[i]))
+	}
+	for i := range in.Or {
+		out.Or = append(out.Or, *samplingCondition(&in.Or[i]))
+	}
+	return out
+}
+
+func getBadgerDB(storageDir string, config eventstorage.BadgerConfig) (*badger.DB, error) {
 	badgerMu.Lock()
 	defer badgerMu.Unlock()
 	if badgerDB == nil {
-		db, err := eventstorage.OpenBadger(storageDir, -1)
+		db, err := eventstorage.OpenBadger(storageDir, config)
 		if err != nil {
 			return nil, err
 		}
@@ -179,12 +338,21 @@ func getBadgerDB(storageDir string) (*badger.DB, error) {
 	return badgerDB, nil
 }
 
-func getStorage(db *badger.DB) *eventstorage.ShardedReadWriter {
+// getStorage returns the tail-sampling storage, creating it with db and opts
+// if it has not yet been created. When the storage is created, its metrics
+// are registered with the default Prometheus registry, reporting usage
+// against limit; like the storage, the collector is created only once, and
+// is not updated if the storage limit is later reconfigured. The default
+// registry is served at /metrics by the HTTP monitoring endpoint, if
+// enabled with http.enabled.
+func getStorage(db *badger.DB, limit int64, opts ...eventstorage.StorageOption) *eventstorage.ShardedReadWriter {
 	storageMu.Lock()
 	defer storageMu.Unlock()
 	if storage == nil {
 		eventCodec := eventstorage.ProtobufCodec{}
-		storage = eventstorage.New(db, eventCodec).NewShardedReadWriter()
+		s := eventstorage.New(db, eventCodec, opts...)
+		prometheus.MustRegister(eventstorageprom.NewPrometheusCollector(s, limit))
+		storage = s.NewShardedReadWriter()
 	}
 	return storage
 }
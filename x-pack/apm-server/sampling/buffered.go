@@ -0,0 +1,82 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package sampling
+
+import (
+	"sync"
+	"time"
+)
+
+// bufferedTracesPruneInterval holds the minimum interval between scans for
+// expired traces when the limit on buffered traces is reached, so that
+// sustained overflow does not cause a scan for every event.
+const bufferedTracesPruneInterval = time.Second
+
+// bufferedTraces tracks the IDs of traces with events buffered in storage
+// awaiting a sampling decision, for limiting the number of such traces; see
+// LocalSamplingConfig.MaxConcurrentTraces.
+//
+// A trace is tracked from when its first event is stored until a sampling
+// decision is recorded for it, its root transaction is dropped from a
+// sampling reservoir, or its events have expired. Traces which are never
+// decided, such as those whose root transaction is not received, are
+// therefore tracked for up to the storage TTL.
+type bufferedTraces struct {
+	max int
+	ttl time.Duration
+
+	mu        sync.Mutex
+	traces    map[string]time.Time
+	nextPrune time.Time
+}
+
+func newBufferedTraces(max int, ttl time.Duration) *bufferedTraces {
+	return &bufferedTraces{
+		max:    max,
+		ttl:    ttl,
+		traces: make(map[string]time.Time),
+	}
+}
+
+// add tracks traceID as buffered, if it is not already, reporting whether
+// it is tracked. add returns false if the trace is not already tracked and
+// the limit on buffered traces has been reached.
+func (b *bufferedTraces) add(traceID string, now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.traces[traceID]; ok {
+		return true
+	}
+	if len(b.traces) >= b.max {
+		if now.Before(b.nextPrune) {
+			return false
+		}
+		b.nextPrune = now.Add(bufferedTracesPruneInterval)
+		for id, added := range b.traces {
+			if now.Sub(added) >= b.ttl {
+				delete(b.traces, id)
+			}
+		}
+		if len(b.traces) >= b.max {
+			return false
+		}
+	}
+	b.traces[traceID] = now
+	return true
+}
+
+// remove stops tracking traceID, after a sampling decision has been made.
+func (b *bufferedTraces) remove(traceID string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.traces, traceID)
+}
+
+// len returns the number of traces currently tracked as buffered.
+func (b *bufferedTraces) len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.traces)
+}
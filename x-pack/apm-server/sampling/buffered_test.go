@@ -0,0 +1,35 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package sampling
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBufferedTraces(t *testing.T) {
+	now := time.Now()
+	b := newBufferedTraces(2, time.Minute)
+	assert.True(t, b.add("a", now))
+	assert.True(t, b.add("b", now.Add(time.Second)))
+	assert.True(t, b.add("a", now.Add(2*time.Second))) // already tracked
+	assert.False(t, b.add("c", now.Add(3*time.Second)))
+	assert.Equal(t, 2, b.len())
+
+	b.remove("a")
+	assert.True(t, b.add("c", now.Add(4*time.Second)))
+	assert.Equal(t, 2, b.len())
+
+	// "b" has expired, and is pruned to make room for "d".
+	assert.True(t, b.add("d", now.Add(61*time.Second)))
+	assert.Equal(t, 2, b.len())
+
+	// "c" expires after 64s, but pruning is rate limited.
+	assert.False(t, b.add("e", now.Add(63500*time.Millisecond)))
+	assert.False(t, b.add("e", now.Add(64200*time.Millisecond)))
+	assert.True(t, b.add("e", now.Add(64500*time.Millisecond)))
+}
@@ -5,6 +5,7 @@
 package sampling
 
 import (
+	"reflect"
 	"time"
 
 	"github.com/dgraph-io/badger/v2"
@@ -55,6 +56,29 @@ type LocalSamplingConfig struct {
 	// the exponentially weighted moving average (EWMA) ingest rate for each trace
 	// group.
 	IngestRateDecayFactor float64
+
+	// MaxConcurrentTraces holds the maximum number of traces whose events
+	// may be buffered in storage awaiting a sampling decision, bounding
+	// decision latency independently of StorageLimit. If zero, the number
+	// of traces is unlimited.
+	//
+	// Once MaxConcurrentTraces is reached, traces whose events are not yet
+	// buffered are decided immediately, using the sample rate of the first
+	// default policy. Traces whose root transactions are admitted to a
+	// reservoir but not sampled stop counting towards the limit when the
+	// reservoir drops them. Traces which are never decided, such as those
+	// whose root transaction is not received, count towards the limit
+	// until TTL after their first event was buffered.
+	MaxConcurrentTraces int
+
+	// AllowedSampleRates, if non-empty, holds the sample rates to which
+	// the effective sample rates of policies are quantized, in descending
+	// order, such as [1, 0.5, 0.1, 0.01]. Effective sample rates, including
+	// those scaled by error rate, are snapped to the nearest allowed rate,
+	// preferring the higher rate when two are equally near, so that counts
+	// can be scaled exactly downstream. A sample rate of zero is never
+	// snapped, so policies which drop all traces continue to do so.
+	AllowedSampleRates []float64
 }
 
 // RemoteSamplingConfig holds Processor configuration related to publishing and
@@ -113,12 +137,99 @@ type StorageConfig struct {
 	// StorageGCInterval holds the amount of time between storage garbage collections.
 	StorageGCInterval time.Duration
 
+	// StorageGCUtilizationTrigger, if non-zero, holds the storage
+	// utilization ratio, in the range (0,1], at or above which storage
+	// garbage collection is triggered in addition to every
+	// StorageGCInterval, so that the storage is collected promptly during
+	// bursts. Utilization is checked every StorageGCUtilizationCheckInterval,
+	// and is relative to the limit configured with
+	// eventstorage.WithStorageLimit; if the storage is unlimited, garbage
+	// collection is never triggered.
+	//
+	// Triggered runs are skipped while garbage collection is paused, and
+	// are not started within one minute of the end of the previous run,
+	// whether triggered or scheduled, as the database's size, and so its
+	// utilization, is only refreshed once a minute. Scheduled runs are
+	// unaffected by triggered runs.
+	StorageGCUtilizationTrigger float64
+
+	// StorageGCUtilizationCheckInterval holds the interval at which storage
+	// utilization is checked, if StorageGCUtilizationTrigger is non-zero.
+	StorageGCUtilizationCheckInterval time.Duration
+
 	// StorageLimit for the badger database, in bytes.
 	StorageLimit uint64
 
+	// EnvironmentStorageLimits optionally holds storage limits for trace
+	// events in bytes, by service environment, for preventing one service
+	// environment from using all of StorageLimit. If StorageLimit is
+	// non-zero, the sum of the environment limits must not exceed it.
+	// See eventstorage.WriterOpts.EnvironmentStorageLimits.
+	EnvironmentStorageLimits map[string]uint64
+
 	// TTL holds the amount of time before events and sampling decisions
 	// are expired from local storage.
 	TTL time.Duration
+
+	// SlidingTTLEvents, if true, causes the TTL of a trace's events to be
+	// measured from the most recently written event of the trace, rather
+	// than from when each was written. Each event written then also
+	// rewrites the trace's previously written events, so write
+	// amplification grows quadratically with the number of events in a
+	// trace, and garbage collection is delayed. Sampling decisions are not
+	// refreshed, as events are written only until their trace is decided.
+	SlidingTTLEvents bool
+
+	// StorageLimitStrategy holds the strategy for handling event writes
+	// which would exceed StorageLimit. See eventstorage.LimitStrategy.
+	StorageLimitStrategy eventstorage.LimitStrategy
+
+	// DecisionConflict holds the policy for handling sampling decisions
+	// made for traces which already have one, such as a remote sampling
+	// decision for a trace sampled out locally. See
+	// eventstorage.DecisionConflict.
+	DecisionConflict eventstorage.DecisionConflict
+
+	// DeltaEncoding, if true, causes the events of a trace received in
+	// the same batch to be stored as deltas against the first of them,
+	// reducing storage size at the cost of additional CPU. See
+	// eventstorage.TraceWriter.
+	DeltaEncoding bool
+
+	// TraceEventSummaries records whether Storage maintains a summary of
+	// each trace's events; see eventstorage.WithTraceEventSummaries. If
+	// true, policies with trace-level criteria are matched using the
+	// stored summary rather than by reading all of the trace's events,
+	// unless any policy matches on span labels or database statements,
+	// which the summary does not hold.
+	TraceEventSummaries bool
+
+	// ExpirySweepInterval holds the interval at which storage is scanned
+	// for traces whose events expired before a sampling decision was made.
+	// If zero, storage is not scanned. See eventstorage.ExpirySweeper for
+	// the limitations of detecting expired traces.
+	ExpirySweepInterval time.Duration
+
+	// OnTraceExpired, if non-nil, is called with the ID of each trace
+	// detected as expired when ExpirySweepInterval is non-zero. It is
+	// called synchronously, and should not block.
+	OnTraceExpired func(traceID string)
+
+	// DecisionFilterRebuildInterval holds the interval at which the
+	// storage's decision filter is rebuilt, to forget expired decisions.
+	// If non-zero, the filter is also rebuilt when the processor starts.
+	// This should be set if, and only if, the storage is configured with
+	// eventstorage.WithDecisionFilter; the TTL is a suitable interval.
+	DecisionFilterRebuildInterval time.Duration
+
+	// PersistSamplerState, if true, causes the learned sampling state of
+	// each trace group, such as its ingest rate and effective sample rate,
+	// to be written to storage after each FlushInterval, and restored when
+	// the processor is created. This avoids relearning ingest rates after
+	// a restart, during which reservoirs may be undersized. State written
+	// more than TTL ago, or for policies which have since changed, is not
+	// restored.
+	PersistSamplerState bool
 }
 
 // Policy holds a tail-sampling policy: criteria for matching root transactions,
@@ -126,9 +237,46 @@ type StorageConfig struct {
 type Policy struct {
 	PolicyCriteria
 
+	// Conditions optionally holds a tree of conditions for matching root
+	// transactions, for criteria which cannot be expressed by a flat
+	// PolicyCriteria, such as "service X and (failure or slow)". If this
+	// is non-nil, it supersedes PolicyCriteria, which is then ignored.
+	//
+	// Policies with Conditions are grouped by service name, like policies
+	// without PolicyCriteria.ServiceName.
+	Conditions *Condition
+
+	// Name optionally holds a name for identifying the policy in logs
+	// and error messages.
+	Name string
+
 	// SampleRate holds the tail-based sample rate to use for traces that
 	// match this policy.
 	SampleRate float64
+
+	// ErrorRateScaling, if true, scales SampleRate up according to the
+	// fraction of root transactions with a "failure" outcome observed for
+	// each of the policy's trace groups over the last FlushInterval. The
+	// effective sample rate is calculated as:
+	//
+	//     min(1, SampleRate * (1 + ErrorRateMultiplier * errorFraction))
+	ErrorRateScaling bool
+
+	// ErrorRateMultiplier holds the multiplier applied to the observed
+	// error fraction when ErrorRateScaling is true.
+	ErrorRateMultiplier float64
+
+	// ErrorRateDeadBand holds the minimum change in the error-scaled sample
+	// rate, in the range [0,1), for the effective sample rate to be changed
+	// when ErrorRateScaling is true. Changes back to SampleRate are always
+	// applied, subject to ErrorRateMinHold.
+	ErrorRateDeadBand float64
+
+	// ErrorRateMinHold holds the minimum duration for which the effective
+	// sample rate is held after changing, when ErrorRateScaling is true.
+	// The effective sample rate is recomputed each FlushInterval, so this
+	// is effectively rounded up to a multiple of FlushInterval.
+	ErrorRateMinHold time.Duration
 }
 
 // PolicyCriteria holds the criteria for matching root transactions to a
@@ -167,6 +315,318 @@ type PolicyCriteria struct {
 	// from the same service) will be grouped together for sampling purposes,
 	// similar to head-based sampling.
 	TraceName string
+
+	// TraceURLPath holds a glob pattern for matching the root transaction's
+	// URL path, where "*" matches any sequence of characters. Unlike
+	// TraceName, which may be a route template, this is matched against
+	// the request's actual path.
+	//
+	// If specified, root transactions without a URL path, such as those
+	// of non-HTTP traces, do not match.
+	TraceURLPath string
+
+	// TraceResult holds a glob pattern for matching the root transaction's
+	// result, such as "HTTP 2xx" or "Error", where "*" matches any sequence
+	// of characters. Unlike TraceOutcome, the result is free-form and
+	// defined by the agent or instrumentation.
+	//
+	// If specified, root transactions without a result do not match.
+	TraceResult string
+
+	// TransactionType holds a glob pattern for matching the root
+	// transaction's type, such as "request" or "messaging", where "*"
+	// matches any sequence of characters. This distinguishes web requests
+	// from background and messaging transactions, independently of the
+	// types of the trace's spans.
+	//
+	// If specified, root transactions without a type do not match.
+	TransactionType string
+
+	// UpstreamSampled, if non-nil, holds the sampling decision propagated
+	// to the root transaction from upstream, such as with the W3C
+	// traceparent sampled flag, for which this policy applies. Root
+	// transactions without a propagated decision are treated as unsampled.
+	//
+	// Head-unsampled transactions are passed through without tail-sampling,
+	// so only transactions which upstream decided to sample are matched
+	// against policies; a policy with UpstreamSampled false never applies.
+	UpstreamSampled *bool
+
+	// CloudProvider holds the cloud provider, such as "aws", of the root
+	// transaction for which this policy applies.
+	//
+	// If specified, root transactions without a cloud provider do not match.
+	CloudProvider string
+
+	// CloudRegion holds a glob pattern for matching the cloud region of
+	// the root transaction, where "*" matches any sequence of characters.
+	//
+	// If specified, root transactions without a cloud region do not match.
+	CloudRegion string
+
+	// UserID and UserEmail hold glob patterns for matching the user.id and
+	// user.email fields of the root transaction, where "*" matches any
+	// sequence of characters. These can be used to guarantee sampling of
+	// traces for specific users, such as VIP customers.
+	//
+	// If specified, root transactions without the field do not match. Note
+	// that user identifiers are personal data: they are held in the policy
+	// configuration in plain text, and matching them does not prevent them
+	// from being stored with sampled events.
+	UserID    string
+	UserEmail string
+
+	// SpanTotalDurationType holds a span type, such as "db", for matching
+	// traces by the total duration of their spans of that type.
+	//
+	// If specified, the policy applies to traces whose spans of this type
+	// have a total duration of at least SpanTotalDurationMin. Spans' full
+	// durations are summed, including time spent in their child spans, and
+	// regardless of whether they overlap; this is not the spans' self time.
+	// Only the spans that have been received by the time the root
+	// transaction is received are considered: spans that arrive later do
+	// not contribute to the total, and may cause the trace to be matched by
+	// a subsequent policy instead.
+	SpanTotalDurationType string
+
+	// SpanTotalDurationMin holds the minimum total duration of spans with
+	// the type SpanTotalDurationType for the policy to apply. This is
+	// ignored if SpanTotalDurationType is unspecified.
+	SpanTotalDurationMin time.Duration
+
+	// DestinationService holds a glob pattern for matching the
+	// span.destination.service.resource field of the trace's spans, such
+	// as "payment-gateway:443", where "*" matches any sequence of
+	// characters. This can be used to sample traces which call a specific
+	// downstream dependency.
+	//
+	// If specified, the policy applies to traces with at least one span
+	// whose destination service resource matches; traces without any
+	// spans with a destination do not match. As with SpanTotalDurationType,
+	// only the spans received by the time the root transaction is
+	// received are considered.
+	DestinationService string
+
+	// SpanDurationRatio holds the minimum ratio of the total duration of
+	// the trace's spans to the duration of the root transaction, for
+	// matching traces with fan-out or concurrent work, such as a short
+	// root transaction which starts long asynchronous operations. Spans'
+	// durations are summed regardless of whether they overlap.
+	//
+	// If specified, the policy applies to traces whose spans have a total
+	// duration of at least SpanDurationRatio times the root transaction's
+	// duration. Root transactions without a duration do not match. As with
+	// SpanTotalDurationType, only the spans received by the time the root
+	// transaction is received are considered.
+	SpanDurationRatio float64
+
+	// SpanLabels holds string labels, such as {"feature_flag": "new_checkout"},
+	// for matching traces with at least one span which has all of the labels
+	// with exactly the given values. Keys must not be empty.
+	//
+	// Only the labels of spans are considered: labels of the root transaction,
+	// or of other transactions, do not match. Global labels are set on every
+	// event, and so match any span. As with SpanTotalDurationType, only the
+	// spans received by the time the root transaction is received are
+	// considered.
+	SpanLabels map[string]string
+
+	// DBStatement holds a glob pattern for matching the span.db.statement
+	// field of the trace's spans, such as "SELECT * FROM orders*", where
+	// "*" matches any sequence of characters. Matching is case-sensitive,
+	// and the pattern must match the whole statement, so patterns should
+	// usually end with "*". This can be used to sample traces which run a
+	// particular kind of database query.
+	//
+	// If specified, the policy applies to traces with at least one span
+	// whose statement matches; traces without any spans with a statement
+	// do not match. Only the first maxDBStatementLength bytes of each
+	// statement are matched, so patterns must not be longer than that.
+	// As with SpanTotalDurationType, only the spans received by the time
+	// the root transaction is received are considered.
+	//
+	// Statements are not held in stored trace event summaries, so, as with
+	// SpanLabels, all of a trace's buffered events are read and decoded to
+	// match each root transaction, even with TraceEventSummaries enabled.
+	// Each statement is then scanned for the pattern, at a cost linear in
+	// its length. For services with many spans per trace or long
+	// statements, this can add significantly to decision latency and CPU
+	// usage.
+	DBStatement string
+
+	// TimeWindows holds windows of the time of day, in TimeZone, for
+	// matching traces by the time they started, such as for sampling less
+	// outside of business hours. Windows must not overlap.
+	//
+	// If specified, the policy applies to traces whose root transaction's
+	// timestamp falls within one of the windows. Root transactions without
+	// a timestamp do not match.
+	TimeWindows []TimeWindow
+
+	// TimeZone holds the time zone in which TimeWindows are evaluated. If
+	// this is nil, UTC is used. This is ignored if TimeWindows is empty.
+	TimeZone *time.Location
+}
+
+// maxDBStatementLength holds the maximum length in bytes of a span's
+// database statement matched by PolicyCriteria.DBStatement, and of the
+// pattern itself. Longer statements are truncated before matching, which
+// bounds the cost of matching statements of unusual length; agents
+// typically truncate statements to this length anyway.
+const maxDBStatementLength = 10000
+
+// TimeWindow holds a window of the time of day, as durations since
+// midnight in the range [0,24h). Windows include Start and exclude End;
+// if End is before Start, the window spans midnight. Offsets are applied
+// to the wall clock, so windows are shifted by daylight saving time
+// transitions in the same way as the local time.
+type TimeWindow struct {
+	Start time.Duration
+	End   time.Duration
+}
+
+// contains reports whether the window contains the time of day t, as a
+// duration since midnight.
+func (w TimeWindow) contains(t time.Duration) bool {
+	if w.Start < w.End {
+		return t >= w.Start && t < w.End
+	}
+	return t >= w.Start || t < w.End
+}
+
+// overlaps reports whether the windows w and other contain any of the
+// same times of day.
+func (w TimeWindow) overlaps(other TimeWindow) bool {
+	return w.contains(other.Start) || other.contains(w.Start)
+}
+
+// validateTimeWindows validates the windows of a TimeWindows criterion.
+func validateTimeWindows(windows []TimeWindow) error {
+	const day = 24 * time.Hour
+	for i, w := range windows {
+		if w.Start < 0 || w.Start >= day || w.End < 0 || w.End >= day {
+			return errors.Errorf("TimeWindows %d out of range [0,24h)", i)
+		}
+		if w.Start == w.End {
+			return errors.Errorf("TimeWindows %d empty", i)
+		}
+		for j, other := range windows[:i] {
+			if w.overlaps(other) {
+				return errors.Errorf("TimeWindows %d and %d overlap", j, i)
+			}
+		}
+	}
+	return nil
+}
+
+// isZero reports whether no criteria are specified.
+func (c PolicyCriteria) isZero() bool {
+	return reflect.DeepEqual(c, PolicyCriteria{})
+}
+
+// requiresTraceSummary reports whether matching the criteria requires a
+// summary of the trace's events.
+func (c PolicyCriteria) requiresTraceSummary() bool {
+	return c.SpanTotalDurationType != "" || c.DestinationService != "" || c.SpanDurationRatio != 0 || c.requiresSpanEvents()
+}
+
+// requiresSpanEvents reports whether matching the criteria requires the
+// labels or database statements of each span, which are not held in
+// stored trace event summaries.
+func (c PolicyCriteria) requiresSpanEvents() bool {
+	return len(c.SpanLabels) > 0 || c.DBStatement != ""
+}
+
+// Condition holds a node in a tree of conditions for matching root
+// transactions to a tail-sampling policy. See Policy.Conditions.
+//
+// A condition matches a root transaction if all of the following hold:
+// its PolicyCriteria match, as for a policy without Conditions; all of
+// the conditions in And match; at least one of the conditions in Or
+// match, if Or is non-empty; and Not does not match, if it is non-nil.
+// A condition must specify at least one of these.
+type Condition struct {
+	PolicyCriteria
+
+	// And holds conditions which must all match.
+	And []Condition
+
+	// Or holds conditions of which at least one must match.
+	Or []Condition
+
+	// Not holds a condition which must not match.
+	Not *Condition
+}
+
+// anyCriteria reports whether f returns true for the criteria of the
+// condition, or of any condition nested within it.
+func (c *Condition) anyCriteria(f func(PolicyCriteria) bool) bool {
+	if f(c.PolicyCriteria) {
+		return true
+	}
+	for i := range c.And {
+		if c.And[i].anyCriteria(f) {
+			return true
+		}
+	}
+	for i := range c.Or {
+		if c.Or[i].anyCriteria(f) {
+			return true
+		}
+	}
+	return c.Not != nil && c.Not.anyCriteria(f)
+}
+
+func (c *Condition) validate() error {
+	if c.PolicyCriteria.isZero() && len(c.And) == 0 && len(c.Or) == 0 && c.Not == nil {
+		return errors.New("condition unspecified")
+	}
+	if c.SpanTotalDurationMin < 0 {
+		return errors.New("SpanTotalDurationMin negative")
+	}
+	if c.SpanDurationRatio < 0 {
+		return errors.New("SpanDurationRatio negative")
+	}
+	if _, ok := c.SpanLabels[""]; ok {
+		return errors.New("SpanLabels key empty")
+	}
+	if len(c.DBStatement) > maxDBStatementLength {
+		return errors.Errorf("DBStatement longer than %d bytes", maxDBStatementLength)
+	}
+	if err := validateTimeWindows(c.TimeWindows); err != nil {
+		return err
+	}
+	for i := range c.And {
+		if err := c.And[i].validate(); err != nil {
+			return errors.Wrapf(err, "And %d invalid", i)
+		}
+	}
+	for i := range c.Or {
+		if err := c.Or[i].validate(); err != nil {
+			return errors.Wrapf(err, "Or %d invalid", i)
+		}
+	}
+	if c.Not != nil {
+		if err := c.Not.validate(); err != nil {
+			return errors.Wrap(err, "Not invalid")
+		}
+	}
+	return nil
+}
+
+// anyCriteria reports whether f returns true for the policy's criteria, or
+// if it has Conditions, for the criteria of any of them.
+func (p Policy) anyCriteria(f func(PolicyCriteria) bool) bool {
+	if p.Conditions != nil {
+		return p.Conditions.anyCriteria(f)
+	}
+	return f(p.PolicyCriteria)
+}
+
+// isDefault reports whether the policy has no criteria, and so matches
+// all root transactions.
+func (p Policy) isDefault() bool {
+	return p.Conditions == nil && p.PolicyCriteria.isZero()
 }
 
 // Validate validates the configuration.
@@ -199,9 +659,12 @@ func (config LocalSamplingConfig) validate() error {
 	var anyDefaultPolicy bool
 	for i, policy := range config.Policies {
 		if err := policy.validate(); err != nil {
+			if policy.Name != "" {
+				return errors.Wrapf(err, "Policy %d (%q) invalid", i, policy.Name)
+			}
 			return errors.Wrapf(err, "Policy %d invalid", i)
 		}
-		if policy.PolicyCriteria == (PolicyCriteria{}) {
+		if policy.isDefault() {
 			anyDefaultPolicy = true
 		}
 	}
@@ -211,6 +674,17 @@ func (config LocalSamplingConfig) validate() error {
 	if config.IngestRateDecayFactor <= 0 || config.IngestRateDecayFactor > 1 {
 		return errors.New("IngestRateDecayFactor unspecified or out of range (0,1]")
 	}
+	if config.MaxConcurrentTraces < 0 {
+		return errors.New("MaxConcurrentTraces negative")
+	}
+	for i, rate := range config.AllowedSampleRates {
+		if rate < 0 || rate > 1 {
+			return errors.Errorf("AllowedSampleRates %d out of range [0,1]", i)
+		}
+		if i > 0 && rate >= config.AllowedSampleRates[i-1] {
+			return errors.New("AllowedSampleRates not sorted in descending order")
+		}
+	}
 	return nil
 }
 
@@ -247,9 +721,30 @@ func (config StorageConfig) validate() error {
 	if config.StorageGCInterval <= 0 {
 		return errors.New("StorageGCInterval unspecified or negative")
 	}
+	if config.StorageGCUtilizationTrigger < 0 || config.StorageGCUtilizationTrigger > 1 {
+		return errors.New("StorageGCUtilizationTrigger out of range [0,1]")
+	}
+	if config.StorageGCUtilizationTrigger > 0 && config.StorageGCUtilizationCheckInterval <= 0 {
+		return errors.New("StorageGCUtilizationCheckInterval unspecified or negative")
+	}
 	if config.TTL <= 0 {
 		return errors.New("TTL unspecified or negative")
 	}
+	if config.ExpirySweepInterval < 0 {
+		return errors.New("ExpirySweepInterval negative")
+	}
+	if config.DecisionFilterRebuildInterval < 0 {
+		return errors.New("DecisionFilterRebuildInterval negative")
+	}
+	if config.StorageLimit > 0 {
+		var total uint64
+		for _, limit := range config.EnvironmentStorageLimits {
+			total += limit
+		}
+		if total > config.StorageLimit {
+			return errors.New("EnvironmentStorageLimits exceed StorageLimit")
+		}
+	}
 	return nil
 }
 
@@ -257,5 +752,34 @@ func (p Policy) validate() error {
 	if p.SampleRate < 0 || p.SampleRate > 1 {
 		return errors.New("SampleRate unspecified or out of range [0,1]")
 	}
+	if p.ErrorRateScaling && p.ErrorRateMultiplier <= 0 {
+		return errors.New("ErrorRateMultiplier unspecified or negative")
+	}
+	if p.ErrorRateDeadBand < 0 || p.ErrorRateDeadBand >= 1 {
+		return errors.New("ErrorRateDeadBand out of range [0,1)")
+	}
+	if p.ErrorRateMinHold < 0 {
+		return errors.New("ErrorRateMinHold negative")
+	}
+	if p.SpanTotalDurationMin < 0 {
+		return errors.New("SpanTotalDurationMin negative")
+	}
+	if p.SpanDurationRatio < 0 {
+		return errors.New("SpanDurationRatio negative")
+	}
+	if _, ok := p.SpanLabels[""]; ok {
+		return errors.New("SpanLabels key empty")
+	}
+	if len(p.DBStatement) > maxDBStatementLength {
+		return errors.Errorf("DBStatement longer than %d bytes", maxDBStatementLength)
+	}
+	if err := validateTimeWindows(p.TimeWindows); err != nil {
+		return err
+	}
+	if p.Conditions != nil {
+		if err := p.Conditions.validate(); err != nil {
+			return errors.Wrap(err, "Conditions invalid")
+		}
+	}
 	return nil
 }
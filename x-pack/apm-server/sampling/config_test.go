@@ -5,7 +5,9 @@
 package sampling_test
 
 import (
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/dgraph-io/badger/v2"
 	"github.com/stretchr/testify/assert"
@@ -48,12 +50,59 @@ func TestNewProcessorConfigInvalid(t *testing.T) {
 	}
 	config.Policies[0].SampleRate = 1.0
 
+	config.Policies[0].ErrorRateScaling = true
+	assertInvalidConfigError("invalid local sampling config: Policy 0 invalid: ErrorRateMultiplier unspecified or negative")
+	config.Policies[0].Name = "default"
+	assertInvalidConfigError(`invalid local sampling config: Policy 0 ("default") invalid: ErrorRateMultiplier unspecified or negative`)
+	config.Policies[0].ErrorRateMultiplier = 2
+
+	config.Policies[0].ErrorRateDeadBand = 1
+	assertInvalidConfigError(`invalid local sampling config: Policy 0 ("default") invalid: ErrorRateDeadBand out of range [0,1)`)
+	config.Policies[0].ErrorRateDeadBand = 0.1
+	config.Policies[0].ErrorRateMinHold = -1
+	assertInvalidConfigError(`invalid local sampling config: Policy 0 ("default") invalid: ErrorRateMinHold negative`)
+	config.Policies[0].ErrorRateMinHold = 0
+	config.Policies[0].SpanTotalDurationMin = -1
+	assertInvalidConfigError(`invalid local sampling config: Policy 0 ("default") invalid: SpanTotalDurationMin negative`)
+	config.Policies[0].SpanTotalDurationMin = 0
+	config.Policies[0].SpanDurationRatio = -1
+	assertInvalidConfigError(`invalid local sampling config: Policy 0 ("default") invalid: SpanDurationRatio negative`)
+	config.Policies[0].SpanDurationRatio = 0
+	config.Policies[0].SpanLabels = map[string]string{"": "value"}
+	assertInvalidConfigError(`invalid local sampling config: Policy 0 ("default") invalid: SpanLabels key empty`)
+	config.Policies[0].SpanLabels = nil
+	config.Policies[0].DBStatement = strings.Repeat("x", 10001)
+	assertInvalidConfigError(`invalid local sampling config: Policy 0 ("default") invalid: DBStatement longer than 10000 bytes`)
+	config.Policies[0].DBStatement = ""
+	config.Policies[0].TimeWindows = []sampling.TimeWindow{{Start: 22 * time.Hour, End: 24 * time.Hour}}
+	assertInvalidConfigError(`invalid local sampling config: Policy 0 ("default") invalid: TimeWindows 0 out of range [0,24h)`)
+	config.Policies[0].TimeWindows = []sampling.TimeWindow{{Start: time.Hour, End: time.Hour}}
+	assertInvalidConfigError(`invalid local sampling config: Policy 0 ("default") invalid: TimeWindows 0 empty`)
+	config.Policies[0].TimeWindows = []sampling.TimeWindow{
+		{Start: 22 * time.Hour, End: 6 * time.Hour},
+		{Start: 5 * time.Hour, End: 7 * time.Hour},
+	}
+	assertInvalidConfigError(`invalid local sampling config: Policy 0 ("default") invalid: TimeWindows 0 and 1 overlap`)
+	config.Policies[0].TimeWindows = nil
+	config.Policies[0].Conditions = &sampling.Condition{Or: []sampling.Condition{
+		{PolicyCriteria: sampling.PolicyCriteria{TraceOutcome: "failure"}},
+		{Not: &sampling.Condition{}},
+	}}
+	assertInvalidConfigError(`invalid local sampling config: Policy 0 ("default") invalid: Conditions invalid: Or 1 invalid: Not invalid: condition unspecified`)
+	config.Policies[0].Conditions = nil
+
 	for _, invalid := range []float64{-1, 0, 2.0} {
 		config.IngestRateDecayFactor = invalid
 		assertInvalidConfigError("invalid local sampling config: IngestRateDecayFactor unspecified or out of range (0,1]")
 	}
 	config.IngestRateDecayFactor = 0.5
 
+	config.AllowedSampleRates = []float64{1, 1.5}
+	assertInvalidConfigError("invalid local sampling config: AllowedSampleRates 1 out of range [0,1]")
+	config.AllowedSampleRates = []float64{0.1, 0.5}
+	assertInvalidConfigError("invalid local sampling config: AllowedSampleRates not sorted in descending order")
+	config.AllowedSampleRates = []float64{1, 0.5, 0.1}
+
 	config.CompressionLevel = 11
 	assertInvalidConfigError("invalid remote sampling config: CompressionLevel out of range [-1,9]")
 	config.CompressionLevel = 0
@@ -83,6 +132,21 @@ func TestNewProcessorConfigInvalid(t *testing.T) {
 	assertInvalidConfigError("invalid storage config: StorageGCInterval unspecified or negative")
 	config.StorageGCInterval = 1
 
+	config.StorageGCUtilizationTrigger = 1.5
+	assertInvalidConfigError("invalid storage config: StorageGCUtilizationTrigger out of range [0,1]")
+	config.StorageGCUtilizationTrigger = 0.7
+	assertInvalidConfigError("invalid storage config: StorageGCUtilizationCheckInterval unspecified or negative")
+	config.StorageGCUtilizationCheckInterval = 1
+
 	assertInvalidConfigError("invalid storage config: TTL unspecified or negative")
 	config.TTL = 1
+
+	config.DecisionFilterRebuildInterval = -1
+	assertInvalidConfigError("invalid storage config: DecisionFilterRebuildInterval negative")
+	config.DecisionFilterRebuildInterval = 0
+
+	config.StorageLimit = 100
+	config.EnvironmentStorageLimits = map[string]uint64{"production": 60, "staging": 50}
+	assertInvalidConfigError("invalid storage config: EnvironmentStorageLimits exceed StorageLimit")
+	config.EnvironmentStorageLimits["staging"] = 40
 }
@@ -0,0 +1,113 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package eventstorage
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/elastic/apm-data/model/modelpb"
+)
+
+const (
+	// AdaptiveCodecUncompressed is the format marker of events encoded by
+	// AdaptiveCodec without compression.
+	AdaptiveCodecUncompressed byte = 'r'
+
+	// AdaptiveCodecZstd is the format marker of events encoded by
+	// AdaptiveCodec with zstd compression.
+	AdaptiveCodecZstd byte = 'z'
+
+	// DefaultAdaptiveCodecThreshold holds the default size in bytes above
+	// which AdaptiveCodec compresses events. Smaller events typically
+	// compress by too little to be worth the CPU.
+	DefaultAdaptiveCodecThreshold = 512
+
+	// maxAdaptiveCodecThreshold holds the maximum compression threshold;
+	// events are never larger than this in practice, so a higher threshold
+	// would disable compression, which is better done by not using
+	// AdaptiveCodec.
+	maxAdaptiveCodecThreshold = 1 << 20
+)
+
+// AdaptiveCodec is an implementation of Codec which wraps another Codec,
+// compressing the events it encodes with zstd only if they are larger than
+// a threshold, trading CPU for storage space only where compression is
+// likely to be effective. Events are also stored uncompressed if compression
+// would not make them smaller.
+//
+// Each encoded event is prefixed with a format marker, AdaptiveCodecZstd or
+// AdaptiveCodecUncompressed, so CodecFormatStats reports the number of
+// events stored with and without compression. AdaptiveCodec is safe for
+// concurrent use.
+type AdaptiveCodec struct {
+	codec     Codec
+	threshold int
+	encoder   *zstd.Encoder
+	decoder   *zstd.Decoder
+}
+
+// NewAdaptiveCodec returns a new AdaptiveCodec, encoding events with codec
+// and compressing those whose encoding is larger than threshold bytes. If
+// threshold is zero, DefaultAdaptiveCodecThreshold is used. An error is
+// returned if threshold is negative or greater than 1MB.
+func NewAdaptiveCodec(codec Codec, threshold int) (*AdaptiveCodec, error) {
+	if threshold == 0 {
+		threshold = DefaultAdaptiveCodecThreshold
+	}
+	if threshold < 0 || threshold > maxAdaptiveCodecThreshold {
+		return nil, fmt.Errorf("threshold %d must be between 0 and %d", threshold, maxAdaptiveCodecThreshold)
+	}
+	encoder, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest))
+	if err != nil {
+		return nil, err
+	}
+	decoder, err := zstd.NewReader(nil)
+	if err != nil {
+		return nil, err
+	}
+	return &AdaptiveCodec{
+		codec:     codec,
+		threshold: threshold,
+		encoder:   encoder,
+		decoder:   decoder,
+	}, nil
+}
+
+// DecodeEvent decodes data, decompressing it first if it was compressed.
+func (c *AdaptiveCodec) DecodeEvent(data []byte, event *modelpb.APMEvent) error {
+	if len(data) == 0 {
+		return errors.New("missing format marker")
+	}
+	switch data[0] {
+	case AdaptiveCodecUncompressed:
+		return c.codec.DecodeEvent(data[1:], event)
+	case AdaptiveCodecZstd:
+		decompressed, err := c.decoder.DecodeAll(data[1:], nil)
+		if err != nil {
+			return fmt.Errorf("failed to decompress event: %w", err)
+		}
+		return c.codec.DecodeEvent(decompressed, event)
+	}
+	return fmt.Errorf("unknown format marker %q", data[0])
+}
+
+// EncodeEvent encodes event, compressing it if its encoding is larger than
+// the threshold and compression makes it smaller.
+func (c *AdaptiveCodec) EncodeEvent(event *modelpb.APMEvent) ([]byte, error) {
+	data, err := c.codec.EncodeEvent(event)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > c.threshold {
+		compressed := c.encoder.EncodeAll(data, []byte{AdaptiveCodecZstd})
+		if len(compressed) <= len(data) {
+			return compressed, nil
+		}
+	}
+	return append([]byte{AdaptiveCodecUncompressed}, data...), nil
+}
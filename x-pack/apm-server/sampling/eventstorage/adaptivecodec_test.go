@@ -0,0 +1,83 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package eventstorage_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/testing/protocmp"
+
+	"github.com/elastic/apm-data/model/modelpb"
+	"github.com/elastic/apm-server/x-pack/apm-server/sampling/eventstorage"
+)
+
+func TestAdaptiveCodec(t *testing.T) {
+	codec, err := eventstorage.NewAdaptiveCodec(eventstorage.ProtobufCodec{}, 100)
+	require.NoError(t, err)
+
+	small := &modelpb.APMEvent{Span: &modelpb.Span{Id: "small"}}
+	large := &modelpb.APMEvent{Span: &modelpb.Span{Id: "large", Name: strings.Repeat("name", 100)}}
+	for _, test := range []struct {
+		event  *modelpb.APMEvent
+		marker byte
+	}{
+		{small, eventstorage.AdaptiveCodecUncompressed},
+		{large, eventstorage.AdaptiveCodecZstd},
+	} {
+		data, err := codec.EncodeEvent(test.event)
+		require.NoError(t, err)
+		assert.Equal(t, test.marker, data[0])
+
+		var decoded modelpb.APMEvent
+		require.NoError(t, codec.DecodeEvent(data, &decoded))
+		assert.Empty(t, cmp.Diff(test.event, &decoded, protocmp.Transform()))
+	}
+
+	var event modelpb.APMEvent
+	assert.EqualError(t, codec.DecodeEvent(nil, &event), "missing format marker")
+	assert.EqualError(t, codec.DecodeEvent([]byte("x"), &event), `unknown format marker 'x'`)
+	assert.Error(t, codec.DecodeEvent([]byte("zgarbage"), &event))
+}
+
+func TestAdaptiveCodecThreshold(t *testing.T) {
+	_, err := eventstorage.NewAdaptiveCodec(eventstorage.ProtobufCodec{}, 0)
+	assert.NoError(t, err)
+	_, err = eventstorage.NewAdaptiveCodec(eventstorage.ProtobufCodec{}, -1)
+	assert.EqualError(t, err, "threshold -1 must be between 0 and 1048576")
+	_, err = eventstorage.NewAdaptiveCodec(eventstorage.ProtobufCodec{}, 2<<20)
+	assert.Error(t, err)
+}
+
+func TestAdaptiveCodecStorage(t *testing.T) {
+	codec, err := eventstorage.NewAdaptiveCodec(eventstorage.ProtobufCodec{}, 100)
+	require.NoError(t, err)
+	db := newBadgerDB(t, badgerOptions)
+	store := eventstorage.New(db, codec)
+	readWriter := store.NewReadWriter()
+	defer readWriter.Close()
+
+	wOpts := eventstorage.WriterOpts{TTL: time.Minute}
+	small := &modelpb.APMEvent{Span: &modelpb.Span{Id: "small"}}
+	large := &modelpb.APMEvent{Span: &modelpb.Span{Id: "large", Name: strings.Repeat("name", 100)}}
+	require.NoError(t, readWriter.WriteTraceEvent("trace_id", "small", small, wOpts))
+	require.NoError(t, readWriter.WriteTraceEvent("trace_id", "large", large, wOpts))
+	require.NoError(t, readWriter.Flush())
+
+	var events modelpb.Batch
+	require.NoError(t, readWriter.ReadTraceEvents("trace_id", &events))
+	assert.Empty(t, cmp.Diff(modelpb.Batch{large, small}, events, protocmp.Transform()))
+
+	stats, err := store.CodecFormatStats()
+	require.NoError(t, err)
+	assert.Equal(t, map[byte]int{
+		eventstorage.AdaptiveCodecUncompressed: 1,
+		eventstorage.AdaptiveCodecZstd:         1,
+	}, stats)
+}
@@ -0,0 +1,59 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package eventstorage
+
+import "time"
+
+// StartAutoFlush starts a background goroutine which flushes the ReadWriter's
+// pending writes every interval, so that writes are committed even if Flush
+// is not called, such as when writes stop arriving. If automatic flushing is
+// already running, it is restarted with the new interval. StartAutoFlush
+// panics if interval is not positive.
+//
+// Automatic flushes hold the ReadWriter's internal lock, and so are never
+// concurrent with other ReadWriter methods. Errors from automatic flushes are
+// returned by the next successful call to Flush; the writes of a failed flush
+// are lost, as with Flush.
+//
+// Automatic flushing is stopped by Close. StartAutoFlush and Close must be
+// called by the goroutine using the ReadWriter.
+func (rw *ReadWriter) StartAutoFlush(interval time.Duration) {
+	if interval <= 0 {
+		panic("interval must be positive")
+	}
+	rw.stopAutoFlush()
+	rw.autoFlushStop = make(chan struct{})
+	rw.autoFlushDone = make(chan struct{})
+	go rw.autoFlush(interval, rw.autoFlushStop, rw.autoFlushDone)
+}
+
+func (rw *ReadWriter) autoFlush(interval time.Duration, stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			rw.mu.Lock()
+			if err := rw.flush(); err != nil {
+				rw.autoFlushErr = err
+			}
+			rw.mu.Unlock()
+		}
+	}
+}
+
+// stopAutoFlush stops automatic flushing, if running, and waits for any
+// in-progress automatic flush to complete.
+func (rw *ReadWriter) stopAutoFlush() {
+	if rw.autoFlushStop == nil {
+		return
+	}
+	close(rw.autoFlushStop)
+	<-rw.autoFlushDone
+	rw.autoFlushStop, rw.autoFlushDone = nil, nil
+}
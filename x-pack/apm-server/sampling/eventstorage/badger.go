@@ -5,6 +5,11 @@
 package eventstorage
 
 import (
+	"errors"
+	"fmt"
+	"syscall"
+	"time"
+
 	"github.com/dgraph-io/badger/v2"
 
 	"github.com/elastic/apm-server/internal/logs"
@@ -13,15 +18,120 @@ import (
 
 const (
 	defaultValueLogFileSize = 64 * 1024 * 1024
+
+	// tableLimit holds the number of in-memory tables, and the number of
+	// L0 tables before compaction starts, for databases opened by OpenBadger.
+	tableLimit = 4
+
+	// Ranges of valid BadgerConfig values. The value log file size range
+	// is enforced by badger; the others exclude values which would make
+	// compaction ineffective or amplify writes excessively.
+	minValueLogFileSize    = 1 << 20
+	maxValueLogFileSize    = 2 << 30
+	minMaxLevels           = 2
+	maxMaxLevels           = 16
+	minLevelSizeMultiplier = 2
+	maxLevelSizeMultiplier = 100
+	maxOpenRetries         = 100
+	minOpenRetryBackoff    = time.Millisecond
+	maxOpenRetryBackoff    = 10 * time.Second
+
+	// Defaults for retrying to acquire the directory lock, retrying for
+	// up to 100ms+200ms+400ms=700ms in total.
+	defaultOpenRetries      = 3
+	defaultOpenRetryBackoff = 100 * time.Millisecond
 )
 
+// BadgerConfig holds configuration for opening a Badger database with
+// OpenBadger.
+type BadgerConfig struct {
+	// ValueLogFileSize holds the value log file size. If this is <= 0,
+	// the default of 64MB will be used.
+	ValueLogFileSize int64
+
+	// MaxLevels holds the maximum number of levels of the LSM tree. If
+	// this is zero, badger's default of 7 will be used.
+	MaxLevels int
+
+	// LevelSizeMultiplier holds the ratio between the maximum sizes of
+	// consecutive levels of the LSM tree. If this is zero, badger's
+	// default of 10 will be used.
+	LevelSizeMultiplier int
+
+	// DisableConflictDetection, if true, disables badger's detection of
+	// conflicts between transactions, which otherwise causes a commit to
+	// fail with badger.ErrConflict if a key read by the transaction was
+	// written by another transaction committed since it started. Disabling
+	// detection saves the memory and CPU of tracking the keys read and
+	// written by each transaction until all older transactions are done.
+	//
+	// This is only safe when each trace is written by a single ReadWriter,
+	// as with a single ReadWriter or a ShardedReadWriter, and no other
+	// process writes to the database. Without detection, a transaction
+	// which read a stale value commits anyway, and the last commit of a
+	// key wins: for example, an event rewritten by a ReadWriter with
+	// WriterOpts.SlidingTTLEvents may be restored after being deleted by
+	// eviction, FinalizeTrace, or another ReadWriter.
+	DisableConflictDetection bool
+
+	// LogLevel holds the minimum level of Badger's log messages to log.
+	// The zero value is logp.InfoLevel.
+	LogLevel logp.Level
+
+	// OpenRetries holds the number of times OpenBadger retries opening the
+	// database if its directory lock is held, such as briefly by a previous
+	// process after a container restart. If this is zero, the default of 3
+	// will be used.
+	OpenRetries int
+
+	// OpenRetryBackoff holds the time OpenBadger waits before its first
+	// retry; the wait doubles for each subsequent retry, up to 10s. If this
+	// is zero, the default of 100ms will be used.
+	OpenRetryBackoff time.Duration
+}
+
+// Validate returns an error if any of the configuration values are outside
+// their valid ranges: ValueLogFileSize must be between 1MB and 2GB, MaxLevels
+// between 2 and 16, LevelSizeMultiplier between 2 and 100, OpenRetries
+// between 0 and 100, and OpenRetryBackoff between 1ms and 10s. Values which
+// select defaults are always valid.
+func (c BadgerConfig) Validate() error {
+	if c.ValueLogFileSize > 0 && (c.ValueLogFileSize < minValueLogFileSize || c.ValueLogFileSize > maxValueLogFileSize) {
+		return fmt.Errorf("ValueLogFileSize %d must be between %d and %d", c.ValueLogFileSize, minValueLogFileSize, maxValueLogFileSize)
+	}
+	if c.MaxLevels != 0 && (c.MaxLevels < minMaxLevels || c.MaxLevels > maxMaxLevels) {
+		return fmt.Errorf("MaxLevels %d must be between %d and %d", c.MaxLevels, minMaxLevels, maxMaxLevels)
+	}
+	if c.LevelSizeMultiplier != 0 && (c.LevelSizeMultiplier < minLevelSizeMultiplier || c.LevelSizeMultiplier > maxLevelSizeMultiplier) {
+		return fmt.Errorf("LevelSizeMultiplier %d must be between %d and %d", c.LevelSizeMultiplier, minLevelSizeMultiplier, maxLevelSizeMultiplier)
+	}
+	if c.OpenRetries < 0 || c.OpenRetries > maxOpenRetries {
+		return fmt.Errorf("OpenRetries %d must be between 0 and %d", c.OpenRetries, maxOpenRetries)
+	}
+	if c.OpenRetryBackoff != 0 && (c.OpenRetryBackoff < minOpenRetryBackoff || c.OpenRetryBackoff > maxOpenRetryBackoff) {
+		return fmt.Errorf("OpenRetryBackoff %s must be between %s and %s", c.OpenRetryBackoff, minOpenRetryBackoff, maxOpenRetryBackoff)
+	}
+	return nil
+}
+
 // OpenBadger creates or opens a Badger database with the specified location
-// and value log file size. If the value log file size is <= 0, the default
-// of 64MB will be used.
+// and configuration, returning an error if the configuration is invalid.
+// Badger's log messages are logged with the sampling logger, at or above the
+// configured level.
+//
+// If the database's directory lock is held by another process, or another
+// badger.DB in this process, opening is retried with exponential backoff
+// as configured by OpenRetries and OpenRetryBackoff, and an error wrapping
+// the last failure is returned once the retries are exhausted. Lock failures
+// are only detected on Unix-like systems; other failures are not retried.
 //
 // NOTE(axw) only one badger.DB for a given storage directory may be open at any given time.
-func OpenBadger(storageDir string, valueLogFileSize int64) (*badger.DB, error) {
+func OpenBadger(storageDir string, config BadgerConfig) (*badger.DB, error) {
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid badger config: %w", err)
+	}
 	logger := logp.NewLogger(logs.Sampling)
+	valueLogFileSize := config.ValueLogFileSize
 	// Tunable memory options:
 	//  - NumMemtables - default 5 in-mem tables (MaxTableSize default)
 	//  - NumLevelZeroTables - default 5 - number of L0 tables before compaction starts.
@@ -31,15 +141,48 @@ func OpenBadger(storageDir string, valueLogFileSize int64) (*badger.DB, error) {
 	if valueLogFileSize <= 0 {
 		valueLogFileSize = defaultValueLogFileSize
 	}
-	const tableLimit = 4
 	badgerOpts := badger.DefaultOptions(storageDir).
-		WithLogger(&LogpAdaptor{Logger: logger}).
+		WithLogger(&LogpAdaptor{Logger: logger, Level: config.LogLevel}).
 		WithTruncate(true).                          // Truncate unreadable files which cannot be read.
 		WithNumMemtables(tableLimit).                // in-memory tables.
 		WithNumLevelZeroTables(tableLimit).          // L0 tables.
 		WithNumLevelZeroTablesStall(tableLimit * 3). // Maintain the default 1-to-3 ratio before stalling.
 		WithMaxTableSize(int64(16 << 20)).           // Max LSM table or file size.
 		WithValueLogFileSize(valueLogFileSize)       // vlog file size.
+	if config.MaxLevels > 0 {
+		badgerOpts = badgerOpts.WithMaxLevels(config.MaxLevels)
+	}
+	if config.LevelSizeMultiplier > 0 {
+		badgerOpts = badgerOpts.WithLevelSizeMultiplier(config.LevelSizeMultiplier)
+	}
+	if config.DisableConflictDetection {
+		badgerOpts = badgerOpts.WithDetectConflicts(false)
+	}
+
+	retries := config.OpenRetries
+	if retries == 0 {
+		retries = defaultOpenRetries
+	}
+	backoff := config.OpenRetryBackoff
+	if backoff == 0 {
+		backoff = defaultOpenRetryBackoff
+	}
+	for attempt := 0; ; attempt++ {
+		db, err := badger.Open(badgerOpts)
+		if err == nil || !isDirectoryLockError(err) {
+			return db, err
+		}
+		if attempt == retries {
+			return nil, fmt.Errorf("failed to acquire directory lock after %d retries: %w", retries, err)
+		}
+		logger.Warnf("storage directory is locked, retrying in %s: %s", backoff, err)
+		time.Sleep(backoff)
+		backoff = min(2*backoff, maxOpenRetryBackoff)
+	}
+}
 
-	return badger.Open(badgerOpts)
+// isDirectoryLockError reports whether err, returned by badger.Open,
+// indicates that the database's directory lock is held elsewhere.
+func isDirectoryLockError(err error) bool {
+	return errors.Is(err, syscall.EWOULDBLOCK)
 }
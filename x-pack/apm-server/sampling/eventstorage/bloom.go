@@ -0,0 +1,106 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package eventstorage
+
+import (
+	"math"
+	"sync"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// unsampledFilter records unsampled trace decisions in a pair of rotating
+// bloom filters, rather than one database entry per trace.
+//
+// New trace IDs are added to the current filter. Once the current filter has
+// had capacity trace IDs added, it becomes the previous filter, and a new
+// current filter is created; trace IDs in the previous filter are forgotten.
+// This bounds the false positive rate of each filter, while remembering at
+// least the capacity most recently added trace IDs.
+type unsampledFilter struct {
+	capacity          int
+	falsePositiveRate float64
+
+	mu       sync.RWMutex
+	current  *bloomFilter
+	previous *bloomFilter
+	count    int
+}
+
+func newUnsampledFilter(capacity int, falsePositiveRate float64) *unsampledFilter {
+	return &unsampledFilter{
+		capacity:          capacity,
+		falsePositiveRate: falsePositiveRate,
+		current:           newBloomFilter(capacity, falsePositiveRate),
+	}
+}
+
+// add records traceID as unsampled.
+func (f *unsampledFilter) add(traceID string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.count == f.capacity {
+		f.previous = f.current
+		f.current = newBloomFilter(f.capacity, f.falsePositiveRate)
+		f.count = 0
+	}
+	f.current.add(traceID)
+	f.count++
+}
+
+// contains reports whether traceID may have been recorded as unsampled.
+// contains may return false positives, but never false negatives for
+// trace IDs that have not been forgotten.
+func (f *unsampledFilter) contains(traceID string) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.current.contains(traceID) || (f.previous != nil && f.previous.contains(traceID))
+}
+
+// bloomFilter is a bloom filter for strings.
+type bloomFilter struct {
+	bits []uint64
+	m    uint64 // number of bits
+	k    uint64 // number of hash functions
+}
+
+// newBloomFilter returns a new bloomFilter sized to hold n items with
+// the given false positive rate.
+func newBloomFilter(n int, falsePositiveRate float64) *bloomFilter {
+	m := math.Ceil(-float64(n) * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2))
+	k := math.Max(1, math.Round(m/float64(n)*math.Ln2))
+	words := (uint64(m) + 63) / 64
+	return &bloomFilter{
+		bits: make([]uint64, words),
+		m:    words * 64,
+		k:    uint64(k),
+	}
+}
+
+func (b *bloomFilter) add(s string) {
+	h1, h2 := bloomHash(s)
+	for i := uint64(0); i < b.k; i++ {
+		bit := (h1 + i*h2) % b.m
+		b.bits[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+func (b *bloomFilter) contains(s string) bool {
+	h1, h2 := bloomHash(s)
+	for i := uint64(0); i < b.k; i++ {
+		bit := (h1 + i*h2) % b.m
+		if b.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// bloomHash returns two hashes of s, which are combined to simulate
+// k independent hash functions (Kirsch-Mitzenmacher).
+func bloomHash(s string) (uint64, uint64) {
+	h := xxhash.Sum64String(s)
+	return h & math.MaxUint32, (h >> 32) | 1
+}
@@ -0,0 +1,106 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package eventstorage
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBloomFilter(t *testing.T) {
+	const n = 10000
+	const falsePositiveRate = 0.01
+	b := newBloomFilter(n, falsePositiveRate)
+	for i := 0; i < n; i++ {
+		b.add(fmt.Sprintf("trace_%d", i))
+	}
+	for i := 0; i < n; i++ {
+		assert.True(t, b.contains(fmt.Sprintf("trace_%d", i)))
+	}
+	var falsePositives int
+	for i := n; i < 2*n; i++ {
+		if b.contains(fmt.Sprintf("trace_%d", i)) {
+			falsePositives++
+		}
+	}
+	assert.Less(t, float64(falsePositives)/n, 2*falsePositiveRate)
+}
+
+func TestUnsampledFilterRotation(t *testing.T) {
+	f := newUnsampledFilter(10, 0.0001)
+	for i := 0; i < 20; i++ {
+		f.add(fmt.Sprintf("trace_%d", i))
+	}
+	// The 20 most recent trace IDs are remembered in two filters.
+	for i := 0; i < 20; i++ {
+		assert.True(t, f.contains(fmt.Sprintf("trace_%d", i)))
+	}
+	// Adding another rotates the filters, forgetting the oldest 10.
+	f.add("trace_20")
+	for i := 0; i < 10; i++ {
+		assert.False(t, f.contains(fmt.Sprintf("trace_%d", i)))
+	}
+	for i := 10; i <= 20; i++ {
+		assert.True(t, f.contains(fmt.Sprintf("trace_%d", i)))
+	}
+}
+
+func TestDecisionFilterRebuild(t *testing.T) {
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	wOpts := WriterOpts{TTL: time.Minute}
+
+	// Decisions in the database before the storage is created are
+	// only known to the filter once it has been rebuilt.
+	rw := New(db, ProtobufCodec{}).NewReadWriter()
+	require.NoError(t, rw.WriteTraceSampled("existing", true, wOpts))
+	require.NoError(t, rw.Flush())
+	rw.Close()
+
+	store := New(db, ProtobufCodec{}, WithDecisionFilter(100, 0.0001))
+	f := store.decisionFilter
+	assert.True(t, f.mayContain("absent"))
+	require.NoError(t, store.RebuildDecisionFilter())
+	assert.True(t, f.mayContain("existing"))
+	assert.False(t, f.mayContain("absent"))
+
+	rw = store.NewReadWriter()
+	defer rw.Close()
+	sampled, err := rw.IsTraceSampled("existing")
+	assert.NoError(t, err)
+	assert.True(t, sampled)
+	_, err = rw.IsTraceSampled("absent")
+	assert.Equal(t, ErrNotFound, err)
+
+	// Decisions are added when written, and uncommitted decisions are
+	// retained in the previous filter across a rebuild.
+	require.NoError(t, rw.WriteTraceSampled("written", false, wOpts))
+	assert.True(t, f.mayContain("written"))
+	require.NoError(t, store.RebuildDecisionFilter())
+	sampled, err = rw.IsTraceSampled("written")
+	assert.NoError(t, err)
+	assert.False(t, sampled)
+	require.NoError(t, rw.Flush())
+
+	// Decisions no longer in the database are forgotten after two
+	// rebuilds.
+	require.NoError(t, db.Update(func(txn *badger.Txn) error {
+		return txn.Delete([]byte("existing"))
+	}))
+	require.NoError(t, store.RebuildDecisionFilter())
+	assert.True(t, f.mayContain("existing"))
+	require.NoError(t, store.RebuildDecisionFilter())
+	assert.False(t, f.mayContain("existing"))
+	assert.True(t, f.mayContain("written"))
+
+	assert.Panics(t, func() { WithDecisionFilter(0, 0.01) })
+	assert.Panics(t, func() { WithDecisionFilter(100, 1) })
+}
@@ -0,0 +1,79 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package eventstorage
+
+import "fmt"
+
+// DecisionConflict defines how WriteTraceSampled behaves when a sampling
+// decision has already been recorded for the trace.
+type DecisionConflict int
+
+const (
+	// Overwrite records each decision regardless of any existing decision,
+	// so that the most recently written decision wins. This is the default,
+	// and costs no reads.
+	Overwrite DecisionConflict = iota
+
+	// PreferSampled records a sampled decision regardless of any existing
+	// decision, upgrading unsampled traces to sampled, and ignores an
+	// unsampled decision for a trace already recorded as sampled.
+	//
+	// Note that the events of a trace recorded as unsampled may have been
+	// dropped or evicted before it is upgraded, in which case only events
+	// received after the upgrade are available for reporting.
+	PreferSampled
+
+	// KeepFirst ignores any decision for a trace which already has one
+	// recorded, so that the first decision is final.
+	KeepFirst
+)
+
+// ParseDecisionConflict parses a DecisionConflict from its string
+// representation, as returned by DecisionConflict.String.
+func ParseDecisionConflict(s string) (DecisionConflict, error) {
+	for _, policy := range []DecisionConflict{Overwrite, PreferSampled, KeepFirst} {
+		if s == policy.String() {
+			return policy, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown decision conflict policy %q", s)
+}
+
+// String returns the string representation of the policy.
+func (c DecisionConflict) String() string {
+	switch c {
+	case Overwrite:
+		return "overwrite"
+	case PreferSampled:
+		return "prefer_sampled"
+	case KeepFirst:
+		return "keep_first"
+	}
+	return fmt.Sprintf("DecisionConflict(%d)", int(c))
+}
+
+// keepExisting reports whether an existing decision should be kept rather
+// than overwritten by a new decision, according to the policy. If a read is
+// required to decide, isTraceSampled is called to check for an existing
+// decision.
+func (c DecisionConflict) keepExisting(sampled bool, isTraceSampled func() (bool, error)) (bool, error) {
+	if c == Overwrite || c == PreferSampled && sampled {
+		// The new decision always wins, so there's no need to read.
+		return false, nil
+	}
+	existing, err := isTraceSampled()
+	switch err {
+	case nil:
+	case ErrNotFound:
+		return false, nil
+	default:
+		return false, err
+	}
+	if c == KeepFirst {
+		return true, nil
+	}
+	// PreferSampled: never downgrade a sampled trace.
+	return existing, nil
+}
@@ -0,0 +1,108 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package eventstorage
+
+import (
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+)
+
+// WithDecisionCache configures the storage with an LRU cache of up to size
+// sampling decisions in front of ReadWriter.IsTraceSampled, shared by all
+// of the storage's ReadWriters, to avoid repeated database reads of the
+// decisions of hot traces.
+//
+// Only committed decisions are cached: decisions written by a ReadWriter
+// are cached once they have been flushed, and lookups of traces with a
+// decision pending in the ReadWriter's transaction are not cached. A
+// trace's cached decision is invalidated when a decision is written for
+// the trace with ReadWriter.WriteTraceSampled.
+//
+// Decisions are cached for ttl, after which they are read from the database
+// again, so that decisions which have expired from the database, or have
+// been overwritten through other means, are not reported indefinitely; ttl
+// should be no longer than the TTL with which decisions are written. If
+// negativeTTL is positive, lookups of traces with no decision, which fail
+// with ErrNotFound, are also cached for negativeTTL. A decision committed
+// by another ReadWriter may not be observed until negativeTTL has elapsed,
+// so it should be short, such as the interval at which ReadWriters are
+// flushed. WithDecisionCache panics if size or ttl is not positive, or
+// negativeTTL is negative.
+func WithDecisionCache(size int, ttl, negativeTTL time.Duration) StorageOption {
+	if size <= 0 {
+		panic("size must be positive")
+	}
+	if ttl <= 0 {
+		panic("ttl must be positive")
+	}
+	if negativeTTL < 0 {
+		panic("negativeTTL must not be negative")
+	}
+	return func(s *Storage) {
+		cache, err := lru.New(size)
+		if err != nil {
+			panic(err) // only returned for non-positive sizes
+		}
+		s.decisions = &decisionCache{cache: cache, ttl: ttl, negativeTTL: negativeTTL}
+	}
+}
+
+// decisionCache caches the results of sampling decision lookups. It is
+// safe for concurrent use.
+type decisionCache struct {
+	cache       *lru.Cache
+	ttl         time.Duration
+	negativeTTL time.Duration
+}
+
+// cachedDecision holds a cached sampling decision lookup result.
+type cachedDecision struct {
+	sampled bool
+	// notFound records that the trace had no decision.
+	notFound bool
+	// expiresAt holds the time until which the result may be reported.
+	expiresAt time.Time
+}
+
+// get returns the cached decision of traceID, reporting whether there is
+// one. If the trace was cached as having no decision, get returns
+// ErrNotFound.
+func (c *decisionCache) get(traceID string) (sampled, ok bool, err error) {
+	v, ok := c.cache.Get(traceID)
+	if !ok {
+		return false, false, nil
+	}
+	d := v.(cachedDecision)
+	if time.Now().After(d.expiresAt) {
+		c.cache.Remove(traceID)
+		return false, false, nil
+	}
+	if d.notFound {
+		return false, true, ErrNotFound
+	}
+	return d.sampled, true, nil
+}
+
+// add caches the result of looking up the committed decision of traceID,
+// if err is nil, or ErrNotFound and negative caching is enabled.
+func (c *decisionCache) add(traceID string, sampled bool, err error) {
+	switch {
+	case err == nil:
+		c.cache.Add(traceID, cachedDecision{sampled: sampled, expiresAt: time.Now().Add(c.ttl)})
+	case err == ErrNotFound && c.negativeTTL > 0:
+		c.cache.Add(traceID, cachedDecision{notFound: true, expiresAt: time.Now().Add(c.negativeTTL)})
+	}
+}
+
+// remove invalidates the cached decision of traceID, if any.
+func (c *decisionCache) remove(traceID string) {
+	c.cache.Remove(traceID)
+}
+
+// purge invalidates all cached decisions.
+func (c *decisionCache) purge() {
+	c.cache.Purge()
+}
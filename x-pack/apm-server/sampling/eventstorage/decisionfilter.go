@@ -0,0 +1,155 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package eventstorage
+
+import (
+	"sync"
+
+	"github.com/dgraph-io/badger/v2"
+)
+
+// WithDecisionFilter configures the storage to maintain an in-memory bloom
+// filter of the trace IDs with sampling decisions in the database, so that
+// IsTraceSampled may return ErrNotFound without a database lookup for
+// traces which definitely have no decision, such as those not yet seen.
+//
+// capacity holds the number of decisions the filter is sized for, and
+// falsePositiveRate holds the desired false positive rate at capacity. For
+// trace IDs which may be in the filter, including false positives,
+// IsTraceSampled falls through to a database lookup, so the filter never
+// changes the result of IsTraceSampled, only its cost. Holding more than
+// capacity decisions increases the false positive rate, and so the number
+// of lookups, but does not cause incorrect results.
+//
+// Decisions are added to the filter when written, but are not removed when
+// they expire, so the filter must be rebuilt periodically from the
+// database with RebuildDecisionFilter, such as at the TTL interval. Until
+// it is first rebuilt, the filter is not used. After each rebuild, the
+// previous filter is retained until the next rebuild, to cover decisions
+// which were written but not yet committed during the rebuild, so decisions
+// are remembered for up to two rebuild intervals after they expire.
+//
+// The filter only reflects decisions written by this Storage and those in
+// the database when it is rebuilt, so it must not be used with a database
+// shared with other processes. WithDecisionFilter panics if capacity is not
+// positive, or falsePositiveRate is not in the range (0,1).
+func WithDecisionFilter(capacity int, falsePositiveRate float64) StorageOption {
+	if capacity <= 0 {
+		panic("capacity must be positive")
+	}
+	if falsePositiveRate <= 0 || falsePositiveRate >= 1 {
+		panic("falsePositiveRate must be in the range (0,1)")
+	}
+	return func(s *Storage) {
+		s.decisionFilter = &decisionFilter{
+			capacity:          capacity,
+			falsePositiveRate: falsePositiveRate,
+			current:           newBloomFilter(capacity, falsePositiveRate),
+		}
+	}
+}
+
+// decisionFilter records the trace IDs with sampling decisions in bloom
+// filters, which are rebuilt periodically to forget expired decisions.
+type decisionFilter struct {
+	capacity          int
+	falsePositiveRate float64
+
+	// rebuildMu serializes rebuilds.
+	rebuildMu sync.Mutex
+
+	// mu guards the fields below.
+	mu sync.RWMutex
+	// current and previous hold the filters built by the two most recent
+	// rebuilds, and the decisions added since. Before the first rebuild,
+	// current holds only the decisions added since the storage was
+	// created, and the filter is not used.
+	current  *bloomFilter
+	previous *bloomFilter
+	// ready records whether the filter has been rebuilt from the
+	// database, and so may be used.
+	ready bool
+	// rebuilding, if non-nil, holds the filter being built by an
+	// in-progress rebuild, to which decisions are also added.
+	rebuilding *bloomFilter
+}
+
+// add records that traceID has a sampling decision.
+func (f *decisionFilter) add(traceID string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.current.add(traceID)
+	if f.rebuilding != nil {
+		f.rebuilding.add(traceID)
+	}
+}
+
+// mayContain reports whether traceID may have a sampling decision. This
+// returns true for all trace IDs until the filter is first rebuilt, and
+// may return false positives, but never false negatives.
+func (f *decisionFilter) mayContain(traceID string) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if !f.ready {
+		return true
+	}
+	return f.current.contains(traceID) || (f.previous != nil && f.previous.contains(traceID))
+}
+
+// RebuildDecisionFilter rebuilds the bloom filter of trace IDs with sampling
+// decisions configured with WithDecisionFilter from the decisions in the
+// database, forgetting expired decisions, and enables its use by
+// IsTraceSampled if this is the first rebuild. Decisions written during the
+// rebuild are added to the rebuilt filter. If the storage is not configured
+// with WithDecisionFilter, RebuildDecisionFilter does nothing.
+//
+// RebuildDecisionFilter scans all sampling decisions, so should be called
+// periodically, such as at the TTL interval, rather than on hot paths.
+func (s *Storage) RebuildDecisionFilter() error {
+	f := s.decisionFilter
+	if f == nil {
+		return nil
+	}
+	f.rebuildMu.Lock()
+	defer f.rebuildMu.Unlock()
+
+	rebuilding := newBloomFilter(f.capacity, f.falsePositiveRate)
+	f.mu.Lock()
+	f.rebuilding = rebuilding
+	f.mu.Unlock()
+
+	err := s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Prefix = s.decisionKeysPrefix()
+		iter := txn.NewIterator(opts)
+		defer iter.Close()
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			item := iter.Item()
+			if item.IsDeletedOrExpired() {
+				continue
+			}
+			switch item.UserMeta() {
+			case entryMetaTraceSampled, entryMetaTraceUnsampled:
+				traceID := string(s.decisionTraceID(item.Key()))
+				f.mu.Lock()
+				rebuilding.add(traceID)
+				f.mu.Unlock()
+			}
+		}
+		return nil
+	})
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.rebuilding = nil
+	if err != nil {
+		return err
+	}
+	f.previous = f.current
+	f.current = rebuilding
+	f.ready = true
+	return nil
+}
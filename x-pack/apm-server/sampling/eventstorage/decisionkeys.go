@@ -0,0 +1,133 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package eventstorage
+
+import (
+	"bytes"
+
+	"github.com/dgraph-io/badger/v2"
+)
+
+// WithPrefixedDecisionKeys sets whether sampling decisions are written with
+// keys prefixed by "d:", rather than keyed by the trace ID alone. Prefixed
+// decision keys are disabled by default, for compatibility with existing
+// databases.
+//
+// Unprefixed decision keys are themselves a prefix of the trace's event keys
+// ("<trace ID>:<event ID>"), so decisions can only be distinguished from
+// other entries by their metadata. Prefixed decision keys are grouped
+// together, so scans of decisions, such as by ExportDecisions and
+// DeleteDecisionsOlderThan, visit only decisions. On the other hand, scans
+// of events which need their trace's decision, such as by ExpirySweeper and
+// eviction of unsampled traces, must then look up the decision of each
+// trace rather than tracking it while iterating.
+//
+// Migration: decisions written with the other key format are not found.
+// After changing this option for an existing database, MigrateDecisionKeys
+// must be called before the storage is used.
+func WithPrefixedDecisionKeys(enabled bool) StorageOption {
+	return func(s *Storage) {
+		s.prefixedDecisionKeys = enabled
+	}
+}
+
+// MigrateDecisionKeys rewrites sampling decisions written with the key
+// format not configured by WithPrefixedDecisionKeys to the configured
+// format, preserving their expiry times, and returns the number of
+// decisions rewritten. If all decisions are already in the configured
+// format, MigrateDecisionKeys does nothing and returns zero.
+//
+// MigrateDecisionKeys must not be called concurrently with writes of
+// decisions. Like ExportDecisions, it scans the entire database, and is
+// intended to be called once, before the storage is used.
+func (s *Storage) MigrateDecisionKeys() (int, error) {
+	if s.readOnly.Load() {
+		return 0, ErrReadOnly
+	}
+	prefixed := append(append([]byte(nil), s.keyPrefix...), decisionKeyPrefix...)
+	var entries []*badger.Entry
+	var oldKeys [][]byte
+	if err := s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false // decisions have no values
+		opts.Prefix = s.keyPrefix
+		if !s.prefixedDecisionKeys {
+			opts.Prefix = prefixed
+		}
+		iter := txn.NewIterator(opts)
+		defer iter.Close()
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			item := iter.Item()
+			if item.IsDeletedOrExpired() {
+				continue
+			}
+			switch item.UserMeta() {
+			case entryMetaTraceSampled, entryMetaTraceUnsampled:
+			default:
+				continue
+			}
+			key := item.Key()
+			var traceID []byte
+			if s.prefixedDecisionKeys {
+				if bytes.HasPrefix(key, prefixed) {
+					continue
+				}
+				traceID = s.trimNamespace(key)
+			} else {
+				traceID = key[len(prefixed):]
+			}
+			e := badger.NewEntry(s.decisionKey(nil, string(traceID)), nil).WithMeta(item.UserMeta())
+			e.ExpiresAt = item.ExpiresAt()
+			entries = append(entries, e)
+			oldKeys = append(oldKeys, item.KeyCopy(nil))
+		}
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+	wb := s.db.NewWriteBatch()
+	defer wb.Cancel()
+	for i, e := range entries {
+		if err := wb.SetEntry(e); err != nil {
+			return 0, err
+		}
+		if err := wb.Delete(oldKeys[i]); err != nil {
+			return 0, err
+		}
+	}
+	if err := wb.Flush(); err != nil {
+		return 0, err
+	}
+	return len(entries), nil
+}
+
+// decisionLookup looks up the sampling decisions of the traces of events
+// visited in key order by a scan, caching the decision of the most recent
+// trace, for scans which cannot track decisions while iterating because
+// prefixed decision keys are enabled.
+type decisionLookup struct {
+	s       *Storage
+	txn     *badger.Txn
+	traceID []byte
+	meta    byte
+}
+
+// decision returns the metadata of the sampling decision entry of the trace
+// with the given ID, or zero if the trace has no decision.
+func (l *decisionLookup) decision(traceID []byte) (byte, error) {
+	if l.traceID != nil && bytes.Equal(traceID, l.traceID) {
+		return l.meta, nil
+	}
+	l.traceID = append(l.traceID[:0], traceID...)
+	l.meta = 0
+	item, err := l.txn.Get(l.s.decisionKey(nil, string(traceID)))
+	if err == badger.ErrKeyNotFound {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	l.meta = item.UserMeta()
+	return l.meta, nil
+}
@@ -0,0 +1,129 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package eventstorage
+
+import (
+	"math"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// decisionLatencyBounds holds the inclusive upper bounds of the buckets of
+// DecisionLatencyHistogram, around typical tail-sampling intervals of
+// seconds to minutes, and the default TTL of 30 minutes. Longer latencies
+// are counted only in the histogram's total.
+var decisionLatencyBounds = [...]time.Duration{
+	time.Second,
+	5 * time.Second,
+	10 * time.Second,
+	30 * time.Second,
+	time.Minute,
+	2 * time.Minute,
+	5 * time.Minute,
+	10 * time.Minute,
+	30 * time.Minute,
+	time.Hour,
+}
+
+// recentDecisionLatencies holds the number of most recent decision
+// latencies retained for DecisionLatencyPercentile.
+const recentDecisionLatencies = 1024
+
+// DecisionLatencyHistogram holds a histogram of decision latencies: the
+// time from the first write of a trace's events to its sampling decision
+// being recorded with ReadWriter.WriteTraceSampled or FinalizeTrace.
+// Decision latency is observed only with WithTraceEventSummaries.
+type DecisionLatencyHistogram struct {
+	// Buckets maps the inclusive upper bound of each bucket to the
+	// number of decisions made within that latency. Counts are
+	// cumulative, as with Prometheus histograms.
+	Buckets map[time.Duration]int64
+
+	// Count holds the total number of decisions observed.
+	Count int64
+
+	// Sum holds the total latency of the decisions.
+	Sum time.Duration
+}
+
+// decisionLatencyHistogram records decision latencies in buckets bounded
+// by decisionLatencyBounds, and retains the most recent latencies for
+// computing percentiles. The final bucket counts latencies longer than
+// all bounds.
+type decisionLatencyHistogram struct {
+	counts [len(decisionLatencyBounds) + 1]atomic.Int64
+	sum    atomic.Int64
+
+	mu     sync.Mutex
+	recent []time.Duration
+	next   int
+}
+
+// observe records a decision made with latency d.
+func (h *decisionLatencyHistogram) observe(d time.Duration) {
+	i := 0
+	for i < len(decisionLatencyBounds) && d > decisionLatencyBounds[i] {
+		i++
+	}
+	h.counts[i].Add(1)
+	h.sum.Add(int64(d))
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.recent) < recentDecisionLatencies {
+		h.recent = append(h.recent, d)
+		return
+	}
+	h.recent[h.next] = d
+	h.next = (h.next + 1) % recentDecisionLatencies
+}
+
+// snapshot returns the histogram's current counts.
+func (h *decisionLatencyHistogram) snapshot() DecisionLatencyHistogram {
+	out := DecisionLatencyHistogram{
+		Buckets: make(map[time.Duration]int64, len(decisionLatencyBounds)),
+		Sum:     time.Duration(h.sum.Load()),
+	}
+	for i := range h.counts {
+		out.Count += h.counts[i].Load()
+		if i < len(decisionLatencyBounds) {
+			out.Buckets[decisionLatencyBounds[i]] = out.Count
+		}
+	}
+	return out
+}
+
+// percentile returns the p-th percentile of the recent latencies, using
+// the nearest-rank method, and reports whether any have been recorded.
+func (h *decisionLatencyHistogram) percentile(p float64) (time.Duration, bool) {
+	h.mu.Lock()
+	recent := slices.Clone(h.recent)
+	h.mu.Unlock()
+	if len(recent) == 0 {
+		return 0, false
+	}
+	slices.Sort(recent)
+	rank := int(math.Ceil(p / 100 * float64(len(recent))))
+	return recent[max(rank, 1)-1], true
+}
+
+// DecisionLatencyPercentile returns the p-th percentile, in the range
+// (0,100], of the latencies of the most recent 1024 trace decisions: the
+// time from the first write of each trace's events to its decision being
+// recorded with ReadWriter.WriteTraceSampled or FinalizeTrace. It reports
+// false if no decisions have been observed. DecisionLatencyPercentile
+// panics if p is out of range.
+//
+// Decision latencies are only observed for traces with a summary, so
+// WithTraceEventSummaries must be enabled. Their cumulative distribution is
+// reported by Stats as StorageStats.DecisionLatency.
+func (s *Storage) DecisionLatencyPercentile(p float64) (time.Duration, bool) {
+	if p <= 0 || p > 100 {
+		panic("p must be in the range (0,100]")
+	}
+	return s.counters.decisionLatency.percentile(p)
+}
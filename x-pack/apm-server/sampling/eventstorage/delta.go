@@ -0,0 +1,298 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package eventstorage
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/dgraph-io/badger/v2"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+
+	"github.com/elastic/apm-data/model/modelpb"
+)
+
+// Delta-encoded events are stored with the entryMetaTraceEventDelta meta,
+// and the value:
+//
+//	uvarint(len(baseID)) baseID
+//	uvarint(n) uvarint(field number) * n
+//	residual
+//
+// where baseID is the ID of a full (entryMetaTraceEvent) event of the same
+// trace, as it appears in the event's key (see WithChronologicalKeys), the
+// field numbers identify top-level APMEvent fields which are
+// inherited from the base event, and residual holds the remaining fields of
+// the event, encoded with the storage's Codec.
+
+// TraceWriter writes the events of a single trace, storing the first event
+// written in full, and subsequent events as deltas against the first.
+//
+// Events of a trace typically share much of their metadata, such as service,
+// agent, and host details; storing these only once per trace can greatly
+// reduce storage size. Delta-encoded events are reconstructed transparently
+// by ReadTraceEvents, at the cost of decoding the base event of the trace.
+//
+// If a trace's base event is deleted or expires before its deltas, the
+// deltas can no longer be decoded. The base event must not be modified while
+// the TraceWriter is in use.
+type TraceWriter struct {
+	w       deltaWriter
+	traceID string
+	opts    WriterOpts
+	baseID  string
+	base    *modelpb.APMEvent
+}
+
+type deltaWriter interface {
+	WriteTraceEvent(traceID, id string, event *modelpb.APMEvent, opts WriterOpts) error
+	WriteTraceEventDelta(traceID, id string, event *modelpb.APMEvent, baseID string, base *modelpb.APMEvent, opts WriterOpts) error
+}
+
+// NewTraceWriter returns a new TraceWriter for writing the events of the
+// trace with the given ID, using opts.
+func (rw *ReadWriter) NewTraceWriter(traceID string, opts WriterOpts) *TraceWriter {
+	return &TraceWriter{w: rw, traceID: traceID, opts: opts}
+}
+
+// WriteTraceEvent writes a trace event with the given ID. The first event
+// successfully written becomes the base event, against which subsequent
+// events are delta-encoded.
+func (w *TraceWriter) WriteTraceEvent(id string, event *modelpb.APMEvent) error {
+	if w.base == nil {
+		if err := w.w.WriteTraceEvent(w.traceID, id, event, w.opts); err != nil {
+			return err
+		}
+		w.baseID, w.base = id, event
+		return nil
+	}
+	return w.w.WriteTraceEventDelta(w.traceID, id, event, w.baseID, w.base, w.opts)
+}
+
+// WriteTraceEventDelta writes a trace event with the given ID, encoded as a
+// delta against base, which must have been written in full with
+// WriteTraceEvent for the same trace, with the ID baseID. If event has no
+// fields in common with base, it is written in full.
+//
+// Most callers should use TraceWriter rather than calling this directly.
+func (rw *ReadWriter) WriteTraceEventDelta(
+	traceID, id string,
+	event *modelpb.APMEvent,
+	baseID string, base *modelpb.APMEvent,
+	opts WriterOpts,
+) error {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	if rw.closed {
+		return ErrClosed
+	}
+	if err := rw.prepareTraceEventWrite(traceID, opts); err != nil {
+		return err
+	}
+	key := rw.s.newEventKey(nil, traceID, id, event)
+	fields := inheritedFields(base, event)
+	if len(fields) == 0 {
+		data, err := rw.s.codec.EncodeEvent(event)
+		if err != nil {
+			return err
+		}
+		return rw.writeTraceEventEntry(traceID, badger.NewEntry(key, data).WithMeta(entryMetaTraceEvent), event, opts)
+	}
+	residual := proto.Clone(event).(*modelpb.APMEvent)
+	m := residual.ProtoReflect()
+	for _, fd := range fields {
+		m.Clear(fd)
+	}
+	data, err := rw.s.codec.EncodeEvent(residual)
+	if err != nil {
+		return err
+	}
+	// Deltas reference the base event by its key, which may include its
+	// timestamp; see WithChronologicalKeys.
+	baseKeyID := string(rw.s.appendEventKeyID(nil, baseID, base))
+	return rw.writeTraceEventEntry(
+		traceID, badger.NewEntry(key, appendDeltaHeader(nil, baseKeyID, fields, data)).WithMeta(entryMetaTraceEventDelta),
+		event, opts,
+	)
+}
+
+// inheritedFields returns the top-level fields of event which are set to
+// the same value in base.
+func inheritedFields(base, event *modelpb.APMEvent) []protoreflect.FieldDescriptor {
+	var fields []protoreflect.FieldDescriptor
+	bm := base.ProtoReflect()
+	em := event.ProtoReflect()
+	bm.Range(func(fd protoreflect.FieldDescriptor, bv protoreflect.Value) bool {
+		if !em.Has(fd) {
+			return true
+		}
+		// Compare single-field messages, to compare values of all kinds
+		// (including lists and maps) with proto.Equal semantics.
+		x := bm.Type().New()
+		x.Set(fd, bv)
+		y := em.Type().New()
+		y.Set(fd, em.Get(fd))
+		if proto.Equal(x.Interface(), y.Interface()) {
+			fields = append(fields, fd)
+		}
+		return true
+	})
+	return fields
+}
+
+func appendDeltaHeader(b []byte, baseID string, fields []protoreflect.FieldDescriptor, residual []byte) []byte {
+	b = protowire.AppendVarint(b, uint64(len(baseID)))
+	b = append(b, baseID...)
+	b = protowire.AppendVarint(b, uint64(len(fields)))
+	for _, fd := range fields {
+		b = protowire.AppendVarint(b, uint64(fd.Number()))
+	}
+	return append(b, residual...)
+}
+
+// deltaHeader holds the decoded header of a delta-encoded event.
+type deltaHeader struct {
+	baseID   string
+	fields   []protowire.Number
+	residual []byte
+}
+
+var errInvalidDelta = errors.New("invalid delta-encoded event")
+
+func decodeDeltaHeader(data []byte) (deltaHeader, error) {
+	var h deltaHeader
+	n, size := protowire.ConsumeVarint(data)
+	if size < 0 || uint64(len(data)-size) < n {
+		return h, errInvalidDelta
+	}
+	data = data[size:]
+	h.baseID, data = string(data[:n]), data[n:]
+	count, size := protowire.ConsumeVarint(data)
+	if size < 0 || uint64(len(data)-size) < count {
+		return h, errInvalidDelta
+	}
+	data = data[size:]
+	h.fields = make([]protowire.Number, count)
+	for i := range h.fields {
+		num, size := protowire.ConsumeVarint(data)
+		if size < 0 {
+			return h, errInvalidDelta
+		}
+		h.fields[i] = protowire.Number(num)
+		data = data[size:]
+	}
+	h.residual = data
+	return h, nil
+}
+
+// reencodeDelta re-encodes the residual of a delta-encoded event from
+// oldCodec to newCodec, preserving the header.
+func reencodeDelta(data []byte, oldCodec, newCodec Codec) ([]byte, error) {
+	h, err := decodeDeltaHeader(data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDecodeFailed, err)
+	}
+	var residual modelpb.APMEvent
+	if err := decodeEvent(oldCodec, h.residual, &residual); err != nil {
+		return nil, err
+	}
+	encoded, err := newCodec.EncodeEvent(&residual)
+	if err != nil {
+		return nil, err
+	}
+	b := data[:len(data)-len(h.residual)]
+	return append(append([]byte(nil), b...), encoded...), nil
+}
+
+// traceEventDecoder decodes full and delta-encoded trace events, caching
+// decoded base events for the most recently decoded trace.
+type traceEventDecoder struct {
+	s       *Storage
+	txn     *badger.Txn
+	traceID string
+	bases   map[string]*modelpb.APMEvent
+	keyBuf  []byte
+}
+
+// decode decodes the trace event stored in item, which must have the meta
+// entryMetaTraceEvent or entryMetaTraceEventDelta, into event.
+func (d *traceEventDecoder) decode(traceID string, item *badger.Item, event *modelpb.APMEvent) error {
+	if isFullTraceEventMeta(item.UserMeta()) {
+		return item.Value(func(data []byte) error {
+			return decodeEvent(d.s.codec, data, event)
+		})
+	}
+	var h deltaHeader
+	if err := item.Value(func(data []byte) error {
+		var err error
+		h, err = decodeDeltaHeader(data)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrDecodeFailed, err)
+		}
+		h.residual = append([]byte(nil), h.residual...)
+		return nil
+	}); err != nil {
+		return err
+	}
+	base, err := d.base(traceID, h.baseID)
+	if err != nil {
+		return err
+	}
+	if err := decodeEvent(d.s.codec, h.residual, event); err != nil {
+		return err
+	}
+	// Clone the base event so reconstructed events do not share memory.
+	bm := proto.Clone(base).ProtoReflect()
+	em := event.ProtoReflect()
+	fields := bm.Descriptor().Fields()
+	for _, num := range h.fields {
+		if fd := fields.ByNumber(num); fd != nil && bm.Has(fd) {
+			em.Set(fd, bm.Get(fd))
+		}
+	}
+	return nil
+}
+
+func (d *traceEventDecoder) base(traceID, baseID string) (*modelpb.APMEvent, error) {
+	if traceID != d.traceID {
+		d.traceID = traceID
+		d.bases = nil
+	}
+	if base, ok := d.bases[baseID]; ok {
+		return base, nil
+	}
+	d.keyBuf = d.s.eventKey(d.keyBuf[:0], traceID, baseID)
+	item, err := d.txn.Get(d.keyBuf)
+	if err == badger.ErrKeyNotFound || (err == nil && (item.IsDeletedOrExpired() || !isFullTraceEventMeta(item.UserMeta()))) {
+		return nil, fmt.Errorf("%w: base event %q not found", ErrDecodeFailed, baseID)
+	} else if err != nil {
+		return nil, err
+	}
+	var base modelpb.APMEvent
+	if err := item.Value(func(data []byte) error {
+		return decodeEvent(d.s.codec, data, &base)
+	}); err != nil {
+		return nil, err
+	}
+	if d.bases == nil {
+		d.bases = make(map[string]*modelpb.APMEvent)
+	}
+	d.bases[baseID] = &base
+	return &base, nil
+}
+
+// isTraceEventMeta reports whether meta is that of a full or delta-encoded
+// trace event.
+func isTraceEventMeta(meta byte) bool {
+	return isFullTraceEventMeta(meta) || meta == entryMetaTraceEventDelta
+}
+
+// isFullTraceEventMeta reports whether meta is that of a full trace event,
+// with or without user flags.
+func isFullTraceEventMeta(meta byte) bool {
+	return meta == entryMetaTraceEvent || meta&entryMetaTraceEventFlagged != 0
+}
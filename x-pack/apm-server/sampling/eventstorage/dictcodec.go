@@ -0,0 +1,199 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package eventstorage
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/elastic/apm-data/model/modelpb"
+)
+
+const (
+	// DictionaryCodecZstd is the format marker of events encoded by
+	// DictionaryCodec with zstd compression using a dictionary. The marker
+	// is followed by the ID of the dictionary.
+	DictionaryCodecZstd byte = 'd'
+
+	// maxDictionarySize holds the maximum size in bytes of dictionaries
+	// trained by TrainDictionary. Larger dictionaries improve compression
+	// with diminishing returns, at the cost of memory in every encoder and
+	// decoder.
+	maxDictionarySize = 112 << 10
+)
+
+// ErrDictionaryNotFound is returned by DictionaryCodec.DecodeEvent for
+// events compressed with a dictionary unknown to the codec.
+var ErrDictionaryNotFound = errors.New("dictionary not found")
+
+// DictionaryCodec is an implementation of Codec which wraps another Codec,
+// compressing the events it encodes with zstd using a shared dictionary
+// trained with TrainDictionary. Dictionaries capture the content common to
+// many events, such as field names and service metadata, so events compress
+// well even when small, unlike with AdaptiveCodec.
+//
+// Each encoded event is prefixed with the format marker DictionaryCodecZstd
+// and the ID of the dictionary used, or with AdaptiveCodecUncompressed if
+// compression would not make it smaller. DictionaryCodec also decodes
+// events encoded by AdaptiveCodec, so the two may be migrated between with
+// Storage.Reencode. DictionaryCodec is safe for concurrent use.
+//
+// # Dictionary versioning
+//
+// Each dictionary has an ID, in the range [1,255], set when it is trained.
+// Events are encoded with a single dictionary, but may be decoded with any
+// of the dictionaries the codec is created with, identified by the ID
+// stored with each event. To replace a dictionary, train a new one with a
+// different ID, and create the codec with the new dictionary followed by
+// the old. Events encoded with the old dictionary remain readable, and the
+// old dictionary may be dropped once they have all expired, after the TTL,
+// or been rewritten with Reencode.
+//
+// # Missing dictionaries
+//
+// Events encoded with a dictionary the codec does not have cannot be
+// decoded: DecodeEvent returns an error wrapping ErrDictionaryNotFound.
+// Dictionaries must therefore be persisted alongside the database for as
+// long as events encoded with them may be stored. If a dictionary is lost,
+// events encoded with it are unrecoverable, and reads of their traces will
+// fail until they are deleted or expire.
+type DictionaryCodec struct {
+	codec   Codec
+	id      byte
+	encoder *zstd.Encoder
+	decoder *zstd.Decoder
+	known   [256]bool
+}
+
+// NewDictionaryCodec returns a new DictionaryCodec, encoding events with
+// codec and compressing them with dict. Events may be decoded with dict or
+// any of the previous dictionaries. An error is returned if any dictionary
+// is invalid, has an ID outside the range [1,255], or has the same ID as
+// another.
+func NewDictionaryCodec(codec Codec, dict []byte, previous ...[]byte) (*DictionaryCodec, error) {
+	c := &DictionaryCodec{codec: codec}
+	for i, d := range append([][]byte{dict}, previous...) {
+		info, err := zstd.InspectDictionary(d)
+		if err != nil {
+			return nil, fmt.Errorf("invalid dictionary %d: %w", i, err)
+		}
+		id := info.ID()
+		if id == 0 || id > 255 {
+			return nil, fmt.Errorf("dictionary %d ID %d must be between 1 and 255", i, id)
+		}
+		if c.known[id] {
+			return nil, fmt.Errorf("dictionary %d ID %d is duplicated", i, id)
+		}
+		c.known[id] = true
+		if i == 0 {
+			c.id = byte(id)
+		}
+	}
+	encoder, err := zstd.NewWriter(nil,
+		zstd.WithEncoderLevel(zstd.SpeedFastest),
+		zstd.WithEncoderDict(dict),
+	)
+	if err != nil {
+		return nil, err
+	}
+	decoder, err := zstd.NewReader(nil, zstd.WithDecoderDicts(append([][]byte{dict}, previous...)...))
+	if err != nil {
+		return nil, err
+	}
+	c.encoder = encoder
+	c.decoder = decoder
+	return c, nil
+}
+
+// DecodeEvent decodes data, decompressing it first if it was compressed.
+// If data was compressed with an unknown dictionary, DecodeEvent returns an
+// error wrapping ErrDictionaryNotFound.
+func (c *DictionaryCodec) DecodeEvent(data []byte, event *modelpb.APMEvent) error {
+	if len(data) == 0 {
+		return errors.New("missing format marker")
+	}
+	switch data[0] {
+	case AdaptiveCodecUncompressed:
+		return c.codec.DecodeEvent(data[1:], event)
+	case AdaptiveCodecZstd:
+		return c.decompressEvent(data[1:], event)
+	case DictionaryCodecZstd:
+		if len(data) < 2 {
+			return errors.New("missing dictionary ID")
+		}
+		if !c.known[data[1]] {
+			return fmt.Errorf("%w: ID %d", ErrDictionaryNotFound, data[1])
+		}
+		return c.decompressEvent(data[2:], event)
+	}
+	return fmt.Errorf("unknown format marker %q", data[0])
+}
+
+func (c *DictionaryCodec) decompressEvent(data []byte, event *modelpb.APMEvent) error {
+	decompressed, err := c.decoder.DecodeAll(data, nil)
+	if err != nil {
+		return fmt.Errorf("failed to decompress event: %w", err)
+	}
+	return c.codec.DecodeEvent(decompressed, event)
+}
+
+// EncodeEvent encodes event, compressing it with the dictionary if that
+// makes it smaller.
+func (c *DictionaryCodec) EncodeEvent(event *modelpb.APMEvent) ([]byte, error) {
+	data, err := c.codec.EncodeEvent(event)
+	if err != nil {
+		return nil, err
+	}
+	compressed := c.encoder.EncodeAll(data, []byte{DictionaryCodecZstd, c.id})
+	if len(compressed) <= len(data) {
+		return compressed, nil
+	}
+	return append([]byte{AdaptiveCodecUncompressed}, data...), nil
+}
+
+// TrainDictionary trains a zstd dictionary with the given ID, in the range
+// [1,255], for use with NewDictionaryCodec, from a sample of events encoded
+// with codec. The sample should be representative of the events to be
+// stored, such as a few thousand recent events from a range of services;
+// the dictionary is built from up to the last 112KB of encoded events.
+// An error is returned if id is out of range, or the sample is too small to
+// train a dictionary from.
+func TrainDictionary(codec Codec, events []*modelpb.APMEvent, id byte) (_ []byte, err error) {
+	if id == 0 {
+		return nil, errors.New("dictionary ID must be between 1 and 255")
+	}
+	if len(events) == 0 {
+		return nil, errors.New("no events to train dictionary")
+	}
+	contents := make([][]byte, 0, len(events))
+	var history []byte
+	for _, event := range events {
+		data, err := codec.EncodeEvent(event)
+		if err != nil {
+			return nil, err
+		}
+		contents = append(contents, data)
+		history = append(history, data...)
+	}
+	if len(history) > maxDictionarySize {
+		history = history[len(history)-maxDictionarySize:]
+	}
+	// BuildDict panics with a division by zero if the sample has too few
+	// matches to build the dictionary's entropy tables.
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("failed to train dictionary, sample too small: %v", r)
+		}
+	}()
+	return zstd.BuildDict(zstd.BuildDictOptions{
+		ID:       uint32(id),
+		Contents: contents,
+		History:  history,
+		Offsets:  [3]int{1, 4, 8},
+		Level:    zstd.SpeedFastest,
+	})
+}
@@ -0,0 +1,109 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package eventstorage_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/testing/protocmp"
+
+	"github.com/elastic/apm-data/model/modelpb"
+	"github.com/elastic/apm-server/x-pack/apm-server/sampling/eventstorage"
+)
+
+func dictionarySampleEvents(n int) []*modelpb.APMEvent {
+	events := make([]*modelpb.APMEvent, n)
+	for i := range events {
+		events[i] = &modelpb.APMEvent{
+			Service: &modelpb.Service{Name: "checkout-service", Environment: "production"},
+			Span: &modelpb.Span{
+				Id:      fmt.Sprintf("span-%d", i),
+				Name:    "SELECT FROM orders WHERE customer_id = ?",
+				Type:    "db",
+				Subtype: "postgresql",
+			},
+		}
+	}
+	return events
+}
+
+func TestDictionaryCodec(t *testing.T) {
+	dict, err := eventstorage.TrainDictionary(eventstorage.ProtobufCodec{}, dictionarySampleEvents(1000), 1)
+	require.NoError(t, err)
+	codec, err := eventstorage.NewDictionaryCodec(eventstorage.ProtobufCodec{}, dict)
+	require.NoError(t, err)
+
+	event := dictionarySampleEvents(1001)[1000]
+	plain, err := eventstorage.ProtobufCodec{}.EncodeEvent(event)
+	require.NoError(t, err)
+	data, err := codec.EncodeEvent(event)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{eventstorage.DictionaryCodecZstd, 1}, data[:2])
+	assert.Less(t, len(data), len(plain))
+
+	var decoded modelpb.APMEvent
+	require.NoError(t, codec.DecodeEvent(data, &decoded))
+	assert.Empty(t, cmp.Diff(event, &decoded, protocmp.Transform()))
+
+	// Events encoded by AdaptiveCodec may be decoded.
+	adaptive, err := eventstorage.NewAdaptiveCodec(eventstorage.ProtobufCodec{}, 1)
+	require.NoError(t, err)
+	data, err = adaptive.EncodeEvent(event)
+	require.NoError(t, err)
+	decoded = modelpb.APMEvent{}
+	require.NoError(t, codec.DecodeEvent(data, &decoded))
+	assert.Empty(t, cmp.Diff(event, &decoded, protocmp.Transform()))
+
+	assert.EqualError(t, codec.DecodeEvent(nil, &decoded), "missing format marker")
+	assert.EqualError(t, codec.DecodeEvent([]byte("d"), &decoded), "missing dictionary ID")
+	assert.EqualError(t, codec.DecodeEvent([]byte("x"), &decoded), `unknown format marker 'x'`)
+	assert.Error(t, codec.DecodeEvent([]byte("d\x01garbage"), &decoded))
+}
+
+func TestDictionaryCodecVersioning(t *testing.T) {
+	samples := dictionarySampleEvents(1000)
+	dict1, err := eventstorage.TrainDictionary(eventstorage.ProtobufCodec{}, samples, 1)
+	require.NoError(t, err)
+	dict2, err := eventstorage.TrainDictionary(eventstorage.ProtobufCodec{}, samples, 2)
+	require.NoError(t, err)
+
+	codec1, err := eventstorage.NewDictionaryCodec(eventstorage.ProtobufCodec{}, dict1)
+	require.NoError(t, err)
+	data, err := codec1.EncodeEvent(samples[0])
+	require.NoError(t, err)
+
+	// A codec with the old dictionary as a previous dictionary decodes
+	// events encoded with it.
+	codec2, err := eventstorage.NewDictionaryCodec(eventstorage.ProtobufCodec{}, dict2, dict1)
+	require.NoError(t, err)
+	var decoded modelpb.APMEvent
+	require.NoError(t, codec2.DecodeEvent(data, &decoded))
+	assert.Empty(t, cmp.Diff(samples[0], &decoded, protocmp.Transform()))
+	data2, err := codec2.EncodeEvent(samples[0])
+	require.NoError(t, err)
+	assert.Equal(t, byte(2), data2[1])
+
+	// A codec without the old dictionary reports it missing.
+	codec2, err = eventstorage.NewDictionaryCodec(eventstorage.ProtobufCodec{}, dict2)
+	require.NoError(t, err)
+	err = codec2.DecodeEvent(data, &decoded)
+	assert.ErrorIs(t, err, eventstorage.ErrDictionaryNotFound)
+	assert.EqualError(t, err, "dictionary not found: ID 1")
+
+	_, err = eventstorage.NewDictionaryCodec(eventstorage.ProtobufCodec{}, dict1, dict1)
+	assert.EqualError(t, err, "dictionary 1 ID 1 is duplicated")
+	_, err = eventstorage.NewDictionaryCodec(eventstorage.ProtobufCodec{}, []byte("garbage"))
+	assert.Error(t, err)
+	_, err = eventstorage.TrainDictionary(eventstorage.ProtobufCodec{}, samples, 0)
+	assert.EqualError(t, err, "dictionary ID must be between 1 and 255")
+	_, err = eventstorage.TrainDictionary(eventstorage.ProtobufCodec{}, nil, 1)
+	assert.EqualError(t, err, "no events to train dictionary")
+	_, err = eventstorage.TrainDictionary(eventstorage.ProtobufCodec{}, samples[:10], 1)
+	assert.Error(t, err)
+}
@@ -0,0 +1,193 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package eventstorage
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// envUsageBuckets holds the number of time buckets over which the storage
+// used by each environment is tracked. The storage used is estimated as the
+// size of the events written in the buckets spanning the most recent TTL.
+const envUsageBuckets = 16
+
+// ErrEnvLimitReached is returned by ReadWriter write methods when writing
+// a trace event would exceed the storage limit of the event's service
+// environment, configured with WriterOpts.EnvironmentStorageLimits.
+var ErrEnvLimitReached = errors.New("configured environment storage limit reached")
+
+// envUsage tracks the estimated size of trace events written for each
+// service environment within the most recent TTL, after which they will
+// have expired. It is also used to track the size of trace events written
+// for each tenant; see WithTenantKey.
+//
+// Events which are deleted before they expire, such as when their trace
+// is finalized, continue to be counted until they would have expired, so
+// this overestimates the storage used by each environment.
+type envUsage struct {
+	// maxEnvs, if positive, holds the maximum number of environments
+	// tracked, beyond which the usage of further environments is tracked
+	// as that of overflowEnv. This bounds the memory used, and the number
+	// of environments reported by usage, when environments are derived
+	// from client-supplied values.
+	maxEnvs     int
+	overflowEnv string
+
+	mu   sync.Mutex
+	envs map[string]*[envUsageBuckets]envUsageBucket
+	// width holds the width of each bucket in nanoseconds, derived from
+	// the TTL most recently given to reserve.
+	width int64
+	// prunedIndex holds the bucket index at which environments without
+	// usage were last pruned, as they can only age out when it changes.
+	prunedIndex int64
+}
+
+type envUsageBucket struct {
+	// index holds the index of the time interval covered by the bucket,
+	// in multiples of the bucket width since the Unix epoch.
+	index int64
+	size  int64
+}
+
+// reserve adds size to the usage of env at time now if it would not exceed
+// limit, and returns the environment whose usage was checked, the usage of
+// that environment within ttl of now, excluding size, and whether size was
+// added. The environment is env, unless maxEnvs environments are already
+// tracked, in which case it is overflowEnv; it must be given to release in
+// place of env.
+func (u *envUsage) reserve(env string, size, limit int64, ttl time.Duration, now time.Time) (string, int64, bool) {
+	width := int64(ttl / envUsageBuckets)
+	if width <= 0 {
+		width = 1
+	}
+	index := now.UnixNano() / width
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.width = width
+	buckets, ok := u.envs[env]
+	if !ok && u.maxEnvs > 0 && len(u.envs) >= u.maxEnvs {
+		if index != u.prunedIndex {
+			u.pruneLocked(index)
+		}
+		if len(u.envs) >= u.maxEnvs {
+			env = u.overflowEnv
+			buckets, ok = u.envs[env]
+		}
+	}
+	if !ok {
+		if u.envs == nil {
+			u.envs = make(map[string]*[envUsageBuckets]envUsageBucket)
+		}
+		buckets = new([envUsageBuckets]envUsageBucket)
+		u.envs[env] = buckets
+	}
+	current := bucketsSize(buckets, index)
+	if current+size > limit {
+		return env, current, false
+	}
+	u.addLocked(buckets, index, size)
+	return env, current, true
+}
+
+// pruneLocked stops tracking the environments without usage within the
+// buckets of index, such as those whose usage has aged out.
+func (u *envUsage) pruneLocked(index int64) {
+	u.prunedIndex = index
+	for env, buckets := range u.envs {
+		if bucketsSize(buckets, index) == 0 {
+			delete(u.envs, env)
+		}
+	}
+}
+
+// release subtracts size from the usage of env recorded at time written,
+// such as when a write fails after reserving its size, or events are
+// evicted before they expire. If written is no longer within the tracked
+// buckets, size has already aged out of the usage, and release does
+// nothing.
+func (u *envUsage) release(env string, size int64, written time.Time) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	buckets, ok := u.envs[env]
+	if !ok || u.width <= 0 {
+		return
+	}
+	index := written.UnixNano() / u.width
+	if b := &buckets[index%envUsageBuckets]; b.index == index {
+		b.size -= size
+	}
+}
+
+// ttl returns the TTL most recently given to reserve, to the precision of
+// the bucket width, or zero if reserve has not been called.
+func (u *envUsage) ttl() time.Duration {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return time.Duration(u.width * envUsageBuckets)
+}
+
+// usage returns the usage of each env within the TTL of now most recently
+// given to reserve, omitting those without usage.
+func (u *envUsage) usage(now time.Time) map[string]int64 {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.width == 0 {
+		return nil
+	}
+	index := now.UnixNano() / u.width
+	usage := make(map[string]int64, len(u.envs))
+	for env, buckets := range u.envs {
+		if size := bucketsSize(buckets, index); size > 0 {
+			usage[env] = size
+		}
+	}
+	return usage
+}
+
+func (u *envUsage) addLocked(buckets *[envUsageBuckets]envUsageBucket, index, size int64) {
+	b := &buckets[index%envUsageBuckets]
+	if b.index != index {
+		*b = envUsageBucket{index: index}
+	}
+	b.size += size
+}
+
+// bucketsSize returns the total size of the buckets within envUsageBuckets
+// of index. Sizes released after being written in an earlier bucket may
+// make the total negative, in which case zero is returned.
+func bucketsSize(buckets *[envUsageBuckets]envUsageBucket, index int64) int64 {
+	var size int64
+	for _, b := range buckets {
+		if b.index > index-envUsageBuckets {
+			size += b.size
+		}
+	}
+	return max(0, size)
+}
+
+// reserveEnvironmentStorage accounts for writing entrySize bytes at time now
+// for a trace event with the service environment env, returning an error
+// wrapping ErrEnvLimitReached if this would exceed the environment's
+// storage limit. It reports whether the size was reserved, in which case
+// the reservation must be released if the write fails.
+func (rw *ReadWriter) reserveEnvironmentStorage(env string, entrySize int64, opts WriterOpts, now time.Time) (bool, error) {
+	limit, ok := opts.EnvironmentStorageLimits[env]
+	if !ok || limit <= 0 {
+		return false, nil
+	}
+	_, current, ok := rw.s.envUsage.reserve(env, entrySize, limit, opts.TTL, now)
+	if !ok {
+		return false, fmt.Errorf(
+			"%w (environment: %q, current: %d, limit: %d)",
+			ErrEnvLimitReached, env, current, limit,
+		)
+	}
+	return true, nil
+}
@@ -0,0 +1,139 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package eventstorage
+
+import (
+	"bytes"
+
+	"github.com/dgraph-io/badger/v2"
+
+	"github.com/elastic/apm-data/model/modelpb"
+)
+
+// WithEventIDIndex sets whether ReadWriters should maintain an index from
+// the ID of each trace event to the ID of its trace, so that events may be
+// read by their ID alone with ReadWriter.ReadEventByID. The index is
+// disabled by default.
+//
+// Each trace event write then also writes an index entry, doubling the
+// number of writes of trace events. Index entries are written with the
+// same TTL as their events, are rewritten with them by sliding TTLs and
+// RewriteTTL, and are deleted with them by FinalizeTrace and
+// DeleteTraceEvent. Events evicted to make room in the storage leave their
+// index entries to expire.
+//
+// Event IDs are expected to be globally unique: if events of different
+// traces are written with the same ID, the index holds the trace of the
+// most recently written event.
+func WithEventIDIndex(enabled bool) StorageOption {
+	return func(s *Storage) {
+		s.eventIDIndex = enabled
+	}
+}
+
+// ReadEventByID reads the trace event with the given ID, looking up its
+// trace ID in the index maintained with WithEventIDIndex. If the event has
+// not been indexed, such as when WithEventIDIndex is disabled, or the event
+// no longer exists, ReadEventByID returns ErrNotFound. If the trace has
+// multiple events with the ID, such as with WithChronologicalKeys or
+// WithNodeID, the first in key order is returned.
+func (rw *ReadWriter) ReadEventByID(id string) (*modelpb.APMEvent, error) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	if rw.closed {
+		return nil, ErrClosed
+	}
+	rw.s.counters.reads.Add(1)
+	traceID, err := rw.readEventIDIndex(id)
+	if err != nil {
+		return nil, err
+	}
+	keys := rw.eventKeys(traceID, id)
+	if len(keys) == 0 {
+		return nil, ErrNotFound
+	}
+	item, err := rw.txn.Get(keys[0])
+	if err != nil {
+		if err == badger.ErrKeyNotFound {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	if item.IsDeletedOrExpired() || !isTraceEventMeta(item.UserMeta()) {
+		return nil, ErrNotFound
+	}
+	decoder := traceEventDecoder{s: rw.s, txn: rw.txn}
+	var event modelpb.APMEvent
+	if err := decoder.decode(traceID, item, &event); err != nil {
+		return nil, err
+	}
+	return &event, nil
+}
+
+// readEventIDIndex returns the trace ID indexed for the event ID, or
+// ErrNotFound if there is none.
+func (rw *ReadWriter) readEventIDIndex(id string) (string, error) {
+	rw.readKeyBuf = rw.s.eventIDIndexKey(rw.readKeyBuf[:0], id)
+	item, err := rw.txn.Get(rw.readKeyBuf)
+	if err != nil {
+		if err == badger.ErrKeyNotFound {
+			return "", ErrNotFound
+		}
+		return "", err
+	}
+	if item.UserMeta() != entryMetaEventIDIndex {
+		return "", ErrNotFound
+	}
+	traceID, err := item.ValueCopy(nil)
+	if err != nil {
+		return "", err
+	}
+	return string(traceID), nil
+}
+
+// updateEventIDIndex indexes the trace event with the given key, of
+// traceID, if WithEventIDIndex is enabled.
+func (rw *ReadWriter) updateEventIDIndex(traceID string, eventKey []byte, opts WriterOpts) error {
+	if !rw.s.eventIDIndex {
+		return nil
+	}
+	id := rw.s.eventKeyTraceEventID(traceID, eventKey)
+	e := badger.NewEntry(rw.s.eventIDIndexKey(nil, string(id)), []byte(traceID)).WithMeta(entryMetaEventIDIndex)
+	return rw.writeEntry(e, opts)
+}
+
+// indexedEventIDKeys returns the keys of the event ID index entries of the
+// trace events of traceID with the given keys, excluding those which index
+// another trace's events with the same ID. This returns nil if
+// WithEventIDIndex is disabled.
+func (rw *ReadWriter) indexedEventIDKeys(traceID string, eventKeys [][]byte) ([][]byte, error) {
+	if !rw.s.eventIDIndex {
+		return nil, nil
+	}
+	var keys [][]byte
+	for _, eventKey := range eventKeys {
+		key := rw.s.eventIDIndexKey(nil, string(rw.s.eventKeyTraceEventID(traceID, eventKey)))
+		item, err := rw.txn.Get(key)
+		if err == badger.ErrKeyNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if item.UserMeta() != entryMetaEventIDIndex {
+			continue
+		}
+		var indexed bool
+		if err := item.Value(func(data []byte) error {
+			indexed = bytes.Equal(data, []byte(traceID))
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+		if indexed {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
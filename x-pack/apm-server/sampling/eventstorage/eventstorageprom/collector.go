@@ -0,0 +1,138 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+// Package eventstorageprom provides a Prometheus collector for tail-sampling
+// event storage metrics. It is separate from package eventstorage so that
+// users of eventstorage do not depend on the Prometheus client library.
+package eventstorageprom
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/elastic/apm-server/x-pack/apm-server/sampling/eventstorage"
+)
+
+const namespace = "apm_tail_sampling_storage"
+
+var (
+	sizeDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "size_bytes"),
+		"Estimated size of the storage database in bytes.",
+		nil, nil,
+	)
+	pendingSizeDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "pending_size_bytes"),
+		"Estimated size of unflushed writes in bytes.",
+		nil, nil,
+	)
+	limitDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "limit_bytes"),
+		"Storage limit in bytes, or 0 if there is no limit.",
+		nil, nil,
+	)
+	usageDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "usage_ratio"),
+		"Estimated size of the storage database and unflushed writes as a fraction of the storage limit.",
+		nil, nil,
+	)
+	writesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "writes_total"),
+		"Total number of entries written.",
+		nil, nil,
+	)
+	readsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "reads_total"),
+		"Total number of trace event and sampling decision reads.",
+		nil, nil,
+	)
+	flushesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "flushes_total"),
+		"Total number of flushes of pending writes.",
+		nil, nil,
+	)
+	limitReachedDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "limit_reached_total"),
+		"Total number of writes rejected due to the storage limit.",
+		nil, nil,
+	)
+	flushSizeDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "flush_writes"),
+		"Number of writes committed by each flush of pending writes.",
+		nil, nil,
+	)
+	decisionLatencyDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "decision_latency_seconds"),
+		"Time from the first write of a trace's events to its sampling decision, for traces with a summary.",
+		nil, nil,
+	)
+	tenantUsageDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "tenant_usage_bytes"),
+		"Estimated storage used by the trace events of each tenant in bytes, if tenants are configured.",
+		[]string{"tenant"}, nil,
+	)
+)
+
+// PrometheusCollector is a prometheus.Collector which exposes the metrics of
+// an eventstorage.Storage, as reported by Storage.Stats.
+type PrometheusCollector struct {
+	storage *eventstorage.Storage
+	limit   int64
+}
+
+// NewPrometheusCollector returns a new PrometheusCollector for storage.
+//
+// limit holds the storage limit in bytes, as given to writes with
+// WriterOpts.StorageLimitInBytes, which is not known to the Storage. If
+// limit is zero, the usage ratio metric is not reported.
+func NewPrometheusCollector(storage *eventstorage.Storage, limit int64) *PrometheusCollector {
+	return &PrometheusCollector{storage: storage, limit: limit}
+}
+
+// Describe implements prometheus.Collector.
+func (c *PrometheusCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- sizeDesc
+	ch <- pendingSizeDesc
+	ch <- limitDesc
+	ch <- usageDesc
+	ch <- writesDesc
+	ch <- readsDesc
+	ch <- flushesDesc
+	ch <- limitReachedDesc
+	ch <- flushSizeDesc
+	ch <- decisionLatencyDesc
+	ch <- tenantUsageDesc
+}
+
+// Collect implements prometheus.Collector.
+func (c *PrometheusCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.storage.Stats()
+	ch <- prometheus.MustNewConstMetric(sizeDesc, prometheus.GaugeValue, float64(stats.Size))
+	ch <- prometheus.MustNewConstMetric(pendingSizeDesc, prometheus.GaugeValue, float64(stats.PendingSize))
+	ch <- prometheus.MustNewConstMetric(limitDesc, prometheus.GaugeValue, float64(c.limit))
+	if c.limit > 0 {
+		usage := float64(stats.Size+stats.PendingSize) / float64(c.limit)
+		ch <- prometheus.MustNewConstMetric(usageDesc, prometheus.GaugeValue, usage)
+	}
+	ch <- prometheus.MustNewConstMetric(writesDesc, prometheus.CounterValue, float64(stats.Writes))
+	ch <- prometheus.MustNewConstMetric(readsDesc, prometheus.CounterValue, float64(stats.Reads))
+	ch <- prometheus.MustNewConstMetric(flushesDesc, prometheus.CounterValue, float64(stats.Flushes))
+	ch <- prometheus.MustNewConstMetric(limitReachedDesc, prometheus.CounterValue, float64(stats.LimitReached))
+	buckets := make(map[float64]uint64, len(stats.FlushSizes.Buckets))
+	for bound, count := range stats.FlushSizes.Buckets {
+		buckets[float64(bound)] = uint64(count)
+	}
+	ch <- prometheus.MustNewConstHistogram(
+		flushSizeDesc, uint64(stats.FlushSizes.Count), float64(stats.FlushSizes.Sum), buckets,
+	)
+	latencyBuckets := make(map[float64]uint64, len(stats.DecisionLatency.Buckets))
+	for bound, count := range stats.DecisionLatency.Buckets {
+		latencyBuckets[bound.Seconds()] = uint64(count)
+	}
+	ch <- prometheus.MustNewConstHistogram(
+		decisionLatencyDesc, uint64(stats.DecisionLatency.Count), stats.DecisionLatency.Sum.Seconds(), latencyBuckets,
+	)
+	for tenant, usage := range stats.TenantUsage {
+		ch <- prometheus.MustNewConstMetric(tenantUsageDesc, prometheus.GaugeValue, float64(usage), tenant)
+	}
+}
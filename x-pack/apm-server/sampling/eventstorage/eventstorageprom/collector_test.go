@@ -0,0 +1,149 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package eventstorageprom_test
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/apm-data/model/modelpb"
+	"github.com/elastic/apm-server/x-pack/apm-server/sampling/eventstorage"
+	"github.com/elastic/apm-server/x-pack/apm-server/sampling/eventstorage/eventstorageprom"
+)
+
+func TestPrometheusCollector(t *testing.T) {
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	store := eventstorage.New(db, eventstorage.ProtobufCodec{})
+
+	collector := eventstorageprom.NewPrometheusCollector(store, 1<<30)
+	registry := prometheus.NewPedanticRegistry()
+	require.NoError(t, registry.Register(collector))
+
+	readWriter := store.NewReadWriter()
+	defer readWriter.Close()
+	wOpts := eventstorage.WriterOpts{TTL: time.Minute}
+	require.NoError(t, readWriter.WriteTraceEvent("trace_id", "span_id", &modelpb.APMEvent{}, wOpts))
+	require.NoError(t, readWriter.WriteTraceSampled("trace_id", true, wOpts))
+	require.NoError(t, readWriter.Flush())
+	var batch modelpb.Batch
+	require.NoError(t, readWriter.ReadTraceEvents("trace_id", &batch))
+
+	assert.NoError(t, testutil.GatherAndCompare(registry, strings.NewReader(`
+# HELP apm_tail_sampling_storage_flush_writes Number of writes committed by each flush of pending writes.
+# TYPE apm_tail_sampling_storage_flush_writes histogram
+apm_tail_sampling_storage_flush_writes_bucket{le="0"} 0
+apm_tail_sampling_storage_flush_writes_bucket{le="10"} 1
+apm_tail_sampling_storage_flush_writes_bucket{le="50"} 1
+apm_tail_sampling_storage_flush_writes_bucket{le="100"} 1
+apm_tail_sampling_storage_flush_writes_bucket{le="200"} 1
+apm_tail_sampling_storage_flush_writes_bucket{le="400"} 1
+apm_tail_sampling_storage_flush_writes_bucket{le="800"} 1
+apm_tail_sampling_storage_flush_writes_bucket{le="1600"} 1
+apm_tail_sampling_storage_flush_writes_bucket{le="+Inf"} 1
+apm_tail_sampling_storage_flush_writes_sum 2
+apm_tail_sampling_storage_flush_writes_count 1
+# HELP apm_tail_sampling_storage_flushes_total Total number of flushes of pending writes.
+# TYPE apm_tail_sampling_storage_flushes_total counter
+apm_tail_sampling_storage_flushes_total 1
+# HELP apm_tail_sampling_storage_limit_bytes Storage limit in bytes, or 0 if there is no limit.
+# TYPE apm_tail_sampling_storage_limit_bytes gauge
+apm_tail_sampling_storage_limit_bytes 1.073741824e+09
+# HELP apm_tail_sampling_storage_limit_reached_total Total number of writes rejected due to the storage limit.
+# TYPE apm_tail_sampling_storage_limit_reached_total counter
+apm_tail_sampling_storage_limit_reached_total 0
+# HELP apm_tail_sampling_storage_reads_total Total number of trace event and sampling decision reads.
+# TYPE apm_tail_sampling_storage_reads_total counter
+apm_tail_sampling_storage_reads_total 1
+# HELP apm_tail_sampling_storage_writes_total Total number of entries written.
+# TYPE apm_tail_sampling_storage_writes_total counter
+apm_tail_sampling_storage_writes_total 2
+`),
+		"apm_tail_sampling_storage_flush_writes",
+		"apm_tail_sampling_storage_flushes_total",
+		"apm_tail_sampling_storage_limit_bytes",
+		"apm_tail_sampling_storage_limit_reached_total",
+		"apm_tail_sampling_storage_reads_total",
+		"apm_tail_sampling_storage_writes_total",
+	))
+
+	// Size metrics vary, but must be reported.
+	families, err := registry.Gather()
+	require.NoError(t, err)
+	names := make([]string, len(families))
+	for i, family := range families {
+		names[i] = family.GetName()
+	}
+	assert.Contains(t, names, "apm_tail_sampling_storage_size_bytes")
+	assert.Contains(t, names, "apm_tail_sampling_storage_pending_size_bytes")
+	assert.Contains(t, names, "apm_tail_sampling_storage_usage_ratio")
+	assert.Contains(t, names, "apm_tail_sampling_storage_decision_latency_seconds")
+}
+
+func TestPrometheusCollectorTenantUsage(t *testing.T) {
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	store := eventstorage.New(db, eventstorage.ProtobufCodec{}, eventstorage.WithTenantKey(eventstorage.TenantKey{
+		ServiceNameSeparator: "-",
+	}))
+
+	collector := eventstorageprom.NewPrometheusCollector(store, 0)
+	registry := prometheus.NewPedanticRegistry()
+	require.NoError(t, registry.Register(collector))
+
+	readWriter := store.NewReadWriter()
+	defer readWriter.Close()
+	event := &modelpb.APMEvent{Service: &modelpb.Service{Name: "acme-checkout"}}
+	require.NoError(t, readWriter.WriteTraceEvent("trace_id", "span_id", event, eventstorage.WriterOpts{TTL: time.Minute}))
+
+	assert.NoError(t, testutil.GatherAndCompare(registry, strings.NewReader(fmt.Sprintf(`
+# HELP apm_tail_sampling_storage_tenant_usage_bytes Estimated storage used by the trace events of each tenant in bytes, if tenants are configured.
+# TYPE apm_tail_sampling_storage_tenant_usage_bytes gauge
+apm_tail_sampling_storage_tenant_usage_bytes{tenant="acme"} %d
+`, store.TenantUsage()["acme"])),
+		"apm_tail_sampling_storage_tenant_usage_bytes",
+	))
+}
+
+func TestPrometheusCollectorScrape(t *testing.T) {
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	store := eventstorage.New(db, eventstorage.ProtobufCodec{})
+
+	registry := prometheus.NewPedanticRegistry()
+	require.NoError(t, registry.Register(eventstorageprom.NewPrometheusCollector(store, 1<<30)))
+	srv := httptest.NewServer(promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	defer srv.Close()
+
+	readWriter := store.NewReadWriter()
+	defer readWriter.Close()
+	require.NoError(t, readWriter.WriteTraceSampled("trace_id", true, eventstorage.WriterOpts{TTL: time.Minute}))
+	require.NoError(t, readWriter.Flush())
+
+	resp, err := http.Get(srv.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Contains(t, string(body), "apm_tail_sampling_storage_writes_total 1\n")
+	assert.Contains(t, string(body), "apm_tail_sampling_storage_flushes_total 1\n")
+	assert.Contains(t, string(body), "apm_tail_sampling_storage_limit_bytes 1.073741824e+09\n")
+}
@@ -0,0 +1,150 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package eventstorage
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/dgraph-io/badger/v2"
+
+	"github.com/elastic/apm-data/model/modelpb"
+)
+
+// TraceEventSummary holds information accumulated over the events written
+// for a trace, for matching trace-level sampling criteria without reading
+// and decoding all of the trace's events. See WithTraceEventSummaries.
+type TraceEventSummary struct {
+	// Events holds the number of events written for the trace.
+	Events int `json:"events"`
+
+	// Spans holds the number of span events written for the trace.
+	Spans int `json:"spans,omitempty"`
+
+	// HasError records whether any event is an error, or has a failure
+	// outcome.
+	HasError bool `json:"has_error,omitempty"`
+
+	// MaxDuration holds the longest duration of any event.
+	MaxDuration time.Duration `json:"max_duration,omitempty"`
+
+	// SpanDurations holds the total duration of spans, keyed by span type.
+	SpanDurations map[string]time.Duration `json:"span_durations,omitempty"`
+
+	// DestinationServices holds the distinct destination service
+	// resources of spans, in sorted order.
+	DestinationServices []string `json:"destination_services,omitempty"`
+
+	// FirstWritten holds the time at which the first event of the trace
+	// was written, for measuring decision latency. This is zero for
+	// summaries written before it was recorded.
+	FirstWritten time.Time `json:"first_written"`
+}
+
+// add updates the summary with event.
+func (s *TraceEventSummary) add(event *modelpb.APMEvent) {
+	s.Events++
+	if event.Type() == modelpb.ErrorEventType || event.GetEvent().GetOutcome() == "failure" {
+		s.HasError = true
+	}
+	duration := time.Duration(event.GetEvent().GetDuration())
+	s.MaxDuration = max(s.MaxDuration, duration)
+	if event.Type() != modelpb.SpanEventType {
+		return
+	}
+	s.Spans++
+	if s.SpanDurations == nil {
+		s.SpanDurations = make(map[string]time.Duration)
+	}
+	s.SpanDurations[event.GetSpan().GetType()] += duration
+	if resource := event.GetSpan().GetDestinationService().GetResource(); resource != "" {
+		i := sort.SearchStrings(s.DestinationServices, resource)
+		if i == len(s.DestinationServices) || s.DestinationServices[i] != resource {
+			s.DestinationServices = append(s.DestinationServices, "")
+			copy(s.DestinationServices[i+1:], s.DestinationServices[i:])
+			s.DestinationServices[i] = resource
+		}
+	}
+}
+
+// WithTraceEventSummaries sets whether ReadWriters should maintain a
+// TraceEventSummary for each trace, updated with each trace event written,
+// which may be read with ReadWriter.ReadTraceEventSummary. Summaries are
+// disabled by default.
+//
+// Each trace event write then also reads, decodes and rewrites the trace's
+// summary, roughly doubling the number of writes; with WithCoalesceWrites,
+// rewrites of a summary within the same transaction are counted only once
+// towards the storage limit. Summaries are written with the same TTL as the
+// events, so a summary expires with the most recently written event of its
+// trace. Summaries are deleted by FinalizeTrace, but are not updated when
+// events are deleted individually with DeleteTraceEvent. Summaries record
+// the time at which their trace's first event was written, from which
+// WriteTraceSampled and FinalizeTrace observe decision latency; without
+// summaries, no decision latency is observed. See DecisionLatencyPercentile.
+func WithTraceEventSummaries(enabled bool) StorageOption {
+	return func(s *Storage) {
+		s.traceEventSummaries = enabled
+	}
+}
+
+// ReadTraceEventSummary returns the summary of the events written for the
+// given trace ID. If there is no summary, such as when no events have been
+// written for the trace or WithTraceEventSummaries is disabled,
+// ReadTraceEventSummary returns ErrNotFound.
+func (rw *ReadWriter) ReadTraceEventSummary(traceID string) (TraceEventSummary, error) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	if rw.closed {
+		return TraceEventSummary{}, ErrClosed
+	}
+	rw.s.counters.reads.Add(1)
+	return rw.readTraceEventSummary(traceID)
+}
+
+func (rw *ReadWriter) readTraceEventSummary(traceID string) (TraceEventSummary, error) {
+	var summary TraceEventSummary
+	rw.readKeyBuf = rw.s.eventSummaryKey(rw.readKeyBuf[:0], traceID)
+	item, err := rw.txn.Get(rw.readKeyBuf)
+	if err != nil {
+		if err == badger.ErrKeyNotFound {
+			return summary, ErrNotFound
+		}
+		return summary, err
+	}
+	if item.UserMeta() != entryMetaTraceEventSummary {
+		return summary, ErrNotFound
+	}
+	err = item.Value(func(data []byte) error {
+		if err := json.Unmarshal(data, &summary); err != nil {
+			return fmt.Errorf("failed to decode trace event summary: %w", err)
+		}
+		return nil
+	})
+	return summary, err
+}
+
+// updateTraceEventSummary adds event to the summary of traceID's events,
+// if WithTraceEventSummaries is enabled.
+func (rw *ReadWriter) updateTraceEventSummary(traceID string, event *modelpb.APMEvent, opts WriterOpts) error {
+	if !rw.s.traceEventSummaries {
+		return nil
+	}
+	summary, err := rw.readTraceEventSummary(traceID)
+	if err == ErrNotFound {
+		summary.FirstWritten = time.Now()
+	} else if err != nil {
+		return err
+	}
+	summary.add(event)
+	data, err := json.Marshal(summary)
+	if err != nil {
+		return err
+	}
+	key := rw.s.eventSummaryKey(nil, traceID)
+	return rw.writeEntry(badger.NewEntry(key, data).WithMeta(entryMetaTraceEventSummary), opts)
+}
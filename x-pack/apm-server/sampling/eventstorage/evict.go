@@ -0,0 +1,419 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package eventstorage
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/dgraph-io/badger/v2"
+)
+
+// LimitStrategy defines how a ReadWriter behaves when a write would exceed
+// WriterOpts.StorageLimitInBytes.
+type LimitStrategy int
+
+const (
+	// FailFlush flushes pending writes and fails the write with
+	// ErrLimitReached. This is the default.
+	FailFlush LimitStrategy = iota
+
+	// DropOldest deletes the events of the oldest traces in storage, by
+	// the latest expiry time of their events, to make room for the write.
+	// Each eviction considers a bounded number of stored events, continuing
+	// from where the previous eviction stopped, so the traces deleted are
+	// the oldest of those considered rather than of all stored traces.
+	DropOldest
+
+	// DropUnsampledEvents deletes the events of traces which have been
+	// recorded as unsampled to make room for the write.
+	DropUnsampledEvents
+
+	// DropOverFairShare deletes the oldest traces of the tenant furthest
+	// over its fair share of the storage limit, to make room for the
+	// write, so that one tenant's burst of events does not cause the
+	// events of others to be dropped. The storage limit is shared equally
+	// between the tenants with stored events, and the tenant of each trace
+	// is recorded when its first event is written, as configured with
+	// WithTenantKey; without a tenant key, this behaves as DropOldest.
+	// As with DropOldest, each eviction considers a bounded number of
+	// stored events.
+	DropOverFairShare
+)
+
+// evictionTargetDivisor determines the number of bytes that eviction
+// attempts to free at once: 1/evictionTargetDivisor of the storage limit.
+// Evicting more than is needed for a single write amortizes the cost of
+// scanning storage over subsequent writes.
+const evictionTargetDivisor = 100
+
+// maxEvictionScanKeys bounds the number of trace event keys scanned by each
+// eviction, so that the cost of eviction does not grow with the size of the
+// storage. The scan is extended past the bound to the end of the last trace,
+// so that traces are always evicted whole.
+const maxEvictionScanKeys = 10000
+
+// ParseLimitStrategy parses a LimitStrategy from its string representation,
+// as returned by LimitStrategy.String.
+func ParseLimitStrategy(s string) (LimitStrategy, error) {
+	for _, strategy := range []LimitStrategy{FailFlush, DropOldest, DropUnsampledEvents, DropOverFairShare} {
+		if s == strategy.String() {
+			return strategy, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown limit strategy %q", s)
+}
+
+// String returns the string representation of the strategy.
+func (s LimitStrategy) String() string {
+	switch s {
+	case FailFlush:
+		return "fail_flush"
+	case DropOldest:
+		return "drop_oldest"
+	case DropUnsampledEvents:
+		return "drop_unsampled_events"
+	case DropOverFairShare:
+		return "drop_over_fair_share"
+	}
+	return fmt.Sprintf("LimitStrategy(%d)", int(s))
+}
+
+// makeRoom attempts to free at least entrySize bytes of storage using the
+// given strategy, reporting whether it succeeded.
+//
+// Freed bytes are estimated in the same way as writes, and are credited to
+// the storage so that subsequent writes may use them without evicting more.
+// Note that deleted entries continue to be reported by badger's DB.Size until
+// they are garbage collected, so a storage over its limit will continue to
+// draw on this credit until then.
+func (s *Storage) makeRoom(strategy LimitStrategy, entrySize, limit int64) (bool, error) {
+	if s.consumeEvictionCredit(entrySize) {
+		return true, nil
+	}
+	target := limit / evictionTargetDivisor
+	if target < entrySize {
+		target = entrySize
+	}
+	var freed int64
+	var err error
+	switch strategy {
+	case DropOldest:
+		freed, err = s.evictOldest(target)
+	case DropUnsampledEvents:
+		freed, err = s.evictUnsampled(target)
+	case DropOverFairShare:
+		freed, err = s.evictOverFairShare(target, limit)
+	default:
+		return false, nil
+	}
+	s.evictionCredit.Add(freed)
+	if err != nil {
+		return false, err
+	}
+	return s.consumeEvictionCredit(entrySize), nil
+}
+
+// WithLimitHook sets a function to be called when a write would exceed
+// WriterOpts.StorageLimitInBytes, and the WriterOpts.OnLimit strategy could
+// not make room for it, giving the caller a chance to free space, such as by
+// finalizing traces or flushing other ReadWriters. The hook returns the
+// estimated number of bytes it freed by deleting entries, such as the sizes
+// reported by Storage.EncodedSize of the events it deleted.
+//
+// Deleted entries continue to be included in the storage size until they
+// are garbage collected, and the size reported by the database is itself
+// only updated periodically, so the bytes freed are credited to the storage
+// as for eviction, and used by the write and subsequent writes. If the hook
+// returns nil, the write proceeds if the credit covers it, or if the storage
+// is now under its limit, such as after flushing other ReadWriters' pending
+// writes; otherwise the write fails as it would without a hook.
+//
+// The hook is called at most once per write, and may be called concurrently
+// by multiple ReadWriters. It is called while the ReadWriter performing the
+// write holds its lock, so it must not use that ReadWriter, nor a
+// ShardedReadWriter containing it.
+func WithLimitHook(hook func() (int64, error)) StorageOption {
+	return func(s *Storage) {
+		s.limitHook = hook
+	}
+}
+
+// callLimitHook calls the storage's limit hook, crediting the bytes it
+// freed, and reports whether there is now room for a write of entrySize
+// bytes, along with the storage's current size, which includes pending
+// writes.
+func (s *Storage) callLimitHook(entrySize, limit int64) (bool, int64, error) {
+	freed, err := s.limitHook()
+	if freed > 0 {
+		s.evictionCredit.Add(freed)
+	}
+	if err != nil {
+		return false, 0, fmt.Errorf("limit hook failed: %w", err)
+	}
+	lsm, vlog := s.db.Size()
+	current := s.size.estimate(lsm+vlog, time.Now()) + s.pendingSize.Load()
+	if s.consumeEvictionCredit(entrySize) {
+		return true, current, nil
+	}
+	return current < limit, current, nil
+}
+
+func (s *Storage) consumeEvictionCredit(n int64) bool {
+	for {
+		credit := s.evictionCredit.Load()
+		if credit < n {
+			return false
+		}
+		if s.evictionCredit.CompareAndSwap(credit, credit-n) {
+			return true
+		}
+	}
+}
+
+// evictOldest deletes the events of the traces whose events have the
+// earliest latest expiry times, of those found by scanEvictionTraces, until
+// at least target bytes have been freed or no such traces remain. Traces
+// are deleted whole, so delta-encoded events are never left without their
+// base event.
+func (s *Storage) evictOldest(target int64) (int64, error) {
+	var traces []*evictionTrace
+	if err := s.db.View(func(txn *badger.Txn) (err error) {
+		traces, err = s.scanEvictionTraces(txn, maxEvictionScanKeys)
+		return err
+	}); err != nil {
+		return 0, err
+	}
+	sort.Slice(traces, func(i, j int) bool {
+		return traces[i].expiresAt < traces[j].expiresAt
+	})
+	return s.evictTraces(traces, target)
+}
+
+// evictionTrace holds the keys of a trace's stored events, as a candidate
+// for eviction.
+type evictionTrace struct {
+	traceID []byte
+	events  []evictionEvent
+	// tenant holds the tenant recorded for the trace, if hasTenant is
+	// true. See WithTenantKey.
+	tenant    string
+	hasTenant bool
+	// size holds the estimated storage size of the events.
+	size int64
+	// expiresAt holds the latest expiry time of the events.
+	expiresAt uint64
+}
+
+type evictionEvent struct {
+	key       []byte
+	size      int64
+	expiresAt uint64
+}
+
+// scanEvictionTraces scans the keys of stored trace events, and returns the
+// traces to which they belong, along with their recorded tenants if tenant
+// usage is tracked. The scan starts from the trace at which the previous
+// scan stopped, wrapping around to the first trace, and stops at the first
+// trace after maxKeys event keys have been scanned, so each trace is
+// returned with all of its events.
+func (s *Storage) scanEvictionTraces(txn *badger.Txn, maxKeys int) ([]*evictionTrace, error) {
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	opts.Prefix = s.keyPrefix
+	iter := txn.NewIterator(opts)
+	defer iter.Close()
+
+	var cursor []byte
+	if p := s.evictionCursor.Load(); p != nil {
+		cursor = *p
+	}
+	var traces []*evictionTrace
+	var scanned int
+	var next []byte
+	// Tenant entry keys ("<trace ID>/tenant") sort immediately before the
+	// keys of their trace's events ("<trace ID>:<event ID>"), so we can
+	// track the most recent tenant entry while iterating.
+	var tenantTraceID []byte
+	var tenant string
+	// visit adds item to the traces, reporting false if the scan should
+	// stop at item, which begins a new trace.
+	visit := func(item *badger.Item) (bool, error) {
+		if item.IsDeletedOrExpired() {
+			return true, nil
+		}
+		if item.UserMeta() == entryMetaTraceTenant && s.tenantKey != nil {
+			key := s.trimNamespace(item.Key())
+			tenantTraceID = append(tenantTraceID[:0], key[:len(key)-len(traceTenantKeySuffix)]...)
+			return true, item.Value(func(data []byte) error {
+				tenant = string(data)
+				return nil
+			})
+		}
+		if !isTraceEventMeta(item.UserMeta()) {
+			return true, nil
+		}
+		traceID, _, ok := s.splitEventKey(item.Key())
+		if !ok {
+			return true, nil
+		}
+		if n := len(traces); n == 0 || !bytes.Equal(traces[n-1].traceID, traceID) {
+			if scanned >= maxKeys {
+				next = s.traceKey(nil, string(traceID))
+				return false, nil
+			}
+			trace := &evictionTrace{traceID: bytes.Clone(traceID)}
+			if bytes.Equal(traceID, tenantTraceID) {
+				trace.tenant, trace.hasTenant = tenant, true
+			}
+			traces = append(traces, trace)
+		}
+		trace := traces[len(traces)-1]
+		event := evictionEvent{
+			key:       item.KeyCopy(nil),
+			size:      estimateItemSize(item),
+			expiresAt: item.ExpiresAt(),
+		}
+		trace.events = append(trace.events, event)
+		trace.size += event.size
+		trace.expiresAt = max(trace.expiresAt, event.expiresAt)
+		scanned++
+		return true, nil
+	}
+	more := true
+	var err error
+	for iter.Seek(cursor); iter.Valid() && more; iter.Next() {
+		if more, err = visit(iter.Item()); err != nil {
+			return nil, err
+		}
+	}
+	if cursor != nil {
+		for iter.Rewind(); iter.Valid() && more; iter.Next() {
+			if bytes.Compare(iter.Item().Key(), cursor) >= 0 {
+				break
+			}
+			if more, err = visit(iter.Item()); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if next != nil {
+		s.evictionCursor.Store(&next)
+	} else {
+		s.evictionCursor.Store(nil)
+	}
+	return traces, nil
+}
+
+// evictTraces deletes the events of the given traces in order, until at
+// least target bytes have been freed or no traces remain, and returns the
+// number of bytes freed. The sizes of evicted events are released from the
+// usage of their trace's recorded tenant, if any.
+func (s *Storage) evictTraces(traces []*evictionTrace, target int64) (int64, error) {
+	wb := s.db.NewWriteBatch()
+	defer wb.Cancel()
+	var freed int64
+	var evicted []*evictionTrace
+	for _, trace := range traces {
+		if freed >= target {
+			break
+		}
+		for _, event := range trace.events {
+			if err := wb.Delete(event.key); err != nil {
+				return 0, err
+			}
+		}
+		freed += trace.size
+		evicted = append(evicted, trace)
+	}
+	if err := wb.Flush(); err != nil {
+		return 0, err
+	}
+	if s.tenantKey != nil {
+		// Usage is recorded in the bucket of each event's write time,
+		// which is derived, to within a second, from its expiry time.
+		ttl := s.tenantUsage.ttl()
+		for _, trace := range evicted {
+			if !trace.hasTenant {
+				continue
+			}
+			for _, event := range trace.events {
+				written := time.Unix(int64(event.expiresAt), 0).Add(-ttl)
+				s.tenantUsage.release(trace.tenant, event.size, written)
+			}
+		}
+	}
+	return freed, nil
+}
+
+// evictUnsampled deletes the events of unsampled traces, until at least
+// target bytes have been freed or no such events remain.
+func (s *Storage) evictUnsampled(target int64) (int64, error) {
+	wb := s.db.NewWriteBatch()
+	defer wb.Cancel()
+	var freed int64
+	if err := s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Prefix = s.keyPrefix
+		iter := txn.NewIterator(opts)
+		defer iter.Close()
+		// Decision keys (trace IDs) sort immediately before the keys of
+		// their events ("<trace ID>:<event ID>"), so we can track the
+		// most recent unsampled trace ID while iterating. Prefixed decision
+		// keys are instead looked up.
+		var unsampledPrefix []byte
+		lookup := decisionLookup{s: s, txn: txn}
+		for iter.Rewind(); iter.Valid() && freed < target; iter.Next() {
+			item := iter.Item()
+			if item.IsDeletedOrExpired() {
+				continue
+			}
+			key := item.Key()
+			switch meta := item.UserMeta(); {
+			case meta == entryMetaTraceUnsampled:
+				unsampledPrefix = append(append(unsampledPrefix[:0], key...), keySeparator)
+			case isTraceEventMeta(meta):
+				unsampled := unsampledPrefix != nil && bytes.HasPrefix(key, unsampledPrefix)
+				if !unsampled && s.prefixedDecisionKeys {
+					if traceID, _, ok := s.splitEventKey(key); ok {
+						meta, err := lookup.decision(traceID)
+						if err != nil {
+							return err
+						}
+						unsampled = meta == entryMetaTraceUnsampled
+					}
+				}
+				if !unsampled && s.unsampled != nil {
+					if traceID, _, ok := s.splitEventKey(key); ok {
+						unsampled = s.unsampled.contains(string(traceID))
+					}
+				}
+				if !unsampled {
+					continue
+				}
+				if err := wb.Delete(item.KeyCopy(nil)); err != nil {
+					return err
+				}
+				freed += estimateItemSize(item)
+			}
+		}
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+	if err := wb.Flush(); err != nil {
+		return 0, err
+	}
+	return freed, nil
+}
+
+// estimateItemSize estimates the storage size of an item, consistent with
+// estimateSize.
+func estimateItemSize(item *badger.Item) int64 {
+	return int64(len(item.Key())) + item.ValueSize() + 12 + 2 + 10
+}
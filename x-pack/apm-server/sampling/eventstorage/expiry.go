@@ -0,0 +1,134 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package eventstorage
+
+import (
+	"bytes"
+
+	"github.com/dgraph-io/badger/v2"
+)
+
+// ExpirySweeper detects traces whose events expired from storage before a
+// sampling decision was recorded for them.
+//
+// badger does not notify of expired entries, so ExpirySweeper works by
+// periodically scanning storage: each call to Sweep records the traces which
+// have events but no sampling decision, and reports those recorded by the
+// previous call which no longer have events, nor a decision. Each expired
+// trace is therefore reported at most once, by the first Sweep after its
+// events expire.
+//
+// Detection is best effort. A trace is reported up to one sweep interval
+// after its events expire; traces whose events are written and expire
+// between two sweeps are not reported; and a trace whose events are deleted,
+// such as with DeleteTraceEvent, without recording a decision, is reported
+// as expired. Each Sweep scans the keys of all entries in storage, so the
+// sweep interval should not be too short.
+type ExpirySweeper struct {
+	s              *Storage
+	onTraceExpired func(traceID string)
+
+	// pending holds the IDs of traces which had events but no sampling
+	// decision as of the previous sweep.
+	pending map[string]struct{}
+}
+
+// NewExpirySweeper returns a new ExpirySweeper which calls onTraceExpired
+// for each trace detected as expired.
+func (s *Storage) NewExpirySweeper(onTraceExpired func(traceID string)) *ExpirySweeper {
+	return &ExpirySweeper{s: s, onTraceExpired: onTraceExpired}
+}
+
+// Sweep scans storage for traces whose events have expired without a sampling
+// decision since the previous call to Sweep, calling onTraceExpired for each
+// of them, and returns the number of such traces. The first call to Sweep
+// never reports any traces.
+//
+// Sweep reads from a snapshot of the database, and does not observe unflushed
+// writes. Sweep must not be called concurrently.
+func (w *ExpirySweeper) Sweep() (int, error) {
+	pending := make(map[string]struct{})
+	var expired []string
+	if err := w.s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Prefix = w.s.keyPrefix
+		iter := txn.NewIterator(opts)
+		// Decision keys (trace IDs) sort immediately before the keys of
+		// their events ("<trace ID>:<event ID>"), so we can track the
+		// most recent decided trace ID while iterating. Prefixed decision
+		// keys are instead looked up.
+		var decidedPrefix []byte
+		lookup := decisionLookup{s: w.s, txn: txn}
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			item := iter.Item()
+			if item.IsDeletedOrExpired() {
+				continue
+			}
+			key := item.Key()
+			switch meta := item.UserMeta(); {
+			case meta == entryMetaTraceSampled, meta == entryMetaTraceUnsampled:
+				decidedPrefix = append(append(decidedPrefix[:0], key...), keySeparator)
+			case isTraceEventMeta(meta):
+				if decidedPrefix != nil && bytes.HasPrefix(key, decidedPrefix) {
+					continue
+				}
+				traceID, _, ok := w.s.splitEventKey(key)
+				if !ok {
+					continue
+				}
+				if w.s.prefixedDecisionKeys {
+					meta, err := lookup.decision(traceID)
+					if err != nil {
+						iter.Close()
+						return err
+					}
+					if meta != 0 {
+						continue
+					}
+				}
+				if _, ok := pending[string(traceID)]; !ok {
+					pending[string(traceID)] = struct{}{}
+				}
+			}
+		}
+		iter.Close()
+
+		for traceID := range w.pending {
+			if _, ok := pending[traceID]; ok {
+				continue
+			}
+			_, err := txn.Get(w.s.decisionKey(nil, traceID))
+			if err == nil {
+				// A decision was recorded, and the trace's events
+				// have been removed.
+				continue
+			} else if err != badger.ErrKeyNotFound {
+				return err
+			}
+			if w.s.unsampled != nil && w.s.unsampled.contains(traceID) {
+				continue
+			}
+			expired = append(expired, traceID)
+		}
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+	// Exclude traces recorded as unsampled in memory. Their events
+	// remain in storage until they expire, and should not be reported.
+	if w.s.unsampled != nil {
+		for traceID := range pending {
+			if w.s.unsampled.contains(traceID) {
+				delete(pending, traceID)
+			}
+		}
+	}
+	w.pending = pending
+	for _, traceID := range expired {
+		w.onTraceExpired(traceID)
+	}
+	return len(expired), nil
+}
@@ -0,0 +1,86 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package eventstorage
+
+import (
+	"errors"
+
+	"github.com/dgraph-io/badger/v2"
+
+	"github.com/elastic/apm-data/model/modelpb"
+)
+
+// TraceEventFlagsMask holds the bits of the entry meta byte available for
+// user flags, such as for tagging events as forwarded from another server.
+//
+// The entry meta byte of each database entry is allocated as follows:
+//   - Bit 7 clear: bits 0-6 hold the entry type, one of a fixed set of
+//     ASCII values for trace events, delta-encoded trace events, sampling
+//     decisions, and trace summaries.
+//   - Bit 7 set: the entry is a full trace event, and bits 0-6 hold its
+//     user flags, which may be zero.
+const TraceEventFlagsMask = ^uint8(entryMetaTraceEventFlagged)
+
+// errInvalidTraceEventFlags is returned by WriteTraceEventFlags for flags
+// outside TraceEventFlagsMask.
+var errInvalidTraceEventFlags = errors.New("trace event flags outside TraceEventFlagsMask")
+
+// WriteTraceEventFlags writes a trace event to storage, like WriteTraceEvent,
+// along with the given user flags, which may be read back with
+// ReadTraceEventFlags. Flags must be within TraceEventFlagsMask. Events with
+// flags are always written in full, and are read by ReadTraceEvents like
+// any other event.
+func (rw *ReadWriter) WriteTraceEventFlags(traceID, id string, event *modelpb.APMEvent, flags uint8, opts WriterOpts) error {
+	if flags&^TraceEventFlagsMask != 0 {
+		return errInvalidTraceEventFlags
+	}
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	if rw.closed {
+		return ErrClosed
+	}
+	meta := byte(entryMetaTraceEvent)
+	if flags != 0 {
+		meta = entryMetaTraceEventFlagged | flags
+	}
+	return rw.writeTraceEvent(traceID, rw.s.newEventKey(nil, traceID, id, event), event, meta, opts)
+}
+
+// ReadTraceEventFlags returns the user flags written with the trace event
+// with the given trace and event IDs by WriteTraceEventFlags, or zero for
+// events written without flags. If the event does not exist,
+// ReadTraceEventFlags returns ErrNotFound.
+func (rw *ReadWriter) ReadTraceEventFlags(traceID, id string) (uint8, error) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	if rw.closed {
+		return 0, ErrClosed
+	}
+	rw.s.counters.reads.Add(1)
+	keys := rw.eventKeys(traceID, id)
+	if len(keys) == 0 {
+		return 0, ErrNotFound
+	}
+	item, err := rw.txn.Get(keys[0])
+	if err != nil {
+		if err == badger.ErrKeyNotFound {
+			return 0, ErrNotFound
+		}
+		return 0, err
+	}
+	meta := item.UserMeta()
+	if !isTraceEventMeta(meta) {
+		return 0, ErrNotFound
+	}
+	return traceEventFlags(meta), nil
+}
+
+// traceEventFlags returns the user flags held in the meta of a trace event.
+func traceEventFlags(meta byte) uint8 {
+	if meta&entryMetaTraceEventFlagged == 0 {
+		return 0
+	}
+	return meta & TraceEventFlagsMask
+}
@@ -0,0 +1,90 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package eventstorage
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// freeDiskCheckInterval holds the minimum interval between checks of the
+// filesystem's free space; results are cached in between.
+const freeDiskCheckInterval = time.Second
+
+// MinFreeDisk holds the minimum free space to maintain on the filesystem
+// containing the database. If both Bytes and Percent are specified, the
+// larger of the two floors applies. The zero value disables the check.
+type MinFreeDisk struct {
+	// Bytes holds the minimum free space in bytes.
+	Bytes uint64
+
+	// Percent holds the minimum free space as a percentage of the
+	// filesystem's total size, in the range [0,100].
+	Percent float64
+}
+
+// WithMinFreeDisk configures ReadWriters to check the actual free space of
+// the filesystem containing dir, which should be the database directory,
+// before writing trace events, and to reject writes of trace events with an
+// error wrapping ErrLimitReached while it is below min. This guards against
+// the filesystem filling up due to other processes, which the storage limit
+// does not account for.
+//
+// Other writes, such as sampling decisions, and deletions of trace events,
+// including by FinalizeTrace, are not rejected, so that traces may still be
+// finalized and their events removed while free space is low. Pending writes
+// are committed by Flush as usual.
+//
+// Free space is checked at most once per second, and the result cached in
+// between. The check is skipped if the free space cannot be read, including
+// on Windows, where it is not supported.
+// WithMinFreeDisk panics if min.Percent is outside the range [0,100].
+func WithMinFreeDisk(dir string, min MinFreeDisk) StorageOption {
+	if min.Percent < 0 || min.Percent > 100 {
+		panic("min.Percent must be in the range [0,100]")
+	}
+	return func(s *Storage) {
+		if min == (MinFreeDisk{}) {
+			s.freeDisk = nil
+			return
+		}
+		s.freeDisk = &freeDiskChecker{dir: dir, min: min}
+	}
+}
+
+// freeDiskChecker checks the free space of a filesystem against a minimum,
+// caching the result for freeDiskCheckInterval. It is safe for concurrent
+// use.
+type freeDiskChecker struct {
+	dir string
+	min MinFreeDisk
+
+	mu        sync.Mutex
+	checkedAt time.Time
+	err       error
+}
+
+// check returns an error wrapping ErrLimitReached if the filesystem's free
+// space is below the minimum, or nil otherwise. If the free space cannot be
+// read, the check is skipped.
+func (c *freeDiskChecker) check(now time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.checkedAt.IsZero() && now.Sub(c.checkedAt) < freeDiskCheckInterval {
+		return c.err
+	}
+	c.checkedAt = now
+	c.err = nil
+	free, total, err := diskSpace(c.dir)
+	if err != nil {
+		return nil
+	}
+	floor := max(c.min.Bytes, uint64(float64(total)*c.min.Percent/100))
+	if free < floor {
+		c.err = fmt.Errorf("%w (free disk: %d, minimum: %d)", ErrLimitReached, free, floor)
+	}
+	return c.err
+}
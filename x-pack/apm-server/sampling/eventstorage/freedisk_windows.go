@@ -0,0 +1,16 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+//go:build windows
+// +build windows
+
+package eventstorage
+
+import "errors"
+
+// diskSpace is not implemented on Windows, where the free disk space
+// check is skipped.
+func diskSpace(dir string) (free, total uint64, err error) {
+	return 0, 0, errors.ErrUnsupported
+}
@@ -0,0 +1,68 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package eventstorage
+
+import "sync"
+
+// gcPause holds the state of PauseGC and ResumeGC.
+type gcPause struct {
+	mu      sync.Mutex
+	paused  bool
+	skipped bool
+	// catchUp receives a value when GC is resumed after skipping runs.
+	catchUp chan struct{}
+}
+
+// PauseGC pauses periodic garbage collection of the database's value log,
+// such as during an ingest spike, to avoid its IO contending with writes.
+// While paused, SkipGC reports that scheduled runs should be skipped. GC
+// remains paused until ResumeGC is called. PauseGC is safe for concurrent
+// use, and pausing GC which is already paused has no effect.
+//
+// PauseGC only affects GC loops which consult SkipGC and GCCatchUp, such as
+// the tail-sampling processor's; it does not prevent RunValueLogGC from
+// being called directly.
+func (s *Storage) PauseGC() {
+	s.gc.mu.Lock()
+	defer s.gc.mu.Unlock()
+	s.gc.paused = true
+}
+
+// ResumeGC resumes garbage collection paused with PauseGC. If any scheduled
+// runs were skipped while paused, a catch-up run is signalled on the channel
+// returned by GCCatchUp. ResumeGC is safe for concurrent use, and resuming
+// GC which is not paused has no effect.
+func (s *Storage) ResumeGC() {
+	s.gc.mu.Lock()
+	defer s.gc.mu.Unlock()
+	s.gc.paused = false
+	if s.gc.skipped {
+		s.gc.skipped = false
+		select {
+		case s.gc.catchUp <- struct{}{}:
+		default:
+			// A catch-up run is already pending.
+		}
+	}
+}
+
+// SkipGC reports whether a scheduled garbage collection run should be
+// skipped because GC has been paused with PauseGC, recording the skipped
+// run so that a catch-up run is signalled when GC is resumed.
+func (s *Storage) SkipGC() bool {
+	s.gc.mu.Lock()
+	defer s.gc.mu.Unlock()
+	if s.gc.paused {
+		s.gc.skipped = true
+	}
+	return s.gc.paused
+}
+
+// GCCatchUp returns a channel which receives a value when garbage
+// collection is resumed with ResumeGC after scheduled runs were skipped,
+// upon which a GC loop should run garbage collection immediately.
+func (s *Storage) GCCatchUp() <-chan struct{} {
+	return s.gc.catchUp
+}
@@ -0,0 +1,340 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package eventstorage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"strings"
+
+	"github.com/elastic/apm-data/model/modelpb"
+)
+
+// Keys are laid out as follows, where <ns> is the storage's namespace
+// prefix (see WithNamespace), which is empty by default:
+//
+//	<ns><trace ID>                         sampling decision
+//	<ns>d:<trace ID>                       sampling decision, prefixed
+//	<ns><trace ID>:<event ID>              trace event
+//	<ns><trace ID>:<timestamp>@<event ID>  trace event, chronological
+//	<ns><trace ID>:<node ID>/<event ID>    trace event, with node ID
+//	<ns><trace ID>/summary                 trace summary
+//	<ns><trace ID>/events                  trace event summary
+//	<ns><trace ID>/lease                   trace lease
+//	<ns>i:<event ID>                       event ID index
+//	<ns>m:sampler                          sampler state
+//
+// where <timestamp> is the event's timestamp in Unix nanoseconds, encoded
+// as 16 lowercase hex digits so that keys sort chronologically. See
+// WithChronologicalKeys. Trace event keys include the ID of the node which
+// wrote them if WithNodeID is specified, following the timestamp if any.
+// Sampling decisions are written with the "d:" prefix if
+// WithPrefixedDecisionKeys is enabled. Event ID index entries are written
+// if WithEventIDIndex is enabled; they share a prefix with the events of
+// the trace ID "i", but are distinguished by their meta. Likewise, the
+// sampler state entry shares a prefix with the events of the trace ID "m";
+// trace IDs are hex-encoded in practice, so neither collides with events.
+//
+// The keys of a trace's events share the trace's key as a prefix, so they
+// are contiguous in key order however the events were written or deleted,
+// and iterating over them does not benefit from rewriting them under new
+// keys. Event keys must not be changed after writing in any case, as
+// events are identified by the IDs in their keys, such as in
+// DeleteTraceEvent, ReadTraceEventRaw and the base references of
+// delta-encoded events.
+
+const (
+	// keySeparator separates a trace ID from an event ID in trace event
+	// keys, and a namespace from the rest of the key.
+	keySeparator = ':'
+
+	// timestampSeparator separates the timestamp from the event ID in
+	// chronological trace event keys.
+	timestampSeparator = '@'
+
+	// timestampWidth holds the number of hex digits of the timestamp in
+	// chronological trace event keys.
+	timestampWidth = 16
+
+	// decisionKeyPrefix prefixes sampling decision keys when prefixed
+	// decision keys are enabled. See WithPrefixedDecisionKeys.
+	decisionKeyPrefix = "d:"
+
+	// nodeIDSeparator separates the node ID from the event ID in trace
+	// event keys written with a node ID. See WithNodeID.
+	nodeIDSeparator = '/'
+
+	// eventIDIndexKeyPrefix prefixes event ID index keys. See
+	// WithEventIDIndex.
+	eventIDIndexKeyPrefix = "i:"
+
+	// samplerStateKey is the key of the sampler state entry. See
+	// Storage.WriteSamplerState.
+	samplerStateKey = "m:sampler"
+
+	// reencodeCursorKey is the key of the entry recording the progress of
+	// an incomplete Storage.Reencode.
+	reencodeCursorKey = "m:reencode"
+)
+
+// WithNamespace configures the storage to prefix all of its keys with
+// namespace, so that multiple logical stores may share a database. Keys are
+// prefixed and stripped transparently: trace IDs reported by methods such
+// as IterateAll and ExportDecisions do not include the namespace.
+//
+// Storages with different namespaces do not observe each other's entries.
+// A Storage without a namespace must not share a database with namespaced
+// Storages, as it would misinterpret their entries. An empty namespace is
+// the same as no namespace. WithNamespace panics if namespace is invalid;
+// see ValidateNamespace.
+func WithNamespace(namespace string) StorageOption {
+	if err := ValidateNamespace(namespace); err != nil {
+		panic(err.Error())
+	}
+	return func(s *Storage) {
+		s.keyPrefix = nil
+		if namespace != "" {
+			s.keyPrefix = append([]byte(namespace), keySeparator)
+		}
+	}
+}
+
+// ValidateNamespace returns an error if namespace cannot be used with
+// WithNamespace, as it contains the key separator ':'. This may be used to
+// validate user-supplied namespaces before configuring a Storage.
+func ValidateNamespace(namespace string) error {
+	if strings.IndexByte(namespace, keySeparator) >= 0 {
+		return errors.New("namespace must not contain ':'")
+	}
+	return nil
+}
+
+// WithChronologicalKeys sets whether trace events are written with their
+// timestamp (modelpb.APMEvent.Timestamp) preceding their ID in their keys,
+// so that ReadTraceEvents and other reads of a trace's events return them
+// in chronological order, rather than ordered by event ID. Chronological
+// keys are disabled by default.
+//
+// Events are still identified by their ID alone in DeleteTraceEvent and
+// ReadTraceEventRaw, but these must then scan the keys of the trace's
+// events to find the event, costing time proportional to the number of
+// events in the trace; DeleteTraceEvents should be used to delete several
+// events of a trace with a single scan. Writing an event with the same ID
+// as an existing event, but a different timestamp, stores both events.
+//
+// Migration: enabling chronological keys for an existing database is
+// safe; events written previously remain readable, but are not ordered
+// chronologically with respect to events written with timestamps.
+// Disabling chronological keys is safe for reading events, but
+// DeleteTraceEvent and ReadTraceEventRaw will not find events written with
+// timestamps, so should not be relied on until those events have expired.
+func WithChronologicalKeys(enabled bool) StorageOption {
+	return func(s *Storage) {
+		s.chronologicalKeys = enabled
+	}
+}
+
+// WithNodeID sets an ID identifying the node writing to the storage, such
+// as an APM Server instance sharing a database with other instances, which
+// is included in the keys of the trace events it writes. Events of the same
+// trace with the same ID written by different nodes then have distinct
+// keys, and do not replace each other. Reads of a trace's events return
+// the events written by all nodes. Events are still identified by their ID
+// alone in DeleteTraceEvent and ReadTraceEventRaw, which must then scan the
+// keys of the trace's events as with WithChronologicalKeys; DeleteTraceEvent
+// deletes the events with the ID written by all nodes.
+//
+// Sampling decisions, trace labels and trace event summaries are still
+// keyed by trace ID alone, so they are shared by all nodes: there is a
+// single sampling decision for each trace, which applies to the events
+// written by all nodes, and conflicting decisions from different nodes are
+// resolved by WriterOpts.OnDecisionConflict as for decisions from the same
+// node.
+//
+// Node IDs are disabled by default, and an empty nodeID disables them.
+// Enabling node IDs for an existing database is safe; events written
+// previously remain readable. All nodes sharing a database should specify
+// a node ID, as event IDs read by nodes without one will include the node
+// ID of events written with one. WithNodeID panics if nodeID contains ':'
+// or '/'.
+func WithNodeID(nodeID string) StorageOption {
+	if strings.IndexByte(nodeID, keySeparator) >= 0 || strings.IndexByte(nodeID, nodeIDSeparator) >= 0 {
+		panic("nodeID must not contain ':' or '/'")
+	}
+	return func(s *Storage) {
+		s.nodeID = nodeID
+	}
+}
+
+// traceKey appends the key from which the keys of traceID's events and
+// summary are derived to b. This is also the key of traceID's sampling
+// decision, unless prefixed decision keys are enabled.
+func (s *Storage) traceKey(b []byte, traceID string) []byte {
+	return append(append(b, s.keyPrefix...), traceID...)
+}
+
+// decisionKey appends the key of traceID's sampling decision to b.
+func (s *Storage) decisionKey(b []byte, traceID string) []byte {
+	if !s.prefixedDecisionKeys {
+		return s.traceKey(b, traceID)
+	}
+	b = append(append(b, s.keyPrefix...), decisionKeyPrefix...)
+	return append(b, traceID...)
+}
+
+// decisionKeysPrefix returns the prefix shared by the storage's sampling
+// decision keys, for restricting scans of decisions. Unless prefixed
+// decision keys are enabled, this is shared with all other keys.
+func (s *Storage) decisionKeysPrefix() []byte {
+	if !s.prefixedDecisionKeys {
+		return s.keyPrefix
+	}
+	return append(append([]byte(nil), s.keyPrefix...), decisionKeyPrefix...)
+}
+
+// decisionTraceID returns the trace ID of a sampling decision key, which
+// must have the prefix returned by decisionKeysPrefix.
+func (s *Storage) decisionTraceID(key []byte) []byte {
+	key = s.trimNamespace(key)
+	if s.prefixedDecisionKeys {
+		key = key[len(decisionKeyPrefix):]
+	}
+	return key
+}
+
+// eventKeyPrefix appends the prefix of the keys of traceID's events to b.
+func (s *Storage) eventKeyPrefix(b []byte, traceID string) []byte {
+	return append(s.traceKey(b, traceID), keySeparator)
+}
+
+// eventKey appends the key of the trace event with the given trace and
+// event IDs to b. For reads, id must include the event's timestamp if it
+// was written with one; see eventKeyID.
+func (s *Storage) eventKey(b []byte, traceID, id string) []byte {
+	return append(s.eventKeyPrefix(b, traceID), id...)
+}
+
+// newEventKey appends the key with which to write event, with the given
+// trace and event IDs, to b.
+func (s *Storage) newEventKey(b []byte, traceID, id string, event *modelpb.APMEvent) []byte {
+	return s.appendEventKeyID(s.eventKeyPrefix(b, traceID), id, event)
+}
+
+// appendEventKeyID appends the event ID portion of the key with which to
+// write event, with the given ID, to b: the ID, preceded by the node ID if
+// specified, preceded by the event's timestamp if chronological keys are
+// enabled.
+func (s *Storage) appendEventKeyID(b []byte, id string, event *modelpb.APMEvent) []byte {
+	if s.chronologicalKeys {
+		var ts [8]byte
+		binary.BigEndian.PutUint64(ts[:], event.GetTimestamp())
+		b = hex.AppendEncode(b, ts[:])
+		b = append(b, timestampSeparator)
+	}
+	if s.nodeID != "" {
+		b = append(append(b, s.nodeID...), nodeIDSeparator)
+	}
+	return append(b, id...)
+}
+
+// eventKeyIDLen returns the length of the event ID portion of keys written
+// for events with an ID of length n.
+func (s *Storage) eventKeyIDLen(n int) int {
+	if s.chronologicalKeys {
+		n += timestampWidth + 1
+	}
+	if s.nodeID != "" {
+		n += len(s.nodeID) + 1
+	}
+	return n
+}
+
+// scanEventKeys reports whether the keys of a trace's events must be
+// scanned to find an event by its ID, as they hold more than the ID.
+func (s *Storage) scanEventKeys() bool {
+	return s.chronologicalKeys || s.nodeID != ""
+}
+
+// trimEventKeyID returns the event ID portion of a trace event key without
+// its timestamp and node ID, if any. Node IDs are only trimmed if the
+// storage has a node ID, as event IDs may otherwise contain '/'.
+func (s *Storage) trimEventKeyID(id []byte) []byte {
+	id = trimTimestamp(id)
+	if s.nodeID != "" {
+		if sep := bytes.IndexByte(id, nodeIDSeparator); sep >= 0 {
+			id = id[sep+1:]
+		}
+	}
+	return id
+}
+
+// trimTimestamp returns the event ID portion of a trace event key without
+// its timestamp, if any.
+func trimTimestamp(id []byte) []byte {
+	if len(id) <= timestampWidth || id[timestampWidth] != timestampSeparator {
+		return id
+	}
+	for _, c := range id[:timestampWidth] {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return id
+		}
+	}
+	return id[timestampWidth+1:]
+}
+
+// summaryKey appends the key of traceID's summary entry to b.
+func (s *Storage) summaryKey(b []byte, traceID string) []byte {
+	return append(s.traceKey(b, traceID), traceSummaryKeySuffix...)
+}
+
+// eventSummaryKey appends the key of traceID's event summary entry to b.
+func (s *Storage) eventSummaryKey(b []byte, traceID string) []byte {
+	return append(s.traceKey(b, traceID), traceEventSummaryKeySuffix...)
+}
+
+// leaseKey appends the key of traceID's lease entry to b.
+func (s *Storage) leaseKey(b []byte, traceID string) []byte {
+	return append(s.traceKey(b, traceID), traceLeaseKeySuffix...)
+}
+
+// traceTenantKey appends the key of traceID's tenant entry to b.
+func (s *Storage) traceTenantKey(b []byte, traceID string) []byte {
+	return append(s.traceKey(b, traceID), traceTenantKeySuffix...)
+}
+
+// eventIDIndexKey appends the key of the event ID index entry of the trace
+// event with the given ID to b.
+func (s *Storage) eventIDIndexKey(b []byte, id string) []byte {
+	b = append(append(b, s.keyPrefix...), eventIDIndexKeyPrefix...)
+	return append(b, id...)
+}
+
+// eventKeyTraceEventID returns the event ID of a trace event key of
+// traceID, without the event's timestamp and node ID, if any.
+func (s *Storage) eventKeyTraceEventID(traceID string, key []byte) []byte {
+	return s.trimEventKeyID(key[len(s.keyPrefix)+len(traceID)+1:])
+}
+
+// trimNamespace returns key without the storage's namespace prefix. The
+// key must have the prefix, such as when read by an iterator restricted to
+// the prefix.
+func (s *Storage) trimNamespace(key []byte) []byte {
+	return key[len(s.keyPrefix):]
+}
+
+// splitEventKey returns the trace and event IDs of a trace event key,
+// without the storage's namespace prefix, the event's timestamp or the
+// node ID, and
+// reports whether the key is a valid trace event key.
+func (s *Storage) splitEventKey(key []byte) (traceID, id []byte, ok bool) {
+	key = s.trimNamespace(key)
+	sep := bytes.IndexByte(key, keySeparator)
+	if sep < 0 {
+		return nil, nil, false
+	}
+	return key[:sep], s.trimEventKeyID(key[sep+1:]), true
+}
@@ -0,0 +1,103 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package eventstorage
+
+import (
+	"errors"
+	"time"
+
+	"github.com/dgraph-io/badger/v2"
+)
+
+// ClaimTrace attempts to claim traceID for processing by the worker with
+// the given ID, such as before finalizing the trace, so that only one of
+// several workers sharing the storage processes it. ClaimTrace reports
+// whether the claim succeeded: if the trace is already claimed by another
+// worker, ClaimTrace returns false, and the caller should skip the trace.
+//
+// A claim is recorded as a lease entry which expires after lease, after
+// which the trace may be claimed by any worker. Leases are released when
+// the trace is finalized with FinalizeTrace. Expiry times
+// are recorded in whole seconds, so a lease may expire up to a second
+// early; leases should be much longer than the time taken to process a
+// trace. The worker holding a lease may renew it before it expires by
+// calling ClaimTrace again with the same worker ID, which succeeds and
+// extends the lease to expire lease after the renewal. A worker which
+// fails to renew its lease in time may lose it to another worker, and
+// should not assume it still holds the claim.
+//
+// Unlike other writes, the lease is written in its own transaction and
+// committed immediately, so that it is observed by all ReadWriters
+// regardless of their pending writes. Claims of the same trace made
+// concurrently through different ReadWriters are resolved by the
+// database's conflict detection, so that only one succeeds; claims are
+// therefore not exclusive if the database was opened with conflict
+// detection disabled. See BadgerConfig.DisableConflictDetection.
+//
+// ClaimTrace returns an error if workerID is empty or lease is not
+// positive. If the storage is configured with WithTraceIDValidation and
+// traceID is invalid, ClaimTrace returns an *InvalidTraceIDError.
+func (rw *ReadWriter) ClaimTrace(traceID, workerID string, lease time.Duration) (bool, error) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	if rw.closed {
+		return false, ErrClosed
+	}
+	if rw.s.readOnly.Load() {
+		return false, ErrReadOnly
+	}
+	if workerID == "" {
+		return false, errors.New("worker ID must not be empty")
+	}
+	if lease <= 0 {
+		return false, errors.New("lease must be positive")
+	}
+	if err := rw.s.checkTraceID(traceID); err != nil {
+		return false, err
+	}
+	key := rw.s.leaseKey(nil, traceID)
+	for {
+		claimed, err := rw.s.claimTrace(key, workerID, lease)
+		if err == badger.ErrConflict {
+			// Another worker claimed or renewed the lease concurrently;
+			// try again, observing its lease.
+			continue
+		}
+		return claimed, err
+	}
+}
+
+// claimTrace writes a lease entry with key for workerID, expiring after
+// lease, unless there is an unexpired lease held by another worker, and
+// reports whether the lease was written.
+func (s *Storage) claimTrace(key []byte, workerID string, lease time.Duration) (bool, error) {
+	var claimed bool
+	err := s.db.Update(func(txn *badger.Txn) error {
+		item, err := txn.Get(key)
+		if err == nil && item.UserMeta() == entryMetaTraceLease {
+			var held bool
+			if err := item.Value(func(holder []byte) error {
+				held = string(holder) != workerID
+				return nil
+			}); err != nil {
+				return err
+			}
+			if held {
+				return nil
+			}
+		} else if err != nil && err != badger.ErrKeyNotFound {
+			return err
+		}
+		claimed = true
+		return txn.SetEntry(badger.NewEntry(key, []byte(workerID)).WithMeta(entryMetaTraceLease).WithTTL(lease))
+	})
+	if err != nil {
+		return false, err
+	}
+	if claimed {
+		s.counters.writes.Add(1)
+	}
+	return claimed, nil
+}
@@ -15,6 +15,10 @@ import (
 type LogpAdaptor struct {
 	*logp.Logger
 
+	// Level holds the minimum level of messages to log. The zero value
+	// is logp.InfoLevel.
+	Level logp.Level
+
 	mu   sync.RWMutex
 	last string
 }
@@ -22,6 +26,9 @@ type LogpAdaptor struct {
 // Errorf prints the log message when the current message isn't the same as the
 // previously logged message.
 func (a *LogpAdaptor) Errorf(format string, args ...interface{}) {
+	if !a.Level.Enabled(logp.ErrorLevel) {
+		return
+	}
 	msg := fmt.Sprintf(format, args...)
 	if a.setLast(msg) {
 		a.Logger.Errorf(format, args...)
@@ -46,5 +53,21 @@ func (a *LogpAdaptor) setLast(msg string) bool {
 
 // Warningf adapts badger.Logger.Warningf to logp.Logger.Warngf.
 func (a *LogpAdaptor) Warningf(format string, args ...interface{}) {
-	a.Warnf(format, args...)
+	if a.Level.Enabled(logp.WarnLevel) {
+		a.Warnf(format, args...)
+	}
+}
+
+// Infof logs the message if the info level is enabled.
+func (a *LogpAdaptor) Infof(format string, args ...interface{}) {
+	if a.Level.Enabled(logp.InfoLevel) {
+		a.Logger.Infof(format, args...)
+	}
+}
+
+// Debugf logs the message if the debug level is enabled.
+func (a *LogpAdaptor) Debugf(format string, args ...interface{}) {
+	if a.Level.Enabled(logp.DebugLevel) {
+		a.Logger.Debugf(format, args...)
+	}
 }
@@ -0,0 +1,40 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package eventstorage_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/apm-server/x-pack/apm-server/sampling/eventstorage"
+	"github.com/elastic/elastic-agent-libs/logp"
+)
+
+func TestLogpAdaptorLevel(t *testing.T) {
+	err := logp.DevelopmentSetup(logp.ToObserverOutput(), logp.WithLevel(logp.DebugLevel))
+	require.NoError(t, err)
+
+	levels := []logp.Level{logp.DebugLevel, logp.InfoLevel, logp.WarnLevel, logp.ErrorLevel}
+	for _, level := range levels {
+		adaptor := &eventstorage.LogpAdaptor{Logger: logp.NewLogger("badger"), Level: level}
+		adaptor.Debugf("debug")
+		adaptor.Infof("info")
+		adaptor.Warningf("warning")
+
+		var logged []logp.Level
+		for _, entry := range logp.ObserverLogs().TakeAll() {
+			logged = append(logged, logp.Level(entry.Level))
+		}
+		var expected []logp.Level
+		for _, l := range levels[:3] {
+			if level.Enabled(l) {
+				expected = append(expected, l)
+			}
+		}
+		assert.Equal(t, expected, logged, level.String())
+	}
+}
@@ -0,0 +1,148 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package eventstorage
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/go-multierror"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/elastic/apm-data/model/modelpb"
+)
+
+// MirrorReadWriter wraps a primary and a secondary ReadWriter, applying
+// writes to both and reading from the primary. This may be used to migrate
+// to a new storage, such as a differently configured database, by
+// dual-writing to it while continuing to serve reads from the existing
+// storage, and comparing their contents with CompareTraceEvents before
+// switching over.
+//
+// Every write is applied twice, so dual writing roughly doubles the CPU
+// cost of encoding events, the number of database writes and flushes, and
+// the disk space used while both storages hold the same events. Writes are
+// applied to the secondary synchronously after the primary, so write
+// latency is also roughly doubled.
+//
+// MirrorReadWriter is safe for concurrent use to the same extent as the
+// wrapped ReadWriters.
+type MirrorReadWriter struct {
+	primary   *ReadWriter
+	secondary *ReadWriter
+}
+
+// NewMirrorReadWriter returns a new MirrorReadWriter which writes to both
+// primary and secondary, and reads from primary.
+func NewMirrorReadWriter(primary, secondary *ReadWriter) *MirrorReadWriter {
+	return &MirrorReadWriter{primary: primary, secondary: secondary}
+}
+
+// mirror applies write to the primary, and then to the secondary if it
+// succeeded, so that the secondary never holds writes that the primary
+// rejected. Errors from the secondary are wrapped to identify them.
+func (m *MirrorReadWriter) mirror(write func(*ReadWriter) error) error {
+	if err := write(m.primary); err != nil {
+		return err
+	}
+	if err := write(m.secondary); err != nil {
+		return fmt.Errorf("secondary storage: %w", err)
+	}
+	return nil
+}
+
+// Close closes both ReadWriters.
+func (m *MirrorReadWriter) Close() {
+	m.primary.Close()
+	m.secondary.Close()
+}
+
+// Flush flushes both ReadWriters, even if flushing the primary fails,
+// returning the errors of both.
+func (m *MirrorReadWriter) Flush() error {
+	var result error
+	if err := m.primary.Flush(); err != nil {
+		result = multierror.Append(result, err)
+	}
+	if err := m.secondary.Flush(); err != nil {
+		result = multierror.Append(result, fmt.Errorf("secondary storage: %w", err))
+	}
+	return result
+}
+
+// WriteTraceEvent calls ReadWriter.WriteTraceEvent on both ReadWriters.
+func (m *MirrorReadWriter) WriteTraceEvent(traceID, id string, event *modelpb.APMEvent, opts WriterOpts) error {
+	return m.mirror(func(rw *ReadWriter) error {
+		return rw.WriteTraceEvent(traceID, id, event, opts)
+	})
+}
+
+// WriteTraceSampled calls ReadWriter.WriteTraceSampled on both ReadWriters.
+func (m *MirrorReadWriter) WriteTraceSampled(traceID string, sampled bool, opts WriterOpts) error {
+	return m.mirror(func(rw *ReadWriter) error {
+		return rw.WriteTraceSampled(traceID, sampled, opts)
+	})
+}
+
+// DeleteTraceEvent calls ReadWriter.DeleteTraceEvent on both ReadWriters.
+func (m *MirrorReadWriter) DeleteTraceEvent(traceID, id string) error {
+	return m.mirror(func(rw *ReadWriter) error {
+		return rw.DeleteTraceEvent(traceID, id)
+	})
+}
+
+// DeleteTraceEvents calls ReadWriter.DeleteTraceEvents on both ReadWriters.
+func (m *MirrorReadWriter) DeleteTraceEvents(traceID string, ids []string) error {
+	return m.mirror(func(rw *ReadWriter) error {
+		return rw.DeleteTraceEvents(traceID, ids)
+	})
+}
+
+// MergeTraceLabels calls ReadWriter.MergeTraceLabels on both ReadWriters.
+func (m *MirrorReadWriter) MergeTraceLabels(traceID string, labels map[string]string, opts WriterOpts) error {
+	return m.mirror(func(rw *ReadWriter) error {
+		return rw.MergeTraceLabels(traceID, labels, opts)
+	})
+}
+
+// IsTraceSampled calls ReadWriter.IsTraceSampled on the primary.
+func (m *MirrorReadWriter) IsTraceSampled(traceID string) (bool, error) {
+	return m.primary.IsTraceSampled(traceID)
+}
+
+// ReadTraceEvents calls ReadWriter.ReadTraceEvents on the primary.
+func (m *MirrorReadWriter) ReadTraceEvents(traceID string, out *modelpb.Batch) error {
+	return m.primary.ReadTraceEvents(traceID, out)
+}
+
+// ReadTraceLabels calls ReadWriter.ReadTraceLabels on the primary.
+func (m *MirrorReadWriter) ReadTraceLabels(traceID string) (map[string]string, error) {
+	return m.primary.ReadTraceLabels(traceID)
+}
+
+// HasTraceEvents calls ReadWriter.HasTraceEvents on the primary.
+func (m *MirrorReadWriter) HasTraceEvents(traceID string) (bool, error) {
+	return m.primary.HasTraceEvents(traceID)
+}
+
+// CompareTraceEvents reads the events of the given trace from both
+// ReadWriters, and reports whether they are equal, in the same order.
+func (m *MirrorReadWriter) CompareTraceEvents(traceID string) (bool, error) {
+	var primary, secondary modelpb.Batch
+	if err := m.primary.ReadTraceEvents(traceID, &primary); err != nil {
+		return false, err
+	}
+	if err := m.secondary.ReadTraceEvents(traceID, &secondary); err != nil {
+		return false, fmt.Errorf("secondary storage: %w", err)
+	}
+	if len(primary) != len(secondary) {
+		return false, nil
+	}
+	for i := range primary {
+		if !proto.Equal(primary[i], secondary[i]) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
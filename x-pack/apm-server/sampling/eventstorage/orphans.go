@@ -0,0 +1,126 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package eventstorage
+
+import (
+	"bytes"
+
+	"github.com/dgraph-io/badger/v2"
+)
+
+// FindOrphanEvents returns the IDs of traces with events in storage but no
+// sampling decision, in key order. This includes traces whose decisions
+// expired before their events, whose events would otherwise remain until
+// they expire, and also traces which are still awaiting a decision.
+// Callers should therefore only treat traces as orphaned if they are found
+// again after longer than it takes to make a decision, as with
+// ExpirySweeper, before deleting them with DeleteOrphanEvents.
+//
+// FindOrphanEvents reads from a snapshot of the database, and does not
+// observe unflushed writes. It scans the keys of the entire database, and
+// additionally looks up the decision of each trace if prefixed decision
+// keys are enabled, so it is not intended for hot paths.
+func (s *Storage) FindOrphanEvents() ([]string, error) {
+	var traceIDs []string
+	if err := s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Prefix = s.keyPrefix
+		iter := txn.NewIterator(opts)
+		defer iter.Close()
+		// Decision keys (trace IDs) sort immediately before the keys of
+		// their events ("<trace ID>:<event ID>"), so we can track the
+		// most recent decided trace ID while iterating. Prefixed decision
+		// keys are instead looked up.
+		var decidedPrefix, lastTraceID []byte
+		lookup := decisionLookup{s: s, txn: txn}
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			item := iter.Item()
+			if item.IsDeletedOrExpired() {
+				continue
+			}
+			key := item.Key()
+			switch meta := item.UserMeta(); {
+			case meta == entryMetaTraceSampled, meta == entryMetaTraceUnsampled:
+				decidedPrefix = append(append(decidedPrefix[:0], key...), keySeparator)
+			case isTraceEventMeta(meta):
+				if decidedPrefix != nil && bytes.HasPrefix(key, decidedPrefix) {
+					continue
+				}
+				traceID, _, ok := s.splitEventKey(key)
+				if !ok || (lastTraceID != nil && bytes.Equal(traceID, lastTraceID)) {
+					continue
+				}
+				lastTraceID = append(lastTraceID[:0], traceID...)
+				if s.prefixedDecisionKeys {
+					meta, err := lookup.decision(traceID)
+					if err != nil {
+						return err
+					}
+					if meta != 0 {
+						continue
+					}
+				}
+				if s.unsampled != nil && s.unsampled.contains(string(traceID)) {
+					continue
+				}
+				traceIDs = append(traceIDs, string(traceID))
+			}
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return traceIDs, nil
+}
+
+// DeleteOrphanEvents deletes the events of the given traces which still
+// have no sampling decision, such as those returned by FindOrphanEvents,
+// and returns the number of events deleted. Traces which have since had
+// a decision recorded are left untouched.
+//
+// Like FindOrphanEvents, DeleteOrphanEvents does not observe unflushed
+// writes, and so must not be given the IDs of traces which may still be
+// decided.
+func (s *Storage) DeleteOrphanEvents(traceIDs []string) (int, error) {
+	wb := s.db.NewWriteBatch()
+	defer wb.Cancel()
+	var n int
+	if err := s.db.View(func(txn *badger.Txn) error {
+		for _, traceID := range traceIDs {
+			if _, err := txn.Get(s.decisionKey(nil, traceID)); err == nil {
+				continue
+			} else if err != badger.ErrKeyNotFound {
+				return err
+			}
+			if s.unsampled != nil && s.unsampled.contains(traceID) {
+				continue
+			}
+			opts := badger.DefaultIteratorOptions
+			opts.PrefetchValues = false
+			opts.Prefix = s.eventKeyPrefix(nil, traceID)
+			iter := txn.NewIterator(opts)
+			for iter.Rewind(); iter.Valid(); iter.Next() {
+				item := iter.Item()
+				if item.IsDeletedOrExpired() || !isTraceEventMeta(item.UserMeta()) {
+					continue
+				}
+				if err := wb.Delete(item.KeyCopy(nil)); err != nil {
+					iter.Close()
+					return err
+				}
+				n++
+			}
+			iter.Close()
+		}
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+	if err := wb.Flush(); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
@@ -0,0 +1,64 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package eventstorage
+
+import (
+	"time"
+
+	"github.com/dgraph-io/badger/v2"
+)
+
+// WriteSamplerState stores state, an opaque serialization of a sampler's
+// in-memory state such as its learned ingest rates, under a reserved key
+// which does not interfere with trace events or sampling decisions, so it
+// may be restored with ReadSamplerState after a restart. Any previously
+// written state is replaced. If ttl is positive, the state expires after
+// ttl, so stale state is not restored after a long outage.
+//
+// Unlike ReadWriter writes, the state is committed immediately, and is not
+// subject to storage limits. WriteSamplerState is safe for concurrent use,
+// and returns ErrReadOnly if the storage is read-only.
+func (s *Storage) WriteSamplerState(state []byte, ttl time.Duration) error {
+	if s.readOnly.Load() {
+		return ErrReadOnly
+	}
+	e := badger.NewEntry(s.samplerStateKey(), state).WithMeta(entryMetaSamplerState)
+	if ttl > 0 {
+		e = e.WithTTL(ttl)
+	}
+	return s.db.Update(func(txn *badger.Txn) error {
+		return txn.SetEntry(e)
+	})
+}
+
+// ReadSamplerState returns the state most recently stored with
+// WriteSamplerState, or ErrNotFound if there is none, or it has expired.
+// ReadSamplerState is safe for concurrent use.
+func (s *Storage) ReadSamplerState() ([]byte, error) {
+	var state []byte
+	err := s.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(s.samplerStateKey())
+		if err != nil {
+			if err == badger.ErrKeyNotFound {
+				return ErrNotFound
+			}
+			return err
+		}
+		if item.IsDeletedOrExpired() || item.UserMeta() != entryMetaSamplerState {
+			return ErrNotFound
+		}
+		state, err = item.ValueCopy(nil)
+		return err
+	})
+	return state, err
+}
+
+func (s *Storage) samplerStateKey() []byte {
+	return append(append([]byte(nil), s.keyPrefix...), samplerStateKey...)
+}
+
+func (s *Storage) reencodeCursorKey() []byte {
+	return append(append([]byte(nil), s.keyPrefix...), reencodeCursorKey...)
+}
@@ -5,8 +5,10 @@
 package eventstorage
 
 import (
+	"fmt"
 	"runtime"
 	"sync"
+	"time"
 
 	"github.com/cespare/xxhash/v2"
 	"github.com/hashicorp/go-multierror"
@@ -17,16 +19,62 @@ import (
 // ShardedReadWriter provides sharded, locked, access to a Storage.
 //
 // ShardedReadWriter shards on trace ID.
+//
+// All shards share the storage's keyspace: a trace's keys do not depend on
+// its shard, and shards differ only in their uncommitted writes. The number
+// of shards may therefore be changed while in use with Reshard, which need
+// only drain the existing shards.
 type ShardedReadWriter struct {
+	storage *Storage
+	hash    func(traceID string) uint64
+
+	// mu guards readWriters: it is held for reading by operations on the
+	// shards, and for writing while they are replaced by Reshard.
+	mu          sync.RWMutex
 	readWriters []lockedReadWriter
 }
 
-func newShardedReadWriter(storage *Storage) *ShardedReadWriter {
+// ShardedReadWriterOption configures a ShardedReadWriter.
+type ShardedReadWriterOption func(*ShardedReadWriter)
+
+// WithShardHash sets the function used to hash trace IDs for choosing
+// their shard. The default is xxhash, which distributes arbitrary IDs
+// evenly; a custom hash may distribute IDs with a known format better,
+// such as those with low entropy in some positions. WithShardHash panics
+// if hash is nil.
+func WithShardHash(hash func(traceID string) uint64) ShardedReadWriterOption {
+	if hash == nil {
+		panic("hash must not be nil")
+	}
+	return func(s *ShardedReadWriter) {
+		s.hash = hash
+	}
+}
+
+// WithShardCount sets the initial number of shards. The default is
+// GOMAXPROCS, which considers cgroup quotas, so as to minimise lock
+// contention, and scale up accordingly with more CPU. The number of shards
+// may be changed later with ShardedReadWriter.Reshard. WithShardCount
+// panics if n is not positive.
+func WithShardCount(n int) ShardedReadWriterOption {
+	if n <= 0 {
+		panic("n must be positive")
+	}
+	return func(s *ShardedReadWriter) {
+		s.readWriters = make([]lockedReadWriter, n)
+	}
+}
+
+func newShardedReadWriter(storage *Storage, opts ...ShardedReadWriterOption) *ShardedReadWriter {
 	s := &ShardedReadWriter{
-		// Create as many ReadWriters as there are GOMAXPROCS, which considers
-		// cgroup quotas, so we can ideally minimise lock contention, and scale
-		// up accordingly with more CPU.
-		readWriters: make([]lockedReadWriter, runtime.GOMAXPROCS(0)),
+		storage: storage,
+		hash:    xxhash.Sum64String,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.readWriters == nil {
+		s.readWriters = make([]lockedReadWriter, runtime.GOMAXPROCS(0))
 	}
 	for i := range s.readWriters {
 		s.readWriters[i].rw = storage.NewReadWriter()
@@ -34,8 +82,47 @@ func newShardedReadWriter(storage *Storage) *ShardedReadWriter {
 	return s
 }
 
+// ShardCount returns the number of shards.
+func (s *ShardedReadWriter) ShardCount() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.readWriters)
+}
+
+// Reshard changes the number of shards to n, which must be positive, while
+// the ShardedReadWriter is in use.
+//
+// As trace keys do not depend on shards, no stored data needs to be moved;
+// instead, a trace's uncommitted writes in its old shard must be committed
+// before any operation on the trace in its new shard, or they could
+// conflict, or be missed by reads. Reshard therefore blocks operations on
+// all shards while it flushes and closes the existing shards, and then
+// replaces them with n new shards. If flushing fails, the existing shards
+// are left in place, with any writes which were not committed, and an
+// error is returned.
+func (s *ShardedReadWriter) Reshard(n int) error {
+	if n <= 0 {
+		return fmt.Errorf("shard count %d must be positive", n)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.flush(); err != nil {
+		return fmt.Errorf("failed to drain shards: %w", err)
+	}
+	for i := range s.readWriters {
+		s.readWriters[i].Close()
+	}
+	s.readWriters = make([]lockedReadWriter, n)
+	for i := range s.readWriters {
+		s.readWriters[i].rw = s.storage.NewReadWriter()
+	}
+	return nil
+}
+
 // Close closes all sharded storage readWriters.
 func (s *ShardedReadWriter) Close() {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	for i := range s.readWriters {
 		s.readWriters[i].Close()
 	}
@@ -43,6 +130,12 @@ func (s *ShardedReadWriter) Close() {
 
 // Flush flushes all sharded storage readWriters.
 func (s *ShardedReadWriter) Flush() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.flush()
+}
+
+func (s *ShardedReadWriter) flush() error {
 	var result error
 	for i := range s.readWriters {
 		if err := s.readWriters[i].Flush(); err != nil {
@@ -54,38 +147,225 @@ func (s *ShardedReadWriter) Flush() error {
 
 // ReadTraceEvents calls Writer.ReadTraceEvents, using a sharded, locked, Writer.
 func (s *ShardedReadWriter) ReadTraceEvents(traceID string, out *modelpb.Batch) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	return s.getWriter(traceID).ReadTraceEvents(traceID, out)
 }
 
+// ReadTraceEventsByType calls Writer.ReadTraceEventsByType, using a sharded, locked, Writer.
+func (s *ShardedReadWriter) ReadTraceEventsByType(traceID string) (map[string]modelpb.Batch, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.getWriter(traceID).ReadTraceEventsByType(traceID)
+}
+
+// ReadTraceEventsSorted calls Writer.ReadTraceEventsSorted, using a sharded, locked, Writer.
+func (s *ShardedReadWriter) ReadTraceEventsSorted(traceID string, less func(a, b *modelpb.APMEvent) bool, out *modelpb.Batch) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.getWriter(traceID).ReadTraceEventsSorted(traceID, less, out)
+}
+
+// ReadTraceEventRaw calls Writer.ReadTraceEventRaw, using a sharded, locked, Writer.
+func (s *ShardedReadWriter) ReadTraceEventRaw(traceID, id string) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.getWriter(traceID).ReadTraceEventRaw(traceID, id)
+}
+
+// ReadEventByID calls Writer.ReadEventByID on each sharded, locked, Writer
+// in turn, as the shard of the event's trace is not known, returning the
+// first event found. If no Writer finds the event, ReadEventByID returns
+// ErrNotFound.
+func (s *ShardedReadWriter) ReadEventByID(id string) (*modelpb.APMEvent, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for i := range s.readWriters {
+		event, err := s.readWriters[i].ReadEventByID(id)
+		if err != ErrNotFound {
+			return event, err
+		}
+	}
+	return nil, ErrNotFound
+}
+
 // WriteTraceEvent calls Writer.WriteTraceEvent, using a sharded, locked, Writer.
 func (s *ShardedReadWriter) WriteTraceEvent(traceID, id string, event *modelpb.APMEvent, opts WriterOpts) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	return s.getWriter(traceID).WriteTraceEvent(traceID, id, event, opts)
 }
 
+// WriteTraceEventFlags calls Writer.WriteTraceEventFlags, using a sharded, locked, Writer.
+func (s *ShardedReadWriter) WriteTraceEventFlags(traceID, id string, event *modelpb.APMEvent, flags uint8, opts WriterOpts) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.getWriter(traceID).WriteTraceEventFlags(traceID, id, event, flags, opts)
+}
+
+// ReadTraceEventFlags calls Writer.ReadTraceEventFlags, using a sharded, locked, Writer.
+func (s *ShardedReadWriter) ReadTraceEventFlags(traceID, id string) (uint8, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.getWriter(traceID).ReadTraceEventFlags(traceID, id)
+}
+
+// WriteTraceEventDelta calls Writer.WriteTraceEventDelta, using a sharded, locked, Writer.
+func (s *ShardedReadWriter) WriteTraceEventDelta(
+	traceID, id string,
+	event *modelpb.APMEvent,
+	baseID string, base *modelpb.APMEvent,
+	opts WriterOpts,
+) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.getWriter(traceID).WriteTraceEventDelta(traceID, id, event, baseID, base, opts)
+}
+
+// NewTraceWriter returns a new TraceWriter for writing the events of the
+// trace with the given ID, using a sharded, locked, Writer.
+func (s *ShardedReadWriter) NewTraceWriter(traceID string, opts WriterOpts) *TraceWriter {
+	return &TraceWriter{w: s, traceID: traceID, opts: opts}
+}
+
 // WriteTraceSampled calls Writer.WriteTraceSampled, using a sharded, locked, Writer.
 func (s *ShardedReadWriter) WriteTraceSampled(traceID string, sampled bool, opts WriterOpts) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	return s.getWriter(traceID).WriteTraceSampled(traceID, sampled, opts)
 }
 
 // IsTraceSampled calls Writer.IsTraceSampled, using a sharded, locked, Writer.
 func (s *ShardedReadWriter) IsTraceSampled(traceID string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	return s.getWriter(traceID).IsTraceSampled(traceID)
 }
 
+// HasTraceEvents calls Writer.HasTraceEvents, using a sharded, locked, Writer.
+func (s *ShardedReadWriter) HasTraceEvents(traceID string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.getWriter(traceID).HasTraceEvents(traceID)
+}
+
+// VerifyTraceTTL calls ReadWriter.VerifyTraceTTL, using a sharded, locked, ReadWriter.
+func (s *ShardedReadWriter) VerifyTraceTTL(traceID string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.getWriter(traceID).VerifyTraceTTL(traceID)
+}
+
 // DeleteTraceEvent calls Writer.DeleteTraceEvent, using a sharded, locked, Writer.
 func (s *ShardedReadWriter) DeleteTraceEvent(traceID, id string) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	return s.getWriter(traceID).DeleteTraceEvent(traceID, id)
 }
 
-// getWriter returns an event storage writer for the given trace ID.
+// DeleteTraceEvents calls Writer.DeleteTraceEvents, using a sharded, locked, Writer.
+func (s *ShardedReadWriter) DeleteTraceEvents(traceID string, ids []string) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.getWriter(traceID).DeleteTraceEvents(traceID, ids)
+}
+
+// MergeTraceLabels calls Writer.MergeTraceLabels, using a sharded, locked, Writer.
+func (s *ShardedReadWriter) MergeTraceLabels(traceID string, labels map[string]string, opts WriterOpts) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.getWriter(traceID).MergeTraceLabels(traceID, labels, opts)
+}
+
+// ReadTraceLabels calls Writer.ReadTraceLabels, using a sharded, locked, Writer.
+func (s *ShardedReadWriter) ReadTraceLabels(traceID string) (map[string]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.getWriter(traceID).ReadTraceLabels(traceID)
+}
+
+// ReadTraceEventSummary calls Writer.ReadTraceEventSummary, using a sharded, locked, Writer.
+func (s *ShardedReadWriter) ReadTraceEventSummary(traceID string) (TraceEventSummary, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.getWriter(traceID).ReadTraceEventSummary(traceID)
+}
+
+// ClaimTrace calls Writer.ClaimTrace, using a sharded, locked, Writer.
+func (s *ShardedReadWriter) ClaimTrace(traceID, workerID string, lease time.Duration) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.getWriter(traceID).ClaimTrace(traceID, workerID, lease)
+}
+
+// FinalizeTrace calls Writer.FinalizeTrace, using a sharded, locked, Writer.
+func (s *ShardedReadWriter) FinalizeTrace(traceID string, sampled bool, indexFn func(modelpb.Batch) error, opts WriterOpts) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.getWriter(traceID).FinalizeTrace(traceID, sampled, indexFn, opts)
+}
+
+// NewExpirySweeper calls Storage.NewExpirySweeper for the underlying Storage.
+func (s *ShardedReadWriter) NewExpirySweeper(onTraceExpired func(traceID string)) *ExpirySweeper {
+	return s.storage.NewExpirySweeper(onTraceExpired)
+}
+
+// RebuildDecisionFilter calls Storage.RebuildDecisionFilter for the
+// underlying Storage.
+func (s *ShardedReadWriter) RebuildDecisionFilter() error {
+	return s.storage.RebuildDecisionFilter()
+}
+
+// WriteSamplerState calls Storage.WriteSamplerState for the underlying
+// Storage.
+func (s *ShardedReadWriter) WriteSamplerState(state []byte, ttl time.Duration) error {
+	return s.storage.WriteSamplerState(state, ttl)
+}
+
+// ReadSamplerState calls Storage.ReadSamplerState for the underlying
+// Storage.
+func (s *ShardedReadWriter) ReadSamplerState() ([]byte, error) {
+	return s.storage.ReadSamplerState()
+}
+
+// UtilizationRatio calls Storage.UtilizationRatio for the underlying Storage.
+func (s *ShardedReadWriter) UtilizationRatio() float64 {
+	return s.storage.UtilizationRatio()
+}
+
+// TenantUsage calls Storage.TenantUsage for the underlying Storage.
+func (s *ShardedReadWriter) TenantUsage() map[string]int64 {
+	return s.storage.TenantUsage()
+}
+
+// PauseGC calls Storage.PauseGC for the underlying Storage.
+func (s *ShardedReadWriter) PauseGC() {
+	s.storage.PauseGC()
+}
+
+// ResumeGC calls Storage.ResumeGC for the underlying Storage.
+func (s *ShardedReadWriter) ResumeGC() {
+	s.storage.ResumeGC()
+}
+
+// SkipGC calls Storage.SkipGC for the underlying Storage.
+func (s *ShardedReadWriter) SkipGC() bool {
+	return s.storage.SkipGC()
+}
+
+// GCCatchUp calls Storage.GCCatchUp for the underlying Storage.
+func (s *ShardedReadWriter) GCCatchUp() <-chan struct{} {
+	return s.storage.GCCatchUp()
+}
+
+// getWriter returns an event storage writer for the given trace ID. The
+// caller must hold s.mu for reading while using the writer.
 //
 // This method is idempotent, which is necessary to avoid transaction
 // conflicts and ensure all events are reported once a sampling decision
 // has been recorded.
 func (s *ShardedReadWriter) getWriter(traceID string) *lockedReadWriter {
-	var h xxhash.Digest
-	h.WriteString(traceID)
-	return &s.readWriters[h.Sum64()%uint64(len(s.readWriters))]
+	return &s.readWriters[s.hash(traceID)%uint64(len(s.readWriters))]
 }
 
 type lockedReadWriter struct {
@@ -111,12 +391,59 @@ func (rw *lockedReadWriter) ReadTraceEvents(traceID string, out *modelpb.Batch)
 	return rw.rw.ReadTraceEvents(traceID, out)
 }
 
+func (rw *lockedReadWriter) ReadTraceEventsByType(traceID string) (map[string]modelpb.Batch, error) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	return rw.rw.ReadTraceEventsByType(traceID)
+}
+
+func (rw *lockedReadWriter) ReadTraceEventsSorted(traceID string, less func(a, b *modelpb.APMEvent) bool, out *modelpb.Batch) error {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	return rw.rw.ReadTraceEventsSorted(traceID, less, out)
+}
+
+func (rw *lockedReadWriter) ReadTraceEventRaw(traceID, id string) ([]byte, error) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	return rw.rw.ReadTraceEventRaw(traceID, id)
+}
+
+func (rw *lockedReadWriter) ReadEventByID(id string) (*modelpb.APMEvent, error) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	return rw.rw.ReadEventByID(id)
+}
+
 func (rw *lockedReadWriter) WriteTraceEvent(traceID, id string, event *modelpb.APMEvent, opts WriterOpts) error {
 	rw.mu.Lock()
 	defer rw.mu.Unlock()
 	return rw.rw.WriteTraceEvent(traceID, id, event, opts)
 }
 
+func (rw *lockedReadWriter) WriteTraceEventFlags(traceID, id string, event *modelpb.APMEvent, flags uint8, opts WriterOpts) error {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	return rw.rw.WriteTraceEventFlags(traceID, id, event, flags, opts)
+}
+
+func (rw *lockedReadWriter) ReadTraceEventFlags(traceID, id string) (uint8, error) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	return rw.rw.ReadTraceEventFlags(traceID, id)
+}
+
+func (rw *lockedReadWriter) WriteTraceEventDelta(
+	traceID, id string,
+	event *modelpb.APMEvent,
+	baseID string, base *modelpb.APMEvent,
+	opts WriterOpts,
+) error {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	return rw.rw.WriteTraceEventDelta(traceID, id, event, baseID, base, opts)
+}
+
 func (rw *lockedReadWriter) WriteTraceSampled(traceID string, sampled bool, opts WriterOpts) error {
 	rw.mu.Lock()
 	defer rw.mu.Unlock()
@@ -129,8 +456,56 @@ func (rw *lockedReadWriter) IsTraceSampled(traceID string) (bool, error) {
 	return rw.rw.IsTraceSampled(traceID)
 }
 
+func (rw *lockedReadWriter) HasTraceEvents(traceID string) (bool, error) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	return rw.rw.HasTraceEvents(traceID)
+}
+
+func (rw *lockedReadWriter) VerifyTraceTTL(traceID string) (bool, error) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	return rw.rw.VerifyTraceTTL(traceID)
+}
+
 func (rw *lockedReadWriter) DeleteTraceEvent(traceID, id string) error {
 	rw.mu.Lock()
 	defer rw.mu.Unlock()
 	return rw.rw.DeleteTraceEvent(traceID, id)
 }
+
+func (rw *lockedReadWriter) DeleteTraceEvents(traceID string, ids []string) error {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	return rw.rw.DeleteTraceEvents(traceID, ids)
+}
+
+func (rw *lockedReadWriter) MergeTraceLabels(traceID string, labels map[string]string, opts WriterOpts) error {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	return rw.rw.MergeTraceLabels(traceID, labels, opts)
+}
+
+func (rw *lockedReadWriter) ReadTraceLabels(traceID string) (map[string]string, error) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	return rw.rw.ReadTraceLabels(traceID)
+}
+
+func (rw *lockedReadWriter) ReadTraceEventSummary(traceID string) (TraceEventSummary, error) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	return rw.rw.ReadTraceEventSummary(traceID)
+}
+
+func (rw *lockedReadWriter) ClaimTrace(traceID, workerID string, lease time.Duration) (bool, error) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	return rw.rw.ClaimTrace(traceID, workerID, lease)
+}
+
+func (rw *lockedReadWriter) FinalizeTrace(traceID string, sampled bool, indexFn func(modelpb.Batch) error, opts WriterOpts) error {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	return rw.rw.FinalizeTrace(traceID, sampled, indexFn, opts)
+}
@@ -0,0 +1,94 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package eventstorage
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// sizeUpdateInterval holds the interval at which badger refreshes
+	// the database size reported by DB.Size.
+	sizeUpdateInterval = time.Minute
+
+	// sizeRateSmoothing holds the weight given to the most recently
+	// observed growth rate when updating the smoothed growth rate.
+	sizeRateSmoothing = 0.5
+)
+
+// sizeEstimator estimates the current size of the database between badger's
+// periodic size updates.
+//
+// badger only refreshes the size reported by DB.Size every minute, so checking
+// a storage limit against it directly allows the database to grow well beyond
+// the limit before the limit is observed, and then to oscillate around it. To
+// react faster, sizeEstimator tracks the growth rate between size updates as
+// an exponentially weighted moving average, and extrapolates the size linearly
+// from the most recent update using that rate.
+//
+// The estimate is a heuristic: it assumes writes continue at a rate similar to
+// recent minutes. A shrinking database (e.g. after garbage collection) is not
+// extrapolated, so the estimate is never less than the reported size, and
+// extrapolation is capped at sizeUpdateInterval, after which the reported size
+// is expected to have been refreshed.
+type sizeEstimator struct {
+	// reported and reportedAt hold the most recently observed reported
+	// size, and the time in Unix nanoseconds at which it was first observed.
+	reported   atomic.Int64
+	reportedAt atomic.Int64
+	// rate holds the smoothed growth rate, in bytes per second, as float64
+	// bits.
+	rate atomic.Uint64
+
+	mu sync.Mutex
+}
+
+// estimate returns the estimated size of the database at now, given the
+// size currently reported by badger. estimate is cheap in the common case
+// that the reported size has not changed since the previous call.
+func (e *sizeEstimator) estimate(reported int64, now time.Time) int64 {
+	if reported != e.reported.Load() || e.reportedAt.Load() == 0 {
+		e.update(reported, now)
+	}
+	rate := math.Float64frombits(e.rate.Load())
+	if rate <= 0 {
+		return reported
+	}
+	elapsed := now.Sub(time.Unix(0, e.reportedAt.Load()))
+	if elapsed <= 0 {
+		return reported
+	}
+	if elapsed > sizeUpdateInterval {
+		elapsed = sizeUpdateInterval
+	}
+	return reported + int64(rate*elapsed.Seconds())
+}
+
+func (e *sizeEstimator) update(reported int64, now time.Time) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	prevAt := e.reportedAt.Load()
+	prev := e.reported.Load()
+	if reported == prev && prevAt != 0 {
+		// Another goroutine updated the estimator first.
+		return
+	}
+	if prevAt != 0 {
+		if elapsed := now.Sub(time.Unix(0, prevAt)).Seconds(); elapsed > 0 {
+			observed := float64(reported-prev) / elapsed
+			if observed < 0 {
+				observed = 0
+			}
+			rate := math.Float64frombits(e.rate.Load())
+			rate = sizeRateSmoothing*observed + (1-sizeRateSmoothing)*rate
+			e.rate.Store(math.Float64bits(rate))
+		}
+	}
+	e.reported.Store(reported)
+	e.reportedAt.Store(now.UnixNano())
+}
@@ -0,0 +1,101 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package eventstorage
+
+import (
+	"time"
+
+	"github.com/dgraph-io/badger/v2"
+)
+
+// StorageSnapshot holds entry counts and sizes of a Storage at a point in
+// time, as returned by Storage.Snapshot.
+type StorageSnapshot struct {
+	// Time holds the time at which the snapshot was taken.
+	Time time.Time
+
+	// Events holds the number of unexpired trace events.
+	Events int64
+
+	// EventBytes holds the estimated size in bytes of the unexpired
+	// trace events' keys and values.
+	EventBytes int64
+
+	// SampledDecisions holds the number of unexpired sampled trace
+	// decisions.
+	SampledDecisions int64
+
+	// UnsampledDecisions holds the number of unexpired unsampled trace
+	// decisions recorded in the database. Unsampled decisions recorded
+	// in memory with WithCompactUnsampled are not counted.
+	UnsampledDecisions int64
+
+	// LSMSize and VLogSize hold the sizes in bytes of the database's
+	// LSM tree and value log, as last computed by badger.
+	LSMSize  int64
+	VLogSize int64
+}
+
+// StorageDiff holds the changes between two StorageSnapshots, as returned
+// by Diff. Each field holds the value in the later snapshot minus the value
+// in the earlier one.
+type StorageDiff struct {
+	Elapsed            time.Duration
+	Events             int64
+	EventBytes         int64
+	SampledDecisions   int64
+	UnsampledDecisions int64
+	LSMSize            int64
+	VLogSize           int64
+}
+
+// Snapshot returns the current entry counts and sizes of the storage.
+// Successive snapshots may be compared with Diff, for example to detect
+// entries accumulating faster than they expire.
+//
+// Snapshot reads from a snapshot of the database, and does not observe
+// unflushed writes. Like IterateAll, Snapshot scans the entire database,
+// and is not intended for hot paths.
+func (s *Storage) Snapshot() StorageSnapshot {
+	snapshot := StorageSnapshot{Time: time.Now()}
+	snapshot.LSMSize, snapshot.VLogSize = s.db.Size()
+
+	txn := s.db.NewTransaction(false)
+	defer txn.Discard()
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false // only sizes are needed
+	opts.Prefix = s.keyPrefix
+	iter := txn.NewIterator(opts)
+	defer iter.Close()
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		item := iter.Item()
+		if item.IsDeletedOrExpired() {
+			continue
+		}
+		switch meta := item.UserMeta(); {
+		case meta == entryMetaTraceSampled:
+			snapshot.SampledDecisions++
+		case meta == entryMetaTraceUnsampled:
+			snapshot.UnsampledDecisions++
+		case isTraceEventMeta(meta):
+			snapshot.Events++
+			snapshot.EventBytes += item.EstimatedSize()
+		}
+	}
+	return snapshot
+}
+
+// Diff returns the changes from snapshot a to snapshot b.
+func Diff(a, b StorageSnapshot) StorageDiff {
+	return StorageDiff{
+		Elapsed:            b.Time.Sub(a.Time),
+		Events:             b.Events - a.Events,
+		EventBytes:         b.EventBytes - a.EventBytes,
+		SampledDecisions:   b.SampledDecisions - a.SampledDecisions,
+		UnsampledDecisions: b.UnsampledDecisions - a.UnsampledDecisions,
+		LSMSize:            b.LSMSize - a.LSMSize,
+		VLogSize:           b.VLogSize - a.VLogSize,
+	}
+}
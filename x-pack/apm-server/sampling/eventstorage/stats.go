@@ -0,0 +1,236 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package eventstorage
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/dgraph-io/badger/v2"
+)
+
+// StorageStats holds the current size and cumulative operation counts of
+// a Storage, as returned by Storage.Stats.
+type StorageStats struct {
+	// Size holds the estimated size in bytes of the database, as used
+	// for enforcing WriterOpts.StorageLimitInBytes. See sizeEstimator.
+	Size int64
+
+	// PendingSize holds the estimated size in bytes of the writes of all
+	// ReadWriters which have not yet been flushed.
+	PendingSize int64
+
+	// Writes holds the number of entries written, including sampling
+	// decisions and trace summaries.
+	Writes int64
+
+	// Reads holds the number of calls to IsTraceSampled, HasTraceEvents,
+	// ReadTraceEvents, and ReadTraceEventRaw, including those made
+	// internally.
+	Reads int64
+
+	// Flushes holds the number of ReadWriter flushes, including those
+	// made automatically and those which failed.
+	Flushes int64
+
+	// LimitReached holds the number of writes rejected with
+	// ErrLimitReached.
+	LimitReached int64
+
+	// FlushSizes holds a histogram of the number of writes committed by
+	// each successful flush, for tuning the number of writes after which
+	// ReadWriters flush.
+	FlushSizes FlushSizeHistogram
+
+	// DecisionLatency holds a histogram of the time from the first write
+	// of a trace's events to the trace being finalized, for traces with
+	// a summary. See DecisionLatencyPercentile.
+	DecisionLatency DecisionLatencyHistogram
+
+	// TenantUsage holds the estimated storage used by each tenant, in
+	// bytes, if WithTenantKey is specified. See Storage.TenantUsage.
+	TenantUsage map[string]int64
+}
+
+// flushSizeBounds holds the inclusive upper bounds of the buckets of
+// FlushSizeHistogram, around the default of flushing after 200 writes
+// and up to maxFlushWrites under compaction pressure. Larger flushes are
+// counted only in the histogram's total.
+var flushSizeBounds = [...]int64{0, 10, 50, 100, 200, 400, 800, 1600}
+
+// FlushSizeHistogram holds a histogram of flush sizes, in writes.
+type FlushSizeHistogram struct {
+	// Buckets maps the inclusive upper bound of each bucket to the
+	// number of flushes of at most that many writes. Counts are
+	// cumulative, as with Prometheus histograms.
+	Buckets map[int64]int64
+
+	// Count holds the total number of flushes observed.
+	Count int64
+
+	// Sum holds the total number of writes committed by the flushes.
+	Sum int64
+}
+
+// flushSizeHistogram records the sizes of flushes in buckets bounded by
+// flushSizeBounds. The final bucket counts flushes larger than all bounds.
+type flushSizeHistogram struct {
+	counts [len(flushSizeBounds) + 1]atomic.Int64
+	sum    atomic.Int64
+}
+
+// observe records a flush of n writes.
+func (h *flushSizeHistogram) observe(n int64) {
+	i := 0
+	for i < len(flushSizeBounds) && n > flushSizeBounds[i] {
+		i++
+	}
+	h.counts[i].Add(1)
+	h.sum.Add(n)
+}
+
+// snapshot returns the histogram's current counts.
+func (h *flushSizeHistogram) snapshot() FlushSizeHistogram {
+	out := FlushSizeHistogram{
+		Buckets: make(map[int64]int64, len(flushSizeBounds)),
+		Sum:     h.sum.Load(),
+	}
+	for i := range h.counts {
+		out.Count += h.counts[i].Load()
+		if i < len(flushSizeBounds) {
+			out.Buckets[flushSizeBounds[i]] = out.Count
+		}
+	}
+	return out
+}
+
+// storageCounters holds the cumulative operation counts of a Storage.
+type storageCounters struct {
+	writes       atomic.Int64
+	reads        atomic.Int64
+	flushes      atomic.Int64
+	limitReached atomic.Int64
+	flushSizes   flushSizeHistogram
+
+	decisionLatency decisionLatencyHistogram
+}
+
+// WithStorageLimit records the configured storage limit in bytes, for
+// reporting by UtilizationRatio. A limit <= 0 means the storage is unlimited.
+//
+// The limit is not enforced: WriterOpts.StorageLimitInBytes must still be
+// specified for writes, and may be lower than the configured limit to
+// allow for delays in badger's size reporting.
+func WithStorageLimit(limit int64) StorageOption {
+	return func(s *Storage) {
+		s.storageLimit = limit
+	}
+}
+
+// UtilizationRatio returns the estimated size of the storage, as reported
+// by Stats, divided by the limit set with WithStorageLimit. The ratio may
+// exceed 1 if the storage has grown beyond its limit, such as before
+// deleted entries are garbage collected. While a limit raised with
+// WithTemporaryLimit is in effect, the ratio is relative to the raised
+// limit. If the storage is unlimited, UtilizationRatio returns 0.
+func (s *Storage) UtilizationRatio() float64 {
+	now := time.Now()
+	limit := s.effectiveLimit(s.storageLimit, now)
+	if limit <= 0 {
+		return 0
+	}
+	lsm, vlog := s.db.Size()
+	size := s.size.estimate(lsm+vlog, now)
+	return max(0, float64(size)/float64(limit))
+}
+
+// TotalEventCount returns the number of unexpired trace events in storage,
+// including delta-encoded events, for all traces. Pending writes which have
+// not been flushed are not counted.
+//
+// TotalEventCount scans only the keys of the storage, without reading or
+// decoding events, and so is much cheaper than reading the events. However,
+// it is O(n) in the number of keys in the storage, and is intended for
+// periodic gauges and capacity planning rather than hot paths.
+func (s *Storage) TotalEventCount() (int, error) {
+	var n int
+	err := s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Prefix = s.keyPrefix
+		iter := txn.NewIterator(opts)
+		defer iter.Close()
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			item := iter.Item()
+			if item.IsDeletedOrExpired() || !isTraceEventMeta(item.UserMeta()) {
+				continue
+			}
+			n++
+		}
+		return nil
+	})
+	return n, err
+}
+
+// AverageEventSize returns the mean size in bytes of the encoded values of
+// up to sample unexpired trace events in storage, including delta-encoded
+// events, for estimating how many more events the storage can hold. If the
+// storage holds no events, AverageEventSize returns zero. An error is
+// returned if sample is not positive.
+//
+// The sampled events are the first in key order, and so are spread across
+// traces in trace ID order; as trace IDs are random, this approximates a
+// random sample, but events of the same trace are sampled together. Only
+// the sizes of the sampled values are read, which badger records with
+// their keys; values are not copied or decoded, and values stored in the
+// value log are not read, so the cost is proportional to sample rather
+// than to the size of the events.
+func (s *Storage) AverageEventSize(sample int) (int, error) {
+	if sample <= 0 {
+		return 0, errors.New("sample must be positive")
+	}
+	var n int
+	var total int64
+	err := s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Prefix = s.keyPrefix
+		iter := txn.NewIterator(opts)
+		defer iter.Close()
+		for iter.Rewind(); iter.Valid() && n < sample; iter.Next() {
+			item := iter.Item()
+			if item.IsDeletedOrExpired() || !isTraceEventMeta(item.UserMeta()) {
+				continue
+			}
+			total += item.ValueSize()
+			n++
+		}
+		return nil
+	})
+	if err != nil || n == 0 {
+		return 0, err
+	}
+	return int(total / int64(n)), nil
+}
+
+// Stats returns the current size and cumulative operation counts of the
+// storage. Stats is cheap, and may be called frequently, such as by a
+// metrics collector.
+func (s *Storage) Stats() StorageStats {
+	lsm, vlog := s.db.Size()
+	return StorageStats{
+		Size:         s.size.estimate(lsm+vlog, time.Now()),
+		PendingSize:  s.pendingSize.Load(),
+		Writes:       s.counters.writes.Load(),
+		Reads:        s.counters.reads.Load(),
+		Flushes:      s.counters.flushes.Load(),
+		LimitReached: s.counters.limitReached.Load(),
+		FlushSizes:   s.counters.flushSizes.snapshot(),
+
+		DecisionLatency: s.counters.decisionLatency.snapshot(),
+		TenantUsage:     s.TenantUsage(),
+	}
+}
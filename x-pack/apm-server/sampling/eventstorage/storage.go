@@ -5,12 +5,17 @@
 package eventstorage
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"sort"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/dgraph-io/badger/v2"
+	"github.com/hashicorp/go-multierror"
 
 	"github.com/elastic/apm-data/model/modelpb"
 )
@@ -18,13 +23,79 @@ import (
 const (
 	// NOTE(axw) these values (and their meanings) must remain stable
 	// over time, to avoid misinterpreting historical data.
-	entryMetaTraceSampled   = 's'
-	entryMetaTraceUnsampled = 'u'
-	entryMetaTraceEvent     = 'e'
+	entryMetaTraceSampled    = 's'
+	entryMetaTraceUnsampled  = 'u'
+	entryMetaTraceEvent      = 'e'
+	entryMetaTraceEventDelta = 'd'
+	entryMetaTraceSummary    = 'l'
+
+	// entryMetaTraceEventSummary is the meta of trace event summaries.
+	// See WithTraceEventSummaries.
+	entryMetaTraceEventSummary = 'c'
+
+	// entryMetaEventIDIndex is the meta of event ID index entries.
+	// See WithEventIDIndex.
+	entryMetaEventIDIndex = 'i'
+
+	// entryMetaSamplerState is the meta of the sampler state entry.
+	// See Storage.WriteSamplerState.
+	entryMetaSamplerState = 'm'
+
+	// entryMetaTraceLease is the meta of trace lease entries. See
+	// ReadWriter.ClaimTrace.
+	entryMetaTraceLease = 'k'
+
+	// entryMetaTraceTenant is the meta of trace tenant entries. See
+	// WithTenantKey.
+	entryMetaTraceTenant = 't'
+
+	// entryMetaReencodeCursor is the meta of the entry recording the
+	// progress of an incomplete Storage.Reencode.
+	entryMetaReencodeCursor = 'r'
+
+	// entryMetaTraceEventFlagged is set in the meta of full trace events
+	// written with user flags, which are held in the bits of
+	// TraceEventFlagsMask. The meta values above are all ASCII, leaving
+	// the high bit free. See ReadWriter.WriteTraceEventFlags.
+	entryMetaTraceEventFlagged = 0x80
+
+	// traceSummaryKeySuffix is appended to a trace ID to form the key of
+	// the trace's summary entry. The summary key must not share the prefix
+	// used for trace events ("<trace ID>:") so it is not visited when
+	// reading trace events.
+	traceSummaryKeySuffix = "/summary"
+
+	// traceEventSummaryKeySuffix is appended to a trace ID to form the key
+	// of the trace's event summary entry, like traceSummaryKeySuffix.
+	traceEventSummaryKeySuffix = "/events"
+
+	// traceLeaseKeySuffix is appended to a trace ID to form the key of the
+	// trace's lease entry, like traceSummaryKeySuffix.
+	traceLeaseKeySuffix = "/lease"
+
+	// traceTenantKeySuffix is appended to a trace ID to form the key of the
+	// trace's tenant entry, like traceSummaryKeySuffix.
+	traceTenantKeySuffix = "/tenant"
 
 	// Initial transaction size
 	// len(txnKey) + 10
 	baseTransactionSize = 10 + 11
+
+	// flushWrites holds the number of uncommitted writes after which a
+	// ReadWriter will flush, absent compaction pressure.
+	//
+	// The 200 value yielded a good balance between read and write speed:
+	// https://github.com/elastic/apm-server/pull/8407#issuecomment-1162994643
+	flushWrites = 200
+
+	// maxFlushWrites holds the maximum number of uncommitted writes after
+	// which a ReadWriter will flush, when backing off due to compaction
+	// pressure.
+	maxFlushWrites = flushWrites << 3
+
+	// compactionPressureCheckInterval holds the minimum interval between
+	// checks of compaction pressure when adaptive flushing is enabled.
+	compactionPressureCheckInterval = time.Second
 )
 
 var (
@@ -35,6 +106,29 @@ var (
 	// ErrLimitReached is returned by the ReadWriter.Flush method when
 	// the configured StorageLimiter.Limit is true.
 	ErrLimitReached = errors.New("configured storage limit reached")
+
+	// ErrReadOnly is returned by ReadWriter write methods when the
+	// Storage has been put into read-only mode with Storage.SetReadOnly.
+	ErrReadOnly = errors.New("storage is read-only")
+
+	// ErrDecodeFailed is returned by ReadWriter.ReadTraceEvents when the
+	// codec fails or panics while decoding a stored event, e.g. due to
+	// corruption.
+	ErrDecodeFailed = errors.New("failed to decode event")
+
+	// ErrTraceUnsampled is returned by ReadWriter.WriteTraceEvent when
+	// WriterOpts.DropUnsampled is true, and the trace has been recorded
+	// as unsampled. The event is not written.
+	ErrTraceUnsampled = errors.New("trace is unsampled")
+
+	// ErrClosed is returned by ReadWriter methods called after the
+	// ReadWriter has been closed.
+	ErrClosed = errors.New("read-writer is closed")
+
+	// ErrEventTooLarge is returned by ReadWriter.WriteTraceEvent when the
+	// encoded event exceeds the size configured with WithMaxEventSize. The
+	// event is not written.
+	ErrEventTooLarge = errors.New("event exceeds maximum size")
 )
 
 // Storage provides storage for sampled transactions and spans,
@@ -44,6 +138,118 @@ type Storage struct {
 	// pendingSize tracks the total size of pending writes across ReadWriters
 	pendingSize *atomic.Int64
 	codec       Codec
+	readOnly    atomic.Bool
+
+	// adaptiveFlush records whether ReadWriters should back off flushing
+	// under compaction pressure. See WithAdaptiveFlush.
+	adaptiveFlush bool
+	// flushWrites holds the current number of uncommitted writes after
+	// which ReadWriters will flush.
+	flushWrites atomic.Int64
+	// nextCompactionPressureCheck holds the time, in Unix nanoseconds,
+	// after which flushWrites should be recalculated.
+	nextCompactionPressureCheck atomic.Int64
+	// maxTransactionSize holds the estimated size in bytes of pending
+	// writes after which ReadWriters will flush, to avoid exceeding the
+	// database's maximum transaction size. See WithMaxTransactionSize.
+	maxTransactionSize int64
+	// unsampled, if non-nil, records unsampled trace decisions in place
+	// of database entries. See WithCompactUnsampled.
+	unsampled *unsampledFilter
+	// decisions, if non-nil, caches committed sampling decisions read by
+	// ReadWriter.IsTraceSampled. See WithDecisionCache.
+	decisions *decisionCache
+	// evictionCredit holds the estimated number of bytes freed by eviction
+	// and not yet used by writes. See LimitStrategy.
+	evictionCredit atomic.Int64
+	// evictionCursor holds the event key prefix of the trace from which
+	// the next eviction scan starts, or nil to start from the first trace.
+	evictionCursor atomic.Pointer[[]byte]
+	// size estimates the database size between badger's size updates.
+	size sizeEstimator
+	// ttl holds the TTL with which sampling decisions are written, for
+	// deriving their write time. See WithTTL.
+	ttl time.Duration
+	// coalesceWrites records whether ReadWriters should account for
+	// repeated writes of a key within a transaction as a single write.
+	// See WithCoalesceWrites.
+	coalesceWrites bool
+	// envUsage tracks the storage used by each service environment with
+	// a limit. See WriterOpts.EnvironmentStorageLimits.
+	envUsage envUsage
+	// tenantKey, if non-nil, derives the tenant of each trace event, whose
+	// storage is tracked by tenantUsage. See WithTenantKey.
+	tenantKey   *TenantKey
+	tenantUsage envUsage
+	// keyPrefix holds the prefix of all keys written and read by the
+	// storage, derived from its namespace. See WithNamespace.
+	keyPrefix []byte
+	// limitHook, if non-nil, is called when a write would exceed the
+	// storage limit. See WithLimitHook.
+	limitHook func() (int64, error)
+	// counters holds cumulative operation counts. See Stats.
+	counters storageCounters
+	// warmCacheKeys holds the maximum number of keys scanned by
+	// WarmCache. See WithWarmCacheKeys.
+	warmCacheKeys int
+	// chronologicalKeys records whether trace event keys are written with
+	// the event's timestamp. See WithChronologicalKeys.
+	chronologicalKeys bool
+	// storageLimit holds the configured storage limit in bytes, or zero
+	// if unlimited. See WithStorageLimit.
+	storageLimit int64
+	// temporaryLimit, if non-nil, holds a storage limit which overrides
+	// lower limits until it ends. See WithTemporaryLimit.
+	temporaryLimit atomic.Pointer[temporaryLimit]
+	// prefixedDecisionKeys records whether sampling decision keys are
+	// prefixed to distinguish them from other keys. See
+	// WithPrefixedDecisionKeys.
+	prefixedDecisionKeys bool
+	// gc holds the state of PauseGC and ResumeGC.
+	gc gcPause
+	// freeDisk, if non-nil, checks the filesystem's free space before
+	// ReadWriters write trace events. See WithMinFreeDisk.
+	freeDisk *freeDiskChecker
+	// traceEventSummaries records whether ReadWriters maintain a summary
+	// of each trace's events. See WithTraceEventSummaries.
+	traceEventSummaries bool
+	// validateTraceIDs records whether writes for invalid trace IDs are
+	// rejected. See WithTraceIDValidation.
+	validateTraceIDs bool
+	// maxEventSize holds the maximum encoded size of a trace event in
+	// bytes, or zero if unlimited. See WithMaxEventSize.
+	maxEventSize int64
+	// nodeID holds the ID of the node writing to the storage, included
+	// in trace event keys, or empty if none. See WithNodeID.
+	nodeID string
+	// maxFlushInterval holds the maximum time between a ReadWriter's
+	// flushes after which a write causes a flush, or zero if unlimited.
+	// See WithMaxFlushInterval.
+	maxFlushInterval time.Duration
+	// eventIDIndex records whether ReadWriters maintain an index from
+	// event IDs to trace IDs. See WithEventIDIndex.
+	eventIDIndex bool
+	// decisionFilter, if non-nil, records the trace IDs with sampling
+	// decisions, to avoid database lookups for those without. See
+	// WithDecisionFilter.
+	decisionFilter *decisionFilter
+}
+
+// StorageOption configures a Storage.
+type StorageOption func(*Storage)
+
+// WithAdaptiveFlush sets whether ReadWriters should adapt how often they
+// flush to the database's compaction pressure. Adaptive flushing is disabled
+// by default, so that ReadWriters flush after a fixed number of writes.
+//
+// When enabled, ReadWriters will flush less often while the number of L0
+// tables is at or above the number which triggers compaction, reducing the
+// number of commits competing with compaction. When disabled, ReadWriters
+// will always flush after a fixed number of uncommitted writes.
+func WithAdaptiveFlush(enabled bool) StorageOption {
+	return func(s *Storage) {
+		s.adaptiveFlush = enabled
+	}
 }
 
 // Codec provides methods for encoding and decoding events.
@@ -52,9 +258,633 @@ type Codec interface {
 	EncodeEvent(*modelpb.APMEvent) ([]byte, error)
 }
 
-// New returns a new Storage using db and codec.
-func New(db *badger.DB, codec Codec) *Storage {
-	return &Storage{db: db, pendingSize: &atomic.Int64{}, codec: codec}
+// WithMaxTransactionSize sets the maximum estimated size in bytes of
+// pending writes in a ReadWriter's transaction, after which the ReadWriter
+// will flush before writing more entries. If size is <= 0, or greater than
+// the database's maximum batch size, the database's maximum batch size is
+// used.
+//
+// Flushing proactively avoids the cost of attempting writes which would be
+// rejected by the database for exceeding the transaction size limit.
+func WithMaxTransactionSize(size int64) StorageOption {
+	return func(s *Storage) {
+		s.maxTransactionSize = size
+	}
+}
+
+// WithCompactUnsampled configures the storage to record unsampled trace
+// decisions compactly in memory, using bloom filters, rather than writing
+// a database entry for each unsampled trace.
+//
+// capacity holds the number of unsampled decisions to record in each
+// bloom filter, and falsePositiveRate holds the desired false positive
+// rate of each filter. Up to two filters are maintained; once a filter
+// has had capacity decisions recorded, a new filter is created, and the
+// decisions in the oldest filter are forgotten.
+//
+// Sampled decisions are always recorded exactly in the database, and take
+// precedence, so a sampled trace is never reported as unsampled. However,
+// with probability up to roughly twice falsePositiveRate, IsTraceSampled
+// may report a trace with no decision as unsampled, causing its events to
+// be dropped. Forgotten unsampled decisions, including all of them after
+// a restart, will be reported as not found. WithCompactUnsampled panics if
+// capacity is not positive, or falsePositiveRate is not in the range (0,1).
+func WithCompactUnsampled(capacity int, falsePositiveRate float64) StorageOption {
+	if capacity <= 0 {
+		panic("capacity must be positive")
+	}
+	if falsePositiveRate <= 0 || falsePositiveRate >= 1 {
+		panic("falsePositiveRate must be in the range (0,1)")
+	}
+	return func(s *Storage) {
+		s.unsampled = newUnsampledFilter(capacity, falsePositiveRate)
+	}
+}
+
+// WithTTL records the TTL with which sampling decisions are written to the
+// storage, so that their write time can be derived from their expiry time.
+// This is required by DeleteDecisionsOlderThan.
+//
+// The TTL is not applied to writes: WriterOpts.TTL must still be specified,
+// and should be the same as ttl for derived write times to be accurate.
+func WithTTL(ttl time.Duration) StorageOption {
+	return func(s *Storage) {
+		s.ttl = ttl
+	}
+}
+
+// WithCoalesceWrites sets whether ReadWriters should coalesce repeated
+// writes of the same key within an uncommitted transaction, such as when
+// an agent resends a span. Coalescing is disabled by default.
+//
+// Badger commits only the last write of a key in a transaction, but each
+// write would otherwise be counted towards the ReadWriter's flush threshold,
+// transaction size, and the storage limit, causing unnecessary flushes and
+// an overestimate of the storage used. When enabled, a write which replaces
+// an uncommitted write is counted only by the difference in their sizes.
+//
+// This requires each ReadWriter to record the keys of its uncommitted
+// writes, costing roughly the key length plus 50 bytes of memory for each
+// uncommitted write; ReadWriters flush after a few hundred writes, or more
+// under compaction pressure with WithAdaptiveFlush.
+func WithCoalesceWrites(enabled bool) StorageOption {
+	return func(s *Storage) {
+		s.coalesceWrites = enabled
+	}
+}
+
+// WithMaxEventSize sets the maximum encoded size in bytes of trace events
+// written by ReadWriters. Larger events, such as spans with pathologically
+// large stack traces, are rejected with ErrEventTooLarge rather than
+// written, so that a single event cannot dominate a transaction or the
+// storage. If size is zero, the size of events is unlimited, which is the
+// default. WithMaxEventSize panics if size is negative.
+func WithMaxEventSize(size int64) StorageOption {
+	if size < 0 {
+		panic("size must not be negative")
+	}
+	return func(s *Storage) {
+		s.maxEventSize = size
+	}
+}
+
+// WithMaxFlushInterval sets the maximum time since a ReadWriter's last
+// flush after which a write causes it to flush, bounding how long writes
+// remain uncommitted when there are too few to reach the flush threshold.
+// By default, the time since the last flush is unlimited.
+//
+// The interval is checked on each write in addition to the count-based
+// flush threshold, and whichever is reached first causes a flush. As with
+// the threshold, the ReadWriter flushes its preceding writes before
+// applying the write which caused the flush, and an idle ReadWriter is not
+// flushed; use ReadWriter.StartAutoFlush to flush without writes.
+// WithMaxFlushInterval panics if interval is not positive.
+func WithMaxFlushInterval(interval time.Duration) StorageOption {
+	if interval <= 0 {
+		panic("interval must be positive")
+	}
+	return func(s *Storage) {
+		s.maxFlushInterval = interval
+	}
+}
+
+// New returns a new Storage using db and codec, configured with opts.
+func New(db *badger.DB, codec Codec, opts ...StorageOption) *Storage {
+	s := &Storage{
+		db:            db,
+		pendingSize:   &atomic.Int64{},
+		codec:         codec,
+		warmCacheKeys: defaultWarmCacheKeys,
+	}
+	s.flushWrites.Store(flushWrites)
+	s.gc.catchUp = make(chan struct{}, 1)
+	for _, opt := range opts {
+		opt(s)
+	}
+	if max := db.MaxBatchSize(); s.maxTransactionSize <= 0 || s.maxTransactionSize > max {
+		s.maxTransactionSize = max
+	}
+	return s
+}
+
+// flushThreshold returns the number of uncommitted writes after which
+// ReadWriters should flush.
+func (s *Storage) flushThreshold() int {
+	if !s.adaptiveFlush {
+		return flushWrites
+	}
+	now := time.Now().UnixNano()
+	next := s.nextCompactionPressureCheck.Load()
+	if now >= next && s.nextCompactionPressureCheck.CompareAndSwap(next, now+int64(compactionPressureCheckInterval)) {
+		s.flushWrites.Store(int64(adaptiveFlushWrites(s.levelZeroTables())))
+	}
+	return int(s.flushWrites.Load())
+}
+
+// levelZeroTables returns the number of L0 tables in the database.
+func (s *Storage) levelZeroTables() int {
+	var n int
+	for _, table := range s.db.Tables(false) {
+		if table.Level == 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// adaptiveFlushWrites returns the number of uncommitted writes after which
+// ReadWriters should flush, given the number of L0 tables. The threshold is
+// doubled for each L0 table at or above the compaction trigger, up to
+// maxFlushWrites.
+func adaptiveFlushWrites(levelZeroTables int) int {
+	n := flushWrites
+	for i := tableLimit; i <= levelZeroTables && n < maxFlushWrites; i++ {
+		n *= 2
+	}
+	return n
+}
+
+// SetReadOnly sets whether the storage is in read-only mode.
+//
+// While in read-only mode, writes of trace events, sampling decisions,
+// and trace labels will fail with ErrReadOnly; reads, deletions, and
+// flushing of previously buffered writes are unaffected. This may be
+// used to drain the storage before shutdown.
+func (s *Storage) SetReadOnly(readOnly bool) {
+	s.readOnly.Store(readOnly)
+}
+
+// TTL returns the TTL configured with WithTTL, or zero if unspecified. The
+// write time of an entry written with this TTL may be derived from its
+// expiry time, as ExpiresAt - TTL.
+func (s *Storage) TTL() time.Duration {
+	return s.ttl
+}
+
+// Codec returns the codec with which events are encoded and decoded: the
+// codec passed to New, or the codec most recently set by Reencode.
+func (s *Storage) Codec() Codec {
+	return s.codec
+}
+
+// Reencode rewrites all stored trace events using newCodec, decoding them
+// with the current codec, and then sets newCodec as the storage's codec.
+// Entry TTLs are preserved, and entries other than trace events are left
+// untouched. Reencode returns the number of events rewritten.
+//
+// Events that cannot be decoded with the current codec cannot be rewritten,
+// and are deleted rather than left to be misread by newCodec. Reencode then
+// completes the migration, and returns a *multierror.Error holding an error
+// wrapping ErrDecodeFailed for each deleted event, as ReadTraceEvents does
+// for the events it skips.
+//
+// Reencode must not be called concurrently with other operations on the
+// storage, such as reads or writes through a ReadWriter.
+//
+// Events are rewritten in key order, over as many transactions as needed.
+// Each transaction also records the key of the last event it rewrote, so
+// that an interrupted migration can be resumed; the record is deleted by the
+// final transaction, after which newCodec is set. Until then, the storage
+// holds events encoded with both codecs, and ReencodeInProgress reports
+// true. To recover from a failed or interrupted Reencode, such as after a
+// restart, call Reencode again with the same newCodec on a Storage created
+// with the original codec, before reading or writing events: it rewrites
+// only the events after the recorded key.
+func (s *Storage) Reencode(newCodec Codec) (int, error) {
+	cursorKey := s.reencodeCursorKey()
+	readTxn := s.db.NewTransaction(false)
+	defer readTxn.Discard()
+	var cursor []byte
+	switch item, err := readTxn.Get(cursorKey); err {
+	case nil:
+		if cursor, err = item.ValueCopy(nil); err != nil {
+			return 0, err
+		}
+	case badger.ErrKeyNotFound:
+	default:
+		return 0, err
+	}
+
+	writeTxn := s.db.NewTransaction(true)
+	defer func() { writeTxn.Discard() }()
+	// Transactions are committed before they would become too big for
+	// the event being rewritten and the cursor entry recording it.
+	var txnCount, txnSize int64
+	maxCount, maxSize := s.db.MaxBatchCount(), s.db.MaxBatchSize()
+	commit := func(lastKey []byte) error {
+		e := badger.NewEntry(cursorKey, lastKey).WithMeta(entryMetaReencodeCursor)
+		if err := writeTxn.SetEntry(e); err != nil {
+			return err
+		}
+		if err := writeTxn.Commit(); err != nil {
+			return err
+		}
+		writeTxn = s.db.NewTransaction(true)
+		txnCount, txnSize = 0, 0
+		return nil
+	}
+
+	var n int
+	var lastKey []byte
+	var decodeErr *multierror.Error
+	iterOpts := badger.DefaultIteratorOptions
+	iterOpts.Prefix = s.keyPrefix
+	iter := readTxn.NewIterator(iterOpts)
+	defer iter.Close()
+	for iter.Seek(cursor); iter.Valid(); iter.Next() {
+		item := iter.Item()
+		if item.IsDeletedOrExpired() || !isTraceEventMeta(item.UserMeta()) {
+			continue
+		}
+		if cursor != nil && bytes.Equal(item.Key(), cursor) {
+			// Rewritten before Reencode was interrupted.
+			continue
+		}
+		var data []byte
+		var undecodable bool
+		if err := item.Value(func(value []byte) error {
+			if item.UserMeta() == entryMetaTraceEventDelta {
+				var err error
+				data, err = reencodeDelta(value, s.codec, newCodec)
+				return err
+			}
+			var event modelpb.APMEvent
+			if err := decodeEvent(s.codec, value, &event); err != nil {
+				return err
+			}
+			var err error
+			data, err = newCodec.EncodeEvent(&event)
+			return err
+		}); err != nil {
+			if !errors.Is(err, ErrDecodeFailed) {
+				return n, fmt.Errorf("failed to reencode %q: %w", item.Key(), err)
+			}
+			// The event is deleted, and the deletion recorded by the
+			// cursor like a rewrite.
+			decodeErr = multierror.Append(decodeErr, fmt.Errorf("%w (key: %q)", err, item.Key()))
+			undecodable = true
+		}
+		e := badger.NewEntry(item.KeyCopy(nil), data).WithMeta(item.UserMeta())
+		e.ExpiresAt = item.ExpiresAt()
+		size := estimateSize(e) + estimateSize(badger.NewEntry(cursorKey, e.Key))
+		if txnCount > 0 && (txnCount+2 >= maxCount || txnSize+size >= maxSize) {
+			if err := commit(lastKey); err != nil {
+				return n, err
+			}
+		}
+		if undecodable {
+			if err := writeTxn.Delete(e.Key); err != nil {
+				return n, err
+			}
+		} else {
+			if err := writeTxn.SetEntry(e); err != nil {
+				return n, err
+			}
+			n++
+		}
+		txnCount++
+		txnSize += estimateSize(e)
+		lastKey = e.Key
+	}
+	if err := writeTxn.Delete(cursorKey); err != nil {
+		return n, err
+	}
+	if err := writeTxn.Commit(); err != nil {
+		return n, err
+	}
+	s.codec = newCodec
+	return n, decodeErr.ErrorOrNil()
+}
+
+// ReencodeInProgress reports whether a previous call to Reencode failed or
+// was interrupted before completing, in which case the storage holds events
+// encoded with both the original and new codecs. Reencode must then be
+// called again with the same new codec to complete the migration.
+func (s *Storage) ReencodeInProgress() (bool, error) {
+	err := s.db.View(func(txn *badger.Txn) error {
+		_, err := txn.Get(s.reencodeCursorKey())
+		return err
+	})
+	switch err {
+	case nil:
+		return true, nil
+	case badger.ErrKeyNotFound:
+		return false, nil
+	}
+	return false, err
+}
+
+// RewriteTTL rewrites all stored trace events and sampling decisions to
+// expire newTTL from now, regardless of their current expiry, and returns
+// the number of entries rewritten. This may be used to apply a changed TTL
+// to previously buffered entries, rather than waiting for them to expire
+// with their original TTL. Trace event summaries, trace tenant entries and
+// event ID index entries are rewritten along with the events they describe;
+// other entries, such as trace labels, are left untouched.
+//
+// RewriteTTL does not change the TTL used for subsequent writes, which is
+// specified with WriterOpts.TTL; if WithTTL was specified, it should be
+// recreated with newTTL for DeleteDecisionsOlderThan to derive write times
+// accurately. Like Reencode, RewriteTTL must not be called concurrently
+// with other operations on the storage.
+func (s *Storage) RewriteTTL(newTTL time.Duration) (int, error) {
+	if newTTL <= 0 {
+		return 0, errors.New("TTL must be positive")
+	}
+	if s.readOnly.Load() {
+		return 0, ErrReadOnly
+	}
+	readTxn := s.db.NewTransaction(false)
+	defer readTxn.Discard()
+	writeTxn := s.db.NewTransaction(true)
+	defer func() { writeTxn.Discard() }()
+
+	setEntry := func(e *badger.Entry) error {
+		err := writeTxn.SetEntry(e)
+		if err != badger.ErrTxnTooBig {
+			return err
+		}
+		// Commit what we have so far, and set the entry on a new transaction.
+		if err := writeTxn.Commit(); err != nil {
+			return err
+		}
+		writeTxn = s.db.NewTransaction(true)
+		return writeTxn.SetEntry(e)
+	}
+
+	var n int
+	iterOpts := badger.DefaultIteratorOptions
+	iterOpts.Prefix = s.keyPrefix
+	iter := readTxn.NewIterator(iterOpts)
+	defer iter.Close()
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		item := iter.Item()
+		if item.IsDeletedOrExpired() {
+			continue
+		}
+		switch meta := item.UserMeta(); {
+		case meta == entryMetaTraceSampled, meta == entryMetaTraceUnsampled, isTraceEventMeta(meta),
+			meta == entryMetaTraceEventSummary, meta == entryMetaEventIDIndex, meta == entryMetaTraceTenant:
+		default:
+			continue
+		}
+		data, err := item.ValueCopy(nil)
+		if err != nil {
+			return n, err
+		}
+		e := badger.NewEntry(item.KeyCopy(nil), data).WithMeta(item.UserMeta()).WithTTL(newTTL)
+		if err := setEntry(e); err != nil {
+			return n, err
+		}
+		n++
+	}
+	if err := writeTxn.Commit(); err != nil {
+		return n, err
+	}
+	return n, nil
+}
+
+// IterateAll calls fn for each trace event in storage, in key order,
+// with the event's trace ID and event ID, and the decoded event. Entries
+// other than trace events, such as sampling decisions, are skipped.
+//
+// If fn returns an error, iteration stops and IterateAll returns the
+// error. IterateAll reads from a snapshot of the database taken when it
+// is called, and does not observe unflushed writes.
+//
+// IterateAll scans the entire database, and is intended for diagnostics
+// and offline analysis only; it must not be used on hot paths.
+func (s *Storage) IterateAll(fn func(traceID, id string, event *modelpb.APMEvent) error) error {
+	return s.db.View(func(txn *badger.Txn) error {
+		decoder := traceEventDecoder{s: s, txn: txn}
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = s.keyPrefix
+		iter := txn.NewIterator(opts)
+		defer iter.Close()
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			item := iter.Item()
+			if item.IsDeletedOrExpired() || !isTraceEventMeta(item.UserMeta()) {
+				continue
+			}
+			key := item.Key()
+			traceIDBytes, id, ok := s.splitEventKey(key)
+			if !ok {
+				// Not a valid event key: ignore.
+				continue
+			}
+			traceID := string(traceIDBytes)
+			var event modelpb.APMEvent
+			if err := decoder.decode(traceID, item, &event); err != nil {
+				return fmt.Errorf("failed to decode %q: %w", key, err)
+			}
+			if err := fn(traceID, string(id), &event); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// CodecFormatStats returns the number of stored trace events with each
+// codec format marker, for confirming that a migration between codecs,
+// such as with Reencode, has completed.
+//
+// CodecFormatStats assumes that codecs prefix their encoded events with a
+// single byte identifying their format, and tallies the first byte of each
+// encoded event; for delta-encoded events, this is the first byte of the
+// codec-encoded residual. Codecs without a format marker, such as
+// ProtobufCodec, will produce meaningless stats. Events with an empty
+// encoding are not counted.
+//
+// Like IterateAll, CodecFormatStats scans the entire database, and is not
+// intended for hot paths.
+func (s *Storage) CodecFormatStats() (map[byte]int, error) {
+	stats := make(map[byte]int)
+	err := s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = s.keyPrefix
+		iter := txn.NewIterator(opts)
+		defer iter.Close()
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			item := iter.Item()
+			if item.IsDeletedOrExpired() {
+				continue
+			}
+			meta := item.UserMeta()
+			if !isTraceEventMeta(meta) {
+				continue
+			}
+			if err := item.Value(func(data []byte) error {
+				if meta == entryMetaTraceEventDelta {
+					h, err := decodeDeltaHeader(data)
+					if err != nil {
+						return fmt.Errorf("failed to decode %q: %w", item.Key(), err)
+					}
+					data = h.residual
+				}
+				if len(data) > 0 {
+					stats[data[0]]++
+				}
+				return nil
+			}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// ExportDecisions calls fn for each trace sampling decision in storage,
+// with the trace ID, whether the trace was sampled, and the time remaining
+// until the decision expires. If the decision does not expire, ttlRemaining
+// will be zero. Entries other than sampling decisions are skipped, as are
+// unsampled decisions recorded in memory with WithCompactUnsampled.
+//
+// If fn returns an error, iteration stops and ExportDecisions returns the
+// error. Like IterateAll, ExportDecisions scans the entire database, and is
+// not intended for hot paths.
+func (s *Storage) ExportDecisions(fn func(traceID string, sampled bool, ttlRemaining time.Duration) error) error {
+	return s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false // decisions have no values
+		opts.Prefix = s.decisionKeysPrefix()
+		iter := txn.NewIterator(opts)
+		defer iter.Close()
+		now := time.Now()
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			item := iter.Item()
+			if item.IsDeletedOrExpired() {
+				continue
+			}
+			var sampled bool
+			switch item.UserMeta() {
+			case entryMetaTraceSampled:
+				sampled = true
+			case entryMetaTraceUnsampled:
+			default:
+				continue
+			}
+			var ttlRemaining time.Duration
+			if expiresAt := item.ExpiresAt(); expiresAt != 0 {
+				ttlRemaining = time.Unix(int64(expiresAt), 0).Sub(now)
+				if ttlRemaining <= 0 {
+					continue
+				}
+			}
+			if err := fn(string(s.decisionTraceID(item.Key())), sampled, ttlRemaining); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// DeleteDecisionsOlderThan deletes all trace sampling decisions written
+// before cutoff, regardless of their TTL, and returns the number deleted.
+//
+// Decisions do not record their write time, so it is derived by subtracting
+// the TTL configured with WithTTL from their expiry time; if no TTL has been
+// configured, DeleteDecisionsOlderThan returns an error. Expiry times have a
+// granularity of one second, so decisions written up to one second after
+// cutoff may also be deleted. Decisions that do not expire are never
+// deleted, as their write time cannot be derived, and nor are unsampled
+// decisions recorded in memory with WithCompactUnsampled.
+//
+// Like ExportDecisions, DeleteDecisionsOlderThan scans the entire database,
+// and is not intended for hot paths.
+func (s *Storage) DeleteDecisionsOlderThan(cutoff time.Time) (int, error) {
+	if s.readOnly.Load() {
+		return 0, ErrReadOnly
+	}
+	if s.ttl <= 0 {
+		return 0, errors.New("cannot derive decision write times: TTL unspecified")
+	}
+	var keys [][]byte
+	if err := s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false // decisions have no values
+		opts.Prefix = s.decisionKeysPrefix()
+		iter := txn.NewIterator(opts)
+		defer iter.Close()
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			item := iter.Item()
+			if item.IsDeletedOrExpired() {
+				continue
+			}
+			switch item.UserMeta() {
+			case entryMetaTraceSampled, entryMetaTraceUnsampled:
+			default:
+				continue
+			}
+			expiresAt := item.ExpiresAt()
+			if expiresAt == 0 {
+				continue
+			}
+			if written := time.Unix(int64(expiresAt), 0).Add(-s.ttl); written.Before(cutoff) {
+				keys = append(keys, item.KeyCopy(nil))
+			}
+		}
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+	wb := s.db.NewWriteBatch()
+	defer wb.Cancel()
+	for _, key := range keys {
+		if err := wb.Delete(key); err != nil {
+			return 0, err
+		}
+	}
+	if err := wb.Flush(); err != nil {
+		return 0, err
+	}
+	if s.decisions != nil {
+		s.decisions.purge()
+	}
+	return len(keys), nil
+}
+
+// EncodedSize returns the estimated number of bytes that event will consume
+// in storage when written with ReadWriter.WriteTraceEvent: the size of the
+// event encoded with the storage's codec, plus the overhead of its key and
+// entry metadata. The key is derived from the event's trace ID, and its
+// transaction or span ID. This is the same estimate used for enforcing
+// WriterOpts.StorageLimitInBytes.
+func (s *Storage) EncodedSize(event *modelpb.APMEvent) (int, error) {
+	data, err := s.codec.EncodeEvent(event)
+	if err != nil {
+		return 0, err
+	}
+	id := event.GetTransaction().GetId()
+	if id == "" {
+		id = event.GetSpan().GetId()
+	}
+	key := s.newEventKey(nil, event.GetTrace().GetId(), id, event)
+	return int(estimateSize(badger.NewEntry(key, data))), nil
 }
 
 // NewShardedReadWriter returns a new ShardedReadWriter, for sharded
@@ -62,8 +892,8 @@ func New(db *badger.DB, codec Codec) *Storage {
 //
 // The returned ShardedReadWriter must be closed when it is no longer
 // needed.
-func (s *Storage) NewShardedReadWriter() *ShardedReadWriter {
-	return newShardedReadWriter(s)
+func (s *Storage) NewShardedReadWriter(opts ...ShardedReadWriterOption) *ShardedReadWriter {
+	return newShardedReadWriter(s, opts...)
 }
 
 // NewReadWriter returns a new ReadWriter for reading events from and
@@ -72,29 +902,88 @@ func (s *Storage) NewShardedReadWriter() *ShardedReadWriter {
 // The returned ReadWriter must be closed when it is no longer needed.
 func (s *Storage) NewReadWriter() *ReadWriter {
 	s.pendingSize.Add(baseTransactionSize)
-	return &ReadWriter{
+	rw := &ReadWriter{
 		s:           s,
 		txn:         s.db.NewTransaction(true),
 		pendingSize: baseTransactionSize,
+		lastFlush:   time.Now(),
+	}
+	if s.coalesceWrites {
+		rw.pendingKeys = make(map[string]int64)
 	}
+	if s.decisions != nil {
+		rw.pendingDecisions = make(map[string]bool)
+	}
+	return rw
 }
 
 // WriterOpts provides configuration options for writes to storage
 type WriterOpts struct {
 	TTL                 time.Duration
 	StorageLimitInBytes int64
+
+	// DropUnsampled, if true, causes WriteTraceEvent to check for a
+	// sampling decision before writing, and to drop events of traces
+	// that have been recorded as unsampled. This costs a read per write.
+	DropUnsampled bool
+
+	// OnLimit holds the strategy for handling writes which would exceed
+	// StorageLimitInBytes. The default is FailFlush.
+	OnLimit LimitStrategy
+
+	// EnvironmentStorageLimits optionally holds storage limits in bytes
+	// for trace events, by service environment. Writes of trace events
+	// which would exceed their environment's limit return an error
+	// wrapping ErrEnvLimitReached. Environments without a limit are
+	// limited only by StorageLimitInBytes.
+	//
+	// The storage used by an environment is estimated as the size of its
+	// trace events written within the last TTL, regardless of whether
+	// they have since been deleted.
+	EnvironmentStorageLimits map[string]int64
+
+	// SlidingTTL, if true, causes WriteTraceEvent to refresh the TTL of
+	// the trace's sampling decision, if any, so that it expires TTL after
+	// the most recent event of the trace rather than after it was written.
+	// This costs a read, and possibly a write, per event written.
+	SlidingTTL bool
+
+	// SlidingTTLEvents, if true, causes WriteTraceEvent to also refresh
+	// the TTL of all previously written events of the trace, so that they
+	// expire together with the most recent event. This costs a read and a
+	// write for each event of the trace per event written, and so grows
+	// quadratically with the number of events in a trace.
+	SlidingTTLEvents bool
+
+	// OnDecisionConflict holds the policy for handling sampling decisions
+	// written for traces which already have a decision recorded. The
+	// default is Overwrite. Policies other than Overwrite cost a read per
+	// decision written, except for sampled decisions with PreferSampled.
+	OnDecisionConflict DecisionConflict
 }
 
 // ReadWriter provides a means of reading events from storage, and batched
 // writing of events to storage.
 //
-// ReadWriter is not safe for concurrent access. All operations that involve
-// a given trace ID should be performed with the same ReadWriter in order to
-// avoid conflicts, e.g. by using consistent hashing to distribute to one of
-// a set of ReadWriters, such as implemented by ShardedReadWriter.
+// ReadWriter is intended for use by a single goroutine. All operations that
+// involve a given trace ID should be performed with the same ReadWriter in
+// order to avoid conflicts, e.g. by using consistent hashing to distribute to
+// one of a set of ReadWriters, such as implemented by ShardedReadWriter.
+//
+// Each method holds an internal lock for its duration, so that methods do not
+// interleave with automatic flushes started with StartAutoFlush. The lock is
+// not intended for sharing a ReadWriter between goroutines: concurrent writes
+// of the same trace would still conflict, and TraceWriters are not safe for
+// concurrent use.
 type ReadWriter struct {
-	s   *Storage
+	s *Storage
+
+	// mu guards the fields below, and the use of txn.
+	mu  sync.Mutex
 	txn *badger.Txn
+	// closed records whether Close has been called, after which txn
+	// has been discarded and must not be used.
+	closed bool
 
 	// readKeyBuf is a reusable buffer for keys used in read operations.
 	// This must not be used in write operations, as keys are expected to
@@ -103,14 +992,39 @@ type ReadWriter struct {
 	pendingWrites int
 	// pendingSize tracks the size of pending writes in the current ReadWriter
 	pendingSize int64
+	// pendingKeys holds the estimated size of each pending write, by key,
+	// for coalescing repeated writes. This is nil unless WithCoalesceWrites
+	// is enabled.
+	pendingKeys map[string]int64
+	// pendingDecisions holds the sampling decisions written in the current
+	// transaction, by trace ID, which are added to the storage's decision
+	// cache once committed. This is nil unless WithDecisionCache is enabled.
+	pendingDecisions map[string]bool
+	// lastFlush holds the time of the last flush, or of the ReadWriter's
+	// creation if it has not flushed. See WithMaxFlushInterval.
+	lastFlush time.Time
+
+	// autoFlushStop and autoFlushDone are non-nil while automatic
+	// flushing is running, and are only accessed by the goroutine using
+	// the ReadWriter. autoFlushErr holds the most recent automatic flush
+	// error not yet returned by Flush. See StartAutoFlush.
+	autoFlushStop chan struct{}
+	autoFlushDone chan struct{}
+	autoFlushErr  error
 }
 
-// Close closes the writer. Any writes that have not been flushed may be lost.
+// Close closes the writer. Any writes that have not been flushed may be lost,
+// including those made since the last automatic flush if StartAutoFlush has
+// been called; Close stops automatic flushing, but does not flush.
 //
 // This must be called when the writer is no longer needed, in order to reclaim
-// resources.
+// resources. After Close, the writer's other methods return ErrClosed.
 func (rw *ReadWriter) Close() {
+	rw.stopAutoFlush()
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
 	rw.txn.Discard()
+	rw.closed = true
 }
 
 // Flush waits for preceding writes to be committed to storage.
@@ -118,14 +1032,44 @@ func (rw *ReadWriter) Close() {
 // Flush must be called to ensure writes are committed to storage.
 // If Flush is not called before the writer is closed, then writes
 // may be lost.
+//
+// If StartAutoFlush has been called, and an automatic flush has failed
+// since the last call to Flush, Flush returns that error if it succeeds.
 func (rw *ReadWriter) Flush() error {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	if rw.closed {
+		return ErrClosed
+	}
+	err := rw.flush()
+	if err == nil {
+		err, rw.autoFlushErr = rw.autoFlushErr, nil
+	}
+	return err
+}
+
+func (rw *ReadWriter) flush() error {
 	const flushErrFmt = "failed to flush pending writes: %w"
+	rw.s.counters.flushes.Add(1)
 	err := rw.txn.Commit()
+	if err == nil {
+		rw.s.counters.flushSizes.observe(int64(rw.pendingWrites))
+	}
+	for traceID, sampled := range rw.pendingDecisions {
+		if err == nil {
+			rw.s.decisions.add(traceID, sampled, nil)
+		} else {
+			rw.s.decisions.remove(traceID)
+		}
+	}
+	clear(rw.pendingDecisions)
 	rw.txn = rw.s.db.NewTransaction(true)
 	rw.s.pendingSize.Add(-rw.pendingSize)
 	rw.pendingWrites = 0
 	rw.pendingSize = baseTransactionSize
 	rw.s.pendingSize.Add(baseTransactionSize)
+	rw.lastFlush = time.Now()
+	clear(rw.pendingKeys)
 	if err != nil {
 		return fmt.Errorf(flushErrFmt, err)
 	}
@@ -133,73 +1077,407 @@ func (rw *ReadWriter) Flush() error {
 }
 
 // WriteTraceSampled records the tail-sampling decision for the given trace ID.
+//
+// If a decision has already been recorded for the trace, it is kept or
+// replaced according to opts.OnDecisionConflict.
+//
+// If the storage is configured with WithCompactUnsampled, unsampled decisions
+// are recorded immediately in memory, rather than written to the database.
+// If it is configured with WithTraceIDValidation and traceID is invalid,
+// WriteTraceSampled returns an *InvalidTraceIDError. If it is configured
+// with WithTraceEventSummaries, the first decision recorded for a trace
+// observes its decision latency.
 func (rw *ReadWriter) WriteTraceSampled(traceID string, sampled bool, opts WriterOpts) error {
-	key := []byte(traceID)
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	if rw.closed {
+		return ErrClosed
+	}
+	if rw.s.readOnly.Load() {
+		return ErrReadOnly
+	}
+	if err := rw.s.checkTraceID(traceID); err != nil {
+		return err
+	}
+	keep, err := opts.OnDecisionConflict.keepExisting(sampled, func() (bool, error) {
+		return rw.isTraceSampled(traceID)
+	})
+	if err != nil || keep {
+		return err
+	}
+	// Decision latency is observed only for the first decision recorded
+	// for a trace, as decisions may be received more than once.
+	var decided bool
+	if rw.s.traceEventSummaries {
+		switch _, err := rw.isTraceSampled(traceID); err {
+		case nil:
+			decided = true
+		case ErrNotFound:
+		default:
+			return err
+		}
+	}
+	if rw.s.decisions != nil {
+		rw.s.decisions.remove(traceID)
+	}
+	if !sampled && rw.s.unsampled != nil {
+		rw.s.unsampled.add(traceID)
+		if !decided {
+			rw.observeDecisionLatency(traceID)
+		}
+		return nil
+	}
+	if rw.s.decisionFilter != nil {
+		rw.s.decisionFilter.add(traceID)
+	}
+	key := rw.s.decisionKey(nil, traceID)
 	var meta uint8 = entryMetaTraceUnsampled
 	if sampled {
 		meta = entryMetaTraceSampled
 	}
-	return rw.writeEntry(badger.NewEntry(key[:], nil).WithMeta(meta), opts)
+	if err := rw.writeEntry(badger.NewEntry(key[:], nil).WithMeta(meta), opts); err != nil {
+		return err
+	}
+	if rw.pendingDecisions != nil {
+		rw.pendingDecisions[traceID] = sampled
+	}
+	if !decided {
+		rw.observeDecisionLatency(traceID)
+	}
+	return nil
+}
+
+// observeDecisionLatency observes the time since the first event of traceID
+// was written, as recorded in its summary. Nothing is observed if summaries
+// are disabled, or if the trace has no readable summary.
+func (rw *ReadWriter) observeDecisionLatency(traceID string) {
+	if !rw.s.traceEventSummaries {
+		return
+	}
+	summary, err := rw.readTraceEventSummary(traceID)
+	if err != nil || summary.FirstWritten.IsZero() {
+		return
+	}
+	rw.s.counters.decisionLatency.observe(time.Since(summary.FirstWritten))
 }
 
 // IsTraceSampled reports whether traceID belongs to a trace that is sampled
 // or unsampled. If no sampling decision has been recorded, IsTraceSampled
 // returns ErrNotFound.
+//
+// If the storage is configured with WithCompactUnsampled, IsTraceSampled may
+// report traces without a recorded decision as unsampled; see its docs. If
+// the storage is configured with WithDecisionCache, decisions are read
+// through its cache. If the storage is configured with WithDecisionFilter,
+// traces which definitely have no decision are reported as not found
+// without reading the database.
 func (rw *ReadWriter) IsTraceSampled(traceID string) (bool, error) {
-	rw.readKeyBuf = append(rw.readKeyBuf[:0], traceID...)
-	item, err := rw.txn.Get(rw.readKeyBuf)
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	if rw.closed {
+		return false, ErrClosed
+	}
+	if rw.s.decisions == nil {
+		return rw.isTraceSampled(traceID)
+	}
+	if sampled, pending := rw.pendingDecisions[traceID]; pending {
+		// The ReadWriter's own pending decision takes precedence over
+		// the cache, which may hold a stale result read by another
+		// ReadWriter or IsTraceSampledConcurrent before it is flushed.
+		// Pending decisions are not cached, as they may yet be
+		// discarded, such as by Close without Flush.
+		return sampled, nil
+	}
+	if sampled, ok, err := rw.s.decisions.get(traceID); ok {
+		return sampled, err
+	}
+	sampled, err := rw.isTraceSampled(traceID)
+	rw.s.decisions.add(traceID, sampled, err)
+	return sampled, err
+}
+
+func (rw *ReadWriter) isTraceSampled(traceID string) (bool, error) {
+	var sampled bool
+	var err error
+	sampled, rw.readKeyBuf, err = rw.s.readTraceSampled(rw.txn, rw.readKeyBuf[:0], traceID)
+	return sampled, err
+}
+
+// readTraceSampled reads the sampling decision of traceID in txn, using
+// keyBuf to build the decision key, and returns keyBuf for reuse.
+func (s *Storage) readTraceSampled(txn *badger.Txn, keyBuf []byte, traceID string) (bool, []byte, error) {
+	s.counters.reads.Add(1)
+	var item *badger.Item
+	err := badger.ErrKeyNotFound
+	if s.decisionFilter == nil || s.decisionFilter.mayContain(traceID) {
+		keyBuf = s.decisionKey(keyBuf, traceID)
+		item, err = txn.Get(keyBuf)
+	}
 	if err != nil {
 		if err == badger.ErrKeyNotFound {
-			return false, ErrNotFound
+			if s.unsampled != nil && s.unsampled.contains(traceID) {
+				return false, keyBuf, nil
+			}
+			return false, keyBuf, ErrNotFound
 		}
-		return false, err
+		return false, keyBuf, err
 	}
-	return item.UserMeta() == entryMetaTraceSampled, nil
+	return item.UserMeta() == entryMetaTraceSampled, keyBuf, nil
+}
+
+// IsTraceSampledConcurrent reports whether traceID belongs to a trace that
+// is sampled or unsampled, as with ReadWriter.IsTraceSampled, but may be
+// called from any goroutine without a ReadWriter. If no sampling decision
+// has been recorded, IsTraceSampledConcurrent returns ErrNotFound.
+//
+// Each call reads the decision in its own read-only transaction, so only
+// decisions which have been committed are observed: unlike a ReadWriter,
+// which observes its own pending writes, IsTraceSampledConcurrent does not
+// observe decisions written by any ReadWriter until they are flushed. The
+// decision cache configured with WithDecisionCache, and the filter
+// configured with WithDecisionFilter, are used as with IsTraceSampled.
+//
+// Creating and discarding a transaction roughly doubles the cost of each
+// lookup compared with a ReadWriter, adding a few hundred nanoseconds and
+// two allocations; see BenchmarkIsTraceSampledConcurrent. In exchange,
+// lookups never wait on a ReadWriter's lock, which may be held during
+// writes and flushes. Callers making many lookups from a single goroutine
+// should prefer a ReadWriter.
+func (s *Storage) IsTraceSampledConcurrent(traceID string) (bool, error) {
+	if s.decisions != nil {
+		if sampled, ok, err := s.decisions.get(traceID); ok {
+			return sampled, err
+		}
+	}
+	txn := s.db.NewTransaction(false)
+	defer txn.Discard()
+	sampled, _, err := s.readTraceSampled(txn, nil, traceID)
+	if s.decisions != nil {
+		s.decisions.add(traceID, sampled, err)
+	}
+	return sampled, err
 }
 
 // WriteTraceEvent writes a trace event to storage.
 //
 // WriteTraceEvent may return before the write is committed to storage.
 // Call Flush to ensure the write is committed.
+//
+// If opts.DropUnsampled is true and the trace has been recorded as
+// unsampled, WriteTraceEvent returns ErrTraceUnsampled. If the storage is
+// configured with WithTraceIDValidation and traceID is invalid,
+// WriteTraceEvent returns an *InvalidTraceIDError. If the encoded event is
+// larger than configured with WithMaxEventSize, WriteTraceEvent returns an
+// error wrapping ErrEventTooLarge.
 func (rw *ReadWriter) WriteTraceEvent(traceID string, id string, event *modelpb.APMEvent, opts WriterOpts) error {
-	key := append(append([]byte(traceID), ':'), id...)
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	if rw.closed {
+		return ErrClosed
+	}
+	return rw.writeTraceEvent(traceID, rw.s.newEventKey(nil, traceID, id, event), event, entryMetaTraceEvent, opts)
+}
+
+// writeTraceEvent writes event in full with the given key, which must be
+// the key of an event of traceID, and meta, which must be the meta of a
+// full trace event. The key must not be modified afterwards.
+func (rw *ReadWriter) writeTraceEvent(traceID string, key []byte, event *modelpb.APMEvent, meta byte, opts WriterOpts) error {
+	if err := rw.prepareTraceEventWrite(traceID, opts); err != nil {
+		return err
+	}
 	data, err := rw.s.codec.EncodeEvent(event)
 	if err != nil {
 		return err
 	}
-	return rw.writeEntry(badger.NewEntry(key[:], data).WithMeta(entryMetaTraceEvent), opts)
+	return rw.writeTraceEventEntry(traceID, badger.NewEntry(key, data).WithMeta(meta), event, opts)
+}
+
+// writeTraceEventEntry writes e, holding the encoding of event, after
+// checking the maximum event size and the storage limit of event's service
+// environment, if any, and recording the usage of event's tenant, if
+// tracked, and then updates the summary of traceID's events and refreshes
+// the trace's TTL if requested by opts.
+func (rw *ReadWriter) writeTraceEventEntry(traceID string, e *badger.Entry, event *modelpb.APMEvent, opts WriterOpts) error {
+	if rw.s.maxEventSize > 0 && int64(len(e.Value)) > rw.s.maxEventSize {
+		return fmt.Errorf("%w (size: %d, maximum: %d)", ErrEventTooLarge, len(e.Value), rw.s.maxEventSize)
+	}
+	now := time.Now()
+	var env string
+	var envReserved bool
+	if len(opts.EnvironmentStorageLimits) > 0 {
+		var err error
+		env = event.GetService().GetEnvironment()
+		if envReserved, err = rw.reserveEnvironmentStorage(env, estimateSize(e), opts, now); err != nil {
+			return err
+		}
+	}
+	tenant, tenantReserved, err := rw.reserveTenantUsage(traceID, event, estimateSize(e), opts, now)
+	if err == nil {
+		err = rw.writeEntry(e, opts)
+	}
+	if err != nil {
+		if envReserved {
+			rw.s.envUsage.release(env, estimateSize(e), now)
+		}
+		if tenantReserved {
+			rw.s.tenantUsage.release(tenant, estimateSize(e), now)
+		}
+		return err
+	}
+	if err := rw.updateEventIDIndex(traceID, e.Key, opts); err != nil {
+		return err
+	}
+	if err := rw.updateTraceEventSummary(traceID, event, opts); err != nil {
+		return err
+	}
+	if opts.SlidingTTL || opts.SlidingTTLEvents {
+		return rw.refreshTraceTTL(traceID, e.Key, opts)
+	}
+	return nil
+}
+
+// prepareTraceEventWrite performs the checks common to all writes of trace
+// events.
+func (rw *ReadWriter) prepareTraceEventWrite(traceID string, opts WriterOpts) error {
+	if rw.s.readOnly.Load() {
+		return ErrReadOnly
+	}
+	if err := rw.s.checkTraceID(traceID); err != nil {
+		return err
+	}
+	if opts.DropUnsampled {
+		sampled, err := rw.isTraceSampled(traceID)
+		if err == nil && !sampled {
+			return ErrTraceUnsampled
+		} else if err != nil && err != ErrNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+// refreshTraceTTL rewrites the trace's sampling decision if opts.SlidingTTL
+// is true, and its events other than the one with the key written if
+// opts.SlidingTTLEvents is true, with opts.TTL. This is called after the
+// event with the key written has been written, so that rejected writes do
+// not extend the trace's TTL.
+func (rw *ReadWriter) refreshTraceTTL(traceID string, written []byte, opts WriterOpts) error {
+	var entries []*badger.Entry
+	if opts.SlidingTTL {
+		rw.readKeyBuf = rw.s.decisionKey(rw.readKeyBuf[:0], traceID)
+		item, err := rw.txn.Get(rw.readKeyBuf)
+		if err == nil {
+			entries = append(entries, badger.NewEntry(item.KeyCopy(nil), nil).WithMeta(item.UserMeta()))
+		} else if err != badger.ErrKeyNotFound {
+			return err
+		}
+	}
+	if opts.SlidingTTLEvents {
+		var eventKeys [][]byte
+		iterOpts := badger.DefaultIteratorOptions
+		rw.readKeyBuf = rw.s.eventKeyPrefix(rw.readKeyBuf[:0], traceID)
+		iterOpts.Prefix = rw.readKeyBuf
+		// Collect the entries before writing, as writing may flush
+		// the transaction, which must not have open iterators.
+		iter := rw.txn.NewIterator(iterOpts)
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			item := iter.Item()
+			if item.IsDeletedOrExpired() || !isTraceEventMeta(item.UserMeta()) || bytes.Equal(item.Key(), written) {
+				continue
+			}
+			data, err := item.ValueCopy(nil)
+			if err != nil {
+				iter.Close()
+				return err
+			}
+			entries = append(entries, badger.NewEntry(item.KeyCopy(nil), data).WithMeta(item.UserMeta()))
+			eventKeys = append(eventKeys, item.KeyCopy(nil))
+		}
+		iter.Close()
+		indexKeys, err := rw.indexedEventIDKeys(traceID, eventKeys)
+		if err != nil {
+			return err
+		}
+		for _, key := range indexKeys {
+			entries = append(entries, badger.NewEntry(key, []byte(traceID)).WithMeta(entryMetaEventIDIndex))
+		}
+	}
+	for _, e := range entries {
+		if err := rw.writeEntry(e, opts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flushOverdue reports whether the time since the last flush exceeds the
+// storage's maximum flush interval, and there are preceding writes to flush.
+func (rw *ReadWriter) flushOverdue(now time.Time) bool {
+	return rw.s.maxFlushInterval > 0 && rw.pendingWrites > 1 && now.Sub(rw.lastFlush) >= rw.s.maxFlushInterval
 }
 
 func (rw *ReadWriter) writeEntry(e *badger.Entry, opts WriterOpts) error {
-	rw.pendingWrites++
+	now := time.Now()
+	if rw.s.freeDisk != nil && isTraceEventMeta(e.UserMeta) {
+		// Only trace events are rejected while free space is low, so
+		// that sampling decisions may still be recorded, and deletions
+		// of trace events may still free space.
+		if err := rw.s.freeDisk.check(now); err != nil {
+			rw.s.counters.limitReached.Add(1)
+			return err
+		}
+	}
 	entrySize := estimateSize(e)
+	if replacedSize, ok := rw.pendingKeys[string(e.Key)]; ok {
+		// The entry replaces a pending write, which will not be
+		// committed, so discount it. See WithCoalesceWrites.
+		rw.pendingWrites--
+		rw.pendingSize -= replacedSize
+		rw.s.pendingSize.Add(-replacedSize)
+	}
+	rw.pendingWrites++
 	// The badger database has an async size reconciliation, with a 1 minute
 	// ticker that keeps the lsm and vlog sizes updated in an in-memory map.
 	// It's OK to call call s.db.Size() on the hot path, since the memory
-	// lookup is cheap.
+	// lookup is cheap. The size is extrapolated between updates; see
+	// sizeEstimator.
 	lsm, vlog := rw.s.db.Size()
+	dbSize := rw.s.size.estimate(lsm+vlog, now)
 
 	// there are multiple ReadWriters writing to the same storage so add
 	// the entry size and consider the new value to avoid TOCTOU issues.
 	pendingSize := rw.s.pendingSize.Add(entrySize)
 	rw.pendingSize += entrySize
 
-	if current := pendingSize + lsm + vlog; opts.StorageLimitInBytes != 0 && current >= opts.StorageLimitInBytes {
-		// flush what we currently have and discard the current entry
-		if err := rw.Flush(); err != nil {
-			return err
+	limit := rw.s.effectiveLimit(opts.StorageLimitInBytes, now)
+	if current := pendingSize + dbSize; limit != 0 && current >= limit {
+		madeRoom, err := rw.s.makeRoom(opts.OnLimit, entrySize, limit)
+		if err != nil {
+			err = fmt.Errorf("failed to evict entries: %w", err)
+		} else if !madeRoom && rw.s.limitHook != nil {
+			madeRoom, current, err = rw.s.callLimitHook(entrySize, limit)
+		}
+		if !madeRoom {
+			rw.s.counters.limitReached.Add(1)
+			// flush what we currently have and discard the current entry
+			if err := rw.flush(); err != nil {
+				return err
+			}
+			if err != nil {
+				return err
+			}
+			return fmt.Errorf("%w (current: %d, limit: %d)", ErrLimitReached, current, limit)
 		}
-		return fmt.Errorf("%w (current: %d, limit: %d)", ErrLimitReached, current, opts.StorageLimitInBytes)
 	}
 
-	if rw.pendingWrites >= 200 {
-		// Attempt to flush if there are 200 or more uncommitted writes.
+	if rw.pendingWrites >= rw.s.flushThreshold() || rw.flushOverdue(now) {
+		// Attempt to flush if there are enough uncommitted writes.
 		// This ensures calls to ReadTraceEvents are not slowed down;
 		// ReadTraceEvents uses an iterator, which must sort all keys
-		// of uncommitted writes.
-		// The 200 value yielded a good balance between read and write speed:
-		// https://github.com/elastic/apm-server/pull/8407#issuecomment-1162994643
-		if err := rw.Flush(); err != nil {
+		// of uncommitted writes. See flushWrites. Also flush if the
+		// writes have been uncommitted for too long, to bound their
+		// staleness. See WithMaxFlushInterval.
+		if err := rw.flush(); err != nil {
 			return err
 		}
 
@@ -207,22 +1485,37 @@ func (rw *ReadWriter) writeEntry(e *badger.Entry, opts WriterOpts) error {
 		// the entrySize again.
 		rw.pendingSize += entrySize
 		rw.s.pendingSize.Add(entrySize)
+	} else if rw.pendingWrites > 1 && rw.pendingSize > rw.s.maxTransactionSize {
+		// The transaction would likely be too big to accommodate the
+		// new entry, so flush the existing transaction before setting
+		// the entry rather than waiting for badger.ErrTxnTooBig.
+		if err := rw.flush(); err != nil {
+			return err
+		}
+		rw.pendingSize += entrySize
+		rw.s.pendingSize.Add(entrySize)
 	}
 
 	err := rw.txn.SetEntry(e.WithTTL(opts.TTL))
 
 	// If the transaction is already too big to accommodate the new entry, flush
-	// the existing transaction and set the entry on a new one, otherwise,
-	// returns early.
-	if err != badger.ErrTxnTooBig {
-		return err
+	// the existing transaction and set the entry on a new one.
+	if err == badger.ErrTxnTooBig {
+		if err := rw.flush(); err != nil {
+			return err
+		}
+		rw.pendingSize += entrySize
+		rw.s.pendingSize.Add(entrySize)
+		err = rw.txn.SetEntry(e.WithTTL(opts.TTL))
 	}
-	if err := rw.Flush(); err != nil {
+	if err != nil {
 		return err
 	}
-	rw.pendingSize += entrySize
-	rw.s.pendingSize.Add(entrySize)
-	return rw.txn.SetEntry(e.WithTTL(opts.TTL))
+	rw.s.counters.writes.Add(1)
+	if rw.pendingKeys != nil {
+		rw.pendingKeys[string(e.Key)] = entrySize
+	}
+	return nil
 }
 
 func estimateSize(e *badger.Entry) int64 {
@@ -241,8 +1534,39 @@ func estimateSize(e *badger.Entry) int64 {
 }
 
 // DeleteTraceEvent deletes the trace event from storage.
+//
+// If the storage is configured with WithChronologicalKeys, all events of
+// the trace with the given ID are deleted, regardless of their timestamps.
+// If the storage is configured with WithEventIDIndex, the event's index
+// entry is also deleted.
 func (rw *ReadWriter) DeleteTraceEvent(traceID, id string) error {
-	key := append(append([]byte(traceID), ':'), id...)
+	return rw.DeleteTraceEvents(traceID, []string{id})
+}
+
+// DeleteTraceEvents deletes the trace events with the given IDs from
+// storage, as with DeleteTraceEvent. If the storage must scan the keys of
+// the trace's events to find them, such as with WithChronologicalKeys, the
+// keys are scanned once for all of the IDs, rather than once for each.
+func (rw *ReadWriter) DeleteTraceEvents(traceID string, ids []string) error {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	if rw.closed {
+		return ErrClosed
+	}
+	keys := rw.eventKeys(traceID, ids...)
+	indexKeys, err := rw.indexedEventIDKeys(traceID, keys)
+	if err != nil {
+		return err
+	}
+	for _, key := range append(keys, indexKeys...) {
+		if err := rw.deleteKey(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (rw *ReadWriter) deleteKey(key []byte) error {
 	err := rw.txn.Delete(key)
 	// If the transaction is already too big to accommodate the new entry, flush
 	// the existing transaction and set the entry on a new one, otherwise,
@@ -250,19 +1574,73 @@ func (rw *ReadWriter) DeleteTraceEvent(traceID, id string) error {
 	if err != badger.ErrTxnTooBig {
 		return err
 	}
-	if err := rw.Flush(); err != nil {
+	if err := rw.flush(); err != nil {
 		return err
 	}
 
 	return rw.txn.Delete(key)
 }
 
+// eventKeys returns the keys of the trace events with the given trace and
+// event IDs. Without chronological keys or node IDs, these are the keys
+// derived from the IDs, whether or not the events exist. Otherwise, the keys
+// of the trace's events are scanned once for those with any of the event
+// IDs, ignoring their timestamps and node IDs.
+func (rw *ReadWriter) eventKeys(traceID string, ids ...string) [][]byte {
+	if !rw.s.scanEventKeys() {
+		keys := make([][]byte, len(ids))
+		for i, id := range ids {
+			keys[i] = rw.s.eventKey(nil, traceID, id)
+		}
+		return keys
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	idSet := make(map[string]struct{}, len(ids))
+	for _, id := range ids {
+		idSet[id] = struct{}{}
+	}
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	rw.readKeyBuf = rw.s.eventKeyPrefix(rw.readKeyBuf[:0], traceID)
+	opts.Prefix = rw.readKeyBuf
+	iter := rw.txn.NewIterator(opts)
+	defer iter.Close()
+	var keys [][]byte
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		item := iter.Item()
+		if item.IsDeletedOrExpired() || !isTraceEventMeta(item.UserMeta()) {
+			continue
+		}
+		if _, ok := idSet[string(rw.s.trimEventKeyID(item.Key()[len(opts.Prefix):]))]; ok {
+			keys = append(keys, item.KeyCopy(nil))
+		}
+	}
+	return keys
+}
+
 // ReadTraceEvents reads trace events with the given trace ID from storage into out.
+//
+// If the codec fails or panics while decoding an event, the event is skipped
+// and the remaining events are read; ReadTraceEvents then returns a
+// *multierror.Error holding an error wrapping ErrDecodeFailed for each
+// skipped event, and out holds the events that were successfully decoded.
 func (rw *ReadWriter) ReadTraceEvents(traceID string, out *modelpb.Batch) error {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	if rw.closed {
+		return ErrClosed
+	}
+	rw.s.counters.reads.Add(1)
 	opts := badger.DefaultIteratorOptions
-	rw.readKeyBuf = append(append(rw.readKeyBuf[:0], traceID...), ':')
+	rw.readKeyBuf = rw.s.eventKeyPrefix(rw.readKeyBuf[:0], traceID)
 	opts.Prefix = rw.readKeyBuf
 
+	// decodeErr records the events that could not be decoded. Such events
+	// are skipped, so the remaining events of the trace can still be read.
+	var decodeErr *multierror.Error
+	decoder := traceEventDecoder{s: rw.s, txn: rw.txn}
 	iter := rw.txn.NewIterator(opts)
 	defer iter.Close()
 	for iter.Rewind(); iter.Valid(); iter.Next() {
@@ -270,15 +1648,14 @@ func (rw *ReadWriter) ReadTraceEvents(traceID string, out *modelpb.Batch) error
 		if item.IsDeletedOrExpired() {
 			continue
 		}
-		switch item.UserMeta() {
-		case entryMetaTraceEvent:
+		switch meta := item.UserMeta(); {
+		case isTraceEventMeta(meta):
 			var event modelpb.APMEvent
-			if err := item.Value(func(data []byte) error {
-				if err := rw.s.codec.DecodeEvent(data, &event); err != nil {
-					return fmt.Errorf("codec failed to decode event: %w", err)
+			if err := decoder.decode(traceID, item, &event); err != nil {
+				if errors.Is(err, ErrDecodeFailed) {
+					decodeErr = multierror.Append(decodeErr, fmt.Errorf("%w (key: %q)", err, item.Key()))
+					continue
 				}
-				return nil
-			}); err != nil {
 				return err
 			}
 			*out = append(*out, &event)
@@ -287,5 +1664,355 @@ func (rw *ReadWriter) ReadTraceEvents(traceID string, out *modelpb.Batch) error
 			continue
 		}
 	}
+	return decodeErr.ErrorOrNil()
+}
+
+// ReadTraceEventsByType reads trace events with the given trace ID from
+// storage, grouped by event type. The map is keyed by the string
+// representation of each event's modelpb.APMEventType: "transaction",
+// "span", "error", "metric", "log", or "undefined" for events whose type
+// cannot be inferred, such as spans without a type. Only types with at least
+// one event are present in the map.
+//
+// Events are read as by ReadTraceEvents, and in the same order within each
+// type. If any events could not be decoded, ReadTraceEventsByType returns
+// the successfully decoded events along with the same error.
+func (rw *ReadWriter) ReadTraceEventsByType(traceID string) (map[string]modelpb.Batch, error) {
+	var events modelpb.Batch
+	err := rw.ReadTraceEvents(traceID, &events)
+	if err != nil && !errors.Is(err, ErrDecodeFailed) {
+		return nil, err
+	}
+	byType := make(map[string]modelpb.Batch)
+	for _, event := range events {
+		eventType := event.Type().String()
+		byType[eventType] = append(byType[eventType], event)
+	}
+	return byType, err
+}
+
+// ReadTraceEventsSorted reads trace events with the given trace ID from
+// storage into out, as by ReadTraceEvents, and sorts the events read using
+// less, which reports whether event a must be ordered before event b. This
+// allows consumers to read events in the order they require, such as by
+// timestamp, independent of the order of the events' storage keys. The
+// sort is stable, so events which less considers equal remain in key
+// order. Events already in out are not reordered.
+//
+// Sorting requires buffering the whole trace in memory; for large traces,
+// prefer ReadTraceEvents where key order suffices.
+//
+// If any events could not be decoded, ReadTraceEventsSorted sorts the
+// successfully decoded events and returns the same error as
+// ReadTraceEvents. ReadTraceEventsSorted returns an error if less is nil.
+func (rw *ReadWriter) ReadTraceEventsSorted(traceID string, less func(a, b *modelpb.APMEvent) bool, out *modelpb.Batch) error {
+	if less == nil {
+		return errors.New("less must not be nil")
+	}
+	offset := len(*out)
+	err := rw.ReadTraceEvents(traceID, out)
+	if err != nil && !errors.Is(err, ErrDecodeFailed) {
+		return err
+	}
+	events := (*out)[offset:]
+	sort.SliceStable(events, func(i, j int) bool {
+		return less(events[i], events[j])
+	})
+	return err
+}
+
+// decodeEvent decodes data into event using codec, returning an error
+// wrapping ErrDecodeFailed if the codec fails or panics.
+func decodeEvent(codec Codec, data []byte, event *modelpb.APMEvent) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%w: codec panicked: %v", ErrDecodeFailed, r)
+		}
+	}()
+	if err := codec.DecodeEvent(data, event); err != nil {
+		return fmt.Errorf("%w: codec failed: %w", ErrDecodeFailed, err)
+	}
 	return nil
 }
+
+// FinalizeTrace records the sampling decision for the given trace ID, and
+// removes the trace's events from storage, as a single transaction.
+//
+// If sampled is true, indexFn is called with the trace's events before the
+// transaction is committed, and must not be nil. If indexFn returns an error, the transaction is
+// discarded, leaving the trace's events in storage without a decision, and
+// FinalizeTrace returns the error; the trace may then be finalized again
+// later. Events which the codec fails or panics while decoding are removed
+// without being indexed. The trace's labels, recorded with
+// MergeTraceLabels, and its lease, recorded with ClaimTrace, are removed
+// along with its events.
+//
+// Any pending writes are flushed before finalizing the trace. The trace's
+// events must fit within a single transaction, which is limited in size
+// by the database's maximum batch size and count; if they do not, the
+// transaction is discarded and FinalizeTrace returns badger.ErrTxnTooBig.
+func (rw *ReadWriter) FinalizeTrace(traceID string, sampled bool, indexFn func(modelpb.Batch) error, opts WriterOpts) error {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	if rw.closed {
+		return ErrClosed
+	}
+	if rw.s.readOnly.Load() {
+		return ErrReadOnly
+	}
+	if sampled && indexFn == nil {
+		return errors.New("indexFn must not be nil for sampled traces")
+	}
+	if err := rw.flush(); err != nil {
+		return err
+	}
+	firstWritten, err := rw.finalizeTrace(traceID, sampled, indexFn, opts)
+	if err != nil {
+		rw.txn.Discard()
+		rw.txn = rw.s.db.NewTransaction(true)
+		return err
+	}
+	if err := rw.flush(); err != nil {
+		return err
+	}
+	if !firstWritten.IsZero() {
+		rw.s.counters.decisionLatency.observe(time.Since(firstWritten))
+	}
+	if rw.s.decisions != nil {
+		rw.s.decisions.remove(traceID)
+	}
+	if !sampled && rw.s.unsampled != nil {
+		rw.s.unsampled.add(traceID)
+	}
+	return nil
+}
+
+// finalizeTrace records the sampling decision for the trace, and deletes
+// its events and associated entries, in the current transaction. It returns
+// the time at which the trace's first event was written, if recorded in
+// its summary, or the zero time otherwise.
+func (rw *ReadWriter) finalizeTrace(traceID string, sampled bool, indexFn func(modelpb.Batch) error, opts WriterOpts) (time.Time, error) {
+	var events modelpb.Batch
+	var keys [][]byte
+	iterOpts := badger.DefaultIteratorOptions
+	rw.readKeyBuf = rw.s.eventKeyPrefix(rw.readKeyBuf[:0], traceID)
+	iterOpts.Prefix = rw.readKeyBuf
+	decoder := traceEventDecoder{s: rw.s, txn: rw.txn}
+	iter := rw.txn.NewIterator(iterOpts)
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		item := iter.Item()
+		if item.IsDeletedOrExpired() || !isTraceEventMeta(item.UserMeta()) {
+			continue
+		}
+		keys = append(keys, item.KeyCopy(nil))
+		if !sampled {
+			continue
+		}
+		var event modelpb.APMEvent
+		if err := decoder.decode(traceID, item, &event); err != nil {
+			if errors.Is(err, ErrDecodeFailed) {
+				continue
+			}
+			iter.Close()
+			return time.Time{}, err
+		}
+		events = append(events, &event)
+	}
+	iter.Close()
+
+	// With WithCompactUnsampled, unsampled decisions are recorded in
+	// memory after committing rather than in the transaction.
+	if sampled || rw.s.unsampled == nil {
+		var meta uint8 = entryMetaTraceUnsampled
+		if sampled {
+			meta = entryMetaTraceSampled
+		}
+		if rw.s.decisionFilter != nil {
+			rw.s.decisionFilter.add(traceID)
+		}
+		e := badger.NewEntry(rw.s.decisionKey(nil, traceID), nil).WithMeta(meta).WithTTL(opts.TTL)
+		if err := rw.txn.SetEntry(e); err != nil {
+			return time.Time{}, err
+		}
+	}
+	indexKeys, err := rw.indexedEventIDKeys(traceID, keys)
+	if err != nil {
+		return time.Time{}, err
+	}
+	keys = append(keys, indexKeys...)
+	var firstWritten time.Time
+	if rw.s.traceEventSummaries {
+		// Summaries which cannot be read are deleted regardless,
+		// without observing decision latency.
+		if summary, err := rw.readTraceEventSummary(traceID); err == nil {
+			firstWritten = summary.FirstWritten
+		}
+		keys = append(keys, rw.s.eventSummaryKey(nil, traceID))
+	}
+	if rw.s.tenantKey != nil {
+		keys = append(keys, rw.s.traceTenantKey(nil, traceID))
+	}
+	// Labels and leases are written for only some traces, so they are
+	// deleted only if present, to avoid writing needless tombstones.
+	for _, key := range [][]byte{rw.s.summaryKey(nil, traceID), rw.s.leaseKey(nil, traceID)} {
+		switch _, err := rw.txn.Get(key); err {
+		case nil:
+			keys = append(keys, key)
+		case badger.ErrKeyNotFound:
+		default:
+			return time.Time{}, err
+		}
+	}
+	for _, key := range keys {
+		if err := rw.txn.Delete(key); err != nil {
+			return time.Time{}, err
+		}
+	}
+	if sampled && len(events) > 0 {
+		if err := indexFn(events); err != nil {
+			return time.Time{}, err
+		}
+	}
+	return firstWritten, nil
+}
+
+// HasTraceEvents reports whether any unexpired events are stored for the
+// given trace ID, such as to skip finalizing traces which have only a
+// sampling decision. Events are not decoded, so this is cheaper than
+// ReadTraceEvents when only their existence is needed.
+func (rw *ReadWriter) HasTraceEvents(traceID string) (bool, error) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	if rw.closed {
+		return false, ErrClosed
+	}
+	rw.s.counters.reads.Add(1)
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	rw.readKeyBuf = rw.s.eventKeyPrefix(rw.readKeyBuf[:0], traceID)
+	opts.Prefix = rw.readKeyBuf
+	iter := rw.txn.NewIterator(opts)
+	defer iter.Close()
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		item := iter.Item()
+		if !item.IsDeletedOrExpired() && isTraceEventMeta(item.UserMeta()) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// ReadTraceEventRaw returns a copy of the raw, encoded, value stored for the
+// trace event with the given trace ID and event ID, without decoding it with
+// the configured Codec. This is intended for diagnosing codec or corruption
+// issues. For events written as deltas with WriteTraceEventDelta, the delta
+// encoding is returned.
+//
+// If the event does not exist or has expired, ReadTraceEventRaw returns
+// ErrNotFound. If the storage is configured with WithChronologicalKeys and
+// the trace has multiple events with the given ID, the earliest is returned.
+func (rw *ReadWriter) ReadTraceEventRaw(traceID, id string) ([]byte, error) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	if rw.closed {
+		return nil, ErrClosed
+	}
+	rw.s.counters.reads.Add(1)
+	keys := rw.eventKeys(traceID, id)
+	if len(keys) == 0 {
+		return nil, ErrNotFound
+	}
+	item, err := rw.txn.Get(keys[0])
+	if err != nil {
+		if err == badger.ErrKeyNotFound {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	if !isTraceEventMeta(item.UserMeta()) {
+		return nil, ErrNotFound
+	}
+	return item.ValueCopy(nil)
+}
+
+// traceSummary holds information accumulated over all events of a trace.
+type traceSummary struct {
+	// Labels holds the union of labels seen for the trace so far.
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// MergeTraceLabels merges labels into the set of labels recorded for the
+// given trace ID. Labels with the same key are overwritten, so the most
+// recently merged value wins.
+//
+// Labels may be written by any event in a trace, which may arrive after the
+// events that are used for making sampling decisions; MergeTraceLabels lets
+// callers record the labels as they arrive, and later match on all of them
+// using ReadTraceLabels.
+func (rw *ReadWriter) MergeTraceLabels(traceID string, labels map[string]string, opts WriterOpts) error {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	if rw.closed {
+		return ErrClosed
+	}
+	if rw.s.readOnly.Load() {
+		return ErrReadOnly
+	}
+	summary, err := rw.readTraceSummary(traceID)
+	if err != nil && err != ErrNotFound {
+		return err
+	}
+	if summary.Labels == nil {
+		summary.Labels = make(map[string]string, len(labels))
+	}
+	for k, v := range labels {
+		summary.Labels[k] = v
+	}
+	data, err := json.Marshal(summary)
+	if err != nil {
+		return err
+	}
+	key := rw.s.summaryKey(nil, traceID)
+	return rw.writeEntry(badger.NewEntry(key, data).WithMeta(entryMetaTraceSummary), opts)
+}
+
+// ReadTraceLabels returns the labels recorded for the given trace ID with
+// MergeTraceLabels. If no labels have been recorded, ReadTraceLabels returns
+// ErrNotFound.
+func (rw *ReadWriter) ReadTraceLabels(traceID string) (map[string]string, error) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	if rw.closed {
+		return nil, ErrClosed
+	}
+	summary, err := rw.readTraceSummary(traceID)
+	if err != nil {
+		return nil, err
+	}
+	if len(summary.Labels) == 0 {
+		return nil, ErrNotFound
+	}
+	return summary.Labels, nil
+}
+
+func (rw *ReadWriter) readTraceSummary(traceID string) (traceSummary, error) {
+	var summary traceSummary
+	rw.readKeyBuf = rw.s.summaryKey(rw.readKeyBuf[:0], traceID)
+	item, err := rw.txn.Get(rw.readKeyBuf)
+	if err != nil {
+		if err == badger.ErrKeyNotFound {
+			return summary, ErrNotFound
+		}
+		return summary, err
+	}
+	if item.UserMeta() != entryMetaTraceSummary {
+		return summary, ErrNotFound
+	}
+	err = item.Value(func(data []byte) error {
+		if err := json.Unmarshal(data, &summary); err != nil {
+			return fmt.Errorf("failed to decode trace summary: %w", err)
+		}
+		return nil
+	})
+	return summary, err
+}
@@ -207,6 +207,57 @@ func BenchmarkIsTraceSampled(b *testing.B) {
 	bench("unknown", unknownTraceUUID.String(), true, false)
 }
 
+func BenchmarkIsTraceSampledConcurrent(b *testing.B) {
+	db := newBadgerDB(b, badgerOptions)
+	store := eventstorage.New(db, eventstorage.ProtobufCodec{})
+	readWriter := store.NewReadWriter()
+	defer readWriter.Close()
+	traceID := uuid.Must(uuid.NewV4()).String()
+	if err := readWriter.WriteTraceSampled(traceID, true, eventstorage.WriterOpts{TTL: time.Minute}); err != nil {
+		b.Fatal(err)
+	}
+	if err := readWriter.Flush(); err != nil {
+		b.Fatal(err)
+	}
+
+	// Compare the per-call transaction of IsTraceSampledConcurrent with a
+	// ReadWriter's long-lived transaction, with and without contention.
+	b.Run("readwriter", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := readWriter.IsTraceSampled(traceID); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("concurrent", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := store.IsTraceSampledConcurrent(traceID); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("readwriter_parallel", func(b *testing.B) {
+		shared := store.NewShardedReadWriter(eventstorage.WithShardCount(1))
+		defer shared.Close()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				if _, err := shared.IsTraceSampled(traceID); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	})
+	b.Run("concurrent_parallel", func(b *testing.B) {
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				if _, err := store.IsTraceSampledConcurrent(traceID); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	})
+}
+
 type nopCodec struct{}
 
 func (nopCodec) DecodeEvent(data []byte, event *modelpb.APMEvent) error { return nil }
@@ -5,6 +5,13 @@
 package eventstorage_test
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -12,8 +19,10 @@ import (
 	"github.com/gofrs/uuid"
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/hashicorp/go-multierror"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/sync/errgroup"
 	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/testing/protocmp"
 
@@ -167,6 +176,49 @@ func TestWriteTraceSampled(t *testing.T) {
 	}, sampled)
 }
 
+func TestWriteTraceSampledConflict(t *testing.T) {
+	for _, tc := range []struct {
+		policy   eventstorage.DecisionConflict
+		first    bool
+		second   bool
+		expected bool
+	}{
+		{eventstorage.Overwrite, false, true, true},
+		{eventstorage.Overwrite, true, false, false},
+		{eventstorage.PreferSampled, false, true, true},
+		{eventstorage.PreferSampled, true, false, true},
+		{eventstorage.PreferSampled, false, false, false},
+		{eventstorage.KeepFirst, false, true, false},
+		{eventstorage.KeepFirst, true, false, true},
+	} {
+		name := fmt.Sprintf("%s_%t_%t", tc.policy, tc.first, tc.second)
+		t.Run(name, func(t *testing.T) {
+			db := newBadgerDB(t, badgerOptions)
+			store := eventstorage.New(db, eventstorage.ProtobufCodec{})
+			readWriter := store.NewReadWriter()
+			defer readWriter.Close()
+			wOpts := eventstorage.WriterOpts{TTL: time.Minute, OnDecisionConflict: tc.policy}
+
+			require.NoError(t, readWriter.WriteTraceSampled("trace_id", tc.first, wOpts))
+			require.NoError(t, readWriter.Flush())
+			require.NoError(t, readWriter.WriteTraceSampled("trace_id", tc.second, wOpts))
+			sampled, err := readWriter.IsTraceSampled("trace_id")
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, sampled)
+		})
+	}
+}
+
+func TestParseDecisionConflict(t *testing.T) {
+	for _, policy := range []eventstorage.DecisionConflict{eventstorage.Overwrite, eventstorage.PreferSampled, eventstorage.KeepFirst} {
+		parsed, err := eventstorage.ParseDecisionConflict(policy.String())
+		require.NoError(t, err)
+		assert.Equal(t, policy, parsed)
+	}
+	_, err := eventstorage.ParseDecisionConflict("last_wins")
+	assert.EqualError(t, err, `unknown decision conflict policy "last_wins"`)
+}
+
 func TestReadTraceEvents(t *testing.T) {
 	db := newBadgerDB(t, badgerOptions)
 	store := eventstorage.New(db, eventstorage.ProtobufCodec{})
@@ -241,82 +293,2964 @@ func TestReadTraceEventsDecodeError(t *testing.T) {
 	assert.Error(t, err)
 }
 
-func TestIsTraceSampled(t *testing.T) {
+func TestHasTraceEvents(t *testing.T) {
+	db := newBadgerDB(t, badgerOptions)
+	store := eventstorage.New(db, eventstorage.ProtobufCodec{})
+	readWriter := store.NewReadWriter()
+	defer readWriter.Close()
+
+	wOpts := eventstorage.WriterOpts{TTL: time.Minute}
+	require.NoError(t, readWriter.WriteTraceEvent("trace_id", "span_id", &modelpb.APMEvent{}, wOpts))
+	require.NoError(t, readWriter.WriteTraceSampled("decision_only", true, wOpts))
+	require.NoError(t, readWriter.WriteTraceEvent("expired", "span_id", &modelpb.APMEvent{}, eventstorage.WriterOpts{TTL: -1}))
+	require.NoError(t, readWriter.WriteTraceEvent("deleted", "span_id", &modelpb.APMEvent{}, wOpts))
+	require.NoError(t, readWriter.Flush())
+	require.NoError(t, readWriter.DeleteTraceEvent("deleted", "span_id"))
+
+	for traceID, expected := range map[string]bool{
+		"trace_id":      true,
+		"decision_only": false,
+		"expired":       false,
+		"deleted":       false,
+		"unknown":       false,
+	} {
+		has, err := readWriter.HasTraceEvents(traceID)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, has, traceID)
+	}
+}
+
+func TestVerifyTraceTTL(t *testing.T) {
 	db := newBadgerDB(t, badgerOptions)
 	store := eventstorage.New(db, eventstorage.ProtobufCodec{})
+	readWriter := store.NewReadWriter()
+	defer readWriter.Close()
+
+	write := func(traceID, id string, ttl time.Duration) {
+		t.Helper()
+		require.NoError(t, readWriter.WriteTraceEvent(traceID, id, &modelpb.APMEvent{
+			Span: &modelpb.Span{Id: id},
+		}, eventstorage.WriterOpts{TTL: ttl}))
+	}
+
+	// A trace with no events is consistent.
+	consistent, err := readWriter.VerifyTraceTTL("trace_id")
+	assert.NoError(t, err)
+	assert.True(t, consistent)
 
+	write("trace_id", "span_1", time.Hour)
+	write("trace_id", "span_2", time.Hour+time.Second)
+	consistent, err = readWriter.VerifyTraceTTL("trace_id")
+	assert.NoError(t, err)
+	assert.True(t, consistent)
+
+	write("trace_id", "span_3", 2*time.Hour)
+	require.NoError(t, readWriter.Flush())
+	consistent, err = readWriter.VerifyTraceTTL("trace_id")
+	assert.False(t, consistent)
+	var ttlErr *eventstorage.TraceTTLError
+	require.ErrorAs(t, err, &ttlErr)
+	assert.Equal(t, "trace_id", ttlErr.TraceID)
+	assert.Equal(t, "span_1", ttlErr.FirstEventID)
+	assert.Equal(t, "span_3", ttlErr.LastEventID)
+	assert.InDelta(t, time.Hour.Seconds(), ttlErr.LastExpiry.Sub(ttlErr.FirstExpiry).Seconds(), 1)
+
+	// Events without a TTL are inconsistent with those with a TTL.
+	write("trace_id_2", "span_1", time.Hour)
+	require.NoError(t, readWriter.Flush())
 	require.NoError(t, db.Update(func(txn *badger.Txn) error {
-		if err := txn.SetEntry(badger.NewEntry([]byte("sampled_trace_id"), nil).WithMeta('s')); err != nil {
-			return err
-		}
-		if err := txn.SetEntry(badger.NewEntry([]byte("unsampled_trace_id"), nil).WithMeta('u')); err != nil {
-			return err
-		}
-		return nil
+		return txn.SetEntry(badger.NewEntry([]byte("trace_id_2:span_2"), nil).WithMeta('e'))
 	}))
+	require.NoError(t, readWriter.Flush()) // start a new transaction to read the entry
+	consistent, err = readWriter.VerifyTraceTTL("trace_id_2")
+	assert.False(t, consistent)
+	require.ErrorAs(t, err, &ttlErr)
+	assert.Equal(t, "span_2", ttlErr.LastEventID)
+	assert.True(t, ttlErr.LastExpiry.IsZero())
+	assert.Contains(t, err.Error(), "event span_2 expires never")
+}
 
-	reader := store.NewShardedReadWriter()
-	defer reader.Close()
+func TestTraceBatch(t *testing.T) {
+	db := newBadgerDB(t, badgerOptions)
+	store := eventstorage.New(db, eventstorage.ProtobufCodec{})
+	readWriter := store.NewReadWriter()
+	defer readWriter.Close()
 
-	sampled, err := reader.IsTraceSampled("sampled_trace_id")
-	assert.NoError(t, err)
-	assert.True(t, sampled)
+	batch := readWriter.TraceBatch("trace_id", eventstorage.WriterOpts{TTL: time.Minute, DropUnsampled: true})
+	span1 := &modelpb.APMEvent{Span: &modelpb.Span{Id: "span_1"}}
+	span2 := &modelpb.APMEvent{Span: &modelpb.Span{Id: "span_2"}}
+	require.NoError(t, batch.Add("span_1", span1))
+	require.NoError(t, batch.Add("span_2", span2))
 
-	sampled, err = reader.IsTraceSampled("unsampled_trace_id")
+	// The batch shares the ReadWriter's transaction, so its writes can be
+	// read through the ReadWriter before flushing.
+	var events modelpb.Batch
+	require.NoError(t, readWriter.ReadTraceEvents("trace_id", &events))
+	assert.Empty(t, cmp.Diff(modelpb.Batch{span1, span2}, events, protocmp.Transform()))
+
+	require.NoError(t, batch.Flush())
+	otherReadWriter := store.NewReadWriter()
+	defer otherReadWriter.Close()
+	data, err := otherReadWriter.ReadTraceEventRaw("trace_id", "span_2")
+	require.NoError(t, err)
+	var event modelpb.APMEvent
+	require.NoError(t, eventstorage.ProtobufCodec{}.DecodeEvent(data, &event))
+	assert.Empty(t, cmp.Diff(span2, &event, protocmp.Transform()))
+
+	// Writes are subject to the same options as WriteTraceEvent.
+	require.NoError(t, readWriter.WriteTraceSampled("trace_id", false, eventstorage.WriterOpts{TTL: time.Minute}))
+	assert.Equal(t, eventstorage.ErrTraceUnsampled, batch.Add("span_3", span1))
+}
+
+func TestReadTraceEventsByType(t *testing.T) {
+	db := newBadgerDB(t, badgerOptions)
+	store := eventstorage.New(db, eventstorage.ProtobufCodec{})
+	readWriter := store.NewShardedReadWriter()
+	defer readWriter.Close()
+	wOpts := eventstorage.WriterOpts{TTL: time.Minute}
+
+	transaction := &modelpb.APMEvent{Transaction: &modelpb.Transaction{Id: "transaction_id", Type: "request"}}
+	span1 := &modelpb.APMEvent{Span: &modelpb.Span{Id: "span_1", Type: "db"}}
+	span2 := &modelpb.APMEvent{Span: &modelpb.Span{Id: "span_2", Type: "external"}}
+	errorEvent := &modelpb.APMEvent{Error: &modelpb.Error{Id: "error_id"}}
+	untyped := &modelpb.APMEvent{Span: &modelpb.Span{Id: "span_3"}}
+	for id, event := range map[string]*modelpb.APMEvent{
+		"transaction_id": transaction,
+		"span_1":         span1,
+		"span_2":         span2,
+		"error_id":       errorEvent,
+		"span_3":         untyped,
+	} {
+		require.NoError(t, readWriter.WriteTraceEvent("trace_id", id, event, wOpts))
+	}
+	require.NoError(t, readWriter.WriteTraceEvent("other_trace_id", "span_4", span1, wOpts))
+
+	byType, err := readWriter.ReadTraceEventsByType("trace_id")
+	require.NoError(t, err)
+	assert.Empty(t, cmp.Diff(map[string]modelpb.Batch{
+		"transaction": {transaction},
+		"span":        {span1, span2},
+		"error":       {errorEvent},
+		"undefined":   {untyped},
+	}, byType, protocmp.Transform()))
+
+	byType, err = readWriter.ReadTraceEventsByType("unknown_trace_id")
+	require.NoError(t, err)
+	assert.Empty(t, byType)
+}
+
+func TestReadTraceEventsSorted(t *testing.T) {
+	db := newBadgerDB(t, badgerOptions)
+	store := eventstorage.New(db, eventstorage.ProtobufCodec{})
+	readWriter := store.NewShardedReadWriter()
+	defer readWriter.Close()
+	wOpts := eventstorage.WriterOpts{TTL: time.Minute}
+
+	// Event IDs are in key order, and durations in reverse key order.
+	span1 := &modelpb.APMEvent{Span: &modelpb.Span{Id: "span_1"}, Event: &modelpb.Event{Duration: 3}}
+	span2 := &modelpb.APMEvent{Span: &modelpb.Span{Id: "span_2"}, Event: &modelpb.Event{Duration: 1}}
+	span3 := &modelpb.APMEvent{Span: &modelpb.Span{Id: "span_3"}, Event: &modelpb.Event{Duration: 2}}
+	span4 := &modelpb.APMEvent{Span: &modelpb.Span{Id: "span_4"}, Event: &modelpb.Event{Duration: 1}}
+	for _, event := range []*modelpb.APMEvent{span1, span2, span3, span4} {
+		require.NoError(t, readWriter.WriteTraceEvent("trace_id", event.Span.Id, event, wOpts))
+	}
+
+	byDuration := func(a, b *modelpb.APMEvent) bool {
+		return a.GetEvent().GetDuration() < b.GetEvent().GetDuration()
+	}
+	existing := &modelpb.APMEvent{Span: &modelpb.Span{Id: "existing"}, Event: &modelpb.Event{Duration: 10}}
+	out := modelpb.Batch{existing}
+	require.NoError(t, readWriter.ReadTraceEventsSorted("trace_id", byDuration, &out))
+	// Events with equal durations remain in key order, and events
+	// already in the batch are not reordered.
+	assert.Empty(t, cmp.Diff(modelpb.Batch{existing, span2, span4, span3, span1}, out, protocmp.Transform()))
+
+	out = nil
+	require.NoError(t, readWriter.ReadTraceEventsSorted("unknown_trace_id", byDuration, &out))
+	assert.Empty(t, out)
+
+	assert.EqualError(t, readWriter.ReadTraceEventsSorted("trace_id", nil, &out), "less must not be nil")
+}
+
+func TestReadTraceEventRaw(t *testing.T) {
+	db := newBadgerDB(t, badgerOptions)
+	store := eventstorage.New(db, eventstorage.ProtobufCodec{})
+	readWriter := store.NewShardedReadWriter()
+	defer readWriter.Close()
+	wOpts := eventstorage.WriterOpts{TTL: time.Minute}
+
+	transaction := &modelpb.APMEvent{Transaction: &modelpb.Transaction{Id: "transaction_id"}}
+	assert.NoError(t, readWriter.WriteTraceEvent("trace_id", "transaction_id", transaction, wOpts))
+	assert.NoError(t, readWriter.WriteTraceSampled("trace_id", true, wOpts))
+
+	expected, err := eventstorage.ProtobufCodec{}.EncodeEvent(transaction)
+	require.NoError(t, err)
+	raw, err := readWriter.ReadTraceEventRaw("trace_id", "transaction_id")
 	assert.NoError(t, err)
-	assert.False(t, sampled)
+	assert.Equal(t, expected, raw)
 
-	_, err = reader.IsTraceSampled("unknown_trace_id")
-	assert.Equal(t, err, eventstorage.ErrNotFound)
+	_, err = readWriter.ReadTraceEventRaw("trace_id", "unknown_id")
+	assert.Equal(t, eventstorage.ErrNotFound, err)
+
+	wOpts.TTL = -1 // expire immediately
+	assert.NoError(t, readWriter.WriteTraceEvent("trace_id", "expired_id", transaction, wOpts))
+	_, err = readWriter.ReadTraceEventRaw("trace_id", "expired_id")
+	assert.Equal(t, eventstorage.ErrNotFound, err)
 }
 
-func TestStorageLimit(t *testing.T) {
-	tempdir := t.TempDir()
-	opts := func() badger.Options {
-		opts := badgerOptions()
-		opts = opts.WithInMemory(false)
-		opts = opts.WithDir(tempdir).WithValueDir(tempdir)
-		return opts
+func TestTraceEventFlags(t *testing.T) {
+	db := newBadgerDB(t, badgerOptions)
+	store := eventstorage.New(db, eventstorage.ProtobufCodec{})
+	readWriter := store.NewShardedReadWriter()
+	defer readWriter.Close()
+	wOpts := eventstorage.WriterOpts{TTL: time.Minute}
+
+	transaction := &modelpb.APMEvent{Transaction: &modelpb.Transaction{Id: "transaction_id"}}
+	span1 := &modelpb.APMEvent{Span: &modelpb.Span{Id: "span_1"}}
+	span2 := &modelpb.APMEvent{Span: &modelpb.Span{Id: "span_2"}}
+	assert.NoError(t, readWriter.WriteTraceEventFlags("trace_id", "transaction_id", transaction, 0x03, wOpts))
+	assert.NoError(t, readWriter.WriteTraceEventFlags("trace_id", "span_1", span1, eventstorage.TraceEventFlagsMask, wOpts))
+	assert.NoError(t, readWriter.WriteTraceEvent("trace_id", "span_2", span2, wOpts))
+	assert.Error(t, readWriter.WriteTraceEventFlags("trace_id", "span_3", span2, 0x80, wOpts))
+	assert.NoError(t, readWriter.Flush())
+
+	for id, expected := range map[string]uint8{
+		"transaction_id": 0x03,
+		"span_1":         0x7f,
+		"span_2":         0,
+	} {
+		flags, err := readWriter.ReadTraceEventFlags("trace_id", id)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, flags, id)
 	}
+	_, err := readWriter.ReadTraceEventFlags("trace_id", "span_3")
+	assert.Equal(t, eventstorage.ErrNotFound, err)
 
-	// Open and close the database to create a non-empty value log file,
-	// which will cause writes below to fail due to the storage limit being
-	// exceeded. We would otherwise have to rely on Badger's one minute
-	// timer to refresh the size.
-	db := newBadgerDB(t, opts)
-	db.Close()
-	db = newBadgerDB(t, opts)
+	// Events with flags are recognized as trace events.
+	var batch modelpb.Batch
+	assert.NoError(t, readWriter.ReadTraceEvents("trace_id", &batch))
+	assert.Empty(t, cmp.Diff(modelpb.Batch{span1, span2, transaction}, batch, protocmp.Transform()))
+	n, err := store.TotalEventCount()
+	assert.NoError(t, err)
+	assert.Equal(t, 3, n)
+}
+
+func TestStorageTTL(t *testing.T) {
+	db := newBadgerDB(t, badgerOptions)
+	assert.Zero(t, eventstorage.New(db, eventstorage.ProtobufCodec{}).TTL())
+	store := eventstorage.New(db, eventstorage.ProtobufCodec{}, eventstorage.WithTTL(time.Hour))
+	assert.Equal(t, time.Hour, store.TTL())
+}
 
+func TestStorageCodec(t *testing.T) {
+	db := newBadgerDB(t, badgerOptions)
 	store := eventstorage.New(db, eventstorage.ProtobufCodec{})
+	assert.Equal(t, eventstorage.ProtobufCodec{}, store.Codec())
+
+	// Reencode replaces the codec.
+	_, err := store.Reencode(jsonCodec{})
+	require.NoError(t, err)
+	assert.Equal(t, jsonCodec{}, store.Codec())
+}
+
+func TestStorageMaxEventSize(t *testing.T) {
+	db := newBadgerDB(t, badgerOptions)
+	small := &modelpb.APMEvent{Span: &modelpb.Span{Id: "small"}}
+	large := &modelpb.APMEvent{Span: &modelpb.Span{Id: "large", Name: strings.Repeat("x", 1000)}}
+	store := eventstorage.New(db, eventstorage.ProtobufCodec{}, eventstorage.WithMaxEventSize(100))
 	readWriter := store.NewReadWriter()
 	defer readWriter.Close()
+	wOpts := eventstorage.WriterOpts{TTL: time.Minute}
 
-	traceID := uuid.Must(uuid.NewV4()).String()
-	transactionID := uuid.Must(uuid.NewV4()).String()
-	transaction := modelpb.APMEvent{Transaction: &modelpb.Transaction{Id: transactionID}}
-	err := readWriter.WriteTraceEvent(traceID, transactionID, &transaction, eventstorage.WriterOpts{
-		TTL:                 time.Minute,
-		StorageLimitInBytes: 1,
-	})
-	assert.ErrorIs(t, err, eventstorage.ErrLimitReached)
+	assert.NoError(t, readWriter.WriteTraceEvent("trace_id", "small", small, wOpts))
+	err := readWriter.WriteTraceEvent("trace_id", "large", large, wOpts)
+	assert.ErrorIs(t, err, eventstorage.ErrEventTooLarge)
+	assert.NoError(t, readWriter.Flush())
+	var batch modelpb.Batch
+	assert.NoError(t, readWriter.ReadTraceEvents("trace_id", &batch))
+	assert.Empty(t, cmp.Diff(modelpb.Batch{small}, batch, protocmp.Transform()))
 
-	// Assert the stored write has been discarded.
+	// Event size is unlimited by default.
+	store = eventstorage.New(db, eventstorage.ProtobufCodec{}, eventstorage.WithMaxEventSize(0))
+	readWriter = store.NewReadWriter()
+	defer readWriter.Close()
+	assert.NoError(t, readWriter.WriteTraceEvent("trace_id", "large", large, wOpts))
+
+	assert.Panics(t, func() { eventstorage.WithMaxEventSize(-1) })
+}
+
+func TestStorageMinFreeDisk(t *testing.T) {
+	db := newBadgerDB(t, badgerOptions)
+	store := eventstorage.New(db, eventstorage.ProtobufCodec{},
+		eventstorage.WithMinFreeDisk(t.TempDir(), eventstorage.MinFreeDisk{Bytes: math.MaxUint64}),
+	)
+	readWriter := store.NewReadWriter()
+	defer readWriter.Close()
+	wOpts := eventstorage.WriterOpts{TTL: time.Minute}
+
+	// Trace events are rejected while free space is below the minimum,
+	// but sampling decisions and deletions are still committed.
+	assert.ErrorIs(t,
+		readWriter.WriteTraceEvent("trace_id", "span_id", &modelpb.APMEvent{}, wOpts),
+		eventstorage.ErrLimitReached,
+	)
+	assert.NoError(t, readWriter.WriteTraceSampled("trace_id", true, wOpts))
+	assert.NoError(t, readWriter.DeleteTraceEvent("trace_id", "span_id"))
+	assert.NoError(t, readWriter.Flush())
 	var batch modelpb.Batch
-	readWriter.ReadTraceEvents(traceID, &batch)
-	assert.Equal(t, 0, len(batch))
+	assert.NoError(t, readWriter.ReadTraceEvents("trace_id", &batch))
+	assert.Empty(t, batch)
+	assert.Equal(t, int64(1), store.Stats().LimitReached)
+	sampled, err := store.IsTraceSampledConcurrent("trace_id")
+	assert.NoError(t, err)
+	assert.True(t, sampled)
+
+	store = eventstorage.New(db, eventstorage.ProtobufCodec{},
+		eventstorage.WithMinFreeDisk(t.TempDir(), eventstorage.MinFreeDisk{Bytes: 1}),
+	)
+	readWriter = store.NewReadWriter()
+	defer readWriter.Close()
+	assert.NoError(t, readWriter.WriteTraceEvent("trace_id", "span_id", &modelpb.APMEvent{}, wOpts))
+	assert.NoError(t, readWriter.Flush())
+	assert.NoError(t, readWriter.ReadTraceEvents("trace_id", &batch))
+	assert.Len(t, batch, 1)
+
+	assert.Panics(t, func() { eventstorage.WithMinFreeDisk("", eventstorage.MinFreeDisk{Percent: 101}) })
 }
 
-func badgerOptions() badger.Options {
-	return badger.DefaultOptions("").WithInMemory(true).WithLogger(nil)
+func TestStorageFlushSizes(t *testing.T) {
+	db := newBadgerDB(t, badgerOptions)
+	store := eventstorage.New(db, eventstorage.ProtobufCodec{})
+	readWriter := store.NewReadWriter()
+	defer readWriter.Close()
+	wOpts := eventstorage.WriterOpts{TTL: time.Minute}
+
+	for i := 0; i < 20; i++ {
+		assert.NoError(t, readWriter.WriteTraceEvent("trace_id", fmt.Sprintf("span_%d", i), &modelpb.APMEvent{}, wOpts))
+	}
+	assert.NoError(t, readWriter.Flush())
+	assert.NoError(t, readWriter.Flush()) // nothing pending
+
+	sizes := store.Stats().FlushSizes
+	assert.Equal(t, int64(2), sizes.Count)
+	assert.Equal(t, int64(20), sizes.Sum)
+	assert.Equal(t, int64(1), sizes.Buckets[0])
+	assert.Equal(t, int64(1), sizes.Buckets[10])
+	assert.Equal(t, int64(2), sizes.Buckets[50])
+	assert.Equal(t, int64(2), sizes.Buckets[1600])
 }
 
-type badgerOptionsFunc func() badger.Options
+func TestStorageMaxFlushInterval(t *testing.T) {
+	db := newBadgerDB(t, badgerOptions)
+	store := eventstorage.New(db, eventstorage.ProtobufCodec{}, eventstorage.WithMaxFlushInterval(50*time.Millisecond))
+	readWriter := store.NewReadWriter()
+	defer readWriter.Close()
+	wOpts := eventstorage.WriterOpts{TTL: time.Minute}
 
-func newBadgerDB(tb testing.TB, badgerOptions badgerOptionsFunc) *badger.DB {
-	db, err := badger.Open(badgerOptions())
-	if err != nil {
-		panic(err)
+	// Writes within the interval are not flushed.
+	assert.NoError(t, readWriter.WriteTraceEvent("trace_id", "span_0", &modelpb.APMEvent{}, wOpts))
+	assert.NoError(t, readWriter.WriteTraceEvent("trace_id", "span_1", &modelpb.APMEvent{}, wOpts))
+	assert.Equal(t, int64(0), store.Stats().Flushes)
+
+	// Once the interval has elapsed, the next write flushes the
+	// preceding writes, well before reaching the flush threshold.
+	time.Sleep(60 * time.Millisecond)
+	assert.NoError(t, readWriter.WriteTraceEvent("trace_id", "span_2", &modelpb.APMEvent{}, wOpts))
+	assert.Equal(t, int64(1), store.Stats().Flushes)
+
+	reader := store.NewReadWriter()
+	defer reader.Close()
+	var batch modelpb.Batch
+	assert.NoError(t, reader.ReadTraceEvents("trace_id", &batch))
+	assert.Len(t, batch, 2)
+
+	assert.Panics(t, func() { eventstorage.WithMaxFlushInterval(0) })
+	assert.Panics(t, func() { eventstorage.WithMaxFlushInterval(-time.Second) })
+}
+
+func TestMergeTraceLabels(t *testing.T) {
+	db := newBadgerDB(t, badgerOptions)
+	store := eventstorage.New(db, eventstorage.ProtobufCodec{})
+	readWriter := store.NewShardedReadWriter()
+	defer readWriter.Close()
+	wOpts := eventstorage.WriterOpts{TTL: time.Minute}
+
+	_, err := readWriter.ReadTraceLabels("trace_id")
+	assert.Equal(t, eventstorage.ErrNotFound, err)
+
+	assert.NoError(t, readWriter.MergeTraceLabels("trace_id", map[string]string{"a": "1", "b": "2"}, wOpts))
+	assert.NoError(t, readWriter.MergeTraceLabels("trace_id", map[string]string{"b": "3", "c": "4"}, wOpts))
+	assert.NoError(t, readWriter.Flush())
+	assert.NoError(t, readWriter.MergeTraceLabels("trace_id", map[string]string{"d": "5"}, wOpts))
+
+	labels, err := readWriter.ReadTraceLabels("trace_id")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"a": "1", "b": "3", "c": "4", "d": "5"}, labels)
+
+	// The trace summary must not be visible as a trace event.
+	var batch modelpb.Batch
+	assert.NoError(t, readWriter.ReadTraceEvents("trace_id", &batch))
+	assert.Empty(t, batch)
+}
+
+func TestMirrorReadWriter(t *testing.T) {
+	primaryStore := eventstorage.New(newBadgerDB(t, badgerOptions), eventstorage.ProtobufCodec{})
+	secondaryStore := eventstorage.New(newBadgerDB(t, badgerOptions), eventstorage.ProtobufCodec{})
+	secondary := secondaryStore.NewReadWriter()
+	readWriter := eventstorage.NewMirrorReadWriter(primaryStore.NewReadWriter(), secondary)
+	defer readWriter.Close()
+	wOpts := eventstorage.WriterOpts{TTL: time.Minute}
+
+	span1 := &modelpb.APMEvent{Span: &modelpb.Span{Id: "span_1"}}
+	span2 := &modelpb.APMEvent{Span: &modelpb.Span{Id: "span_2"}}
+	assert.NoError(t, readWriter.WriteTraceEvent("trace_id", "span_1", span1, wOpts))
+	assert.NoError(t, readWriter.WriteTraceEvent("trace_id", "span_2", span2, wOpts))
+	assert.NoError(t, readWriter.WriteTraceSampled("trace_id", true, wOpts))
+	assert.NoError(t, readWriter.Flush())
+
+	// Writes are applied to both storages.
+	var batch modelpb.Batch
+	assert.NoError(t, secondary.ReadTraceEvents("trace_id", &batch))
+	assert.Empty(t, cmp.Diff(modelpb.Batch{span1, span2}, batch, protocmp.Transform()))
+	sampled, err := secondary.IsTraceSampled("trace_id")
+	assert.NoError(t, err)
+	assert.True(t, sampled)
+	equal, err := readWriter.CompareTraceEvents("trace_id")
+	assert.NoError(t, err)
+	assert.True(t, equal)
+
+	// Reads are served by the primary, so differences are detected.
+	assert.NoError(t, secondary.DeleteTraceEvent("trace_id", "span_2"))
+	batch = nil
+	assert.NoError(t, readWriter.ReadTraceEvents("trace_id", &batch))
+	assert.Len(t, batch, 2)
+	equal, err = readWriter.CompareTraceEvents("trace_id")
+	assert.NoError(t, err)
+	assert.False(t, equal)
+
+	// Writes rejected by the primary are not applied to the secondary.
+	primaryStore.SetReadOnly(true)
+	assert.Equal(t, eventstorage.ErrReadOnly, readWriter.WriteTraceEvent("trace_id_2", "span_1", span1, wOpts))
+	has, err := secondary.HasTraceEvents("trace_id_2")
+	assert.NoError(t, err)
+	assert.False(t, has)
+	primaryStore.SetReadOnly(false)
+
+	// Errors from the secondary are identified as such.
+	secondaryStore.SetReadOnly(true)
+	err = readWriter.WriteTraceEvent("trace_id_2", "span_1", span1, wOpts)
+	assert.ErrorIs(t, err, eventstorage.ErrReadOnly)
+	assert.EqualError(t, err, "secondary storage: storage is read-only")
+}
+
+func TestValidTraceID(t *testing.T) {
+	for id, valid := range map[string]bool{
+		"0102030405060708090a0b0c0d0e0f10":  true,
+		"0102030405060708090A0B0C0D0E0F10":  true,
+		"":                                  false,
+		"trace_id":                          false,
+		"0102030405060708090a0b0c0d0e0f1":   false,
+		"0102030405060708090a0b0c0d0e0f100": false,
+		"0102030405060708090a0b0c0d0e0f1g":  false,
+	} {
+		assert.Equal(t, valid, eventstorage.ValidTraceID(id), id)
 	}
-	tb.Cleanup(func() { db.Close() })
-	return db
+}
+
+func TestStorageTraceIDValidation(t *testing.T) {
+	db := newBadgerDB(t, badgerOptions)
+	store := eventstorage.New(db, eventstorage.ProtobufCodec{}, eventstorage.WithTraceIDValidation(true))
+	readWriter := store.NewReadWriter()
+	defer readWriter.Close()
+	wOpts := eventstorage.WriterOpts{TTL: time.Minute}
+
+	var idErr *eventstorage.InvalidTraceIDError
+	err := readWriter.WriteTraceEvent("trace_id", "span_id", &modelpb.APMEvent{}, wOpts)
+	require.ErrorAs(t, err, &idErr)
+	assert.Equal(t, "trace_id", idErr.TraceID)
+	assert.EqualError(t, err, `invalid trace ID "trace_id": must be 32 hex digits`)
+	assert.ErrorAs(t, readWriter.WriteTraceSampled("trace_id", true, wOpts), &idErr)
+	assert.NoError(t, readWriter.Flush())
+	_, err = readWriter.IsTraceSampled("trace_id")
+	assert.Equal(t, eventstorage.ErrNotFound, err)
+
+	const traceID = "0102030405060708090a0b0c0d0e0f10"
+	assert.NoError(t, readWriter.WriteTraceEvent(traceID, "span_id", &modelpb.APMEvent{}, wOpts))
+	assert.NoError(t, readWriter.WriteTraceSampled(traceID, true, wOpts))
+
+	// Invalid trace IDs are accepted unless validation is enabled.
+	store = eventstorage.New(db, eventstorage.ProtobufCodec{})
+	readWriter = store.NewReadWriter()
+	defer readWriter.Close()
+	assert.NoError(t, readWriter.WriteTraceEvent("trace_id", "span_id", &modelpb.APMEvent{}, wOpts))
+}
+
+func TestTraceEventSummaries(t *testing.T) {
+	db := newBadgerDB(t, badgerOptions)
+	store := eventstorage.New(db, eventstorage.ProtobufCodec{}, eventstorage.WithTraceEventSummaries(true))
+	readWriter := store.NewShardedReadWriter()
+	defer readWriter.Close()
+	wOpts := eventstorage.WriterOpts{TTL: time.Minute}
+
+	_, err := readWriter.ReadTraceEventSummary("trace_id")
+	assert.Equal(t, eventstorage.ErrNotFound, err)
+
+	events := []*modelpb.APMEvent{{
+		Transaction: &modelpb.Transaction{Id: "transaction"},
+		Event:       &modelpb.Event{Duration: uint64(5 * time.Second)},
+	}, {
+		Span: &modelpb.Span{
+			Id:                 "span_1",
+			Type:               "db",
+			DestinationService: &modelpb.DestinationService{Resource: "mysql"},
+		},
+		Event: &modelpb.Event{Duration: uint64(time.Second)},
+	}, {
+		Span: &modelpb.Span{
+			Id:                 "span_2",
+			Type:               "db",
+			DestinationService: &modelpb.DestinationService{Resource: "elasticsearch"},
+		},
+		Event: &modelpb.Event{Duration: uint64(2 * time.Second), Outcome: "failure"},
+	}, {
+		Span:  &modelpb.Span{Id: "span_3", Type: "external"},
+		Event: &modelpb.Event{Duration: uint64(3 * time.Second)},
+	}}
+	ids := []string{"transaction", "span_1", "span_2", "span_3"}
+	for i, event := range events {
+		assert.NoError(t, readWriter.WriteTraceEvent("trace_id", ids[i], event, wOpts))
+	}
+	assert.NoError(t, readWriter.Flush())
+
+	summary, err := readWriter.ReadTraceEventSummary("trace_id")
+	assert.NoError(t, err)
+	assert.WithinDuration(t, time.Now(), summary.FirstWritten, time.Minute)
+	summary.FirstWritten = time.Time{}
+	assert.Equal(t, eventstorage.TraceEventSummary{
+		Events:      4,
+		Spans:       3,
+		HasError:    true,
+		MaxDuration: 5 * time.Second,
+		SpanDurations: map[string]time.Duration{
+			"db":       3 * time.Second,
+			"external": 3 * time.Second,
+		},
+		DestinationServices: []string{"elasticsearch", "mysql"},
+	}, summary)
+
+	// The summary must not be visible as a trace event.
+	var batch modelpb.Batch
+	assert.NoError(t, readWriter.ReadTraceEvents("trace_id", &batch))
+	assert.Len(t, batch, 4)
+
+	// Finalizing the trace deletes its summary along with its events.
+	assert.NoError(t, readWriter.FinalizeTrace("trace_id", false, nil, wOpts))
+	_, err = readWriter.ReadTraceEventSummary("trace_id")
+	assert.Equal(t, eventstorage.ErrNotFound, err)
+
+	// Summaries are not maintained unless enabled.
+	store = eventstorage.New(db, eventstorage.ProtobufCodec{})
+	readWriter = store.NewShardedReadWriter()
+	defer readWriter.Close()
+	assert.NoError(t, readWriter.WriteTraceEvent("trace_id_2", "span_1", events[1], wOpts))
+	_, err = readWriter.ReadTraceEventSummary("trace_id_2")
+	assert.Equal(t, eventstorage.ErrNotFound, err)
+}
+
+func TestDecisionLatency(t *testing.T) {
+	db := newBadgerDB(t, badgerOptions)
+	store := eventstorage.New(db, eventstorage.ProtobufCodec{}, eventstorage.WithTraceEventSummaries(true))
+	readWriter := store.NewReadWriter()
+	defer readWriter.Close()
+	wOpts := eventstorage.WriterOpts{TTL: time.Minute}
+
+	_, ok := store.DecisionLatencyPercentile(50)
+	assert.False(t, ok)
+
+	for i := 0; i < 4; i++ {
+		traceID := fmt.Sprintf("trace_%d", i)
+		assert.NoError(t, readWriter.WriteTraceEvent(traceID, "span", &modelpb.APMEvent{}, wOpts))
+	}
+	assert.NoError(t, readWriter.Flush())
+	time.Sleep(10 * time.Millisecond)
+	for i := 0; i < 4; i++ {
+		traceID := fmt.Sprintf("trace_%d", i)
+		assert.NoError(t, readWriter.FinalizeTrace(traceID, i%2 == 0, func(modelpb.Batch) error { return nil }, wOpts))
+	}
+	// Traces without events, and so without a summary, are not observed.
+	assert.NoError(t, readWriter.FinalizeTrace("trace_4", true, func(modelpb.Batch) error { return nil }, wOpts))
+
+	// Decisions recorded with WriteTraceSampled are observed, but only
+	// the first decision for each trace.
+	assert.NoError(t, readWriter.WriteTraceEvent("trace_5", "span", &modelpb.APMEvent{}, wOpts))
+	time.Sleep(10 * time.Millisecond)
+	assert.NoError(t, readWriter.WriteTraceSampled("trace_5", true, wOpts))
+	assert.NoError(t, readWriter.WriteTraceSampled("trace_5", true, wOpts))
+
+	latency := store.Stats().DecisionLatency
+	assert.Equal(t, int64(5), latency.Count)
+	assert.GreaterOrEqual(t, latency.Sum, 50*time.Millisecond)
+	assert.Equal(t, int64(5), latency.Buckets[time.Second])
+	assert.Equal(t, int64(5), latency.Buckets[time.Hour])
+
+	p50, ok := store.DecisionLatencyPercentile(50)
+	assert.True(t, ok)
+	p100, ok := store.DecisionLatencyPercentile(100)
+	assert.True(t, ok)
+	assert.GreaterOrEqual(t, p50, 10*time.Millisecond)
+	assert.GreaterOrEqual(t, p100, p50)
+	assert.Less(t, p100, time.Second)
+
+	assert.Panics(t, func() { store.DecisionLatencyPercentile(0) })
+	assert.Panics(t, func() { store.DecisionLatencyPercentile(101) })
+}
+
+func TestEventIDIndex(t *testing.T) {
+	db := newBadgerDB(t, badgerOptions)
+	store := eventstorage.New(db, eventstorage.ProtobufCodec{}, eventstorage.WithEventIDIndex(true))
+	readWriter := store.NewShardedReadWriter()
+	defer readWriter.Close()
+	wOpts := eventstorage.WriterOpts{TTL: time.Minute}
+
+	_, err := readWriter.ReadEventByID("span_1")
+	assert.Equal(t, eventstorage.ErrNotFound, err)
+
+	span1 := &modelpb.APMEvent{Span: &modelpb.Span{Id: "span_1", Name: "one"}}
+	span2 := &modelpb.APMEvent{Span: &modelpb.Span{Id: "span_2", Name: "two"}}
+	assert.NoError(t, readWriter.WriteTraceEvent("trace_1", "span_1", span1, wOpts))
+	assert.NoError(t, readWriter.WriteTraceEvent("trace_2", "span_2", span2, wOpts))
+	assert.NoError(t, readWriter.Flush())
+
+	event, err := readWriter.ReadEventByID("span_1")
+	assert.NoError(t, err)
+	assert.Empty(t, cmp.Diff(span1, event, protocmp.Transform()))
+	event, err = readWriter.ReadEventByID("span_2")
+	assert.NoError(t, err)
+	assert.Empty(t, cmp.Diff(span2, event, protocmp.Transform()))
+
+	// Index entries must not be visible as trace events, and are
+	// counted separately by Verify.
+	var batch modelpb.Batch
+	assert.NoError(t, readWriter.ReadTraceEvents("trace_1", &batch))
+	assert.Len(t, batch, 1)
+	report, err := store.Verify(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, eventstorage.VerifyReport{Events: 2, EventIDIndexes: 2}, report)
+
+	// Deleting or finalizing deletes index entries along with events.
+	assert.NoError(t, readWriter.DeleteTraceEvent("trace_1", "span_1"))
+	assert.NoError(t, readWriter.FinalizeTrace("trace_2", false, nil, wOpts))
+	assert.NoError(t, readWriter.Flush())
+	_, err = readWriter.ReadEventByID("span_1")
+	assert.Equal(t, eventstorage.ErrNotFound, err)
+	_, err = readWriter.ReadEventByID("span_2")
+	assert.Equal(t, eventstorage.ErrNotFound, err)
+	report, err = store.Verify(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, eventstorage.VerifyReport{Decisions: 1}, report)
+
+	// Events are not indexed unless enabled.
+	store = eventstorage.New(db, eventstorage.ProtobufCodec{})
+	readWriter = store.NewShardedReadWriter()
+	defer readWriter.Close()
+	assert.NoError(t, readWriter.WriteTraceEvent("trace_3", "span_3", span1, wOpts))
+	assert.NoError(t, readWriter.Flush())
+	_, err = readWriter.ReadEventByID("span_3")
+	assert.Equal(t, eventstorage.ErrNotFound, err)
+}
+
+func TestStorageReadOnly(t *testing.T) {
+	db := newBadgerDB(t, badgerOptions)
+	store := eventstorage.New(db, eventstorage.ProtobufCodec{})
+	readWriter := store.NewShardedReadWriter()
+	defer readWriter.Close()
+	wOpts := eventstorage.WriterOpts{TTL: time.Minute}
+
+	transaction := &modelpb.APMEvent{Transaction: &modelpb.Transaction{Id: "transaction_id"}}
+	assert.NoError(t, readWriter.WriteTraceEvent("trace_id", "transaction_id", transaction, wOpts))
+	assert.NoError(t, readWriter.WriteTraceSampled("trace_id", true, wOpts))
+
+	store.SetReadOnly(true)
+	err := readWriter.WriteTraceEvent("trace_id", "span_id", &modelpb.APMEvent{Span: &modelpb.Span{Id: "span_id"}}, wOpts)
+	assert.Equal(t, eventstorage.ErrReadOnly, err)
+	err = readWriter.WriteTraceSampled("trace_id2", true, wOpts)
+	assert.Equal(t, eventstorage.ErrReadOnly, err)
+	err = readWriter.MergeTraceLabels("trace_id", map[string]string{"k": "v"}, wOpts)
+	assert.Equal(t, eventstorage.ErrReadOnly, err)
+
+	// Pending writes may still be flushed, and reads continue to work.
+	assert.NoError(t, readWriter.Flush())
+	var batch modelpb.Batch
+	assert.NoError(t, readWriter.ReadTraceEvents("trace_id", &batch))
+	assert.Len(t, batch, 1)
+	sampled, err := readWriter.IsTraceSampled("trace_id")
+	assert.NoError(t, err)
+	assert.True(t, sampled)
+
+	store.SetReadOnly(false)
+	assert.NoError(t, readWriter.WriteTraceSampled("trace_id2", true, wOpts))
+}
+
+func TestStorageVerify(t *testing.T) {
+	db := newBadgerDB(t, badgerOptions)
+	store := eventstorage.New(db, eventstorage.ProtobufCodec{}, eventstorage.WithTTL(time.Hour))
+	readWriter := store.NewReadWriter()
+	defer readWriter.Close()
+	wOpts := eventstorage.WriterOpts{TTL: time.Hour}
+	require.NoError(t, readWriter.WriteTraceEvent("trace_id", "span_1", &modelpb.APMEvent{}, wOpts))
+	require.NoError(t, readWriter.WriteTraceSampled("trace_id", true, wOpts))
+	require.NoError(t, readWriter.MergeTraceLabels("trace_id", map[string]string{"a": "b"}, wOpts))
+	require.NoError(t, readWriter.Flush())
+
+	report, err := store.Verify(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, eventstorage.VerifyReport{Events: 1, Decisions: 1, Summaries: 1}, report)
+
+	require.NoError(t, db.Update(func(txn *badger.Txn) error {
+		for _, e := range []*badger.Entry{
+			badger.NewEntry([]byte("trace_id:span_2"), []byte{0xff}).WithMeta('e').WithTTL(time.Hour),
+			badger.NewEntry([]byte("trace_id:span_3"), nil).WithMeta('e').WithTTL(2 * time.Hour),
+			badger.NewEntry([]byte("trace:id"), nil).WithMeta('s').WithTTL(time.Hour),
+			badger.NewEntry([]byte("other"), nil).WithMeta('z').WithTTL(time.Hour),
+		} {
+			if err := txn.SetEntry(e); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	report, err = store.Verify(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 2, report.Events)
+	assert.Equal(t, 2, report.Decisions)
+	assert.Equal(t, 1, report.Unknown)
+	var problems []string
+	for _, p := range report.Problems {
+		problems = append(problems, p.Key+": "+strings.SplitN(p.Problem, ":", 2)[0])
+	}
+	assert.ElementsMatch(t, []string{
+		"other: unknown entry type 0x7a",
+		"trace:id: sampling decision key collides with trace event keys",
+		"trace_id:span_2: failed to decode trace event",
+		"trace_id:span_3: entry expires in 2h0m0s, exceeding TTL 1h0m0s",
+	}, problems)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = store.Verify(ctx)
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestReadTraceEventsDecodePanic(t *testing.T) {
+	db := newBadgerDB(t, badgerOptions)
+	store := eventstorage.New(db, panickingCodec{})
+	readWriter := store.NewShardedReadWriter()
+	defer readWriter.Close()
+	wOpts := eventstorage.WriterOpts{TTL: time.Minute}
+
+	good := &modelpb.APMEvent{Transaction: &modelpb.Transaction{Id: "good"}}
+	bad := &modelpb.APMEvent{Transaction: &modelpb.Transaction{Id: "bad"}}
+	assert.NoError(t, readWriter.WriteTraceEvent("trace_id", "a", bad, wOpts))
+	assert.NoError(t, readWriter.WriteTraceEvent("trace_id", "b", good, wOpts))
+	assert.NoError(t, readWriter.Flush())
+
+	var batch modelpb.Batch
+	err := readWriter.ReadTraceEvents("trace_id", &batch)
+	assert.ErrorIs(t, err, eventstorage.ErrDecodeFailed)
+	require.Len(t, batch, 1)
+	assert.Equal(t, "good", batch[0].Transaction.Id)
+}
+
+// panickingCodec is a Codec that panics when decoding events
+// whose transaction ID is "bad".
+type panickingCodec struct {
+	eventstorage.ProtobufCodec
+}
+
+func (c panickingCodec) DecodeEvent(data []byte, event *modelpb.APMEvent) error {
+	if err := c.ProtobufCodec.DecodeEvent(data, event); err != nil {
+		return err
+	}
+	if event.Transaction.GetId() == "bad" {
+		panic("bad event")
+	}
+	return nil
+}
+
+func TestReadTraceEventsPartialResults(t *testing.T) {
+	db := newBadgerDB(t, badgerOptions)
+	store := eventstorage.New(db, failingCodec{})
+	readWriter := store.NewShardedReadWriter()
+	defer readWriter.Close()
+	wOpts := eventstorage.WriterOpts{TTL: time.Minute}
+
+	for i, id := range []string{"bad", "good", "failing", "good"} {
+		event := &modelpb.APMEvent{Transaction: &modelpb.Transaction{Id: id}}
+		assert.NoError(t, readWriter.WriteTraceEvent("trace_id", fmt.Sprint(i), event, wOpts))
+	}
+	assert.NoError(t, readWriter.Flush())
+
+	var batch modelpb.Batch
+	err := readWriter.ReadTraceEvents("trace_id", &batch)
+	assert.ErrorIs(t, err, eventstorage.ErrDecodeFailed)
+	var merr *multierror.Error
+	require.ErrorAs(t, err, &merr)
+	require.Len(t, merr.Errors, 2)
+	assert.ErrorContains(t, merr.Errors[0], "codec panicked")
+	assert.ErrorContains(t, merr.Errors[1], "codec failed: failing event")
+	require.Len(t, batch, 2)
+	assert.Equal(t, "good", batch[0].Transaction.Id)
+	assert.Equal(t, "good", batch[1].Transaction.Id)
+}
+
+// failingCodec is a Codec that panics when decoding events whose
+// transaction ID is "bad", like panickingCodec, and returns an error
+// when decoding events whose transaction ID is "failing".
+type failingCodec struct {
+	panickingCodec
+}
+
+func (c failingCodec) DecodeEvent(data []byte, event *modelpb.APMEvent) error {
+	if err := c.panickingCodec.DecodeEvent(data, event); err != nil {
+		return err
+	}
+	if event.Transaction.GetId() == "failing" {
+		return errors.New("failing event")
+	}
+	return nil
+}
+
+func TestStorageReencode(t *testing.T) {
+	db := newBadgerDB(t, badgerOptions)
+	store := eventstorage.New(db, eventstorage.ProtobufCodec{})
+	readWriter := store.NewReadWriter()
+	wOpts := eventstorage.WriterOpts{TTL: time.Minute}
+
+	transaction := &modelpb.APMEvent{Transaction: &modelpb.Transaction{Id: "transaction_id"}}
+	span := &modelpb.APMEvent{Span: &modelpb.Span{Id: "span_id"}}
+	assert.NoError(t, readWriter.WriteTraceEvent("trace_id", "transaction_id", transaction, wOpts))
+	assert.NoError(t, readWriter.WriteTraceEvent("trace_id", "span_id", span, wOpts))
+	assert.NoError(t, readWriter.WriteTraceSampled("trace_id", true, wOpts))
+	assert.NoError(t, readWriter.Flush())
+	readWriter.Close()
+
+	n, err := store.Reencode(jsonCodec{})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	readWriter = store.NewReadWriter()
+	defer readWriter.Close()
+
+	raw, err := readWriter.ReadTraceEventRaw("trace_id", "span_id")
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"span":{"id":"span_id"}}`, string(raw))
+
+	var batch modelpb.Batch
+	assert.NoError(t, readWriter.ReadTraceEvents("trace_id", &batch))
+	assert.Empty(t, cmp.Diff(modelpb.Batch{span, transaction}, batch, protocmp.Transform()))
+
+	sampled, err := readWriter.IsTraceSampled("trace_id")
+	assert.NoError(t, err)
+	assert.True(t, sampled)
+}
+
+func TestStorageReencodeDecodeFailed(t *testing.T) {
+	db := newBadgerDB(t, badgerOptions)
+	store := eventstorage.New(db, failingCodec{})
+	readWriter := store.NewReadWriter()
+	wOpts := eventstorage.WriterOpts{TTL: time.Minute}
+
+	for i, id := range []string{"bad", "good", "failing", "good"} {
+		event := &modelpb.APMEvent{Transaction: &modelpb.Transaction{Id: id}}
+		assert.NoError(t, readWriter.WriteTraceEvent("trace_id", fmt.Sprint(i), event, wOpts))
+	}
+	assert.NoError(t, readWriter.Flush())
+	readWriter.Close()
+
+	// Events that cannot be decoded are deleted and reported, without
+	// aborting the migration.
+	n, err := store.Reencode(jsonCodec{})
+	assert.ErrorIs(t, err, eventstorage.ErrDecodeFailed)
+	var merr *multierror.Error
+	require.ErrorAs(t, err, &merr)
+	require.Len(t, merr.Errors, 2)
+	assert.ErrorContains(t, merr.Errors[0], `codec panicked: bad event (key: "trace_id:0")`)
+	assert.ErrorContains(t, merr.Errors[1], `codec failed: failing event (key: "trace_id:2")`)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, jsonCodec{}, store.Codec())
+	inProgress, err := store.ReencodeInProgress()
+	assert.NoError(t, err)
+	assert.False(t, inProgress)
+
+	readWriter = store.NewReadWriter()
+	defer readWriter.Close()
+	var batch modelpb.Batch
+	assert.NoError(t, readWriter.ReadTraceEvents("trace_id", &batch))
+	require.Len(t, batch, 2)
+	assert.Equal(t, "good", batch[0].Transaction.Id)
+	assert.Equal(t, "good", batch[1].Transaction.Id)
+}
+
+func TestStorageRewriteTTL(t *testing.T) {
+	db := newBadgerDB(t, badgerOptions)
+	store := eventstorage.New(db, eventstorage.ProtobufCodec{})
+	readWriter := store.NewReadWriter()
+	defer readWriter.Close()
+	wOpts := eventstorage.WriterOpts{TTL: time.Hour}
+
+	span := &modelpb.APMEvent{Span: &modelpb.Span{Id: "span_id"}}
+	assert.NoError(t, readWriter.WriteTraceEvent("trace_1", "transaction_id", &modelpb.APMEvent{}, wOpts))
+	assert.NoError(t, readWriter.WriteTraceEvent("trace_1", "span_id", span, wOpts))
+	assert.NoError(t, readWriter.WriteTraceSampled("trace_2", false, wOpts))
+	assert.NoError(t, readWriter.MergeTraceLabels("trace_1", map[string]string{"k": "v"}, wOpts))
+	assert.NoError(t, readWriter.Flush())
+
+	_, err := store.RewriteTTL(0)
+	assert.Error(t, err)
+
+	n, err := store.RewriteTTL(time.Minute)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, n)
+
+	expiries := make(map[string]time.Duration)
+	assert.NoError(t, db.View(func(txn *badger.Txn) error {
+		iter := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer iter.Close()
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			item := iter.Item()
+			expiries[string(item.Key())] = time.Until(time.Unix(int64(item.ExpiresAt()), 0))
+		}
+		return nil
+	}))
+	assert.Len(t, expiries, 4)
+	for key, remaining := range expiries {
+		expected := time.Minute
+		if key != "trace_1:span_id" && key != "trace_1:transaction_id" && key != "trace_2" {
+			expected = time.Hour // labels are left untouched
+		}
+		assert.InDelta(t, expected, remaining, float64(2*time.Second), key)
+	}
+
+	var batch modelpb.Batch
+	assert.NoError(t, readWriter.ReadTraceEvents("trace_1", &batch))
+	assert.Len(t, batch, 2)
+}
+
+// jsonCodec is a Codec that encodes events as JSON.
+type jsonCodec struct{}
+
+func (jsonCodec) DecodeEvent(data []byte, event *modelpb.APMEvent) error {
+	return json.Unmarshal(data, event)
+}
+
+func (jsonCodec) EncodeEvent(event *modelpb.APMEvent) ([]byte, error) {
+	return json.Marshal(event)
+}
+
+func TestStorageCodecFormatStats(t *testing.T) {
+	db := newBadgerDB(t, badgerOptions)
+	store := eventstorage.New(db, markerCodec(1))
+	readWriter := store.NewReadWriter()
+	wOpts := eventstorage.WriterOpts{TTL: time.Minute}
+
+	service := &modelpb.Service{Name: "service_name"}
+	writer := readWriter.NewTraceWriter("trace_1", wOpts)
+	assert.NoError(t, writer.WriteTraceEvent("transaction_id", &modelpb.APMEvent{
+		Service:     service,
+		Transaction: &modelpb.Transaction{Id: "transaction_id"},
+	}))
+	assert.NoError(t, writer.WriteTraceEvent("span_id", &modelpb.APMEvent{
+		Service: service,
+		Span:    &modelpb.Span{Id: "span_id"},
+	})) // delta-encoded
+	assert.NoError(t, readWriter.WriteTraceEvent("trace_2", "span_id", &modelpb.APMEvent{}, wOpts))
+	assert.NoError(t, readWriter.WriteTraceSampled("trace_1", true, wOpts))
+	assert.NoError(t, readWriter.Flush())
+	readWriter.Close()
+
+	stats, err := store.CodecFormatStats()
+	assert.NoError(t, err)
+	assert.Equal(t, map[byte]int{1: 3}, stats)
+
+	_, err = store.Reencode(markerCodec(2))
+	assert.NoError(t, err)
+	stats, err = store.CodecFormatStats()
+	assert.NoError(t, err)
+	assert.Equal(t, map[byte]int{2: 3}, stats)
+}
+
+func TestStorageReencodeResume(t *testing.T) {
+	// Small tables limit the transaction size, so that Reencode commits
+	// several times.
+	db := newBadgerDB(t, func() badger.Options {
+		return badgerOptions().WithMaxTableSize(1 << 15)
+	})
+	store := eventstorage.New(db, markerCodec(1))
+	readWriter := store.NewReadWriter()
+	wOpts := eventstorage.WriterOpts{TTL: time.Minute}
+	const numEvents = 1000
+	for i := 0; i < numEvents; i++ {
+		traceID := fmt.Sprintf("trace_%04d", i)
+		assert.NoError(t, readWriter.WriteTraceEvent(traceID, "span_id", &modelpb.APMEvent{
+			Span: &modelpb.Span{Id: "span_id", Name: strings.Repeat("x", 100)},
+		}, wOpts))
+		assert.NoError(t, readWriter.Flush())
+	}
+	readWriter.Close()
+
+	inProgress, err := store.ReencodeInProgress()
+	assert.NoError(t, err)
+	assert.False(t, inProgress)
+
+	// Interrupt Reencode after some transactions have been committed.
+	_, err = store.Reencode(&interruptingCodec{Codec: markerCodec(2), remaining: numEvents / 2})
+	assert.EqualError(t, err, `failed to reencode "trace_0500:span_id": encoding failed`)
+	assert.Equal(t, markerCodec(1), store.Codec())
+	inProgress, err = store.ReencodeInProgress()
+	assert.NoError(t, err)
+	assert.True(t, inProgress)
+	stats, err := store.CodecFormatStats()
+	assert.NoError(t, err)
+	assert.Len(t, stats, 2)
+	assert.Equal(t, numEvents, stats[1]+stats[2])
+	assert.NotZero(t, stats[2])
+
+	// Resuming rewrites only the events not yet reencoded.
+	n, err := store.Reencode(markerCodec(2))
+	assert.NoError(t, err)
+	assert.Equal(t, stats[1], n)
+	assert.Equal(t, markerCodec(2), store.Codec())
+	inProgress, err = store.ReencodeInProgress()
+	assert.NoError(t, err)
+	assert.False(t, inProgress)
+	stats, err = store.CodecFormatStats()
+	assert.NoError(t, err)
+	assert.Equal(t, map[byte]int{2: numEvents}, stats)
+
+	report, err := store.Verify(context.Background())
+	assert.NoError(t, err)
+	assert.Empty(t, report.Problems)
+}
+
+// interruptingCodec is a Codec that fails to encode events once remaining
+// events have been encoded.
+type interruptingCodec struct {
+	eventstorage.Codec
+	remaining int
+}
+
+func (c *interruptingCodec) EncodeEvent(event *modelpb.APMEvent) ([]byte, error) {
+	if c.remaining == 0 {
+		return nil, errors.New("encoding failed")
+	}
+	c.remaining--
+	return c.Codec.EncodeEvent(event)
+}
+
+// markerCodec is a Codec that prefixes protobuf-encoded events with a
+// format marker byte.
+type markerCodec byte
+
+func (c markerCodec) DecodeEvent(data []byte, event *modelpb.APMEvent) error {
+	if len(data) == 0 || data[0] != byte(c) {
+		return errors.New("unexpected format marker")
+	}
+	return eventstorage.ProtobufCodec{}.DecodeEvent(data[1:], event)
+}
+
+func (c markerCodec) EncodeEvent(event *modelpb.APMEvent) ([]byte, error) {
+	data, err := eventstorage.ProtobufCodec{}.EncodeEvent(event)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{byte(c)}, data...), nil
+}
+
+func TestStorageIterateAll(t *testing.T) {
+	db := newBadgerDB(t, badgerOptions)
+	store := eventstorage.New(db, eventstorage.ProtobufCodec{})
+	readWriter := store.NewReadWriter()
+	defer readWriter.Close()
+	wOpts := eventstorage.WriterOpts{TTL: time.Minute}
+
+	for _, traceID := range []string{"trace_1", "trace_2"} {
+		for _, id := range []string{"a", "b"} {
+			event := &modelpb.APMEvent{Span: &modelpb.Span{Id: traceID + id}}
+			assert.NoError(t, readWriter.WriteTraceEvent(traceID, id, event, wOpts))
+		}
+		assert.NoError(t, readWriter.WriteTraceSampled(traceID, true, wOpts))
+	}
+	assert.NoError(t, readWriter.MergeTraceLabels("trace_1", map[string]string{"k": "v"}, wOpts))
+	assert.NoError(t, readWriter.Flush())
+
+	var visited []string
+	err := store.IterateAll(func(traceID, id string, event *modelpb.APMEvent) error {
+		assert.Equal(t, traceID+id, event.Span.Id)
+		visited = append(visited, traceID+"/"+id)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"trace_1/a", "trace_1/b", "trace_2/a", "trace_2/b"}, visited)
+
+	// Returning an error stops iteration early.
+	stop := errors.New("stop")
+	visited = visited[:0]
+	err = store.IterateAll(func(traceID, id string, event *modelpb.APMEvent) error {
+		visited = append(visited, traceID+"/"+id)
+		return stop
+	})
+	assert.Equal(t, stop, err)
+	assert.Equal(t, []string{"trace_1/a"}, visited)
+}
+
+func TestWriteTraceEventDropUnsampled(t *testing.T) {
+	db := newBadgerDB(t, badgerOptions)
+	store := eventstorage.New(db, eventstorage.ProtobufCodec{})
+	readWriter := store.NewShardedReadWriter()
+	defer readWriter.Close()
+	wOpts := eventstorage.WriterOpts{TTL: time.Minute, DropUnsampled: true}
+
+	span := &modelpb.APMEvent{Span: &modelpb.Span{Id: "span_id"}}
+	assert.NoError(t, readWriter.WriteTraceSampled("unsampled", false, wOpts))
+	assert.NoError(t, readWriter.WriteTraceSampled("sampled", true, wOpts))
+	for traceID, expectedErr := range map[string]error{
+		"unsampled": eventstorage.ErrTraceUnsampled,
+		"sampled":   nil,
+		"undecided": nil,
+	} {
+		err := readWriter.WriteTraceEvent(traceID, "span_id", span, wOpts)
+		assert.Equal(t, expectedErr, err, traceID)
+	}
+
+	var batch modelpb.Batch
+	assert.NoError(t, readWriter.ReadTraceEvents("unsampled", &batch))
+	assert.Empty(t, batch)
+
+	// Without DropUnsampled, events are written regardless.
+	wOpts.DropUnsampled = false
+	assert.NoError(t, readWriter.WriteTraceEvent("unsampled", "span_id", span, wOpts))
+	assert.NoError(t, readWriter.ReadTraceEvents("unsampled", &batch))
+	assert.Len(t, batch, 1)
+}
+
+func TestStorageExportDecisions(t *testing.T) {
+	db := newBadgerDB(t, badgerOptions)
+	store := eventstorage.New(db, eventstorage.ProtobufCodec{})
+	readWriter := store.NewReadWriter()
+	defer readWriter.Close()
+
+	span := &modelpb.APMEvent{Span: &modelpb.Span{Id: "span_id"}}
+	assert.NoError(t, readWriter.WriteTraceEvent("trace_1", "span_id", span, eventstorage.WriterOpts{TTL: time.Hour}))
+	assert.NoError(t, readWriter.WriteTraceSampled("trace_1", true, eventstorage.WriterOpts{TTL: time.Hour}))
+	assert.NoError(t, readWriter.WriteTraceSampled("trace_2", false, eventstorage.WriterOpts{TTL: time.Minute}))
+	assert.NoError(t, readWriter.Flush())
+	require.NoError(t, db.Update(func(txn *badger.Txn) error {
+		return txn.SetEntry(badger.NewEntry([]byte("trace_3"), nil).WithMeta('u'))
+	}))
+
+	type decision struct {
+		sampled      bool
+		ttlRemaining time.Duration
+	}
+	decisions := make(map[string]decision)
+	err := store.ExportDecisions(func(traceID string, sampled bool, ttlRemaining time.Duration) error {
+		decisions[traceID] = decision{sampled: sampled, ttlRemaining: ttlRemaining}
+		return nil
+	})
+	assert.NoError(t, err)
+	require.Len(t, decisions, 3)
+	assert.True(t, decisions["trace_1"].sampled)
+	assert.InDelta(t, time.Hour, decisions["trace_1"].ttlRemaining, float64(2*time.Second))
+	assert.False(t, decisions["trace_2"].sampled)
+	assert.InDelta(t, time.Minute, decisions["trace_2"].ttlRemaining, float64(2*time.Second))
+	assert.Equal(t, decision{}, decisions["trace_3"]) // no expiry
+}
+
+func TestStorageDeleteDecisionsOlderThan(t *testing.T) {
+	db := newBadgerDB(t, badgerOptions)
+	store := eventstorage.New(db, eventstorage.ProtobufCodec{}, eventstorage.WithTTL(time.Hour))
+	readWriter := store.NewReadWriter()
+	defer readWriter.Close()
+
+	wOpts := eventstorage.WriterOpts{TTL: time.Hour}
+	require.NoError(t, readWriter.WriteTraceSampled("new_trace", true, wOpts))
+	require.NoError(t, readWriter.WriteTraceEvent("new_trace", "span_id", &modelpb.APMEvent{}, wOpts))
+	require.NoError(t, readWriter.Flush())
+	require.NoError(t, db.Update(func(txn *badger.Txn) error {
+		// Decisions written 30 minutes ago, and one that never expires.
+		expiresAt := uint64(time.Now().Add(30 * time.Minute).Unix())
+		e := badger.NewEntry([]byte("old_sampled"), nil).WithMeta('s')
+		e.ExpiresAt = expiresAt
+		if err := txn.SetEntry(e); err != nil {
+			return err
+		}
+		e = badger.NewEntry([]byte("old_unsampled"), nil).WithMeta('u')
+		e.ExpiresAt = expiresAt
+		if err := txn.SetEntry(e); err != nil {
+			return err
+		}
+		return txn.SetEntry(badger.NewEntry([]byte("no_expiry"), nil).WithMeta('s'))
+	}))
+
+	n, err := store.DeleteDecisionsOlderThan(time.Now().Add(-10 * time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	var decisions []string
+	require.NoError(t, store.ExportDecisions(func(traceID string, sampled bool, ttlRemaining time.Duration) error {
+		decisions = append(decisions, traceID)
+		return nil
+	}))
+	assert.ElementsMatch(t, []string{"new_trace", "no_expiry"}, decisions)
+
+	var batch modelpb.Batch
+	assert.NoError(t, readWriter.ReadTraceEvents("new_trace", &batch))
+	assert.Len(t, batch, 1)
+
+	// The TTL is required for deriving write times.
+	_, err = eventstorage.New(db, eventstorage.ProtobufCodec{}).DeleteDecisionsOlderThan(time.Now())
+	assert.Error(t, err)
+}
+
+func TestStorageSnapshotDiff(t *testing.T) {
+	db := newBadgerDB(t, badgerOptions)
+	store := eventstorage.New(db, eventstorage.ProtobufCodec{})
+	readWriter := store.NewReadWriter()
+	defer readWriter.Close()
+
+	before := store.Snapshot()
+	assert.Zero(t, before.Events)
+
+	wOpts := eventstorage.WriterOpts{TTL: time.Minute}
+	require.NoError(t, readWriter.WriteTraceEvent("trace_1", "transaction_id", &modelpb.APMEvent{}, wOpts))
+	require.NoError(t, readWriter.WriteTraceEvent("trace_1", "span_id", &modelpb.APMEvent{}, wOpts))
+	require.NoError(t, readWriter.WriteTraceSampled("trace_1", true, wOpts))
+	require.NoError(t, readWriter.WriteTraceSampled("trace_2", false, wOpts))
+	require.NoError(t, readWriter.WriteTraceSampled("trace_3", false, wOpts))
+	// Unflushed writes are not observed.
+	diff := eventstorage.Diff(before, store.Snapshot())
+	assert.Zero(t, diff.Events)
+	assert.Zero(t, diff.SampledDecisions)
+	require.NoError(t, readWriter.Flush())
+
+	after := store.Snapshot()
+	diff = eventstorage.Diff(before, after)
+	assert.Equal(t, int64(2), diff.Events)
+	assert.Greater(t, diff.EventBytes, int64(0))
+	assert.Equal(t, int64(1), diff.SampledDecisions)
+	assert.Equal(t, int64(2), diff.UnsampledDecisions)
+	assert.Equal(t, after.Time.Sub(before.Time), diff.Elapsed)
+
+	require.NoError(t, readWriter.DeleteTraceEvent("trace_1", "span_id"))
+	require.NoError(t, readWriter.Flush())
+	diff = eventstorage.Diff(after, store.Snapshot())
+	assert.Equal(t, int64(-1), diff.Events)
+	assert.Zero(t, diff.SampledDecisions)
+	assert.Zero(t, diff.UnsampledDecisions)
+}
+
+func TestStorageEncodedSize(t *testing.T) {
+	db := newBadgerDB(t, badgerOptions)
+	store := eventstorage.New(db, eventstorage.ProtobufCodec{})
+
+	event := &modelpb.APMEvent{
+		Trace:       &modelpb.Trace{Id: "trace_id"},
+		Transaction: &modelpb.Transaction{Id: "transaction_id", Name: "name"},
+	}
+	data, err := eventstorage.ProtobufCodec{}.EncodeEvent(event)
+	require.NoError(t, err)
+
+	size, err := store.EncodedSize(event)
+	assert.NoError(t, err)
+	keySize := len("trace_id:transaction_id")
+	assert.Greater(t, size, len(data)+keySize)
+
+	// A larger event has a correspondingly larger estimate.
+	event.Transaction.Name = "a much longer transaction name"
+	largerSize, err := store.EncodedSize(event)
+	assert.NoError(t, err)
+	assert.Equal(t, size+len(event.Transaction.Name)-len("name"), largerSize)
+}
+
+func TestWriteTraceEventSlidingTTL(t *testing.T) {
+	db := newBadgerDB(t, badgerOptions)
+	store := eventstorage.New(db, eventstorage.ProtobufCodec{})
+	readWriter := store.NewReadWriter()
+	defer readWriter.Close()
+
+	expiresAt := func(key string) time.Time {
+		var expiresAt uint64
+		require.NoError(t, db.View(func(txn *badger.Txn) error {
+			item, err := txn.Get([]byte(key))
+			if err != nil {
+				return err
+			}
+			expiresAt = item.ExpiresAt()
+			return nil
+		}))
+		return time.Unix(int64(expiresAt), 0)
+	}
+
+	span := &modelpb.APMEvent{Span: &modelpb.Span{Id: "span_id"}}
+	wOpts := eventstorage.WriterOpts{TTL: time.Minute}
+	assert.NoError(t, readWriter.WriteTraceSampled("trace_id", false, wOpts))
+	assert.NoError(t, readWriter.WriteTraceEvent("trace_id", "a", span, wOpts))
+	assert.NoError(t, readWriter.Flush())
+	assert.WithinDuration(t, time.Now().Add(time.Minute), expiresAt("trace_id"), 2*time.Second)
+	assert.WithinDuration(t, time.Now().Add(time.Minute), expiresAt("trace_id:a"), 2*time.Second)
+
+	// Writes which are rejected do not refresh the trace's TTL.
+	rejectedOpts := eventstorage.WriterOpts{
+		TTL: time.Hour, SlidingTTL: true, SlidingTTLEvents: true,
+		EnvironmentStorageLimits: map[string]int64{"production": 1},
+	}
+	production := &modelpb.APMEvent{
+		Service: &modelpb.Service{Environment: "production"},
+		Span:    &modelpb.Span{Id: "span_id"},
+	}
+	err := readWriter.WriteTraceEvent("trace_id", "rejected", production, rejectedOpts)
+	assert.ErrorIs(t, err, eventstorage.ErrEnvLimitReached)
+	assert.NoError(t, readWriter.Flush())
+	assert.WithinDuration(t, time.Now().Add(time.Minute), expiresAt("trace_id"), 2*time.Second)
+	assert.WithinDuration(t, time.Now().Add(time.Minute), expiresAt("trace_id:a"), 2*time.Second)
+
+	// Writing a new event with SlidingTTL refreshes the decision's TTL,
+	// and with SlidingTTLEvents, the trace's other events' TTLs.
+	wOpts = eventstorage.WriterOpts{TTL: time.Hour, SlidingTTL: true}
+	assert.NoError(t, readWriter.WriteTraceEvent("trace_id", "b", span, wOpts))
+	assert.NoError(t, readWriter.Flush())
+	assert.WithinDuration(t, time.Now().Add(time.Hour), expiresAt("trace_id"), 2*time.Second)
+	assert.WithinDuration(t, time.Now().Add(time.Minute), expiresAt("trace_id:a"), 2*time.Second)
+
+	wOpts.SlidingTTLEvents = true
+	wOpts.TTL = 2 * time.Hour
+	assert.NoError(t, readWriter.WriteTraceEvent("trace_id", "c", span, wOpts))
+	assert.NoError(t, readWriter.Flush())
+	for _, key := range []string{"trace_id", "trace_id:a", "trace_id:b", "trace_id:c"} {
+		assert.WithinDuration(t, time.Now().Add(2*time.Hour), expiresAt(key), 2*time.Second, key)
+	}
+	sampled, err := readWriter.IsTraceSampled("trace_id")
+	assert.NoError(t, err)
+	assert.False(t, sampled)
+}
+
+func TestFinalizeTrace(t *testing.T) {
+	db := newBadgerDB(t, badgerOptions)
+	store := eventstorage.New(db, eventstorage.ProtobufCodec{})
+	readWriter := store.NewShardedReadWriter()
+	defer readWriter.Close()
+	wOpts := eventstorage.WriterOpts{TTL: time.Minute}
+
+	transaction := &modelpb.APMEvent{Transaction: &modelpb.Transaction{Id: "transaction_id"}}
+	span := &modelpb.APMEvent{Span: &modelpb.Span{Id: "span_id"}}
+	for _, traceID := range []string{"sampled", "unsampled"} {
+		assert.NoError(t, readWriter.WriteTraceEvent(traceID, "transaction_id", transaction, wOpts))
+		assert.NoError(t, readWriter.WriteTraceEvent(traceID, "span_id", span, wOpts))
+	}
+
+	// If indexing fails, nothing is changed.
+	indexErr := errors.New("index failed")
+	err := readWriter.FinalizeTrace("sampled", true, func(modelpb.Batch) error { return indexErr }, wOpts)
+	assert.Equal(t, indexErr, err)
+	_, err = readWriter.IsTraceSampled("sampled")
+	assert.Equal(t, eventstorage.ErrNotFound, err)
+	var batch modelpb.Batch
+	assert.NoError(t, readWriter.ReadTraceEvents("sampled", &batch))
+	assert.Len(t, batch, 2)
+
+	var indexed modelpb.Batch
+	err = readWriter.FinalizeTrace("sampled", true, func(events modelpb.Batch) error {
+		indexed = events
+		return nil
+	}, wOpts)
+	assert.NoError(t, err)
+	assert.Empty(t, cmp.Diff(modelpb.Batch{span, transaction}, indexed, protocmp.Transform()))
+
+	err = readWriter.FinalizeTrace("unsampled", false, func(events modelpb.Batch) error {
+		t.Fatal("indexFn should not be called for unsampled traces")
+		return nil
+	}, wOpts)
+	assert.NoError(t, err)
+
+	for traceID, expectSampled := range map[string]bool{"sampled": true, "unsampled": false} {
+		sampled, err := readWriter.IsTraceSampled(traceID)
+		assert.NoError(t, err)
+		assert.Equal(t, expectSampled, sampled)
+		batch = batch[:0]
+		assert.NoError(t, readWriter.ReadTraceEvents(traceID, &batch))
+		assert.Empty(t, batch)
+	}
+
+	// Sampled traces cannot be finalized without indexFn.
+	assert.EqualError(t, readWriter.FinalizeTrace("sampled", true, nil, wOpts), "indexFn must not be nil for sampled traces")
+}
+
+func TestFinalizeTraceLabelsLease(t *testing.T) {
+	db := newBadgerDB(t, badgerOptions)
+	store := eventstorage.New(db, eventstorage.ProtobufCodec{})
+	readWriter := store.NewReadWriter()
+	defer readWriter.Close()
+	wOpts := eventstorage.WriterOpts{TTL: time.Minute}
+
+	assert.NoError(t, readWriter.WriteTraceEvent("trace_id", "span_id", &modelpb.APMEvent{}, wOpts))
+	assert.NoError(t, readWriter.MergeTraceLabels("trace_id", map[string]string{"k": "v"}, wOpts))
+	claimed, err := readWriter.ClaimTrace("trace_id", "worker_1", time.Minute)
+	assert.NoError(t, err)
+	assert.True(t, claimed)
+	assert.NoError(t, readWriter.FinalizeTrace("trace_id", false, nil, wOpts))
+
+	// The trace's labels and lease are removed with its events.
+	_, err = readWriter.ReadTraceLabels("trace_id")
+	assert.Equal(t, eventstorage.ErrNotFound, err)
+	claimed, err = readWriter.ClaimTrace("trace_id", "worker_2", time.Minute)
+	assert.NoError(t, err)
+	assert.True(t, claimed)
+}
+
+func TestTraceWriterDeltaEncoding(t *testing.T) {
+	db := newBadgerDB(t, badgerOptions)
+	store := eventstorage.New(db, eventstorage.ProtobufCodec{})
+	readWriter := store.NewShardedReadWriter()
+	defer readWriter.Close()
+
+	newEvent := func(span *modelpb.Span, transaction *modelpb.Transaction) *modelpb.APMEvent {
+		return &modelpb.APMEvent{
+			Service:     &modelpb.Service{Name: "service", Version: "1.2.3", Environment: "production"},
+			Agent:       &modelpb.Agent{Name: "go", Version: "2.0.0"},
+			Host:        &modelpb.Host{Hostname: "host.example.com", Architecture: "amd64"},
+			Labels:      map[string]*modelpb.LabelValue{"team": {Value: "apm"}},
+			Trace:       &modelpb.Trace{Id: "trace_id"},
+			Span:        span,
+			Transaction: transaction,
+		}
+	}
+	transaction := newEvent(nil, &modelpb.Transaction{Id: "transaction_id", Name: "GET /"})
+	span1 := newEvent(&modelpb.Span{Id: "span_1", Name: "SELECT"}, nil)
+	span2 := newEvent(&modelpb.Span{Id: "span_2", Name: "INSERT"}, nil)
+	span2.Service.Version = "1.2.4"
+	span2.Labels = nil
+
+	wOpts := eventstorage.WriterOpts{TTL: time.Minute}
+	writer := readWriter.NewTraceWriter("trace_id", wOpts)
+	assert.NoError(t, writer.WriteTraceEvent("transaction_id", transaction))
+	assert.NoError(t, writer.WriteTraceEvent("span_1", span1))
+	assert.NoError(t, writer.WriteTraceEvent("span_2", span2))
+
+	// Shared metadata is stored only in the base event.
+	full, err := proto.Marshal(span1)
+	require.NoError(t, err)
+	delta, err := readWriter.ReadTraceEventRaw("trace_id", "span_1")
+	require.NoError(t, err)
+	assert.Less(t, len(delta), len(full)/2)
+
+	var batch modelpb.Batch
+	assert.NoError(t, readWriter.ReadTraceEvents("trace_id", &batch))
+	assert.Empty(t, cmp.Diff(modelpb.Batch{span1, span2, transaction}, batch, protocmp.Transform()))
+
+	// Reconstructed events do not share memory.
+	batch[0].Service.Name = "modified"
+	assert.Equal(t, "service", batch[2].Service.Name)
+
+	var indexed modelpb.Batch
+	assert.NoError(t, readWriter.FinalizeTrace("trace_id", true, func(events modelpb.Batch) error {
+		indexed = events
+		return nil
+	}, wOpts))
+	assert.Empty(t, cmp.Diff(modelpb.Batch{span1, span2, transaction}, indexed, protocmp.Transform()))
+}
+
+func TestTraceWriterDeltaBaseNotFound(t *testing.T) {
+	db := newBadgerDB(t, badgerOptions)
+	store := eventstorage.New(db, eventstorage.ProtobufCodec{})
+	readWriter := store.NewReadWriter()
+	defer readWriter.Close()
+
+	transaction := &modelpb.APMEvent{
+		Service:     &modelpb.Service{Name: "service"},
+		Transaction: &modelpb.Transaction{Id: "transaction_id"},
+	}
+	span := &modelpb.APMEvent{
+		Service: &modelpb.Service{Name: "service"},
+		Span:    &modelpb.Span{Id: "span_id"},
+	}
+	wOpts := eventstorage.WriterOpts{TTL: time.Minute}
+	writer := readWriter.NewTraceWriter("trace_id", wOpts)
+	assert.NoError(t, writer.WriteTraceEvent("transaction_id", transaction))
+	assert.NoError(t, writer.WriteTraceEvent("span_id", span))
+	assert.NoError(t, readWriter.DeleteTraceEvent("trace_id", "transaction_id"))
+
+	var batch modelpb.Batch
+	err := readWriter.ReadTraceEvents("trace_id", &batch)
+	assert.ErrorIs(t, err, eventstorage.ErrDecodeFailed)
+	assert.Empty(t, batch)
+}
+
+func TestExpirySweeper(t *testing.T) {
+	for _, prefixed := range []bool{false, true} {
+		t.Run(fmt.Sprintf("prefixed_decision_keys=%v", prefixed), func(t *testing.T) {
+			db := newBadgerDB(t, badgerOptions)
+			store := eventstorage.New(db, eventstorage.ProtobufCodec{}, eventstorage.WithPrefixedDecisionKeys(prefixed))
+			readWriter := store.NewReadWriter()
+			defer readWriter.Close()
+
+			var expired []string
+			sweeper := store.NewExpirySweeper(func(traceID string) {
+				expired = append(expired, traceID)
+			})
+
+			wOpts := eventstorage.WriterOpts{TTL: time.Minute}
+			span := &modelpb.APMEvent{Span: &modelpb.Span{Id: "span_id"}}
+			for _, traceID := range []string{"trace_1", "trace_2", "trace_3"} {
+				require.NoError(t, readWriter.WriteTraceEvent(traceID, "span_id", span, wOpts))
+			}
+			require.NoError(t, readWriter.WriteTraceEvent("trace_4", "span_id", span, wOpts))
+			require.NoError(t, readWriter.WriteTraceSampled("trace_4", false, wOpts))
+			require.NoError(t, readWriter.Flush())
+
+			n, err := sweeper.Sweep()
+			require.NoError(t, err)
+			assert.Zero(t, n)
+
+			// Remove the events of trace_1 without a decision, as if expired,
+			// and finalize trace_2. trace_3 remains pending, and trace_4 was
+			// already decided.
+			require.NoError(t, readWriter.DeleteTraceEvent("trace_1", "span_id"))
+			require.NoError(t, readWriter.DeleteTraceEvent("trace_4", "span_id"))
+			require.NoError(t, readWriter.FinalizeTrace("trace_2", true, func(modelpb.Batch) error { return nil }, wOpts))
+			require.NoError(t, readWriter.Flush())
+
+			n, err = sweeper.Sweep()
+			require.NoError(t, err)
+			assert.Equal(t, 1, n)
+			assert.Equal(t, []string{"trace_1"}, expired)
+
+			// Expired traces are reported only once.
+			n, err = sweeper.Sweep()
+			require.NoError(t, err)
+			assert.Zero(t, n)
+		})
+	}
+}
+
+func TestOrphanEvents(t *testing.T) {
+	for _, prefixed := range []bool{false, true} {
+		t.Run(fmt.Sprintf("prefixed_decision_keys=%v", prefixed), func(t *testing.T) {
+			db := newBadgerDB(t, badgerOptions)
+			store := eventstorage.New(db, eventstorage.ProtobufCodec{}, eventstorage.WithPrefixedDecisionKeys(prefixed))
+			readWriter := store.NewReadWriter()
+			defer readWriter.Close()
+
+			wOpts := eventstorage.WriterOpts{TTL: time.Minute}
+			for _, traceID := range []string{"trace_1", "trace_2", "trace_3"} {
+				for _, id := range []string{"span_1", "span_2"} {
+					require.NoError(t, readWriter.WriteTraceEvent(traceID, id, &modelpb.APMEvent{}, wOpts))
+				}
+			}
+			require.NoError(t, readWriter.WriteTraceSampled("trace_2", false, wOpts))
+			require.NoError(t, readWriter.Flush())
+
+			orphans, err := store.FindOrphanEvents()
+			require.NoError(t, err)
+			assert.Equal(t, []string{"trace_1", "trace_3"}, orphans)
+
+			// trace_3 is decided before its events are deleted.
+			require.NoError(t, readWriter.WriteTraceSampled("trace_3", true, wOpts))
+			require.NoError(t, readWriter.Flush())
+			n, err := store.DeleteOrphanEvents(orphans)
+			require.NoError(t, err)
+			assert.Equal(t, 2, n)
+
+			orphans, err = store.FindOrphanEvents()
+			require.NoError(t, err)
+			assert.Empty(t, orphans)
+			for _, traceID := range []string{"trace_2", "trace_3"} {
+				var batch modelpb.Batch
+				require.NoError(t, readWriter.ReadTraceEvents(traceID, &batch))
+				assert.Len(t, batch, 2, traceID)
+			}
+		})
+	}
+}
+
+func TestPrefixedDecisionKeys(t *testing.T) {
+	db := newBadgerDB(t, badgerOptions)
+	wOpts := eventstorage.WriterOpts{TTL: time.Minute}
+	span := &modelpb.APMEvent{Span: &modelpb.Span{Id: "span_id"}}
+	keyExists := func(key string) bool {
+		err := db.View(func(txn *badger.Txn) error {
+			_, err := txn.Get([]byte(key))
+			return err
+		})
+		if err == badger.ErrKeyNotFound {
+			return false
+		}
+		require.NoError(t, err)
+		return true
+	}
+
+	legacy := eventstorage.New(db, eventstorage.ProtobufCodec{})
+	legacyReadWriter := legacy.NewReadWriter()
+	require.NoError(t, legacyReadWriter.WriteTraceSampled("trace_1", true, wOpts))
+	require.NoError(t, legacyReadWriter.WriteTraceSampled("trace_2", false, wOpts))
+	require.NoError(t, legacyReadWriter.WriteTraceEvent("trace_3", "span_id", span, wOpts))
+	require.NoError(t, legacyReadWriter.Flush())
+	legacyReadWriter.Close()
+
+	store := eventstorage.New(db, eventstorage.ProtobufCodec{}, eventstorage.WithPrefixedDecisionKeys(true))
+	readWriter := store.NewReadWriter()
+	_, err := readWriter.IsTraceSampled("trace_1")
+	assert.Equal(t, eventstorage.ErrNotFound, err)
+	readWriter.Close()
+
+	n, err := store.MigrateDecisionKeys()
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+	assert.True(t, keyExists("d:trace_1"))
+	assert.False(t, keyExists("trace_1"))
+
+	readWriter = store.NewReadWriter()
+	defer readWriter.Close()
+	sampled, err := readWriter.IsTraceSampled("trace_1")
+	assert.NoError(t, err)
+	assert.True(t, sampled)
+	sampled, err = readWriter.IsTraceSampled("trace_2")
+	assert.NoError(t, err)
+	assert.False(t, sampled)
+	var events modelpb.Batch
+	require.NoError(t, readWriter.ReadTraceEvents("trace_3", &events))
+	assert.Len(t, events, 1)
+
+	decisions := make(map[string]bool)
+	require.NoError(t, store.ExportDecisions(func(traceID string, sampled bool, ttlRemaining time.Duration) error {
+		decisions[traceID] = sampled
+		assert.Greater(t, ttlRemaining, time.Duration(0))
+		return nil
+	}))
+	assert.Equal(t, map[string]bool{"trace_1": true, "trace_2": false}, decisions)
+
+	// Migrating again does nothing.
+	n, err = store.MigrateDecisionKeys()
+	require.NoError(t, err)
+	assert.Zero(t, n)
+
+	// Decisions may be migrated back to unprefixed keys.
+	n, err = legacy.MigrateDecisionKeys()
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+	assert.True(t, keyExists("trace_1"))
+	assert.False(t, keyExists("d:trace_1"))
+}
+
+func TestIsTraceSampled(t *testing.T) {
+	db := newBadgerDB(t, badgerOptions)
+	store := eventstorage.New(db, eventstorage.ProtobufCodec{})
+
+	require.NoError(t, db.Update(func(txn *badger.Txn) error {
+		if err := txn.SetEntry(badger.NewEntry([]byte("sampled_trace_id"), nil).WithMeta('s')); err != nil {
+			return err
+		}
+		if err := txn.SetEntry(badger.NewEntry([]byte("unsampled_trace_id"), nil).WithMeta('u')); err != nil {
+			return err
+		}
+		return nil
+	}))
+
+	reader := store.NewShardedReadWriter()
+	defer reader.Close()
+
+	sampled, err := reader.IsTraceSampled("sampled_trace_id")
+	assert.NoError(t, err)
+	assert.True(t, sampled)
+
+	sampled, err = reader.IsTraceSampled("unsampled_trace_id")
+	assert.NoError(t, err)
+	assert.False(t, sampled)
+
+	_, err = reader.IsTraceSampled("unknown_trace_id")
+	assert.Equal(t, err, eventstorage.ErrNotFound)
+}
+
+func TestIsTraceSampledCompactUnsampled(t *testing.T) {
+	db := newBadgerDB(t, badgerOptions)
+	store := eventstorage.New(db, eventstorage.ProtobufCodec{}, eventstorage.WithCompactUnsampled(1000, 0.0001))
+	readWriter := store.NewShardedReadWriter()
+	defer readWriter.Close()
+	wOpts := eventstorage.WriterOpts{TTL: time.Minute}
+
+	assert.NoError(t, readWriter.WriteTraceSampled("sampled_trace_id", true, wOpts))
+	assert.NoError(t, readWriter.WriteTraceSampled("unsampled_trace_id", false, wOpts))
+	assert.NoError(t, readWriter.Flush())
+
+	sampled, err := readWriter.IsTraceSampled("sampled_trace_id")
+	assert.NoError(t, err)
+	assert.True(t, sampled)
+
+	sampled, err = readWriter.IsTraceSampled("unsampled_trace_id")
+	assert.NoError(t, err)
+	assert.False(t, sampled)
+
+	_, err = readWriter.IsTraceSampled("unknown_trace_id")
+	assert.Equal(t, eventstorage.ErrNotFound, err)
+
+	// Unsampled decisions are not written to the database.
+	require.NoError(t, db.View(func(txn *badger.Txn) error {
+		_, err := txn.Get([]byte("unsampled_trace_id"))
+		assert.Equal(t, badger.ErrKeyNotFound, err)
+		return nil
+	}))
+}
+
+func TestIsTraceSampledDecisionCache(t *testing.T) {
+	const negativeTTL = 100 * time.Millisecond
+	db := newBadgerDB(t, badgerOptions)
+	store := eventstorage.New(db, eventstorage.ProtobufCodec{}, eventstorage.WithDecisionCache(10, time.Minute, negativeTTL))
+	readWriter := store.NewReadWriter()
+	defer readWriter.Close()
+	wOpts := eventstorage.WriterOpts{TTL: time.Minute}
+
+	assert.NoError(t, readWriter.WriteTraceSampled("trace_id", true, wOpts))
+	assert.NoError(t, readWriter.Flush())
+	sampled, err := readWriter.IsTraceSampled("trace_id")
+	assert.NoError(t, err)
+	assert.True(t, sampled)
+	_, err = readWriter.IsTraceSampled("unknown_trace_id")
+	assert.Equal(t, eventstorage.ErrNotFound, err)
+
+	// Modify the database directly: cached lookups are unaffected.
+	require.NoError(t, db.Update(func(txn *badger.Txn) error {
+		if err := txn.Delete([]byte("trace_id")); err != nil {
+			return err
+		}
+		return txn.SetEntry(badger.NewEntry([]byte("unknown_trace_id"), nil).WithMeta('s'))
+	}))
+	assert.NoError(t, readWriter.Flush())
+	sampled, err = readWriter.IsTraceSampled("trace_id")
+	assert.NoError(t, err)
+	assert.True(t, sampled)
+	_, err = readWriter.IsTraceSampled("unknown_trace_id")
+	assert.Equal(t, eventstorage.ErrNotFound, err)
+
+	// Writing a decision invalidates the cached decision.
+	assert.NoError(t, readWriter.WriteTraceSampled("trace_id", false, wOpts))
+	sampled, err = readWriter.IsTraceSampled("trace_id")
+	assert.NoError(t, err)
+	assert.False(t, sampled)
+
+	// Traces with no decision are cached for negativeTTL.
+	time.Sleep(negativeTTL)
+	sampled, err = readWriter.IsTraceSampled("unknown_trace_id")
+	assert.NoError(t, err)
+	assert.True(t, sampled)
+
+	// Decisions pending in a ReadWriter's transaction are not cached, so
+	// they are not reported by other ReadWriters if discarded.
+	other := store.NewReadWriter()
+	assert.NoError(t, other.WriteTraceSampled("pending_trace_id", true, wOpts))
+	sampled, err = other.IsTraceSampled("pending_trace_id")
+	assert.NoError(t, err)
+	assert.True(t, sampled)
+	other.Close()
+	_, err = store.IsTraceSampledConcurrent("pending_trace_id")
+	assert.Equal(t, eventstorage.ErrNotFound, err)
+
+	// Decisions are cached once flushed.
+	assert.NoError(t, readWriter.WriteTraceSampled("flushed_trace_id", true, wOpts))
+	assert.NoError(t, readWriter.Flush())
+	require.NoError(t, db.Update(func(txn *badger.Txn) error {
+		return txn.Delete([]byte("flushed_trace_id"))
+	}))
+	sampled, err = store.IsTraceSampledConcurrent("flushed_trace_id")
+	assert.NoError(t, err)
+	assert.True(t, sampled)
+
+	assert.Panics(t, func() { eventstorage.WithDecisionCache(0, time.Minute, negativeTTL) })
+	assert.Panics(t, func() { eventstorage.WithDecisionCache(10, 0, negativeTTL) })
+	assert.Panics(t, func() { eventstorage.WithDecisionCache(10, time.Minute, -1) })
+}
+
+func TestIsTraceSampledDecisionCacheTTL(t *testing.T) {
+	const ttl = 50 * time.Millisecond
+	db := newBadgerDB(t, badgerOptions)
+	store := eventstorage.New(db, eventstorage.ProtobufCodec{}, eventstorage.WithDecisionCache(10, ttl, 0))
+	readWriter := store.NewReadWriter()
+	defer readWriter.Close()
+
+	assert.NoError(t, readWriter.WriteTraceSampled("trace_id", true, eventstorage.WriterOpts{TTL: time.Minute}))
+	assert.NoError(t, readWriter.Flush())
+	require.NoError(t, db.Update(func(txn *badger.Txn) error {
+		return txn.Delete([]byte("trace_id"))
+	}))
+	sampled, err := readWriter.IsTraceSampled("trace_id")
+	assert.NoError(t, err)
+	assert.True(t, sampled)
+
+	// Cached decisions are read from the database again after ttl.
+	time.Sleep(ttl)
+	_, err = store.IsTraceSampledConcurrent("trace_id")
+	assert.Equal(t, eventstorage.ErrNotFound, err)
+}
+
+func TestStorageCoalesceWrites(t *testing.T) {
+	for _, coalesce := range []bool{false, true} {
+		db := newBadgerDB(t, badgerOptions)
+		store := eventstorage.New(db, eventstorage.ProtobufCodec{},
+			eventstorage.WithAdaptiveFlush(false),
+			eventstorage.WithCoalesceWrites(coalesce),
+		)
+		readWriter := store.NewReadWriter()
+		defer readWriter.Close()
+
+		// Repeatedly write the same event, as when an agent retries.
+		// Each write is counted towards the flush threshold unless
+		// writes are coalesced.
+		wOpts := eventstorage.WriterOpts{TTL: time.Minute}
+		for i := 0; i < 1000; i++ {
+			event := &modelpb.APMEvent{Span: &modelpb.Span{Id: "span_id", Name: fmt.Sprint(i)}}
+			require.NoError(t, readWriter.WriteTraceEvent("trace_id", "span_id", event, wOpts))
+		}
+
+		reader := store.NewReadWriter()
+		var batch modelpb.Batch
+		require.NoError(t, reader.ReadTraceEvents("trace_id", &batch))
+		if coalesce {
+			assert.Empty(t, batch, "coalesced writes should not have been flushed")
+		} else {
+			assert.Len(t, batch, 1)
+		}
+
+		require.NoError(t, readWriter.Flush())
+		reader.Close()
+		reader = store.NewReadWriter()
+		batch = batch[:0]
+		require.NoError(t, reader.ReadTraceEvents("trace_id", &batch))
+		require.Len(t, batch, 1)
+		assert.Equal(t, "999", batch[0].Span.Name)
+		reader.Close()
+	}
+}
+
+func TestReadWriterAutoFlush(t *testing.T) {
+	db := newBadgerDB(t, badgerOptions)
+	store := eventstorage.New(db, eventstorage.ProtobufCodec{})
+	readWriter := store.NewReadWriter()
+	readWriter.StartAutoFlush(10 * time.Millisecond)
+
+	wOpts := eventstorage.WriterOpts{TTL: time.Minute}
+	require.NoError(t, readWriter.WriteTraceEvent("trace_id", "span_id", &modelpb.APMEvent{}, wOpts))
+
+	// The write should be committed without calling Flush.
+	assert.Eventually(t, func() bool {
+		reader := store.NewReadWriter()
+		defer reader.Close()
+		var batch modelpb.Batch
+		require.NoError(t, reader.ReadTraceEvents("trace_id", &batch))
+		return len(batch) == 1
+	}, 10*time.Second, 10*time.Millisecond)
+
+	// Methods may be called while automatic flushes are running.
+	for i := 0; i < 100; i++ {
+		require.NoError(t, readWriter.WriteTraceEvent("trace_id", fmt.Sprint(i), &modelpb.APMEvent{}, wOpts))
+	}
+	require.NoError(t, readWriter.Flush())
+	readWriter.Close()
+
+	readWriter = store.NewReadWriter()
+	defer readWriter.Close()
+	assert.Panics(t, func() { readWriter.StartAutoFlush(0) })
+}
+
+func TestUtilizationRatio(t *testing.T) {
+	db := newBadgerDB(t, badgerOptions)
+	assert.Zero(t, eventstorage.New(db, eventstorage.ProtobufCodec{}).UtilizationRatio())
+
+	const limit = 1000
+	store := eventstorage.New(db, eventstorage.ProtobufCodec{}, eventstorage.WithStorageLimit(limit))
+	readWriter := store.NewReadWriter()
+	defer readWriter.Close()
+	require.NoError(t, readWriter.WriteTraceSampled("trace_id", true, eventstorage.WriterOpts{TTL: time.Minute}))
+	require.NoError(t, readWriter.Flush())
+	assert.Equal(t, float64(store.Stats().Size)/limit, store.UtilizationRatio())
+}
+
+func TestReadWriterClosed(t *testing.T) {
+	db := newBadgerDB(t, badgerOptions)
+	store := eventstorage.New(db, eventstorage.ProtobufCodec{})
+	readWriter := store.NewReadWriter()
+	wOpts := eventstorage.WriterOpts{TTL: time.Minute}
+	event := &modelpb.APMEvent{Span: &modelpb.Span{Id: "span_id"}}
+	require.NoError(t, readWriter.WriteTraceEvent("trace_id", "span_id", event, wOpts))
+	require.NoError(t, readWriter.Flush())
+	batch := readWriter.TraceBatch("trace_id", wOpts)
+	readWriter.Close()
+	readWriter.Close() // idempotent
+
+	assert.Equal(t, eventstorage.ErrClosed, readWriter.Flush())
+	assert.Equal(t, eventstorage.ErrClosed, readWriter.WriteTraceEvent("trace_id", "span_id", event, wOpts))
+	assert.Equal(t, eventstorage.ErrClosed, readWriter.WriteTraceEventDelta("trace_id", "span_id_2", event, "span_id", event, wOpts))
+	assert.Equal(t, eventstorage.ErrClosed, readWriter.WriteTraceSampled("trace_id", true, wOpts))
+	assert.Equal(t, eventstorage.ErrClosed, readWriter.DeleteTraceEvent("trace_id", "span_id"))
+	assert.Equal(t, eventstorage.ErrClosed, readWriter.MergeTraceLabels("trace_id", map[string]string{"k": "v"}, wOpts))
+	assert.Equal(t, eventstorage.ErrClosed, readWriter.FinalizeTrace("trace_id", true, nil, wOpts))
+	assert.Equal(t, eventstorage.ErrClosed, batch.Add("span_id_3", event))
+	assert.Equal(t, eventstorage.ErrClosed, readWriter.ReadTraceEvents("trace_id", &modelpb.Batch{}))
+	_, err := readWriter.ReadTraceEventsByType("trace_id")
+	assert.Equal(t, eventstorage.ErrClosed, err)
+	_, err = readWriter.IsTraceSampled("trace_id")
+	assert.Equal(t, eventstorage.ErrClosed, err)
+	_, err = readWriter.HasTraceEvents("trace_id")
+	assert.Equal(t, eventstorage.ErrClosed, err)
+	_, err = readWriter.ReadTraceEventRaw("trace_id", "span_id")
+	assert.Equal(t, eventstorage.ErrClosed, err)
+	_, err = readWriter.ReadTraceLabels("trace_id")
+	assert.Equal(t, eventstorage.ErrClosed, err)
+	_, err = readWriter.VerifyTraceTTL("trace_id")
+	assert.Equal(t, eventstorage.ErrClosed, err)
+
+	// Events flushed before closing are unaffected.
+	readWriter = store.NewReadWriter()
+	defer readWriter.Close()
+	_, err = readWriter.ReadTraceEventRaw("trace_id", "span_id")
+	assert.NoError(t, err)
+}
+
+func TestTotalEventCount(t *testing.T) {
+	db := newBadgerDB(t, badgerOptions)
+	store := eventstorage.New(db, eventstorage.ProtobufCodec{})
+	readWriter := store.NewReadWriter()
+	defer readWriter.Close()
+
+	n, err := store.TotalEventCount()
+	require.NoError(t, err)
+	assert.Zero(t, n)
+
+	wOpts := eventstorage.WriterOpts{TTL: time.Minute}
+	base := &modelpb.APMEvent{Service: &modelpb.Service{Name: "service"}, Span: &modelpb.Span{Id: "span_1"}}
+	require.NoError(t, readWriter.WriteTraceEvent("trace_1", "span_1", base, wOpts))
+	require.NoError(t, readWriter.WriteTraceEventDelta("trace_1", "span_2", &modelpb.APMEvent{
+		Service: &modelpb.Service{Name: "service"},
+		Span:    &modelpb.Span{Id: "span_2"},
+	}, "span_1", base, wOpts))
+	require.NoError(t, readWriter.WriteTraceEvent("trace_2", "span_3", &modelpb.APMEvent{}, wOpts))
+	require.NoError(t, readWriter.WriteTraceEvent("trace_2", "span_4", &modelpb.APMEvent{}, wOpts))
+	require.NoError(t, readWriter.DeleteTraceEvent("trace_2", "span_4"))
+	require.NoError(t, readWriter.WriteTraceSampled("trace_3", true, wOpts))
+
+	// Pending writes are not counted.
+	n, err = store.TotalEventCount()
+	require.NoError(t, err)
+	assert.Zero(t, n)
+
+	require.NoError(t, readWriter.Flush())
+	n, err = store.TotalEventCount()
+	require.NoError(t, err)
+	assert.Equal(t, 3, n)
+}
+
+func TestAverageEventSize(t *testing.T) {
+	db := newBadgerDB(t, badgerOptions)
+	codec := eventstorage.ProtobufCodec{}
+	store := eventstorage.New(db, codec)
+	readWriter := store.NewReadWriter()
+	defer readWriter.Close()
+
+	_, err := store.AverageEventSize(0)
+	assert.EqualError(t, err, "sample must be positive")
+	size, err := store.AverageEventSize(10)
+	require.NoError(t, err)
+	assert.Zero(t, size)
+
+	wOpts := eventstorage.WriterOpts{TTL: time.Minute}
+	var encodedSizes []int
+	for _, name := range []string{"a", "bb", "cccccccc"} {
+		event := &modelpb.APMEvent{Span: &modelpb.Span{Id: name, Name: name}}
+		require.NoError(t, readWriter.WriteTraceEvent("trace_id", name, event, wOpts))
+		data, err := codec.EncodeEvent(event)
+		require.NoError(t, err)
+		encodedSizes = append(encodedSizes, len(data))
+	}
+	require.NoError(t, readWriter.WriteTraceSampled("trace_id_2", true, wOpts))
+	require.NoError(t, readWriter.Flush())
+
+	size, err = store.AverageEventSize(10)
+	require.NoError(t, err)
+	assert.Equal(t, (encodedSizes[0]+encodedSizes[1]+encodedSizes[2])/3, size)
+
+	// Only the first events in key order are sampled.
+	size, err = store.AverageEventSize(2)
+	require.NoError(t, err)
+	assert.Equal(t, (encodedSizes[0]+encodedSizes[1])/2, size)
+}
+
+func TestChronologicalKeys(t *testing.T) {
+	db := newBadgerDB(t, badgerOptions)
+	wOpts := eventstorage.WriterOpts{TTL: time.Minute}
+
+	// Events written without chronological keys remain readable.
+	legacy := &modelpb.APMEvent{Timestamp: 5, Span: &modelpb.Span{Id: "legacy"}}
+	legacyReadWriter := eventstorage.New(db, eventstorage.ProtobufCodec{}).NewReadWriter()
+	require.NoError(t, legacyReadWriter.WriteTraceEvent("trace_id", "legacy", legacy, wOpts))
+	require.NoError(t, legacyReadWriter.Flush())
+	legacyReadWriter.Close()
+
+	store := eventstorage.New(db, eventstorage.ProtobufCodec{}, eventstorage.WithChronologicalKeys(true))
+	readWriter := store.NewReadWriter()
+	defer readWriter.Close()
+	service := &modelpb.Service{Name: "service"}
+	third := &modelpb.APMEvent{Timestamp: 3, Service: service, Span: &modelpb.Span{Id: "a"}}
+	first := &modelpb.APMEvent{Timestamp: 1, Service: service, Span: &modelpb.Span{Id: "c"}}
+	second := &modelpb.APMEvent{Timestamp: 2, Service: service, Span: &modelpb.Span{Id: "b"}}
+	tw := readWriter.NewTraceWriter("trace_id", wOpts)
+	require.NoError(t, tw.WriteTraceEvent("a", third))
+	require.NoError(t, tw.WriteTraceEvent("c", first))
+	require.NoError(t, tw.WriteTraceEvent("b", second))
+	require.NoError(t, readWriter.Flush())
+
+	var events modelpb.Batch
+	require.NoError(t, readWriter.ReadTraceEvents("trace_id", &events))
+	assert.Empty(t, cmp.Diff(modelpb.Batch{first, second, third, legacy}, events, protocmp.Transform()))
+
+	var ids []string
+	require.NoError(t, store.IterateAll(func(traceID, id string, event *modelpb.APMEvent) error {
+		ids = append(ids, id)
+		return nil
+	}))
+	assert.Equal(t, []string{"c", "b", "a", "legacy"}, ids)
+
+	// Events can still be read and deleted by ID alone.
+	for _, id := range []string{"a", "legacy"} {
+		_, err := readWriter.ReadTraceEventRaw("trace_id", id)
+		assert.NoError(t, err, id)
+	}
+	require.NoError(t, readWriter.DeleteTraceEvent("trace_id", "b"))
+	_, err := readWriter.ReadTraceEventRaw("trace_id", "b")
+	assert.Equal(t, eventstorage.ErrNotFound, err)
+	events = events[:0]
+	require.NoError(t, readWriter.ReadTraceEvents("trace_id", &events))
+	assert.Empty(t, cmp.Diff(modelpb.Batch{first, third, legacy}, events, protocmp.Transform()))
+
+	// Several events can be deleted with a single scan.
+	require.NoError(t, readWriter.DeleteTraceEvents("trace_id", []string{"c", "legacy", "unknown"}))
+	events = events[:0]
+	require.NoError(t, readWriter.ReadTraceEvents("trace_id", &events))
+	assert.Empty(t, cmp.Diff(modelpb.Batch{third}, events, protocmp.Transform()))
+}
+
+func TestNodeIDKeys(t *testing.T) {
+	db := newBadgerDB(t, badgerOptions)
+	wOpts := eventstorage.WriterOpts{TTL: time.Minute}
+
+	// Events written without node IDs remain readable.
+	legacy := &modelpb.APMEvent{Span: &modelpb.Span{Id: "legacy"}}
+	legacyReadWriter := eventstorage.New(db, eventstorage.ProtobufCodec{}).NewReadWriter()
+	require.NoError(t, legacyReadWriter.WriteTraceEvent("trace_id", "legacy", legacy, wOpts))
+	require.NoError(t, legacyReadWriter.Flush())
+	legacyReadWriter.Close()
+
+	// Events with the same ID written by different nodes do not replace
+	// each other, and are read by all nodes.
+	storeA := eventstorage.New(db, eventstorage.ProtobufCodec{}, eventstorage.WithNodeID("a"))
+	storeB := eventstorage.New(db, eventstorage.ProtobufCodec{}, eventstorage.WithNodeID("b"))
+	rwA, rwB := storeA.NewReadWriter(), storeB.NewReadWriter()
+	defer rwA.Close()
+	defer rwB.Close()
+	spanA := &modelpb.APMEvent{Service: &modelpb.Service{Name: "a"}, Span: &modelpb.Span{Id: "span"}}
+	spanB := &modelpb.APMEvent{Service: &modelpb.Service{Name: "b"}, Span: &modelpb.Span{Id: "span"}}
+	require.NoError(t, rwA.WriteTraceEvent("trace_id", "span", spanA, wOpts))
+	require.NoError(t, rwA.Flush())
+	require.NoError(t, rwB.WriteTraceEvent("trace_id", "span", spanB, wOpts))
+	require.NoError(t, rwB.Flush())
+	require.NoError(t, rwA.Flush()) // observe B's writes
+
+	var events modelpb.Batch
+	require.NoError(t, rwA.ReadTraceEvents("trace_id", &events))
+	assert.Empty(t, cmp.Diff(modelpb.Batch{spanA, spanB, legacy}, events, protocmp.Transform()))
+
+	var ids []string
+	require.NoError(t, storeA.IterateAll(func(traceID, id string, event *modelpb.APMEvent) error {
+		ids = append(ids, id)
+		return nil
+	}))
+	assert.Equal(t, []string{"span", "span", "legacy"}, ids)
+
+	// Sampling decisions are shared by all nodes.
+	require.NoError(t, rwB.WriteTraceSampled("trace_id", true, wOpts))
+	require.NoError(t, rwB.Flush())
+	require.NoError(t, rwA.Flush())
+	sampled, err := rwA.IsTraceSampled("trace_id")
+	assert.NoError(t, err)
+	assert.True(t, sampled)
+
+	// Events can still be read and deleted by ID alone, which deletes
+	// the events with the ID written by all nodes.
+	for _, id := range []string{"span", "legacy"} {
+		_, err := rwA.ReadTraceEventRaw("trace_id", id)
+		assert.NoError(t, err, id)
+	}
+	require.NoError(t, rwA.DeleteTraceEvent("trace_id", "span"))
+	require.NoError(t, rwA.Flush())
+	events = events[:0]
+	require.NoError(t, rwA.ReadTraceEvents("trace_id", &events))
+	assert.Empty(t, cmp.Diff(modelpb.Batch{legacy}, events, protocmp.Transform()))
+
+	assert.Panics(t, func() { eventstorage.WithNodeID("a/b") })
+	assert.Panics(t, func() { eventstorage.WithNodeID("a:b") })
+}
+
+func TestWarmCache(t *testing.T) {
+	db := newBadgerDB(t, badgerOptions)
+	store := eventstorage.New(db, eventstorage.ProtobufCodec{})
+	readWriter := store.NewReadWriter()
+	defer readWriter.Close()
+	wOpts := eventstorage.WriterOpts{TTL: time.Minute}
+	for i := 0; i < 10; i++ {
+		require.NoError(t, readWriter.WriteTraceSampled(fmt.Sprintf("trace_%d", i), true, wOpts))
+	}
+	require.NoError(t, readWriter.Flush())
+
+	assert.NoError(t, store.WarmCache(context.Background()))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, context.Canceled, store.WarmCache(ctx))
+
+	// With no keys to scan, WarmCache does nothing.
+	disabled := eventstorage.New(db, eventstorage.ProtobufCodec{}, eventstorage.WithWarmCacheKeys(0))
+	assert.NoError(t, disabled.WarmCache(ctx))
+}
+
+func TestStorageNamespace(t *testing.T) {
+	db := newBadgerDB(t, badgerOptions)
+	storeA := eventstorage.New(db, eventstorage.ProtobufCodec{}, eventstorage.WithNamespace("a"))
+	storeB := eventstorage.New(db, eventstorage.ProtobufCodec{}, eventstorage.WithNamespace("b"))
+
+	wOpts := eventstorage.WriterOpts{TTL: time.Minute}
+	rwA := storeA.NewReadWriter()
+	defer rwA.Close()
+	tw := rwA.NewTraceWriter("trace_id", wOpts)
+	require.NoError(t, tw.WriteTraceEvent("transaction_id", &modelpb.APMEvent{
+		Service:     &modelpb.Service{Name: "service"},
+		Transaction: &modelpb.Transaction{Id: "transaction_id"},
+	}))
+	require.NoError(t, tw.WriteTraceEvent("span_id", &modelpb.APMEvent{
+		Service: &modelpb.Service{Name: "service"},
+		Span:    &modelpb.Span{Id: "span_id"},
+	}))
+	require.NoError(t, rwA.WriteTraceSampled("trace_id", true, wOpts))
+	require.NoError(t, rwA.Flush())
+
+	var batch modelpb.Batch
+	require.NoError(t, rwA.ReadTraceEvents("trace_id", &batch))
+	require.Len(t, batch, 2)
+	assert.Equal(t, "service", batch[1].Service.Name, "delta-encoded event should be reconstructed")
+	sampled, err := rwA.IsTraceSampled("trace_id")
+	assert.NoError(t, err)
+	assert.True(t, sampled)
+
+	// Entries in namespace "a" must not be visible in namespace "b".
+	rwB := storeB.NewReadWriter()
+	defer rwB.Close()
+	batch = batch[:0]
+	require.NoError(t, rwB.ReadTraceEvents("trace_id", &batch))
+	assert.Empty(t, batch)
+	_, err = rwB.IsTraceSampled("trace_id")
+	assert.Equal(t, eventstorage.ErrNotFound, err)
+
+	// Scans report keys without the namespace.
+	var ids []string
+	require.NoError(t, storeA.IterateAll(func(traceID, id string, event *modelpb.APMEvent) error {
+		ids = append(ids, traceID+"/"+id)
+		return nil
+	}))
+	assert.Equal(t, []string{"trace_id/span_id", "trace_id/transaction_id"}, ids)
+	var decisions []string
+	require.NoError(t, storeA.ExportDecisions(func(traceID string, sampled bool, ttlRemaining time.Duration) error {
+		decisions = append(decisions, traceID)
+		return nil
+	}))
+	assert.Equal(t, []string{"trace_id"}, decisions)
+	require.NoError(t, storeB.IterateAll(func(traceID, id string, event *modelpb.APMEvent) error {
+		t.Errorf("unexpected event %s/%s in namespace b", traceID, id)
+		return nil
+	}))
+
+	assert.PanicsWithValue(t, "namespace must not contain ':'", func() {
+		eventstorage.WithNamespace("a:b")
+	})
+	assert.EqualError(t, eventstorage.ValidateNamespace("a:b"), "namespace must not contain ':'")
+	assert.NoError(t, eventstorage.ValidateNamespace(""))
+}
+
+func TestStorageLimit(t *testing.T) {
+	tempdir := t.TempDir()
+	opts := func() badger.Options {
+		opts := badgerOptions()
+		opts = opts.WithInMemory(false)
+		opts = opts.WithDir(tempdir).WithValueDir(tempdir)
+		return opts
+	}
+
+	// Open and close the database to create a non-empty value log file,
+	// which will cause writes below to fail due to the storage limit being
+	// exceeded. We would otherwise have to rely on Badger's one minute
+	// timer to refresh the size.
+	db := newBadgerDB(t, opts)
+	db.Close()
+	db = newBadgerDB(t, opts)
+
+	store := eventstorage.New(db, eventstorage.ProtobufCodec{})
+	readWriter := store.NewReadWriter()
+	defer readWriter.Close()
+
+	traceID := uuid.Must(uuid.NewV4()).String()
+	transactionID := uuid.Must(uuid.NewV4()).String()
+	transaction := modelpb.APMEvent{Transaction: &modelpb.Transaction{Id: transactionID}}
+	err := readWriter.WriteTraceEvent(traceID, transactionID, &transaction, eventstorage.WriterOpts{
+		TTL:                 time.Minute,
+		StorageLimitInBytes: 1,
+	})
+	assert.ErrorIs(t, err, eventstorage.ErrLimitReached)
+
+	// Assert the stored write has been discarded.
+	var batch modelpb.Batch
+	readWriter.ReadTraceEvents(traceID, &batch)
+	assert.Equal(t, 0, len(batch))
+}
+
+func TestStorageLimitHook(t *testing.T) {
+	db := newBadgerDB(t, badgerOptions)
+	var other *eventstorage.ReadWriter
+	var hookErr error
+	var hookCalls int
+	var hookFreed int64
+	store := eventstorage.New(db, eventstorage.ProtobufCodec{}, eventstorage.WithLimitHook(func() (int64, error) {
+		hookCalls++
+		if hookErr != nil {
+			return 0, hookErr
+		}
+		// Flushing the other ReadWriter's pending writes brings the
+		// storage under its limit, as the database size reported by
+		// badger is not updated until later.
+		return hookFreed, other.Flush()
+	}))
+	other = store.NewReadWriter()
+	defer other.Close()
+	readWriter := store.NewReadWriter()
+	defer readWriter.Close()
+
+	large := &modelpb.APMEvent{Message: strings.Repeat("x", 2000)}
+	small := &modelpb.APMEvent{}
+	limitOpts := eventstorage.WriterOpts{TTL: time.Minute, StorageLimitInBytes: 1000}
+
+	// Without a hook failure, the write proceeds once the hook has made
+	// room for it.
+	require.NoError(t, other.WriteTraceEvent("trace_id", "large", large, eventstorage.WriterOpts{TTL: time.Minute}))
+	require.NoError(t, readWriter.WriteTraceEvent("trace_id", "small", small, limitOpts))
+	assert.Equal(t, 1, hookCalls)
+
+	// The write fails if the hook fails, or does not make room.
+	require.NoError(t, other.WriteTraceEvent("trace_id", "large", large, eventstorage.WriterOpts{TTL: time.Minute}))
+	hookErr = errors.New("boom")
+	err := readWriter.WriteTraceEvent("trace_id", "small", small, limitOpts)
+	assert.EqualError(t, err, "limit hook failed: boom")
+	assert.Equal(t, 2, hookCalls)
+
+	hookErr = nil
+	err = readWriter.WriteTraceEvent("trace_id", "large", large, limitOpts)
+	assert.ErrorIs(t, err, eventstorage.ErrLimitReached)
+	assert.Equal(t, 3, hookCalls)
+
+	// Bytes freed by the hook are credited, such as for deleted entries
+	// which are still included in the database size, so the write
+	// proceeds, and subsequent writes draw on the remaining credit.
+	size, err := store.EncodedSize(large)
+	require.NoError(t, err)
+	hookFreed = int64(size) * 3
+	require.NoError(t, readWriter.WriteTraceEvent("trace_id", "large", large, limitOpts))
+	assert.Equal(t, 4, hookCalls)
+	hookFreed = 0
+	require.NoError(t, readWriter.WriteTraceEvent("trace_id", "large2", large, limitOpts))
+	assert.Equal(t, 4, hookCalls)
+	assert.ErrorIs(t, readWriter.WriteTraceEvent("trace_id", "large3", large, limitOpts), eventstorage.ErrLimitReached)
+	assert.Equal(t, 5, hookCalls)
+}
+
+func TestStorageEnvironmentLimits(t *testing.T) {
+	db := newBadgerDB(t, badgerOptions)
+	store := eventstorage.New(db, eventstorage.ProtobufCodec{})
+	readWriter := store.NewReadWriter()
+	defer readWriter.Close()
+
+	newEvent := func(env string) *modelpb.APMEvent {
+		return &modelpb.APMEvent{
+			Service: &modelpb.Service{Name: "service_name", Environment: env},
+			Trace:   &modelpb.Trace{Id: "trace_id"},
+			Span:    &modelpb.Span{Id: uuid.Must(uuid.NewV4()).String()},
+		}
+	}
+	size, err := store.EncodedSize(newEvent("production"))
+	require.NoError(t, err)
+	wOpts := eventstorage.WriterOpts{
+		TTL: time.Minute,
+		EnvironmentStorageLimits: map[string]int64{
+			"production": int64(size * 3),
+			"staging":    int64(size),
+			"testing":    int64(size),
+		},
+	}
+
+	write := func(env string) error {
+		event := newEvent(env)
+		return readWriter.WriteTraceEvent("trace_id", event.Span.Id, event, wOpts)
+	}
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, write("production"))
+	}
+	assert.ErrorIs(t, write("production"), eventstorage.ErrEnvLimitReached)
+
+	assert.NoError(t, write("staging"))
+	err = write("staging")
+	assert.ErrorIs(t, err, eventstorage.ErrEnvLimitReached)
+	assert.ErrorContains(t, err, `environment: "staging"`)
+
+	// Environments without a limit are not limited.
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, write("development"))
+		assert.NoError(t, write(""))
+	}
+
+	// Writes which fail after reserving environment storage, such as for
+	// exceeding the storage limit, do not count towards the environment's
+	// limit.
+	wOpts.StorageLimitInBytes = 1
+	for i := 0; i < 3; i++ {
+		assert.ErrorIs(t, write("testing"), eventstorage.ErrLimitReached)
+	}
+	wOpts.StorageLimitInBytes = 0
+	assert.NoError(t, write("testing"))
+
+	// Refused writes are not stored.
+	require.NoError(t, readWriter.Flush())
+	var batch modelpb.Batch
+	require.NoError(t, readWriter.ReadTraceEvents("trace_id", &batch))
+	assert.Len(t, batch, 25)
+}
+
+func TestStorageLimitEviction(t *testing.T) {
+	openStore := func(t *testing.T, storageOpts ...eventstorage.StorageOption) *eventstorage.Storage {
+		tempdir := t.TempDir()
+		opts := func() badger.Options {
+			opts := badgerOptions()
+			opts = opts.WithInMemory(false)
+			opts = opts.WithDir(tempdir).WithValueDir(tempdir)
+			return opts
+		}
+		// See TestStorageLimit.
+		db := newBadgerDB(t, opts)
+		db.Close()
+		db = newBadgerDB(t, opts)
+		return eventstorage.New(db, eventstorage.ProtobufCodec{}, storageOpts...)
+	}
+	readTraceIDs := func(t *testing.T, readWriter *eventstorage.ReadWriter, traceIDs ...string) []string {
+		var found []string
+		for _, traceID := range traceIDs {
+			var batch modelpb.Batch
+			require.NoError(t, readWriter.ReadTraceEvents(traceID, &batch))
+			if len(batch) > 0 {
+				found = append(found, traceID)
+			}
+		}
+		return found
+	}
+	span := &modelpb.APMEvent{Span: &modelpb.Span{Id: "span_id"}}
+
+	t.Run("fail_flush", func(t *testing.T) {
+		readWriter := openStore(t).NewReadWriter()
+		defer readWriter.Close()
+		wOpts := eventstorage.WriterOpts{TTL: time.Minute}
+		require.NoError(t, readWriter.WriteTraceEvent("trace_1", "span_id", span, wOpts))
+		require.NoError(t, readWriter.Flush())
+
+		wOpts.StorageLimitInBytes = 1
+		err := readWriter.WriteTraceEvent("trace_2", "span_id", span, wOpts)
+		assert.ErrorIs(t, err, eventstorage.ErrLimitReached)
+		assert.Equal(t, []string{"trace_1"}, readTraceIDs(t, readWriter, "trace_1", "trace_2"))
+	})
+
+	t.Run("drop_oldest", func(t *testing.T) {
+		readWriter := openStore(t).NewReadWriter()
+		defer readWriter.Close()
+		require.NoError(t, readWriter.WriteTraceEvent("trace_1", "span_id", span, eventstorage.WriterOpts{TTL: time.Hour}))
+		// The events of trace_2 are delta-encoded against the first of
+		// them, so the trace must be evicted whole: reading the trace
+		// would fail if only its base event were evicted.
+		tw := readWriter.NewTraceWriter("trace_2", eventstorage.WriterOpts{TTL: time.Minute})
+		for _, id := range []string{"span_1", "span_2", "span_3"} {
+			require.NoError(t, tw.WriteTraceEvent(id, &modelpb.APMEvent{
+				Service: &modelpb.Service{Name: "service"},
+				Span:    &modelpb.Span{Id: id},
+			}))
+		}
+		require.NoError(t, readWriter.Flush())
+
+		wOpts := eventstorage.WriterOpts{
+			TTL:                 time.Hour,
+			StorageLimitInBytes: 1,
+			OnLimit:             eventstorage.DropOldest,
+		}
+		require.NoError(t, readWriter.WriteTraceEvent("trace_3", "span_id", span, wOpts))
+		require.NoError(t, readWriter.Flush())
+		assert.Equal(t, []string{"trace_1", "trace_3"}, readTraceIDs(t, readWriter, "trace_1", "trace_2", "trace_3"))
+	})
+
+	t.Run("drop_unsampled_events", func(t *testing.T) {
+		readWriter := openStore(t).NewReadWriter()
+		defer readWriter.Close()
+		wOpts := eventstorage.WriterOpts{TTL: time.Minute}
+		require.NoError(t, readWriter.WriteTraceEvent("trace_1", "span_id", span, wOpts))
+		require.NoError(t, readWriter.WriteTraceEvent("trace_2", "span_id", span, wOpts))
+		require.NoError(t, readWriter.WriteTraceSampled("trace_1", true, wOpts))
+		require.NoError(t, readWriter.WriteTraceSampled("trace_2", false, wOpts))
+		require.NoError(t, readWriter.Flush())
+
+		wOpts.StorageLimitInBytes = 1
+		wOpts.OnLimit = eventstorage.DropUnsampledEvents
+		require.NoError(t, readWriter.WriteTraceEvent("trace_3", "span_id", span, wOpts))
+		require.NoError(t, readWriter.Flush())
+		assert.Equal(t, []string{"trace_1", "trace_3"}, readTraceIDs(t, readWriter, "trace_1", "trace_2", "trace_3"))
+
+		// There are no more unsampled trace events to evict.
+		err := readWriter.WriteTraceEvent("trace_4", "span_id", span, wOpts)
+		assert.ErrorIs(t, err, eventstorage.ErrLimitReached)
+	})
+
+	t.Run("drop_over_fair_share", func(t *testing.T) {
+		store := openStore(t, eventstorage.WithTenantKey(eventstorage.TenantKey{ServiceNameSeparator: "-"}))
+		readWriter := store.NewReadWriter()
+		defer readWriter.Close()
+		tenantSpan := func(serviceName string) *modelpb.APMEvent {
+			return &modelpb.APMEvent{Service: &modelpb.Service{Name: serviceName}, Span: &modelpb.Span{Id: "span_id"}}
+		}
+		// Tenant "b" has the oldest events, but tenant "a" is using
+		// more than its fair share of the storage.
+		require.NoError(t, readWriter.WriteTraceEvent("trace_b1", "span_id", tenantSpan("b-frontend"), eventstorage.WriterOpts{TTL: time.Minute}))
+		wOpts := eventstorage.WriterOpts{TTL: time.Hour}
+		for _, traceID := range []string{"trace_a1", "trace_a2", "trace_a3"} {
+			require.NoError(t, readWriter.WriteTraceEvent(traceID, "span_id", tenantSpan("a-checkout"), wOpts))
+		}
+		require.NoError(t, readWriter.Flush())
+		usage := store.TenantUsage()
+		require.Len(t, usage, 2)
+		assert.Equal(t, 3*usage["b"], usage["a"])
+
+		wOpts.StorageLimitInBytes = 1
+		wOpts.OnLimit = eventstorage.DropOverFairShare
+		// Room is made for both the event of trace_b2 and the entry
+		// recording its tenant, evicting whole traces of tenant "a".
+		require.NoError(t, readWriter.WriteTraceEvent("trace_b2", "span_id", tenantSpan("b-frontend"), wOpts))
+		require.NoError(t, readWriter.Flush())
+		assert.Equal(t,
+			[]string{"trace_b1", "trace_a3", "trace_b2"},
+			readTraceIDs(t, readWriter, "trace_b1", "trace_a1", "trace_a2", "trace_a3", "trace_b2"),
+		)
+		// Evicted events are no longer counted towards their tenant's usage.
+		assert.Equal(t, map[string]int64{"a": usage["b"], "b": 2 * usage["b"]}, store.TenantUsage())
+	})
+}
+
+func TestTenantKey(t *testing.T) {
+	db := newBadgerDB(t, badgerOptions)
+	assert.Nil(t, eventstorage.New(db, eventstorage.ProtobufCodec{}).TenantUsage())
+
+	store := eventstorage.New(db, eventstorage.ProtobufCodec{}, eventstorage.WithTenantKey(eventstorage.TenantKey{Label: "tenant"}))
+	readWriter := store.NewReadWriter()
+	defer readWriter.Close()
+	wOpts := eventstorage.WriterOpts{TTL: time.Minute}
+	for i, tenant := range []string{"acme", "acme", ""} {
+		event := &modelpb.APMEvent{Span: &modelpb.Span{Id: "span_id"}}
+		if tenant != "" {
+			event.Labels = map[string]*modelpb.LabelValue{"tenant": {Value: tenant}}
+		}
+		require.NoError(t, readWriter.WriteTraceEvent(fmt.Sprintf("trace_%d", i), "span_id", event, wOpts))
+	}
+	usage := store.TenantUsage()
+	assert.Len(t, usage, 2)
+	assert.Greater(t, usage["acme"], usage[""])
+	assert.Positive(t, usage[""])
+	assert.Equal(t, usage, store.Stats().TenantUsage)
+
+	// Traces belong to the tenant of their first event written.
+	other := &modelpb.APMEvent{
+		Span:   &modelpb.Span{Id: "other_span_id"},
+		Labels: map[string]*modelpb.LabelValue{"tenant": {Value: "other"}},
+	}
+	require.NoError(t, readWriter.WriteTraceEvent("trace_0", "other_span_id", other, wOpts))
+	usage = store.TenantUsage()
+	assert.Len(t, usage, 2)
+	assert.NotContains(t, usage, "other")
+
+	// Usage is not recorded for events which fail to be written.
+	limitStore := eventstorage.New(newBadgerDB(t, badgerOptions), eventstorage.ProtobufCodec{},
+		eventstorage.WithTenantKey(eventstorage.TenantKey{Label: "tenant"}),
+	)
+	limitReadWriter := limitStore.NewReadWriter()
+	defer limitReadWriter.Close()
+	large := &modelpb.APMEvent{
+		Span:   &modelpb.Span{Id: "span_id", Name: strings.Repeat("x", 1000)},
+		Labels: map[string]*modelpb.LabelValue{"tenant": {Value: "acme"}},
+	}
+	err := limitReadWriter.WriteTraceEvent("trace_id", "span_id", large, eventstorage.WriterOpts{
+		TTL: time.Minute, StorageLimitInBytes: 500,
+	})
+	assert.ErrorIs(t, err, eventstorage.ErrLimitReached)
+	assert.Empty(t, limitStore.TenantUsage())
+
+	assert.EqualError(t, eventstorage.TenantKey{}.Validate(), "one of Label or ServiceNameSeparator must be specified")
+	assert.EqualError(t,
+		eventstorage.TenantKey{Label: "tenant", ServiceNameSeparator: "-"}.Validate(),
+		"only one of Label or ServiceNameSeparator may be specified",
+	)
+	assert.PanicsWithValue(t, "invalid tenant key: one of Label or ServiceNameSeparator must be specified", func() {
+		eventstorage.WithTenantKey(eventstorage.TenantKey{})
+	})
+}
+
+func TestTenantKeyOverflow(t *testing.T) {
+	db := newBadgerDB(t, badgerOptions)
+	store := eventstorage.New(db, eventstorage.ProtobufCodec{}, eventstorage.WithTenantKey(eventstorage.TenantKey{Label: "tenant"}))
+	readWriter := store.NewReadWriter()
+	defer readWriter.Close()
+	wOpts := eventstorage.WriterOpts{TTL: time.Minute}
+
+	// Usage is tracked for at most 1000 tenants, beyond which traces are
+	// attributed to the overflow tenant.
+	for i := 0; i < 1010; i++ {
+		event := &modelpb.APMEvent{
+			Span:   &modelpb.Span{Id: "span_id"},
+			Labels: map[string]*modelpb.LabelValue{"tenant": {Value: fmt.Sprintf("tenant_%d", i)}},
+		}
+		require.NoError(t, readWriter.WriteTraceEvent(fmt.Sprintf("trace_%d", i), "span_id", event, wOpts))
+	}
+	usage := store.TenantUsage()
+	assert.Len(t, usage, 1001)
+	assert.Contains(t, usage, "tenant_999")
+	assert.NotContains(t, usage, "tenant_1000")
+	assert.Greater(t, usage["_overflow"], usage["tenant_0"])
+}
+
+func TestParseLimitStrategy(t *testing.T) {
+	for _, strategy := range []eventstorage.LimitStrategy{
+		eventstorage.FailFlush,
+		eventstorage.DropOldest,
+		eventstorage.DropUnsampledEvents,
+		eventstorage.DropOverFairShare,
+	} {
+		parsed, err := eventstorage.ParseLimitStrategy(strategy.String())
+		assert.NoError(t, err)
+		assert.Equal(t, strategy, parsed)
+	}
+	_, err := eventstorage.ParseLimitStrategy("drop_everything")
+	assert.EqualError(t, err, `unknown limit strategy "drop_everything"`)
+}
+
+func badgerOptions() badger.Options {
+	return badger.DefaultOptions("").WithInMemory(true).WithLogger(nil)
+}
+
+type badgerOptionsFunc func() badger.Options
+
+func TestOpenBadgerConfig(t *testing.T) {
+	db, err := eventstorage.OpenBadger(t.TempDir(), eventstorage.BadgerConfig{
+		ValueLogFileSize:    128 << 20,
+		MaxLevels:           5,
+		LevelSizeMultiplier: 8,
+	})
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	db, err = eventstorage.OpenBadger(t.TempDir(), eventstorage.BadgerConfig{DisableConflictDetection: true})
+	require.NoError(t, err)
+	store := eventstorage.New(db, eventstorage.ProtobufCodec{})
+	rw1 := store.NewReadWriter()
+	rw2 := store.NewReadWriter()
+	// Without conflict detection, a transaction which read a key may
+	// commit after another transaction has written it.
+	_, err = rw1.IsTraceSampled("trace_id")
+	assert.Equal(t, eventstorage.ErrNotFound, err)
+	require.NoError(t, rw2.WriteTraceSampled("trace_id", true, eventstorage.WriterOpts{}))
+	require.NoError(t, rw2.Flush())
+	require.NoError(t, rw1.WriteTraceSampled("trace_id", false, eventstorage.WriterOpts{OnDecisionConflict: eventstorage.KeepFirst}))
+	assert.NoError(t, rw1.Flush())
+	rw1.Close()
+	rw2.Close()
+	require.NoError(t, db.Close())
+
+	for _, config := range []eventstorage.BadgerConfig{
+		{ValueLogFileSize: 1024},
+		{ValueLogFileSize: 4 << 30},
+		{MaxLevels: 1},
+		{MaxLevels: 100},
+		{LevelSizeMultiplier: 1},
+		{LevelSizeMultiplier: -1},
+		{OpenRetries: -1},
+		{OpenRetries: 1000},
+		{OpenRetryBackoff: time.Microsecond},
+		{OpenRetryBackoff: time.Minute},
+	} {
+		_, err := eventstorage.OpenBadger(t.TempDir(), config)
+		assert.Error(t, err, config)
+	}
+	assert.EqualError(t, eventstorage.BadgerConfig{MaxLevels: 1}.Validate(), "MaxLevels 1 must be between 2 and 16")
+}
+
+func TestOpenBadgerRetry(t *testing.T) {
+	dir := t.TempDir()
+	config := eventstorage.BadgerConfig{OpenRetries: 2, OpenRetryBackoff: time.Millisecond}
+	db, err := eventstorage.OpenBadger(dir, config)
+	require.NoError(t, err)
+
+	// The directory lock is held by db, so opening fails after retrying.
+	_, err = eventstorage.OpenBadger(dir, config)
+	assert.ErrorContains(t, err, "failed to acquire directory lock after 2 retries")
+
+	// Opening succeeds if the lock is released while retrying.
+	config = eventstorage.BadgerConfig{OpenRetries: 10, OpenRetryBackoff: 10 * time.Millisecond}
+	closed := make(chan error, 1)
+	time.AfterFunc(50*time.Millisecond, func() { closed <- db.Close() })
+	db, err = eventstorage.OpenBadger(dir, config)
+	require.NoError(t, err)
+	require.NoError(t, <-closed)
+	require.NoError(t, db.Close())
+}
+
+func newBadgerDB(tb testing.TB, badgerOptions badgerOptionsFunc) *badger.DB {
+	db, err := badger.Open(badgerOptions())
+	if err != nil {
+		panic(err)
+	}
+	tb.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestPauseGC(t *testing.T) {
+	db := newBadgerDB(t, badgerOptions)
+	store := eventstorage.New(db, eventstorage.ProtobufCodec{})
+	assert.False(t, store.SkipGC())
+
+	store.PauseGC()
+	store.PauseGC()
+	assert.True(t, store.SkipGC())
+	assert.True(t, store.SkipGC())
+	select {
+	case <-store.GCCatchUp():
+		t.Fatal("unexpected catch-up while paused")
+	default:
+	}
+
+	// Resuming after skipped runs signals a single catch-up run.
+	store.ResumeGC()
+	assert.False(t, store.SkipGC())
+	select {
+	case <-store.GCCatchUp():
+	default:
+		t.Fatal("expected catch-up after resuming")
+	}
+	store.ResumeGC()
+	select {
+	case <-store.GCCatchUp():
+		t.Fatal("unexpected catch-up")
+	default:
+	}
+
+	// Resuming without skipped runs does not signal a catch-up run.
+	store.PauseGC()
+	store.ResumeGC()
+	select {
+	case <-store.GCCatchUp():
+		t.Fatal("unexpected catch-up without skipped runs")
+	default:
+	}
+}
+
+func TestShardedReadWriterReshard(t *testing.T) {
+	db := newBadgerDB(t, badgerOptions)
+	store := eventstorage.New(db, eventstorage.ProtobufCodec{})
+	readWriter := store.NewShardedReadWriter(eventstorage.WithShardCount(4))
+	defer readWriter.Close()
+	assert.Equal(t, 4, readWriter.ShardCount())
+
+	wOpts := eventstorage.WriterOpts{TTL: time.Minute}
+	for i := 0; i < 10; i++ {
+		traceID := fmt.Sprintf("trace_%d", i)
+		require.NoError(t, readWriter.WriteTraceEvent(traceID, "span", &modelpb.APMEvent{Span: &modelpb.Span{Id: "span"}}, wOpts))
+		require.NoError(t, readWriter.WriteTraceSampled(traceID, i%2 == 0, wOpts))
+	}
+
+	// Resharding drains the uncommitted writes of the existing shards.
+	require.NoError(t, readWriter.Reshard(3))
+	assert.Equal(t, 3, readWriter.ShardCount())
+	reader := store.NewReadWriter()
+	defer reader.Close()
+	for _, rw := range []interface {
+		ReadTraceEvents(string, *modelpb.Batch) error
+		IsTraceSampled(string) (bool, error)
+	}{reader, readWriter} {
+		for i := 0; i < 10; i++ {
+			traceID := fmt.Sprintf("trace_%d", i)
+			var batch modelpb.Batch
+			require.NoError(t, rw.ReadTraceEvents(traceID, &batch))
+			assert.Len(t, batch, 1)
+			sampled, err := rw.IsTraceSampled(traceID)
+			require.NoError(t, err)
+			assert.Equal(t, i%2 == 0, sampled)
+		}
+	}
+
+	assert.EqualError(t, readWriter.Reshard(0), "shard count 0 must be positive")
+	assert.PanicsWithValue(t, "n must be positive", func() { eventstorage.WithShardCount(0) })
+}
+
+func TestShardedReadWriterReshardConcurrent(t *testing.T) {
+	db := newBadgerDB(t, badgerOptions)
+	store := eventstorage.New(db, eventstorage.ProtobufCodec{})
+	readWriter := store.NewShardedReadWriter(eventstorage.WithShardCount(2))
+	defer readWriter.Close()
+
+	const writers, events = 4, 100
+	wOpts := eventstorage.WriterOpts{TTL: time.Minute}
+	errs := make(chan error, writers)
+	for w := 0; w < writers; w++ {
+		go func(w int) {
+			traceID := fmt.Sprintf("trace_%d", w)
+			writer := readWriter.NewTraceWriter(traceID, wOpts)
+			for i := 0; i < events; i++ {
+				id := fmt.Sprintf("span_%d", i)
+				if err := writer.WriteTraceEvent(id, &modelpb.APMEvent{Span: &modelpb.Span{Id: id}}); err != nil {
+					errs <- err
+					return
+				}
+			}
+			errs <- nil
+		}(w)
+	}
+	for n := 1; n <= 8; n++ {
+		require.NoError(t, readWriter.Reshard(n))
+	}
+	for w := 0; w < writers; w++ {
+		require.NoError(t, <-errs)
+	}
+
+	for w := 0; w < writers; w++ {
+		var batch modelpb.Batch
+		require.NoError(t, readWriter.ReadTraceEvents(fmt.Sprintf("trace_%d", w), &batch))
+		assert.Len(t, batch, events)
+	}
+}
+
+func TestStorageWithTemporaryLimit(t *testing.T) {
+	db := newBadgerDB(t, badgerOptions)
+	store := eventstorage.New(db, eventstorage.ProtobufCodec{}, eventstorage.WithStorageLimit(1))
+	readWriter := store.NewReadWriter()
+	defer readWriter.Close()
+
+	wOpts := eventstorage.WriterOpts{TTL: time.Minute, StorageLimitInBytes: 1}
+	write := func() error {
+		return readWriter.WriteTraceSampled(uuid.Must(uuid.NewV4()).String(), true, wOpts)
+	}
+	assert.ErrorIs(t, write(), eventstorage.ErrLimitReached)
+
+	store.WithTemporaryLimit(1<<30, 100*time.Millisecond)
+	assert.NoError(t, write())
+	require.NoError(t, readWriter.Flush())
+	assert.Less(t, store.UtilizationRatio(), 1.0)
+
+	// Once the raise ends, the configured limit is restored.
+	assert.Eventually(t, func() bool {
+		return errors.Is(write(), eventstorage.ErrLimitReached)
+	}, 10*time.Second, 10*time.Millisecond)
+
+	assert.PanicsWithValue(t, "limit must be positive", func() { store.WithTemporaryLimit(0, time.Minute) })
+	assert.PanicsWithValue(t, "d must be positive", func() { store.WithTemporaryLimit(1, 0) })
+}
+
+func TestIsTraceSampledConcurrent(t *testing.T) {
+	db := newBadgerDB(t, badgerOptions)
+	store := eventstorage.New(db, eventstorage.ProtobufCodec{})
+	readWriter := store.NewReadWriter()
+	defer readWriter.Close()
+
+	wOpts := eventstorage.WriterOpts{TTL: time.Minute}
+	require.NoError(t, readWriter.WriteTraceSampled("sampled", true, wOpts))
+	require.NoError(t, readWriter.WriteTraceSampled("unsampled", false, wOpts))
+
+	// Pending decisions are not observed until they are flushed.
+	_, err := store.IsTraceSampledConcurrent("sampled")
+	assert.ErrorIs(t, err, eventstorage.ErrNotFound)
+	require.NoError(t, readWriter.Flush())
+
+	var g errgroup.Group
+	for i := 0; i < 10; i++ {
+		g.Go(func() error {
+			for traceID, expected := range map[string]bool{"sampled": true, "unsampled": false} {
+				sampled, err := store.IsTraceSampledConcurrent(traceID)
+				if err != nil {
+					return err
+				}
+				if sampled != expected {
+					return fmt.Errorf("trace %s: expected sampled=%v", traceID, expected)
+				}
+			}
+			if _, err := store.IsTraceSampledConcurrent("unknown"); err != eventstorage.ErrNotFound {
+				return fmt.Errorf("expected ErrNotFound, got %v", err)
+			}
+			return nil
+		})
+	}
+	assert.NoError(t, g.Wait())
+}
+
+func TestIsTraceSampledConcurrentDecisionCache(t *testing.T) {
+	db := newBadgerDB(t, badgerOptions)
+	store := eventstorage.New(db, eventstorage.ProtobufCodec{}, eventstorage.WithDecisionCache(10, time.Minute, time.Minute))
+	readWriter := store.NewReadWriter()
+	defer readWriter.Close()
+	wOpts := eventstorage.WriterOpts{TTL: time.Minute}
+	require.NoError(t, readWriter.WriteTraceSampled("overwritten", false, wOpts))
+	require.NoError(t, readWriter.Flush())
+
+	// Concurrent lookups between a decision being written and flushed
+	// cache the committed result, but the writing ReadWriter observes
+	// its own pending decision.
+	require.NoError(t, readWriter.WriteTraceSampled("new", true, wOpts))
+	require.NoError(t, readWriter.WriteTraceSampled("overwritten", true, wOpts))
+	_, err := store.IsTraceSampledConcurrent("new")
+	assert.ErrorIs(t, err, eventstorage.ErrNotFound)
+	sampled, err := store.IsTraceSampledConcurrent("overwritten")
+	assert.NoError(t, err)
+	assert.False(t, sampled)
+	for _, traceID := range []string{"new", "overwritten"} {
+		sampled, err := readWriter.IsTraceSampled(traceID)
+		assert.NoError(t, err, traceID)
+		assert.True(t, sampled, traceID)
+	}
+
+	// Once flushed, the decisions are observed by concurrent lookups.
+	require.NoError(t, readWriter.Flush())
+	for _, traceID := range []string{"new", "overwritten"} {
+		sampled, err := store.IsTraceSampledConcurrent(traceID)
+		assert.NoError(t, err, traceID)
+		assert.True(t, sampled, traceID)
+	}
+}
+
+func TestSamplerState(t *testing.T) {
+	db := newBadgerDB(t, badgerOptions)
+	store := eventstorage.New(db, eventstorage.ProtobufCodec{}, eventstorage.WithTTL(time.Minute))
+	_, err := store.ReadSamplerState()
+	assert.ErrorIs(t, err, eventstorage.ErrNotFound)
+
+	require.NoError(t, store.WriteSamplerState([]byte("state1"), time.Minute))
+	require.NoError(t, store.WriteSamplerState([]byte("state2"), time.Minute))
+	state, err := store.ReadSamplerState()
+	require.NoError(t, err)
+	assert.Equal(t, []byte("state2"), state)
+
+	// The sampler state is not mistaken for trace events.
+	readWriter := store.NewReadWriter()
+	defer readWriter.Close()
+	var batch modelpb.Batch
+	require.NoError(t, readWriter.ReadTraceEvents("m", &batch))
+	assert.Empty(t, batch)
+	report, err := store.Verify(context.Background())
+	require.NoError(t, err)
+	assert.Empty(t, report.Problems)
+
+	// Storages with other namespaces have their own sampler state.
+	other := eventstorage.New(db, eventstorage.ProtobufCodec{}, eventstorage.WithNamespace("other"))
+	_, err = other.ReadSamplerState()
+	assert.ErrorIs(t, err, eventstorage.ErrNotFound)
+
+	store.SetReadOnly(true)
+	assert.ErrorIs(t, store.WriteSamplerState([]byte("state3"), time.Minute), eventstorage.ErrReadOnly)
+}
+
+func TestClaimTrace(t *testing.T) {
+	db := newBadgerDB(t, badgerOptions)
+	store := eventstorage.New(db, eventstorage.ProtobufCodec{}, eventstorage.WithTTL(time.Minute))
+	readWriter1 := store.NewReadWriter()
+	defer readWriter1.Close()
+	readWriter2 := store.NewReadWriter()
+	defer readWriter2.Close()
+
+	claimed, err := readWriter1.ClaimTrace("trace_id", "worker_1", time.Minute)
+	require.NoError(t, err)
+	assert.True(t, claimed)
+
+	// Other workers observe the lease immediately, without a flush.
+	claimed, err = readWriter2.ClaimTrace("trace_id", "worker_2", time.Minute)
+	require.NoError(t, err)
+	assert.False(t, claimed)
+	claimed, err = readWriter2.ClaimTrace("other_trace_id", "worker_2", time.Minute)
+	require.NoError(t, err)
+	assert.True(t, claimed)
+
+	// The worker holding the lease may renew it.
+	claimed, err = readWriter2.ClaimTrace("trace_id", "worker_1", time.Minute)
+	require.NoError(t, err)
+	assert.True(t, claimed)
+
+	// The lease is not mistaken for trace events or summaries.
+	var batch modelpb.Batch
+	require.NoError(t, readWriter1.ReadTraceEvents("trace_id", &batch))
+	assert.Empty(t, batch)
+	report, err := store.Verify(context.Background())
+	require.NoError(t, err)
+	assert.Empty(t, report.Problems)
+
+	_, err = readWriter1.ClaimTrace("trace_id", "", time.Minute)
+	assert.EqualError(t, err, "worker ID must not be empty")
+	_, err = readWriter1.ClaimTrace("trace_id", "worker_1", 0)
+	assert.EqualError(t, err, "lease must be positive")
+	store.SetReadOnly(true)
+	_, err = readWriter1.ClaimTrace("trace_id", "worker_1", time.Minute)
+	assert.ErrorIs(t, err, eventstorage.ErrReadOnly)
+}
+
+func TestClaimTraceExpiry(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping slow test")
+	}
+	db := newBadgerDB(t, badgerOptions)
+	readWriter := eventstorage.New(db, eventstorage.ProtobufCodec{}).NewReadWriter()
+	defer readWriter.Close()
+
+	claimed, err := readWriter.ClaimTrace("trace_id", "worker_1", time.Second)
+	require.NoError(t, err)
+	require.True(t, claimed)
+	assert.Eventually(t, func() bool {
+		claimed, err := readWriter.ClaimTrace("trace_id", "worker_2", time.Minute)
+		return err == nil && claimed
+	}, 5*time.Second, 100*time.Millisecond)
+}
+
+func TestClaimTraceConcurrent(t *testing.T) {
+	db := newBadgerDB(t, badgerOptions)
+	store := eventstorage.New(db, eventstorage.ProtobufCodec{})
+
+	const workers = 8
+	var g errgroup.Group
+	var claims atomic.Int64
+	for i := 0; i < workers; i++ {
+		readWriter := store.NewReadWriter()
+		defer readWriter.Close()
+		workerID := fmt.Sprintf("worker_%d", i)
+		g.Go(func() error {
+			claimed, err := readWriter.ClaimTrace("trace_id", workerID, time.Minute)
+			if claimed {
+				claims.Add(1)
+			}
+			return err
+		})
+	}
+	require.NoError(t, g.Wait())
+	assert.Equal(t, int64(1), claims.Load())
 }
@@ -5,6 +5,7 @@
 package eventstorage
 
 import (
+	"math"
 	"testing"
 	"time"
 
@@ -92,3 +93,203 @@ func fillTxnUntilTxnTooBig(txn *badger.Txn) {
 		err = txn.SetEntry(entry)
 	}
 }
+
+func TestAdaptiveFlushWrites(t *testing.T) {
+	assert.Equal(t, flushWrites, adaptiveFlushWrites(0))
+	assert.Equal(t, flushWrites, adaptiveFlushWrites(tableLimit-1))
+	assert.Equal(t, flushWrites*2, adaptiveFlushWrites(tableLimit))
+	assert.Equal(t, flushWrites*4, adaptiveFlushWrites(tableLimit+1))
+	assert.Equal(t, maxFlushWrites, adaptiveFlushWrites(tableLimit+100))
+}
+
+func TestFlushThreshold(t *testing.T) {
+	readWriter := newReadWriter(t)
+	assert.False(t, readWriter.s.adaptiveFlush)
+	assert.Equal(t, flushWrites, readWriter.s.flushThreshold())
+	WithAdaptiveFlush(true)(readWriter.s)
+	assert.Equal(t, flushWrites, readWriter.s.flushThreshold())
+
+	// Simulate compaction pressure having been observed previously.
+	readWriter.s.flushWrites.Store(maxFlushWrites)
+	readWriter.s.nextCompactionPressureCheck.Store(time.Now().Add(time.Hour).UnixNano())
+	assert.Equal(t, maxFlushWrites, readWriter.s.flushThreshold())
+
+	WithAdaptiveFlush(false)(readWriter.s)
+	assert.Equal(t, flushWrites, readWriter.s.flushThreshold())
+}
+
+func TestWriteTraceEvent_MaxTransactionSize(t *testing.T) {
+	readWriter := newReadWriter(t)
+	assert.Equal(t, readWriter.s.db.MaxBatchSize(), readWriter.s.maxTransactionSize)
+	WithMaxTransactionSize(1024)(readWriter.s)
+
+	// Write events until the transaction exceeds the configured size,
+	// which should cause the pending writes to be flushed proactively.
+	var flushed bool
+	for i := 0; i < 100 && !flushed; i++ {
+		before := readWriter.pendingWrites
+		writeEvent(t, readWriter)
+		flushed = readWriter.pendingWrites <= before
+	}
+	assert.True(t, flushed)
+	assert.LessOrEqual(t, readWriter.pendingSize, int64(1024))
+}
+
+func TestShardHash(t *testing.T) {
+	rw := newReadWriter(t)
+	var hashed []string
+	s := rw.s.NewShardedReadWriter(WithShardHash(func(traceID string) uint64 {
+		hashed = append(hashed, traceID)
+		return uint64(len(traceID))
+	}))
+	defer s.Close()
+
+	assert.Same(t, &s.readWriters[1%len(s.readWriters)], s.getWriter("a"))
+	assert.Same(t, &s.readWriters[3%len(s.readWriters)], s.getWriter("abc"))
+	assert.Equal(t, []string{"a", "abc"}, hashed)
+
+	assert.PanicsWithValue(t, "hash must not be nil", func() { WithShardHash(nil) })
+}
+
+func TestSizeEstimator(t *testing.T) {
+	var e sizeEstimator
+	t0 := time.Unix(1000, 0)
+
+	// No growth rate is known until the reported size changes.
+	assert.Equal(t, int64(100), e.estimate(100, t0))
+	assert.Equal(t, int64(100), e.estimate(100, t0.Add(30*time.Second)))
+
+	// The size grew by 6000 bytes over one minute: 100 bytes/s, smoothed
+	// to 50 bytes/s.
+	t1 := t0.Add(time.Minute)
+	assert.Equal(t, int64(6100), e.estimate(6100, t1))
+	assert.Equal(t, int64(6100+50*10), e.estimate(6100, t1.Add(10*time.Second)))
+
+	// Extrapolation is capped at one update interval.
+	assert.Equal(t, int64(6100+50*60), e.estimate(6100, t1.Add(10*time.Minute)))
+
+	// Shrinking reduces the rate, but is not extrapolated.
+	t2 := t1.Add(time.Minute)
+	assert.Equal(t, int64(100), e.estimate(100, t2))
+	assert.Equal(t, int64(100+25*10), e.estimate(100, t2.Add(10*time.Second)))
+}
+
+func TestEnvUsage(t *testing.T) {
+	const ttl = 16 * time.Minute // one minute per bucket
+	var u envUsage
+	now := time.Unix(0, 0).Add(time.Hour)
+
+	_, current, ok := u.reserve("production", 60, 100, ttl, now)
+	assert.True(t, ok)
+	assert.Equal(t, int64(0), current)
+	_, current, ok = u.reserve("production", 60, 100, ttl, now.Add(10*time.Minute))
+	assert.False(t, ok)
+	assert.Equal(t, int64(60), current)
+	_, _, ok = u.reserve("staging", 60, 100, ttl, now.Add(10*time.Minute))
+	assert.True(t, ok)
+
+	// Once the first reservation falls outside the TTL, it no longer counts.
+	_, current, ok = u.reserve("production", 60, 100, ttl, now.Add(ttl))
+	assert.True(t, ok)
+	assert.Equal(t, int64(0), current)
+	_, current, ok = u.reserve("production", 40, 100, ttl, now.Add(ttl+time.Minute))
+	assert.True(t, ok)
+	assert.Equal(t, int64(60), current)
+	_, current, ok = u.reserve("production", 1, 100, ttl, now.Add(ttl+time.Minute))
+	assert.False(t, ok)
+	assert.Equal(t, int64(100), current)
+}
+
+func TestEnvUsageMaxEnvs(t *testing.T) {
+	const ttl = 16 * time.Minute // one minute per bucket
+	u := envUsage{maxEnvs: 2, overflowEnv: "overflow"}
+	now := time.Unix(0, 0).Add(time.Hour)
+
+	env, _, _ := u.reserve("a", 10, math.MaxInt64, ttl, now)
+	assert.Equal(t, "a", env)
+	env, _, _ = u.reserve("b", 20, math.MaxInt64, ttl, now)
+	assert.Equal(t, "b", env)
+	// Further environments are tracked as the overflow environment.
+	env, _, _ = u.reserve("c", 30, math.MaxInt64, ttl, now)
+	assert.Equal(t, "overflow", env)
+	env, current, _ := u.reserve("d", 40, math.MaxInt64, ttl, now)
+	assert.Equal(t, "overflow", env)
+	assert.Equal(t, int64(30), current)
+	env, _, _ = u.reserve("a", 1, math.MaxInt64, ttl, now)
+	assert.Equal(t, "a", env)
+	assert.Equal(t, map[string]int64{"a": 11, "b": 20, "overflow": 70}, u.usage(now))
+
+	// Environments whose usage has aged out, or been released, are no
+	// longer tracked, making room for others.
+	u.release("b", 20, now)
+	later := now.Add(ttl)
+	env, _, _ = u.reserve("c", 30, math.MaxInt64, ttl, later)
+	assert.Equal(t, "c", env)
+	env, _, _ = u.reserve("d", 40, math.MaxInt64, ttl, later)
+	assert.Equal(t, "d", env)
+	assert.Len(t, u.envs, 2)
+	assert.Equal(t, map[string]int64{"c": 30, "d": 40}, u.usage(later))
+}
+
+func FuzzDecodeEvent(f *testing.F) {
+	data, err := ProtobufCodec{}.EncodeEvent(&modelpb.APMEvent{
+		Transaction: &modelpb.Transaction{Id: "transaction_id", Name: "name"},
+		Span:        &modelpb.Span{Id: "span_id"},
+	})
+	require.NoError(f, err)
+	f.Add(data)
+	f.Add(data[:len(data)/2])
+	f.Add([]byte{})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var event modelpb.APMEvent
+		// Decoding arbitrary data may fail, but must never panic.
+		_ = decodeEvent(ProtobufCodec{}, data, &event)
+	})
+}
+
+func TestFreeDiskChecker(t *testing.T) {
+	c := &freeDiskChecker{dir: t.TempDir(), min: MinFreeDisk{Percent: 100}}
+	now := time.Now()
+	err := c.check(now)
+	assert.ErrorIs(t, err, ErrLimitReached)
+
+	// The result is cached until freeDiskCheckInterval has elapsed.
+	c.min = MinFreeDisk{Bytes: 1}
+	assert.ErrorIs(t, c.check(now.Add(freeDiskCheckInterval/2)), ErrLimitReached)
+	assert.NoError(t, c.check(now.Add(freeDiskCheckInterval)))
+
+	// The check is skipped if the free space cannot be read.
+	c = &freeDiskChecker{dir: "/nonexistent", min: MinFreeDisk{Percent: 100}}
+	assert.NoError(t, c.check(now))
+}
+
+func TestScanEvictionTraces(t *testing.T) {
+	readWriter := newReadWriter(t)
+	wOpts := WriterOpts{TTL: time.Minute}
+	for _, traceID := range []string{"trace_1", "trace_2", "trace_3"} {
+		for _, id := range []string{"span_1", "span_2"} {
+			require.NoError(t, readWriter.WriteTraceEvent(traceID, id, &modelpb.APMEvent{}, wOpts))
+		}
+	}
+	require.NoError(t, readWriter.Flush())
+
+	scan := func(maxKeys int) (traceIDs []string) {
+		require.NoError(t, readWriter.s.db.View(func(txn *badger.Txn) error {
+			traces, err := readWriter.s.scanEvictionTraces(txn, maxKeys)
+			require.NoError(t, err)
+			for _, trace := range traces {
+				assert.Len(t, trace.events, 2, string(trace.traceID))
+				traceIDs = append(traceIDs, string(trace.traceID))
+			}
+			return nil
+		}))
+		return traceIDs
+	}
+	// Traces are scanned whole, beyond the bound, and subsequent scans
+	// continue from where the previous scan stopped, wrapping around.
+	assert.Equal(t, []string{"trace_1"}, scan(1))
+	assert.Equal(t, []string{"trace_2", "trace_3"}, scan(3))
+	assert.Equal(t, []string{"trace_1", "trace_2", "trace_3"}, scan(10))
+	assert.Equal(t, []string{"trace_1", "trace_2"}, scan(3))
+	assert.Equal(t, []string{"trace_3", "trace_1"}, scan(3))
+}
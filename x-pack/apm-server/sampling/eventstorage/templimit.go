@@ -0,0 +1,59 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package eventstorage
+
+import (
+	"time"
+
+	"github.com/elastic/apm-server/internal/logs"
+	"github.com/elastic/elastic-agent-libs/logp"
+)
+
+// temporaryLimit holds a storage limit raised by WithTemporaryLimit.
+type temporaryLimit struct {
+	limit int64
+	until time.Time
+}
+
+// WithTemporaryLimit raises the storage limit to limit bytes for the
+// duration d, after which the configured limit is restored, such as to
+// allow the storage to grow beyond its usual limit during a planned load
+// test without reconfiguring it.
+//
+// While the raise is in effect, writes are limited to limit bytes instead
+// of WriterOpts.StorageLimitInBytes, if that is lower, and UtilizationRatio
+// is relative to limit instead of the limit set with WithStorageLimit.
+// Writes without a limit remain unlimited. Calling WithTemporaryLimit
+// again replaces any raise in effect. The start and end of the raise are
+// logged.
+//
+// WithTemporaryLimit panics if limit or d is not positive.
+func (s *Storage) WithTemporaryLimit(limit int64, d time.Duration) {
+	if limit <= 0 {
+		panic("limit must be positive")
+	}
+	if d <= 0 {
+		panic("d must be positive")
+	}
+	logger := logp.NewLogger(logs.Sampling)
+	t := &temporaryLimit{limit: limit, until: time.Now().Add(d)}
+	s.temporaryLimit.Store(t)
+	logger.Infof("storage limit temporarily raised to %d bytes for %s", limit, d)
+	time.AfterFunc(d, func() {
+		if s.temporaryLimit.CompareAndSwap(t, nil) {
+			logger.Infof("temporary storage limit of %d bytes ended, configured limit restored", limit)
+		}
+	})
+}
+
+// effectiveLimit returns the storage limit in effect at now, given the
+// configured limit, which is zero or negative if unlimited.
+func (s *Storage) effectiveLimit(configured int64, now time.Time) int64 {
+	t := s.temporaryLimit.Load()
+	if t == nil || configured <= 0 || t.limit <= configured || !now.Before(t.until) {
+		return configured
+	}
+	return t.limit
+}
@@ -0,0 +1,216 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package eventstorage
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/badger/v2"
+
+	"github.com/elastic/apm-data/model/modelpb"
+)
+
+const (
+	// maxTenants holds the maximum number of tenants whose storage usage
+	// is tracked, beyond which the usage of further tenants is attributed
+	// to overflowTenant. Tenants are derived from client-supplied values,
+	// so this bounds the memory used and the number of tenants reported.
+	maxTenants = 1000
+
+	// overflowTenant is the tenant to which traces are attributed once
+	// maxTenants tenants are tracked.
+	overflowTenant = "_overflow"
+)
+
+// TenantKey defines how the tenant of a trace event is derived, for
+// tracking the storage used by each tenant of a shared storage. Exactly
+// one of Label and ServiceNameSeparator must be specified. See
+// WithTenantKey.
+type TenantKey struct {
+	// Label holds the name of a label, such as "tenant", whose string
+	// value is the event's tenant. Events without the label belong to
+	// the empty tenant.
+	Label string
+
+	// ServiceNameSeparator holds a separator, such as "-", for deriving
+	// the event's tenant from the prefix of its service name before the
+	// first separator: the service "acme-checkout" belongs to the tenant
+	// "acme". Events of services whose names do not contain the separator
+	// belong to the empty tenant.
+	ServiceNameSeparator string
+}
+
+// Validate returns an error if the tenant key is invalid.
+func (k TenantKey) Validate() error {
+	switch {
+	case k.Label == "" && k.ServiceNameSeparator == "":
+		return errors.New("one of Label or ServiceNameSeparator must be specified")
+	case k.Label != "" && k.ServiceNameSeparator != "":
+		return errors.New("only one of Label or ServiceNameSeparator may be specified")
+	}
+	return nil
+}
+
+// tenant returns the tenant of event.
+func (k TenantKey) tenant(event *modelpb.APMEvent) string {
+	if k.Label != "" {
+		return event.GetLabels()[k.Label].GetValue()
+	}
+	prefix, _, ok := strings.Cut(event.GetService().GetName(), k.ServiceNameSeparator)
+	if !ok {
+		return ""
+	}
+	return prefix
+}
+
+// WithTenantKey sets the key from which the tenant of each trace event is
+// derived, and enables tracking of the storage used by each tenant, which
+// is reported by Stats. Tenant usage is also used by the DropOverFairShare
+// limit strategy, to evict the traces of the tenants using the most
+// storage. Usage is estimated in the same way as for
+// WriterOpts.EnvironmentStorageLimits, from the size of the events written
+// for each tenant within the last TTL, less those evicted.
+//
+// Each trace belongs to the tenant of the first of its events written, and
+// the storage used by all of its events is attributed to that tenant. The
+// tenant is recorded in an entry alongside the trace's events, which is
+// read with each event written, and rewritten at most once per second to
+// extend its TTL with the trace's events.
+//
+// Usage is tracked for at most 1000 tenants at a time. Once that many
+// tenants have usage, new traces of other tenants are attributed to the
+// tenant "_overflow" until the usage of some tenants ages out.
+//
+// WithTenantKey panics if key is invalid.
+func WithTenantKey(key TenantKey) StorageOption {
+	if err := key.Validate(); err != nil {
+		panic("invalid tenant key: " + err.Error())
+	}
+	return func(s *Storage) {
+		s.tenantKey = &key
+		s.tenantUsage.maxEnvs = maxTenants
+		s.tenantUsage.overflowEnv = overflowTenant
+	}
+}
+
+// reserveTenantUsage accounts for writing entrySize bytes at time now for
+// event to the usage of its trace's tenant, if tenant usage is tracked,
+// before event is written. If the trace has no tenant recorded, it is
+// recorded as event's tenant, or overflowTenant if too many tenants are
+// tracked. reserveTenantUsage returns the tenant and reports whether the
+// size was reserved, in which case the reservation must be released if
+// the write fails.
+func (rw *ReadWriter) reserveTenantUsage(traceID string, event *modelpb.APMEvent, entrySize int64, opts WriterOpts, now time.Time) (string, bool, error) {
+	if rw.s.tenantKey == nil {
+		return "", false, nil
+	}
+	key := rw.s.traceTenantKey(nil, traceID)
+	var tenant string
+	var recorded bool
+	item, err := rw.txn.Get(key)
+	switch err {
+	case nil:
+		if err := item.Value(func(data []byte) error {
+			tenant = string(data)
+			return nil
+		}); err != nil {
+			return "", false, err
+		}
+		// The tenant entry is rewritten if the event would expire after
+		// it, so that it expires with the trace's last event.
+		recorded = item.ExpiresAt() >= uint64(now.Add(opts.TTL).Unix())
+	case badger.ErrKeyNotFound:
+		tenant = rw.s.tenantKey.tenant(event)
+	default:
+		return "", false, err
+	}
+	// The recorded tenant may no longer be tracked, and its usage be
+	// attributed to overflowTenant, in which case the entry is rewritten.
+	reserved, _, _ := rw.s.tenantUsage.reserve(tenant, entrySize, math.MaxInt64, opts.TTL, now)
+	if !recorded || reserved != tenant {
+		tenant = reserved
+		e := badger.NewEntry(key, []byte(tenant)).WithMeta(entryMetaTraceTenant)
+		if err := rw.writeEntry(e, opts); err != nil {
+			rw.s.tenantUsage.release(tenant, entrySize, now)
+			return "", false, err
+		}
+	}
+	return tenant, true, nil
+}
+
+// TenantUsage returns the estimated storage used by each tenant, in bytes,
+// omitting tenants without usage. If WithTenantKey is not specified,
+// TenantUsage returns nil.
+func (s *Storage) TenantUsage() map[string]int64 {
+	if s.tenantKey == nil {
+		return nil
+	}
+	return s.tenantUsage.usage(time.Now())
+}
+
+// evictOverFairShare deletes the traces of the tenants furthest over their
+// fair share of limit, which is divided equally between the tenants with
+// stored events, of those found by scanEvictionTraces, until at least
+// target bytes have been freed or no such traces remain. The traces of each
+// tenant are deleted whole, in order of expiry, and all of a tenant's
+// traces are deleted before those of the next.
+//
+// Traces without a recorded tenant, such as those written before
+// WithTenantKey was specified, belong to the empty tenant. Without a tenant
+// key, all traces belong to the same tenant, and the oldest traces are
+// deleted as with DropOldest.
+func (s *Storage) evictOverFairShare(target, limit int64) (int64, error) {
+	var traces []*evictionTrace
+	if err := s.db.View(func(txn *badger.Txn) (err error) {
+		traces, err = s.scanEvictionTraces(txn, maxEvictionScanKeys)
+		return err
+	}); err != nil {
+		return 0, err
+	}
+	if len(traces) == 0 {
+		return 0, nil
+	}
+
+	usage := s.tenantUsage.usage(time.Now())
+	tenantTraces := make(map[string][]*evictionTrace)
+	for _, trace := range traces {
+		tenantTraces[trace.tenant] = append(tenantTraces[trace.tenant], trace)
+	}
+	tenants := make([]string, 0, len(tenantTraces))
+	for tenant := range tenantTraces {
+		tenants = append(tenants, tenant)
+	}
+	// The fair share is divided between the tenants with usage, which
+	// includes tenants whose traces were not scanned.
+	numTenants := len(usage)
+	for _, tenant := range tenants {
+		if _, ok := usage[tenant]; !ok {
+			numTenants++
+		}
+	}
+	fairShare := limit / int64(numTenants)
+	sort.Slice(tenants, func(i, j int) bool {
+		overI := usage[tenants[i]] - fairShare
+		overJ := usage[tenants[j]] - fairShare
+		if overI != overJ {
+			return overI > overJ
+		}
+		return tenants[i] < tenants[j]
+	})
+
+	ordered := make([]*evictionTrace, 0, len(traces))
+	for _, tenant := range tenants {
+		traces := tenantTraces[tenant]
+		sort.Slice(traces, func(i, j int) bool {
+			return traces[i].expiresAt < traces[j].expiresAt
+		})
+		ordered = append(ordered, traces...)
+	}
+	return s.evictTraces(ordered, target)
+}
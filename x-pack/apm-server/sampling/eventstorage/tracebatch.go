@@ -0,0 +1,54 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package eventstorage
+
+import (
+	"github.com/elastic/apm-data/model/modelpb"
+)
+
+// TraceBatch writes events of a single trace through a ReadWriter, sharing
+// its transaction. The trace's key prefix is computed once, so each event
+// key is built with a single allocation; otherwise, Add behaves the same
+// as ReadWriter.WriteTraceEvent.
+//
+// Unlike TraceWriter, TraceBatch writes every event in full.
+type TraceBatch struct {
+	rw      *ReadWriter
+	traceID string
+	opts    WriterOpts
+	prefix  []byte
+}
+
+// TraceBatch returns a new TraceBatch for writing the events of the trace
+// with the given ID, using opts.
+func (rw *ReadWriter) TraceBatch(traceID string, opts WriterOpts) *TraceBatch {
+	return &TraceBatch{
+		rw:      rw,
+		traceID: traceID,
+		opts:    opts,
+		prefix:  rw.s.eventKeyPrefix(nil, traceID),
+	}
+}
+
+// Add writes a trace event with the given ID, as with
+// ReadWriter.WriteTraceEvent.
+func (b *TraceBatch) Add(id string, event *modelpb.APMEvent) error {
+	// Entry keys are retained by the transaction until it is committed,
+	// so each event needs its own key.
+	key := make([]byte, 0, len(b.prefix)+b.rw.s.eventKeyIDLen(len(id)))
+	key = b.rw.s.appendEventKeyID(append(key, b.prefix...), id, event)
+	b.rw.mu.Lock()
+	defer b.rw.mu.Unlock()
+	if b.rw.closed {
+		return ErrClosed
+	}
+	return b.rw.writeTraceEvent(b.traceID, key, event, entryMetaTraceEvent, b.opts)
+}
+
+// Flush calls ReadWriter.Flush, committing the writes of the TraceBatch
+// along with any other pending writes of the ReadWriter.
+func (b *TraceBatch) Flush() error {
+	return b.rw.Flush()
+}
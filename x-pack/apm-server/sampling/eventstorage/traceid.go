@@ -0,0 +1,59 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package eventstorage
+
+import "fmt"
+
+// traceIDLength holds the length of a valid trace ID: 16 bytes, hex-encoded,
+// as defined by W3C Trace Context.
+const traceIDLength = 32
+
+// ValidTraceID reports whether id is a valid trace ID: exactly 32
+// hexadecimal digits. Both lower and upper case digits are accepted.
+func ValidTraceID(id string) bool {
+	if len(id) != traceIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		switch c := id[i]; {
+		case '0' <= c && c <= '9', 'a' <= c && c <= 'f', 'A' <= c && c <= 'F':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// InvalidTraceIDError is returned by ReadWriter write methods for trace IDs
+// rejected by ValidTraceID, when WithTraceIDValidation is enabled.
+type InvalidTraceIDError struct {
+	// TraceID holds the invalid trace ID.
+	TraceID string
+}
+
+func (e *InvalidTraceIDError) Error() string {
+	return fmt.Sprintf("invalid trace ID %q: must be %d hex digits", e.TraceID, traceIDLength)
+}
+
+// WithTraceIDValidation sets whether ReadWriters should reject trace events
+// and sampling decisions for trace IDs which are not valid according to
+// ValidTraceID, returning an *InvalidTraceIDError without writing them.
+// This guards against malformed trace IDs from misbehaving clients using
+// storage space. Validation is disabled by default, so that deployments
+// using non-standard trace IDs continue to work.
+func WithTraceIDValidation(enabled bool) StorageOption {
+	return func(s *Storage) {
+		s.validateTraceIDs = enabled
+	}
+}
+
+// checkTraceID returns an *InvalidTraceIDError if trace ID validation is
+// enabled and traceID is invalid, and nil otherwise.
+func (s *Storage) checkTraceID(traceID string) error {
+	if s.validateTraceIDs && !ValidTraceID(traceID) {
+		return &InvalidTraceIDError{TraceID: traceID}
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package eventstorage
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/dgraph-io/badger/v2"
+)
+
+// TraceTTLTolerance holds the maximum difference between the expiry times
+// of a trace's events for VerifyTraceTTL to consider them consistent. Events
+// of a trace are written as they are received, so their expiry times differ
+// by up to the trace's duration even when written with the same TTL.
+const TraceTTLTolerance = time.Minute
+
+// TraceTTLError describes events of a trace with inconsistent expiry times,
+// as reported by VerifyTraceTTL.
+type TraceTTLError struct {
+	// TraceID holds the ID of the trace.
+	TraceID string
+
+	// FirstEventID and FirstExpiry hold the ID and expiry time of the
+	// trace's event which expires first.
+	FirstEventID string
+	FirstExpiry  time.Time
+
+	// LastEventID and LastExpiry hold the ID and expiry time of the trace's
+	// event which expires last. LastExpiry is the zero time if the event
+	// was written without a TTL, and never expires.
+	LastEventID string
+	LastExpiry  time.Time
+}
+
+func (e *TraceTTLError) Error() string {
+	last := "never"
+	if !e.LastExpiry.IsZero() {
+		last = e.LastExpiry.UTC().Format(time.RFC3339)
+	}
+	return fmt.Sprintf(
+		"trace %s has inconsistent event TTLs: event %s expires at %s, event %s expires %s",
+		e.TraceID,
+		e.FirstEventID, e.FirstExpiry.UTC().Format(time.RFC3339),
+		e.LastEventID, last,
+	)
+}
+
+// VerifyTraceTTL reports whether the unexpired events of the given trace
+// have consistent expiry times, differing by no more than TraceTTLTolerance.
+// An event written without a TTL is inconsistent with events written with
+// one. VerifyTraceTTL is a diagnostic for events written with the wrong TTL,
+// such as after the TTL configuration is changed.
+//
+// If the events are inconsistent, VerifyTraceTTL returns false and a
+// *TraceTTLError describing the events expiring first and last. A trace with
+// no events is consistent.
+func (rw *ReadWriter) VerifyTraceTTL(traceID string) (consistent bool, err error) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	if rw.closed {
+		return false, ErrClosed
+	}
+
+	var first, last struct {
+		id        string
+		expiresAt uint64
+	}
+	var n int
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	rw.readKeyBuf = rw.s.eventKeyPrefix(rw.readKeyBuf[:0], traceID)
+	opts.Prefix = rw.readKeyBuf
+	iter := rw.txn.NewIterator(opts)
+	defer iter.Close()
+	for iter.Rewind(); iter.Valid(); iter.Next() {
+		item := iter.Item()
+		if item.IsDeletedOrExpired() || !isTraceEventMeta(item.UserMeta()) {
+			continue
+		}
+		_, id, ok := rw.s.splitEventKey(item.Key())
+		if !ok {
+			continue
+		}
+		// Events without a TTL have a zero expiry; treat them as
+		// expiring after all others.
+		expiresAt := item.ExpiresAt()
+		if expiresAt == 0 {
+			expiresAt = ^uint64(0)
+		}
+		if n == 0 || expiresAt < first.expiresAt {
+			first.id, first.expiresAt = string(id), expiresAt
+		}
+		if n == 0 || expiresAt > last.expiresAt {
+			last.id, last.expiresAt = string(id), expiresAt
+		}
+		n++
+	}
+	if n == 0 || last.expiresAt-first.expiresAt <= uint64(TraceTTLTolerance/time.Second) {
+		return true, nil
+	}
+	ttlErr := &TraceTTLError{
+		TraceID:      traceID,
+		FirstEventID: first.id,
+		FirstExpiry:  time.Unix(int64(first.expiresAt), 0),
+		LastEventID:  last.id,
+	}
+	if last.expiresAt != ^uint64(0) {
+		ttlErr.LastExpiry = time.Unix(int64(last.expiresAt), 0)
+	}
+	return false, ttlErr
+}
@@ -0,0 +1,175 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package eventstorage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/dgraph-io/badger/v2"
+
+	"github.com/elastic/apm-data/model/modelpb"
+)
+
+// maxVerifyProblems holds the maximum number of problems recorded in a
+// VerifyReport; further problems are only counted.
+const maxVerifyProblems = 1000
+
+// VerifyReport holds the results of Storage.Verify.
+type VerifyReport struct {
+	// Events holds the number of trace events which were decoded
+	// successfully.
+	Events int
+
+	// Decisions holds the number of sampling decisions.
+	Decisions int
+
+	// Summaries holds the number of trace summaries, including trace
+	// labels and trace event summaries.
+	Summaries int
+
+	// EventIDIndexes holds the number of event ID index entries. See
+	// WithEventIDIndex.
+	EventIDIndexes int
+
+	// Unknown holds the number of entries with an unknown entry type.
+	Unknown int
+
+	// Problems holds the problems found, up to a maximum of 1000.
+	Problems []VerifyProblem
+
+	// OmittedProblems holds the number of problems found in excess of
+	// the maximum, which are not held in Problems.
+	OmittedProblems int
+}
+
+// VerifyProblem describes a problem with a stored entry, found by
+// Storage.Verify.
+type VerifyProblem struct {
+	// Key holds the entry's key, without the storage's namespace prefix.
+	Key string
+
+	// Problem describes the problem.
+	Problem string
+}
+
+func (r *VerifyReport) addProblem(key []byte, format string, args ...interface{}) {
+	if len(r.Problems) == maxVerifyProblems {
+		r.OmittedProblems++
+		return
+	}
+	r.Problems = append(r.Problems, VerifyProblem{Key: string(key), Problem: fmt.Sprintf(format, args...)})
+}
+
+// Verify scans the entire storage, checking that: every trace event can be
+// decoded; every key can be parsed according to its entry type; no
+// sampling decision key could be mistaken for the prefix of trace event
+// keys; and, if a TTL was specified with WithTTL, every entry expires, and
+// no later than TTL plus TraceTTLTolerance from now. It returns a report
+// counting the entries of each type, and describing the problems found.
+//
+// Problems with entries are reported in the VerifyReport rather than
+// returned as errors; Verify returns an error only if the storage cannot be
+// read, or ctx is cancelled, in which case the report is incomplete. Like
+// IterateAll, Verify is intended for diagnostics and CI, and must not be
+// used on hot paths.
+func (s *Storage) Verify(ctx context.Context) (VerifyReport, error) {
+	var report VerifyReport
+	now := time.Now()
+	err := s.db.View(func(txn *badger.Txn) error {
+		decoder := traceEventDecoder{s: s, txn: txn}
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = s.keyPrefix
+		iter := txn.NewIterator(opts)
+		defer iter.Close()
+		for iter.Rewind(); iter.Valid(); iter.Next() {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			item := iter.Item()
+			if item.IsDeletedOrExpired() {
+				continue
+			}
+			key := item.Key()
+			s.verifyTTL(&report, item, now)
+			switch meta := item.UserMeta(); {
+			case meta == entryMetaTraceSampled, meta == entryMetaTraceUnsampled:
+				report.Decisions++
+				traceID := s.decisionTraceID(key)
+				if len(traceID) == 0 {
+					report.addProblem(s.trimNamespace(key), "sampling decision has an empty trace ID")
+				} else if bytes.IndexByte(traceID, keySeparator) >= 0 {
+					report.addProblem(s.trimNamespace(key), "sampling decision key collides with trace event keys")
+				}
+			case isTraceEventMeta(meta):
+				traceID, id, ok := s.splitEventKey(key)
+				if !ok || len(traceID) == 0 || len(id) == 0 {
+					report.addProblem(s.trimNamespace(key), "invalid trace event key")
+					continue
+				}
+				var event modelpb.APMEvent
+				if err := decoder.decode(string(traceID), item, &event); err != nil {
+					report.addProblem(s.trimNamespace(key), "failed to decode trace event: %v", err)
+					continue
+				}
+				report.Events++
+			case meta == entryMetaTraceSummary, meta == entryMetaTraceEventSummary:
+				report.Summaries++
+				suffix := traceSummaryKeySuffix
+				if meta == entryMetaTraceEventSummary {
+					suffix = traceEventSummaryKeySuffix
+				}
+				if !bytes.HasSuffix(key, []byte(suffix)) || len(s.trimNamespace(key)) == len(suffix) {
+					report.addProblem(s.trimNamespace(key), "invalid trace summary key")
+				}
+			case meta == entryMetaEventIDIndex:
+				report.EventIDIndexes++
+				id := s.trimNamespace(key)
+				if !bytes.HasPrefix(id, []byte(eventIDIndexKeyPrefix)) || len(id) == len(eventIDIndexKeyPrefix) {
+					report.addProblem(id, "invalid event ID index key")
+				}
+			case meta == entryMetaTraceLease:
+				if !bytes.HasSuffix(key, []byte(traceLeaseKeySuffix)) || len(s.trimNamespace(key)) == len(traceLeaseKeySuffix) {
+					report.addProblem(s.trimNamespace(key), "invalid trace lease key")
+				}
+			case meta == entryMetaTraceTenant:
+				if !bytes.HasSuffix(key, []byte(traceTenantKeySuffix)) || len(s.trimNamespace(key)) == len(traceTenantKeySuffix) {
+					report.addProblem(s.trimNamespace(key), "invalid trace tenant key")
+				}
+			case meta == entryMetaSamplerState:
+				if !bytes.Equal(s.trimNamespace(key), []byte(samplerStateKey)) {
+					report.addProblem(s.trimNamespace(key), "invalid sampler state key")
+				}
+			case meta == entryMetaReencodeCursor:
+				if !bytes.Equal(s.trimNamespace(key), []byte(reencodeCursorKey)) {
+					report.addProblem(s.trimNamespace(key), "invalid reencode cursor key")
+				}
+			default:
+				report.Unknown++
+				report.addProblem(s.trimNamespace(key), "unknown entry type 0x%02x", meta)
+			}
+		}
+		return nil
+	})
+	return report, err
+}
+
+// verifyTTL records a problem in report if the storage has a TTL, and item
+// does not expire or expires later than the TTL allows.
+func (s *Storage) verifyTTL(report *VerifyReport, item *badger.Item, now time.Time) {
+	if s.ttl <= 0 {
+		return
+	}
+	expiresAt := item.ExpiresAt()
+	if expiresAt == 0 {
+		report.addProblem(s.trimNamespace(item.Key()), "entry does not expire")
+		return
+	}
+	if remaining := time.Unix(int64(expiresAt), 0).Sub(now); remaining > s.ttl+TraceTTLTolerance {
+		report.addProblem(s.trimNamespace(item.Key()), "entry expires in %s, exceeding TTL %s", remaining.Round(time.Minute), s.ttl)
+	}
+}
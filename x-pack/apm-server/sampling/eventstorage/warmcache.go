@@ -0,0 +1,55 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package eventstorage
+
+import (
+	"context"
+
+	"github.com/dgraph-io/badger/v2"
+)
+
+// defaultWarmCacheKeys holds the default maximum number of keys scanned by
+// WarmCache. See WithWarmCacheKeys.
+const defaultWarmCacheKeys = 100000
+
+// WithWarmCacheKeys sets the maximum number of keys scanned by WarmCache,
+// bounding the time it takes. The default is 100000. If n <= 0, WarmCache
+// does nothing.
+func WithWarmCacheKeys(n int) StorageOption {
+	return func(s *Storage) {
+		s.warmCacheKeys = n
+	}
+}
+
+// WarmCache scans the storage's keys, up to the limit set by
+// WithWarmCacheKeys, so that the tables they are stored in are loaded into
+// badger's block cache and the operating system's page cache. Calling
+// WarmCache after opening a database avoids the latency of reading from
+// disk for the first sampling decisions and events read.
+//
+// Keys are scanned in order, so traces with lower IDs are favoured when the
+// storage holds more keys than the limit. Values stored outside the LSM tree,
+// in the value log, are not read. WarmCache returns ctx.Err() if ctx is done
+// before the scan completes.
+func (s *Storage) WarmCache(ctx context.Context) error {
+	if s.warmCacheKeys <= 0 {
+		return nil
+	}
+	return s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Prefix = s.keyPrefix
+		iter := txn.NewIterator(opts)
+		defer iter.Close()
+		n := 0
+		for iter.Rewind(); iter.Valid() && n < s.warmCacheKeys; iter.Next() {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			n++
+		}
+		return nil
+	})
+}
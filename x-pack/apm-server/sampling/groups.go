@@ -9,8 +9,11 @@ import (
 	"math"
 	"math/rand"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/ryanuber/go-glob"
+
 	"github.com/elastic/apm-data/model/modelpb"
 )
 
@@ -32,6 +35,44 @@ type traceGroups struct {
 	// be created, and events may be dropped.
 	maxDynamicServiceGroups int
 
+	// allowedSampleRates holds the sample rates to which effective
+	// sample rates are quantized, in descending order. If empty, rates
+	// are not quantized. See LocalSamplingConfig.AllowedSampleRates.
+	allowedSampleRates []float64
+
+	// requiresTraceSummary records whether any policy has trace-level
+	// criteria which require a summary of the trace's events for matching.
+	requiresTraceSummary bool
+
+	// requiresSpanEvents records whether any policy matches on span
+	// labels or database statements, which are not held in stored trace
+	// event summaries.
+	requiresSpanEvents bool
+
+	// trackDropped records whether the IDs of traces dropped from the
+	// groups' reservoirs are recorded. dropped holds those dropped up to
+	// the most recent call to finalizeSampledTraces, and is protected by
+	// mu. See trackDroppedTraces.
+	trackDropped bool
+	dropped      []string
+
+	// now returns the current time, for applying sample rate hysteresis.
+	now func() time.Time
+
+	// defaultPolicy holds the index of the first policy with no criteria,
+	// which matches all root transactions not matched by an earlier policy,
+	// or -1 if there is none. Policies after it can never match.
+	defaultPolicy int
+
+	// servicePolicies holds, for each service name specified by a policy
+	// before defaultPolicy, the indices of the policies before defaultPolicy
+	// which may match root transactions of that service, in order.
+	// anyServicePolicies holds the same for other services. Root
+	// transactions which match none of these are matched by defaultPolicy
+	// without evaluating any other policies.
+	servicePolicies    map[string][]int
+	anyServicePolicies []int
+
 	mu                      sync.RWMutex
 	policyGroups            []policyGroup
 	numDynamicServiceGroups int
@@ -41,46 +82,239 @@ type policyGroup struct {
 	policy  Policy
 	g       *traceGroup            // nil for catch-all
 	dynamic map[string]*traceGroup // nil for static
+
+	// matched holds the number of root transactions matched by this
+	// policy in the current sampling interval. This must be accessed
+	// atomically.
+	matched *atomic.Int64
+
+	// stats holds the policy statistics for the most recently finalized
+	// sampling interval. This is protected by traceGroups.mu.
+	stats policyStats
+}
+
+// policyStats holds statistics for a policy over a sampling interval.
+type policyStats struct {
+	// Matched holds the number of root transactions matched by the policy.
+	Matched int64
+	// Sampled holds the number of traces sampled by the policy.
+	Sampled int64
+	// Dropped holds the number of traces matched but not sampled by the policy.
+	Dropped int64
+}
+
+// match reports whether the policy matches the given root transaction.
+//
+// If summary is nil, then policies with trace-level criteria computed
+// from the trace's events will not match.
+func (g *policyGroup) match(transactionEvent *modelpb.APMEvent, summary *traceSummary) bool {
+	if g.policy.Conditions != nil {
+		return g.policy.Conditions.match(transactionEvent, summary)
+	}
+	return g.policy.PolicyCriteria.match(transactionEvent, summary)
+}
+
+// match reports whether the condition matches the given root transaction.
+func (c *Condition) match(transactionEvent *modelpb.APMEvent, summary *traceSummary) bool {
+	if !c.PolicyCriteria.match(transactionEvent, summary) {
+		return false
+	}
+	for i := range c.And {
+		if !c.And[i].match(transactionEvent, summary) {
+			return false
+		}
+	}
+	if len(c.Or) > 0 {
+		var matched bool
+		for i := range c.Or {
+			if c.Or[i].match(transactionEvent, summary) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return c.Not == nil || !c.Not.match(transactionEvent, summary)
 }
 
-func (g *policyGroup) match(transactionEvent *modelpb.APMEvent) bool {
-	if g.policy.ServiceName != "" && g.policy.ServiceName != transactionEvent.Service.Name {
+// match reports whether the criteria match the given root transaction.
+// Empty criteria are ignored.
+func (c *PolicyCriteria) match(transactionEvent *modelpb.APMEvent, summary *traceSummary) bool {
+	if c.ServiceName != "" && c.ServiceName != transactionEvent.Service.Name {
+		return false
+	}
+	if c.ServiceEnvironment != "" && c.ServiceEnvironment != transactionEvent.Service.Environment {
+		return false
+	}
+	if c.TraceOutcome != "" && c.TraceOutcome != transactionEvent.Event.Outcome {
+		return false
+	}
+	if c.TraceName != "" && c.TraceName != transactionEvent.Transaction.Name {
+		return false
+	}
+	if c.TraceURLPath != "" {
+		urlPath := transactionEvent.GetUrl().GetPath()
+		if urlPath == "" || !glob.Glob(c.TraceURLPath, urlPath) {
+			return false
+		}
+	}
+	if c.TraceResult != "" {
+		result := transactionEvent.Transaction.Result
+		if result == "" || !glob.Glob(c.TraceResult, result) {
+			return false
+		}
+	}
+	if c.TransactionType != "" {
+		transactionType := transactionEvent.Transaction.Type
+		if transactionType == "" || !glob.Glob(c.TransactionType, transactionType) {
+			return false
+		}
+	}
+	if c.UpstreamSampled != nil && *c.UpstreamSampled != transactionEvent.GetTransaction().GetSampled() {
 		return false
 	}
-	if g.policy.ServiceEnvironment != "" && g.policy.ServiceEnvironment != transactionEvent.Service.Environment {
+	if c.CloudProvider != "" && c.CloudProvider != transactionEvent.GetCloud().GetProvider() {
 		return false
 	}
-	if g.policy.TraceOutcome != "" && g.policy.TraceOutcome != transactionEvent.Event.Outcome {
+	if c.CloudRegion != "" {
+		region := transactionEvent.GetCloud().GetRegion()
+		if region == "" || !glob.Glob(c.CloudRegion, region) {
+			return false
+		}
+	}
+	if c.UserID != "" {
+		id := transactionEvent.GetUser().GetId()
+		if id == "" || !glob.Glob(c.UserID, id) {
+			return false
+		}
+	}
+	if c.UserEmail != "" {
+		email := transactionEvent.GetUser().GetEmail()
+		if email == "" || !glob.Glob(c.UserEmail, email) {
+			return false
+		}
+	}
+	if c.SpanTotalDurationType != "" {
+		if summary == nil || summary.spanDurations[c.SpanTotalDurationType] < c.SpanTotalDurationMin {
+			return false
+		}
+	}
+	if c.DestinationService != "" {
+		if summary == nil || !summary.hasDestinationService(c.DestinationService) {
+			return false
+		}
+	}
+	if c.SpanDurationRatio != 0 && !c.matchSpanDurationRatio(transactionEvent, summary) {
 		return false
 	}
-	if g.policy.TraceName != "" && g.policy.TraceName != transactionEvent.Transaction.Name {
+	if len(c.SpanLabels) > 0 {
+		if summary == nil || !summary.hasSpanLabels(c.SpanLabels) {
+			return false
+		}
+	}
+	if c.DBStatement != "" {
+		if summary == nil || !summary.hasDBStatement(c.DBStatement) {
+			return false
+		}
+	}
+	if len(c.TimeWindows) > 0 && !c.matchTimeWindows(transactionEvent.GetTimestamp()) {
 		return false
 	}
 	return true
 }
 
+// matchSpanDurationRatio reports whether the total duration of the trace's
+// spans is at least SpanDurationRatio times the root transaction's duration.
+func (c *PolicyCriteria) matchSpanDurationRatio(transactionEvent *modelpb.APMEvent, summary *traceSummary) bool {
+	rootDuration := transactionEvent.GetEvent().GetDuration()
+	if rootDuration == 0 || summary == nil {
+		return false
+	}
+	return float64(summary.totalSpanDuration()) >= c.SpanDurationRatio*float64(rootDuration)
+}
+
+// matchTimeWindows reports whether the timestamp, in nanoseconds since the
+// Unix epoch, falls within one of the criteria's time windows.
+func (c *PolicyCriteria) matchTimeWindows(timestamp uint64) bool {
+	if timestamp == 0 {
+		return false
+	}
+	loc := c.TimeZone
+	if loc == nil {
+		loc = time.UTC
+	}
+	t := time.Unix(0, int64(timestamp)).In(loc)
+	hour, min, sec := t.Clock()
+	timeOfDay := time.Duration(hour)*time.Hour + time.Duration(min)*time.Minute +
+		time.Duration(sec)*time.Second + time.Duration(t.Nanosecond())
+	for _, w := range c.TimeWindows {
+		if w.contains(timeOfDay) {
+			return true
+		}
+	}
+	return false
+}
+
 func newTraceGroups(
 	policies []Policy,
 	maxDynamicServiceGroups int,
 	ingestRateDecayFactor float64,
+	allowedSampleRates []float64,
 ) *traceGroups {
 	groups := &traceGroups{
 		ingestRateDecayFactor:   ingestRateDecayFactor,
+		allowedSampleRates:      allowedSampleRates,
 		maxDynamicServiceGroups: maxDynamicServiceGroups,
 		policyGroups:            make([]policyGroup, len(policies)),
+		now:                     time.Now,
 	}
 	for i, policy := range policies {
-		pg := policyGroup{policy: policy}
-		if policy.ServiceName != "" {
-			pg.g = newTraceGroup(policy.SampleRate)
+		pg := policyGroup{policy: policy, matched: &atomic.Int64{}}
+		if policy.anyCriteria(PolicyCriteria.requiresTraceSummary) {
+			groups.requiresTraceSummary = true
+		}
+		if policy.anyCriteria(PolicyCriteria.requiresSpanEvents) {
+			groups.requiresSpanEvents = true
+		}
+		if policy.Conditions == nil && policy.ServiceName != "" {
+			pg.g = newTraceGroup(policy)
 		} else {
 			pg.dynamic = make(map[string]*traceGroup)
 		}
 		groups.policyGroups[i] = pg
 	}
+	groups.indexPolicies()
 	return groups
 }
 
+// indexPolicies records the policies which may match root transactions of
+// each service, for skipping policies which cannot match in getTraceGroup.
+func (g *traceGroups) indexPolicies() {
+	g.defaultPolicy = -1
+	g.servicePolicies = make(map[string][]int)
+	for i, pg := range g.policyGroups {
+		if pg.policy.isDefault() {
+			g.defaultPolicy = i
+			break
+		}
+		if pg.policy.Conditions == nil && pg.policy.ServiceName != "" {
+			if _, ok := g.servicePolicies[pg.policy.ServiceName]; !ok {
+				// Policies for any service before the first policy for
+				// this service may also match, and must be evaluated first.
+				g.servicePolicies[pg.policy.ServiceName] = append([]int(nil), g.anyServicePolicies...)
+			}
+			g.servicePolicies[pg.policy.ServiceName] = append(g.servicePolicies[pg.policy.ServiceName], i)
+			continue
+		}
+		g.anyServicePolicies = append(g.anyServicePolicies, i)
+		for serviceName, indices := range g.servicePolicies {
+			g.servicePolicies[serviceName] = append(indices, i)
+		}
+	}
+}
+
 // traceGroup represents a single trace group, including a measurement of the
 // observed ingest rate, a trace ID weighted random sampling reservoir.
 type traceGroup struct {
@@ -88,6 +322,17 @@ type traceGroup struct {
 	// trace group to sample, as a fraction in the range (0,1).
 	samplingFraction float64
 
+	// errorRateMultiplier holds the multiplier applied to the observed
+	// error fraction when scaling samplingFraction. If this is zero, then
+	// error rate scaling is disabled.
+	errorRateMultiplier float64
+
+	// rateDeadBand and rateMinHold hold the hysteresis parameters for
+	// changing effectiveSamplingFraction. See Policy.ErrorRateDeadBand
+	// and Policy.ErrorRateMinHold.
+	rateDeadBand float64
+	rateMinHold  time.Duration
+
 	mu sync.Mutex
 	// reservoir holds a random sample of root transactions observed
 	// for this trace group, weighted by duration.
@@ -96,6 +341,22 @@ type traceGroup struct {
 	// this trace group, including those that are not added to the
 	// reservoir. This is used to update ingestRate.
 	total int
+	// failed holds the number of root transactions observed for this
+	// trace group with a "failure" outcome. This is used for scaling
+	// the sampling fraction by the error rate.
+	failed int
+	// effectiveSamplingFraction holds the sampling fraction applied in
+	// the most recent call to finalizeSampledTraces, after scaling by the
+	// observed error rate.
+	effectiveSamplingFraction float64
+	// effectiveSamplingFractionChanged holds the time at which
+	// effectiveSamplingFraction last changed.
+	effectiveSamplingFractionChanged time.Time
+	// trackDropped records whether the IDs of traces admitted to the
+	// reservoir but not sampled are recorded in dropped. See
+	// traceGroups.trackDroppedTraces.
+	trackDropped bool
+	dropped      []string
 	// ingestRate holds the exponentially weighted moving average number
 	// of root transactions observed for this trace group per tail
 	// sampling interval. This is read and written only by the periodic
@@ -103,14 +364,21 @@ type traceGroup struct {
 	ingestRate float64
 }
 
-func newTraceGroup(samplingFraction float64) *traceGroup {
-	return &traceGroup{
-		samplingFraction: samplingFraction,
+func newTraceGroup(policy Policy) *traceGroup {
+	g := &traceGroup{
+		samplingFraction:          policy.SampleRate,
+		effectiveSamplingFraction: policy.SampleRate,
 		reservoir: newWeightedRandomSample(
 			rand.New(rand.NewSource(time.Now().UnixNano())),
 			minReservoirSize,
 		),
 	}
+	if policy.ErrorRateScaling {
+		g.errorRateMultiplier = policy.ErrorRateMultiplier
+		g.rateDeadBand = policy.ErrorRateDeadBand
+		g.rateMinHold = policy.ErrorRateMinHold
+	}
+	return g
 }
 
 // sampleTrace will return true if the root transaction is admitted to
@@ -118,26 +386,38 @@ func newTraceGroup(samplingFraction float64) *traceGroup {
 //
 // If the transaction is not admitted due to the transaction group limit
 // having been reached, sampleTrace will return errTooManyTraceGroups.
-func (g *traceGroups) sampleTrace(transactionEvent *modelpb.APMEvent) (bool, error) {
-	group, err := g.getTraceGroup(transactionEvent)
+//
+// summary holds a summary of the trace's events received so far, for
+// matching policies with trace-level criteria. This may be nil if no
+// policies require it; see requiresTraceSummary.
+func (g *traceGroups) sampleTrace(transactionEvent *modelpb.APMEvent, summary *traceSummary) (bool, error) {
+	group, err := g.getTraceGroup(transactionEvent, summary)
 	if err != nil {
 		return false, err
 	}
 	return group.sampleTrace(transactionEvent)
 }
 
-func (g *traceGroups) getTraceGroup(transactionEvent *modelpb.APMEvent) (*traceGroup, error) {
+func (g *traceGroups) getTraceGroup(transactionEvent *modelpb.APMEvent, summary *traceSummary) (*traceGroup, error) {
 	var pg *policyGroup
-	for i := range g.policyGroups {
-		if g.policyGroups[i].match(transactionEvent) {
+	candidates, ok := g.servicePolicies[transactionEvent.GetService().GetName()]
+	if !ok {
+		candidates = g.anyServicePolicies
+	}
+	for _, i := range candidates {
+		if g.policyGroups[i].match(transactionEvent, summary) {
 			pg = &g.policyGroups[i]
 			break
 		}
 	}
 	if pg == nil {
-		return nil, errNoMatchingPolicy
+		if g.defaultPolicy < 0 {
+			return nil, errNoMatchingPolicy
+		}
+		pg = &g.policyGroups[g.defaultPolicy]
 	}
 	if pg.g != nil {
+		pg.matched.Add(1)
 		return pg.g, nil
 	}
 
@@ -150,9 +430,13 @@ func (g *traceGroups) getTraceGroup(transactionEvent *modelpb.APMEvent) (*traceG
 			return nil, errTooManyTraceGroups
 		}
 		g.numDynamicServiceGroups++
-		group = newTraceGroup(pg.policy.SampleRate)
+		group = newTraceGroup(pg.policy)
+		group.trackDropped = g.trackDropped
 		pg.dynamic[transactionEvent.GetService().GetName()] = group
 	}
+	// Only count traces which are admitted to a group, so that those
+	// rejected for exceeding the group limit are not reported as matched.
+	pg.matched.Add(1)
 	return group, nil
 }
 
@@ -163,10 +447,43 @@ func (g *traceGroup) sampleTrace(transactionEvent *modelpb.APMEvent) (bool, erro
 	g.mu.Lock()
 	defer g.mu.Unlock()
 	g.total++
-	return g.reservoir.Sample(
+	if transactionEvent.GetEvent().GetOutcome() == "failure" {
+		g.failed++
+	}
+	sampled, evicted := g.reservoir.Sample(
 		time.Duration(transactionEvent.GetEvent().GetDuration()).Seconds(),
 		transactionEvent.GetTrace().GetId(),
-	), nil
+	)
+	if evicted != "" && g.trackDropped {
+		g.dropped = append(g.dropped, evicted)
+	}
+	return sampled, nil
+}
+
+// effectiveSampleRate returns the sample rate applied for the policy at
+// index i in the most recent sampling interval. For policies with dynamic
+// service groups, the highest rate across all of the groups is returned.
+func (g *traceGroups) effectiveSampleRate(i int) float64 {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	pg := &g.policyGroups[i]
+	if pg.g != nil {
+		return pg.g.getEffectiveSamplingFraction()
+	}
+	if len(pg.dynamic) == 0 {
+		return pg.policy.SampleRate
+	}
+	var rate float64
+	for _, group := range pg.dynamic {
+		rate = math.Max(rate, group.getEffectiveSamplingFraction())
+	}
+	return rate
+}
+
+func (g *traceGroup) getEffectiveSamplingFraction() float64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.effectiveSamplingFraction
 }
 
 // finalizeSampledTraces locks the groups, appends their current trace IDs to
@@ -181,27 +498,113 @@ func (g *traceGroups) finalizeSampledTraces(traceIDs []string) []string {
 	g.mu.Lock()
 	defer g.mu.Unlock()
 	maxDynamicServiceGroupsReached := g.numDynamicServiceGroups == g.maxDynamicServiceGroups
-	for _, pg := range g.policyGroups {
+	now := g.now()
+	for i := range g.policyGroups {
+		pg := &g.policyGroups[i]
+		n := len(traceIDs)
 		if pg.g != nil {
-			traceIDs = pg.g.finalizeSampledTraces(traceIDs, g.ingestRateDecayFactor)
-			continue
+			traceIDs = pg.g.finalizeSampledTraces(traceIDs, g.ingestRateDecayFactor, g.allowedSampleRates, now)
+			g.dropped = pg.g.takeDropped(g.dropped)
 		}
 		for serviceName, group := range pg.dynamic {
 			total := group.total
-			traceIDs = group.finalizeSampledTraces(traceIDs, g.ingestRateDecayFactor)
+			traceIDs = group.finalizeSampledTraces(traceIDs, g.ingestRateDecayFactor, g.allowedSampleRates, now)
+			g.dropped = group.takeDropped(g.dropped)
 			if (maxDynamicServiceGroupsReached || total == 0) && group.reservoir.Size() == minReservoirSize {
 				g.numDynamicServiceGroups--
 				delete(pg.dynamic, serviceName)
 			}
 		}
+		matched := pg.matched.Swap(0)
+		sampled := int64(len(traceIDs) - n)
+		pg.stats = policyStats{
+			Matched: matched,
+			Sampled: sampled,
+			Dropped: max(0, matched-sampled),
+		}
 	}
 	return traceIDs
 }
 
+// trackDroppedTraces enables recording the IDs of traces which are admitted
+// to a sampling reservoir, but are then not sampled: those evicted from a
+// full reservoir by a trace with a greater weight, and those removed from a
+// reservoir by finalizeSampledTraces to limit it to the desired fraction of
+// traces. The recorded IDs are returned by takeDroppedTraces. This must be
+// called before sampling any traces.
+func (g *traceGroups) trackDroppedTraces() {
+	g.trackDropped = true
+	for i := range g.policyGroups {
+		if pg := &g.policyGroups[i]; pg.g != nil {
+			pg.g.trackDropped = true
+		}
+	}
+}
+
+// takeDroppedTraces appends the IDs of traces dropped from the groups'
+// reservoirs up to the most recent call to finalizeSampledTraces to
+// traceIDs, and returns the extended slice; see trackDroppedTraces. The
+// IDs are returned only once.
+func (g *traceGroups) takeDroppedTraces(traceIDs []string) []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	traceIDs = append(traceIDs, g.dropped...)
+	g.dropped = nil
+	return traceIDs
+}
+
+// policyStats returns the statistics for the policy at index i, for the
+// most recently finalized sampling interval.
+func (g *traceGroups) policyStats(i int) policyStats {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return g.policyGroups[i].stats
+}
+
+// dampSamplingFraction returns the sampling fraction to apply, given the
+// target fraction computed for the current interval, applying hysteresis to
+// avoid the effective sampling fraction flapping between intervals.
+//
+// The effective sampling fraction is changed only if the target differs from
+// it by more than rateDeadBand, and at least rateMinHold has elapsed since it
+// last changed. Returning to the configured sampling fraction is exempt from
+// the dead band, so the rate does not remain elevated after errors subside.
+func (g *traceGroup) dampSamplingFraction(target float64, now time.Time) float64 {
+	current := g.effectiveSamplingFraction
+	if target == current {
+		return current
+	}
+	if target != g.samplingFraction && math.Abs(target-current) <= g.rateDeadBand {
+		return current
+	}
+	if g.rateMinHold > 0 && now.Sub(g.effectiveSamplingFractionChanged) < g.rateMinHold {
+		return current
+	}
+	g.effectiveSamplingFractionChanged = now
+	return target
+}
+
+// quantizeSampleRate returns the rate in allowed, which is sorted in
+// descending order, nearest to rate, preferring the higher of two equally
+// near rates. If allowed is empty or rate is zero, rate is returned as is.
+func quantizeSampleRate(rate float64, allowed []float64) float64 {
+	if len(allowed) == 0 || rate == 0 {
+		return rate
+	}
+	nearest := allowed[0]
+	for _, a := range allowed[1:] {
+		if math.Abs(a-rate) < math.Abs(nearest-rate) {
+			nearest = a
+		}
+	}
+	return nearest
+}
+
 // finalizeSampledTraces appends the group's current trace IDs to traceIDs, and
 // returns the extended slice. On return the groups' sampling reservoirs will be
-// reset.
-func (g *traceGroup) finalizeSampledTraces(traceIDs []string, ingestRateDecayFactor float64) []string {
+// reset. Effective sample rates are quantized to allowedSampleRates, if
+// non-empty.
+func (g *traceGroup) finalizeSampledTraces(traceIDs []string, ingestRateDecayFactor float64, allowedSampleRates []float64, now time.Time) []string {
 	g.mu.Lock()
 	defer g.mu.Unlock()
 
@@ -211,24 +614,57 @@ func (g *traceGroup) finalizeSampledTraces(traceIDs []string, ingestRateDecayFac
 		g.ingestRate *= 1 - ingestRateDecayFactor
 		g.ingestRate += ingestRateDecayFactor * float64(g.total)
 	}
-	desiredTotal := int(math.Ceil(g.samplingFraction * float64(g.total)))
+	samplingFraction := g.samplingFraction
+	if g.errorRateMultiplier > 0 && g.total > 0 {
+		errorFraction := float64(g.failed) / float64(g.total)
+		samplingFraction = math.Min(1, samplingFraction*(1+g.errorRateMultiplier*errorFraction))
+	}
+	samplingFraction = g.dampSamplingFraction(samplingFraction, now)
+	samplingFraction = quantizeSampleRate(samplingFraction, allowedSampleRates)
+	g.effectiveSamplingFraction = samplingFraction
+	desiredTotal := int(math.Ceil(samplingFraction * float64(g.total)))
 	g.total = 0
+	g.failed = 0
 
 	for n := g.reservoir.Len(); n > desiredTotal; n-- {
 		// The reservoir is larger than the desired fraction of the
 		// observed total number of traces in this interval. Pop the
 		// lowest weighted traces to limit to the desired total.
-		g.reservoir.Pop()
+		dropped := g.reservoir.Pop()
+		if g.trackDropped {
+			g.dropped = append(g.dropped, dropped)
+		}
 	}
 	traceIDs = append(traceIDs, g.reservoir.Values()...)
-
-	// Resize the reservoir, so that it can hold the desired fraction of
-	// the observed ingest rate.
-	newReservoirSize := int(math.Ceil(g.samplingFraction * g.ingestRate))
-	if newReservoirSize < minReservoirSize {
-		newReservoirSize = minReservoirSize
-	}
 	g.reservoir.Reset()
-	g.reservoir.Resize(newReservoirSize)
+	g.reservoir.Resize(g.reservoirSize(allowedSampleRates))
+	return traceIDs
+}
+
+// takeDropped appends the IDs of traces dropped from the group's reservoir
+// to traceIDs, and returns the extended slice, clearing the group's record
+// of them.
+func (g *traceGroup) takeDropped(traceIDs []string) []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	traceIDs = append(traceIDs, g.dropped...)
+	g.dropped = nil
 	return traceIDs
 }
+
+// reservoirSize returns the reservoir size needed to hold the desired
+// fraction of the observed ingest rate. When scaling by error rate, the
+// size is for the maximum possible sampling fraction, as the error rate
+// for the next interval is not yet known.
+func (g *traceGroup) reservoirSize(allowedSampleRates []float64) int {
+	maxSamplingFraction := g.samplingFraction
+	if g.errorRateMultiplier > 0 {
+		maxSamplingFraction = math.Min(1, maxSamplingFraction*(1+g.errorRateMultiplier))
+	}
+	maxSamplingFraction = quantizeSampleRate(maxSamplingFraction, allowedSampleRates)
+	size := int(math.Ceil(maxSamplingFraction * g.ingestRate))
+	if size < minReservoirSize {
+		size = minReservoirSize
+	}
+	return size
+}
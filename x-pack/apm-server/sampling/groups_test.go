@@ -6,6 +6,7 @@ package sampling
 
 import (
 	"fmt"
+	"strings"
 	"testing"
 	"time"
 
@@ -63,13 +64,13 @@ func TestTraceGroupsPolicies(t *testing.T) {
 		policy.ServiceName = ""
 		policies = append(policies, policy)
 	}
-	groups := newTraceGroups(policies, 1000, 1.0)
+	groups := newTraceGroups(policies, 1000, 1.0, nil)
 
 	assertSampleRate := func(sampleRate float64, serviceName, serviceEnvironment, traceOutcome, traceName string) {
 		tx := makeTransaction(serviceName, serviceEnvironment, traceOutcome, traceName)
 		const N = 1000
 		for i := 0; i < N; i++ {
-			if _, err := groups.sampleTrace(tx); err != nil {
+			if _, err := groups.sampleTrace(tx, nil); err != nil {
 				t.Fatal(err)
 			}
 		}
@@ -91,7 +92,7 @@ func TestTraceGroupsMax(t *testing.T) {
 		ingestRateCoefficient = 1.0
 	)
 	policies := []Policy{{SampleRate: 1.0}}
-	groups := newTraceGroups(policies, maxDynamicServices, ingestRateCoefficient)
+	groups := newTraceGroups(policies, maxDynamicServices, ingestRateCoefficient, nil)
 
 	for i := 0; i < maxDynamicServices; i++ {
 		serviceName := fmt.Sprintf("service_group_%d", i)
@@ -106,7 +107,7 @@ func TestTraceGroupsMax(t *testing.T) {
 					Name: "whatever",
 					Id:   uuid.Must(uuid.NewV4()).String(),
 				},
-			})
+			}, nil)
 			require.NoError(t, err)
 			assert.True(t, admitted)
 		}
@@ -119,9 +120,10 @@ func TestTraceGroupsMax(t *testing.T) {
 			Name: "overflow",
 			Id:   uuid.Must(uuid.NewV4()).String(),
 		},
-	})
+	}, nil)
 	assert.Equal(t, errTooManyTraceGroups, err)
 	assert.False(t, admitted)
+	assert.Equal(t, int64(maxDynamicServices*minReservoirSize), groups.policyGroups[0].matched.Load())
 }
 
 func TestTraceGroupReservoirResize(t *testing.T) {
@@ -130,7 +132,7 @@ func TestTraceGroupReservoirResize(t *testing.T) {
 		ingestRateCoefficient = 0.75
 	)
 	policies := []Policy{{SampleRate: 0.2}}
-	groups := newTraceGroups(policies, maxDynamicServices, ingestRateCoefficient)
+	groups := newTraceGroups(policies, maxDynamicServices, ingestRateCoefficient, nil)
 
 	sendTransactions := func(n int) {
 		for i := 0; i < n; i++ {
@@ -140,7 +142,7 @@ func TestTraceGroupReservoirResize(t *testing.T) {
 					Type: "type",
 					Id:   "0102030405060708",
 				},
-			})
+			}, nil)
 		}
 	}
 
@@ -166,13 +168,62 @@ func TestTraceGroupReservoirResize(t *testing.T) {
 	}
 }
 
+func TestTraceGroupsDroppedTraces(t *testing.T) {
+	const (
+		maxDynamicServices    = 1
+		ingestRateCoefficient = 1.0
+	)
+	policies := []Policy{{SampleRate: 0.1}}
+	groups := newTraceGroups(policies, maxDynamicServices, ingestRateCoefficient, nil)
+	groups.trackDroppedTraces()
+
+	// Traces beyond the reservoir size are evicted from it, or not
+	// admitted; the remainder beyond the sampling fraction are removed
+	// when the reservoir is finalized.
+	traceIDs := make(map[string]bool)
+	for i := 0; i < 1500; i++ {
+		traceID := fmt.Sprintf("%032x", i)
+		admitted, err := groups.sampleTrace(&modelpb.APMEvent{
+			Trace:       &modelpb.Trace{Id: traceID},
+			Event:       &modelpb.Event{Duration: uint64(time.Millisecond)},
+			Transaction: &modelpb.Transaction{Type: "type", Id: traceID[:16]},
+		}, nil)
+		require.NoError(t, err)
+		if admitted {
+			traceIDs[traceID] = true
+		}
+	}
+	sampled := groups.finalizeSampledTraces(nil)
+	assert.Len(t, sampled, 150)
+	dropped := groups.takeDroppedTraces(nil)
+	assert.Len(t, dropped, len(traceIDs)-150)
+	for _, traceID := range append(sampled, dropped...) {
+		assert.True(t, traceIDs[traceID], traceID)
+		delete(traceIDs, traceID)
+	}
+	assert.Empty(t, traceIDs)
+	assert.Empty(t, groups.takeDroppedTraces(nil))
+
+	// Dropped traces are not recorded unless enabled.
+	groups = newTraceGroups(policies, maxDynamicServices, ingestRateCoefficient, nil)
+	for i := 0; i < 1500; i++ {
+		traceID := fmt.Sprintf("%032x", i)
+		groups.sampleTrace(&modelpb.APMEvent{
+			Trace:       &modelpb.Trace{Id: traceID},
+			Transaction: &modelpb.Transaction{Type: "type", Id: traceID[:16]},
+		}, nil)
+	}
+	assert.Len(t, groups.finalizeSampledTraces(nil), 150)
+	assert.Empty(t, groups.takeDroppedTraces(nil))
+}
+
 func TestTraceGroupReservoirResizeMinimum(t *testing.T) {
 	const (
 		maxDynamicServices    = 1
 		ingestRateCoefficient = 1.0
 	)
 	policies := []Policy{{SampleRate: 0.1}}
-	groups := newTraceGroups(policies, maxDynamicServices, ingestRateCoefficient)
+	groups := newTraceGroups(policies, maxDynamicServices, ingestRateCoefficient, nil)
 
 	sendTransactions := func(n int) {
 		for i := 0; i < n; i++ {
@@ -182,7 +233,7 @@ func TestTraceGroupReservoirResizeMinimum(t *testing.T) {
 					Type: "type",
 					Id:   "0102030405060708",
 				},
-			})
+			}, nil)
 		}
 	}
 
@@ -198,6 +249,622 @@ func TestTraceGroupReservoirResizeMinimum(t *testing.T) {
 	assert.Len(t, groups.finalizeSampledTraces(nil), 1000) // min reservoir size
 }
 
+func TestTraceGroupsErrorRateScaling(t *testing.T) {
+	policies := []Policy{{SampleRate: 0.25, ErrorRateScaling: true, ErrorRateMultiplier: 2}}
+	groups := newTraceGroups(policies, 1000, 1.0, nil)
+
+	sendTransactions := func(n int, outcome string) {
+		for i := 0; i < n; i++ {
+			_, err := groups.sampleTrace(&modelpb.APMEvent{
+				Service: &modelpb.Service{Name: "service"},
+				Event:   &modelpb.Event{Outcome: outcome},
+				Trace:   &modelpb.Trace{Id: uuid.Must(uuid.NewV4()).String()},
+				Transaction: &modelpb.Transaction{
+					Type: "type",
+					Id:   uuid.Must(uuid.NewV4()).String(),
+				},
+			}, nil)
+			require.NoError(t, err)
+		}
+	}
+
+	// No failures: the configured sample rate is applied.
+	sendTransactions(1000, "success")
+	assert.Len(t, groups.finalizeSampledTraces(nil), 250)
+	assert.Equal(t, 0.25, groups.effectiveSampleRate(0))
+
+	// 50% failures: 0.25 * (1 + 2*0.5) = 0.5
+	sendTransactions(500, "success")
+	sendTransactions(500, "failure")
+	assert.Len(t, groups.finalizeSampledTraces(nil), 500)
+	assert.Equal(t, 0.5, groups.effectiveSampleRate(0))
+
+	// 100% failures: the effective sample rate is capped at 1.
+	policies[0].SampleRate = 0.5
+	groups = newTraceGroups(policies, 1000, 1.0, nil)
+	sendTransactions(1000, "failure")
+	assert.Len(t, groups.finalizeSampledTraces(nil), 1000)
+	assert.Equal(t, 1.0, groups.effectiveSampleRate(0))
+}
+
+func TestTraceGroupsAllowedSampleRates(t *testing.T) {
+	policies := []Policy{{SampleRate: 0.25, ErrorRateScaling: true, ErrorRateMultiplier: 2}}
+	groups := newTraceGroups(policies, 1000, 1.0, []float64{1, 0.5, 0.1})
+
+	sendTransactions := func(n int, outcome string) {
+		for i := 0; i < n; i++ {
+			_, err := groups.sampleTrace(&modelpb.APMEvent{
+				Service: &modelpb.Service{Name: "service"},
+				Event:   &modelpb.Event{Outcome: outcome},
+				Trace:   &modelpb.Trace{Id: uuid.Must(uuid.NewV4()).String()},
+				Transaction: &modelpb.Transaction{
+					Type: "type",
+					Id:   uuid.Must(uuid.NewV4()).String(),
+				},
+			}, nil)
+			require.NoError(t, err)
+		}
+	}
+
+	// No failures: 0.25 is snapped to 0.1.
+	sendTransactions(1000, "success")
+	assert.Len(t, groups.finalizeSampledTraces(nil), 100)
+	assert.Equal(t, 0.1, groups.effectiveSampleRate(0))
+
+	// 20% failures: 0.25 * (1 + 2*0.2) = 0.35 is snapped to 0.5.
+	sendTransactions(800, "success")
+	sendTransactions(200, "failure")
+	assert.Len(t, groups.finalizeSampledTraces(nil), 500)
+	assert.Equal(t, 0.5, groups.effectiveSampleRate(0))
+}
+
+func TestQuantizeSampleRate(t *testing.T) {
+	allowed := []float64{1, 0.5, 0.1, 0.01}
+	for _, test := range []struct {
+		rate, expected float64
+	}{
+		{1, 1},
+		{0.8, 1},
+		{0.75, 1}, // equally near 1 and 0.5
+		{0.6, 0.5},
+		{0.2, 0.1},
+		{0.001, 0.01},
+		{0, 0},
+	} {
+		assert.Equal(t, test.expected, quantizeSampleRate(test.rate, allowed), "rate %v", test.rate)
+	}
+	assert.Equal(t, 0.2, quantizeSampleRate(0.2, nil))
+}
+
+func TestTraceGroupsErrorRateHysteresis(t *testing.T) {
+	policies := []Policy{{
+		SampleRate:          0.25,
+		ErrorRateScaling:    true,
+		ErrorRateMultiplier: 2,
+		ErrorRateDeadBand:   0.1,
+		ErrorRateMinHold:    2 * time.Minute,
+	}}
+	groups := newTraceGroups(policies, 1000, 1.0, nil)
+	now := time.Unix(0, 0)
+	groups.now = func() time.Time { return now }
+
+	finalize := func(successes, failures int) float64 {
+		for outcome, n := range map[string]int{"success": successes, "failure": failures} {
+			for i := 0; i < n; i++ {
+				_, err := groups.sampleTrace(&modelpb.APMEvent{
+					Service: &modelpb.Service{Name: "service"},
+					Event:   &modelpb.Event{Outcome: outcome},
+					Trace:   &modelpb.Trace{Id: uuid.Must(uuid.NewV4()).String()},
+					Transaction: &modelpb.Transaction{
+						Type: "type",
+						Id:   uuid.Must(uuid.NewV4()).String(),
+					},
+				}, nil)
+				require.NoError(t, err)
+			}
+		}
+		groups.finalizeSampledTraces(nil)
+		now = now.Add(time.Minute)
+		return groups.effectiveSampleRate(0)
+	}
+
+	assert.Equal(t, 0.25, finalize(1000, 0))
+	// 5% failures: 0.25 * (1 + 2*0.05) = 0.275, within the dead band.
+	assert.Equal(t, 0.25, finalize(950, 50))
+	// 50% failures: 0.25 * (1 + 2*0.5) = 0.5, outside the dead band.
+	assert.Equal(t, 0.5, finalize(500, 500))
+	// No failures: the rate is held for at least two minutes.
+	assert.Equal(t, 0.5, finalize(1000, 0))
+	assert.Equal(t, 0.25, finalize(1000, 0))
+}
+
+func TestTraceGroupsPolicyStats(t *testing.T) {
+	policies := []Policy{
+		{PolicyCriteria: PolicyCriteria{ServiceName: "never"}, SampleRate: 1},
+		{PolicyCriteria: PolicyCriteria{ServiceName: "service"}, SampleRate: 0.25},
+		{SampleRate: 0.5},
+	}
+	groups := newTraceGroups(policies, 1000, 1.0, nil)
+
+	sendTransactions := func(n int, serviceName string) {
+		for i := 0; i < n; i++ {
+			_, err := groups.sampleTrace(&modelpb.APMEvent{
+				Service: &modelpb.Service{Name: serviceName},
+				Trace:   &modelpb.Trace{Id: uuid.Must(uuid.NewV4()).String()},
+				Transaction: &modelpb.Transaction{
+					Type: "type",
+					Id:   uuid.Must(uuid.NewV4()).String(),
+				},
+			}, nil)
+			require.NoError(t, err)
+		}
+	}
+	sendTransactions(1000, "service")
+	sendTransactions(100, "other")
+	assert.Equal(t, policyStats{}, groups.policyStats(1)) // not yet finalized
+
+	assert.Len(t, groups.finalizeSampledTraces(nil), 300)
+	assert.Equal(t, policyStats{}, groups.policyStats(0))
+	assert.Equal(t, policyStats{Matched: 1000, Sampled: 250, Dropped: 750}, groups.policyStats(1))
+	assert.Equal(t, policyStats{Matched: 100, Sampled: 50, Dropped: 50}, groups.policyStats(2))
+
+	// Statistics are reset for each interval.
+	assert.Len(t, groups.finalizeSampledTraces(nil), 0)
+	assert.Equal(t, policyStats{}, groups.policyStats(1))
+}
+
+func TestTraceGroupsPolicyOrder(t *testing.T) {
+	policies := []Policy{
+		{PolicyCriteria: PolicyCriteria{TraceOutcome: "failure"}, SampleRate: 1},
+		{PolicyCriteria: PolicyCriteria{ServiceName: "foo"}, SampleRate: 0.5},
+		{PolicyCriteria: PolicyCriteria{TraceName: "GET /"}, SampleRate: 0.5},
+		{PolicyCriteria: PolicyCriteria{ServiceName: "bar", TraceName: "GET /"}, SampleRate: 0.5}, // shadowed by 2
+		{PolicyCriteria: PolicyCriteria{ServiceName: "bar"}, SampleRate: 0.5},
+		{SampleRate: 0.1},
+		{PolicyCriteria: PolicyCriteria{ServiceName: "baz"}, SampleRate: 0.5}, // shadowed by 5
+	}
+	groups := newTraceGroups(policies, 1000, 1.0, nil)
+
+	matchedPolicy := func(serviceName, outcome, name string) int {
+		for i := range groups.policyGroups {
+			groups.policyGroups[i].matched.Store(0)
+		}
+		_, err := groups.sampleTrace(&modelpb.APMEvent{
+			Service:     &modelpb.Service{Name: serviceName},
+			Event:       &modelpb.Event{Outcome: outcome},
+			Trace:       &modelpb.Trace{Id: uuid.Must(uuid.NewV4()).String()},
+			Transaction: &modelpb.Transaction{Type: "type", Name: name},
+		}, nil)
+		require.NoError(t, err)
+		for i := range groups.policyGroups {
+			if groups.policyGroups[i].matched.Load() != 0 {
+				return i
+			}
+		}
+		return -1
+	}
+	assert.Equal(t, 0, matchedPolicy("foo", "failure", "GET /"))
+	assert.Equal(t, 1, matchedPolicy("foo", "success", "GET /"))
+	assert.Equal(t, 2, matchedPolicy("bar", "success", "GET /"))
+	assert.Equal(t, 4, matchedPolicy("bar", "success", "GET /about"))
+	assert.Equal(t, 2, matchedPolicy("baz", "success", "GET /"))
+	assert.Equal(t, 5, matchedPolicy("baz", "success", "GET /about"))
+	assert.Equal(t, 5, matchedPolicy("qux", "success", "GET /about"))
+	assert.Equal(t, 0, matchedPolicy("qux", "failure", "GET /about"))
+
+	// Without a default policy, unmatched root transactions are rejected.
+	groups = newTraceGroups(policies[:5], 1000, 1.0, nil)
+	_, err := groups.sampleTrace(&modelpb.APMEvent{
+		Service:     &modelpb.Service{Name: "qux"},
+		Event:       &modelpb.Event{Outcome: "success"},
+		Transaction: &modelpb.Transaction{Type: "type", Name: "GET /about"},
+	}, nil)
+	assert.Equal(t, errNoMatchingPolicy, err)
+}
+
+func TestTraceGroupsURLPath(t *testing.T) {
+	policies := []Policy{
+		{PolicyCriteria: PolicyCriteria{TraceURLPath: "/api/*"}, SampleRate: 1},
+		{SampleRate: 0},
+	}
+	groups := newTraceGroups(policies, 1000, 1.0, nil)
+	sampleTrace := func(url *modelpb.URL) bool {
+		admitted, err := groups.sampleTrace(&modelpb.APMEvent{
+			Service:     &modelpb.Service{Name: "service"},
+			Trace:       &modelpb.Trace{Id: uuid.Must(uuid.NewV4()).String()},
+			Transaction: &modelpb.Transaction{Type: "type", Id: uuid.Must(uuid.NewV4()).String()},
+			Url:         url,
+		}, nil)
+		require.NoError(t, err)
+		return admitted
+	}
+	assert.True(t, sampleTrace(&modelpb.URL{Path: "/api/v1/users"}))
+	assert.False(t, sampleTrace(&modelpb.URL{Path: "/health"}))
+	assert.False(t, sampleTrace(nil)) // non-HTTP
+}
+
+func TestTraceGroupsResult(t *testing.T) {
+	policies := []Policy{
+		{PolicyCriteria: PolicyCriteria{TraceResult: "HTTP 5*"}, SampleRate: 1},
+		{SampleRate: 0},
+	}
+	groups := newTraceGroups(policies, 1000, 1.0, nil)
+	sampleTrace := func(result string) bool {
+		admitted, err := groups.sampleTrace(&modelpb.APMEvent{
+			Service: &modelpb.Service{Name: "service"},
+			Trace:   &modelpb.Trace{Id: uuid.Must(uuid.NewV4()).String()},
+			Transaction: &modelpb.Transaction{
+				Type:   "type",
+				Id:     uuid.Must(uuid.NewV4()).String(),
+				Result: result,
+			},
+		}, nil)
+		require.NoError(t, err)
+		return admitted
+	}
+	assert.True(t, sampleTrace("HTTP 5xx"))
+	assert.False(t, sampleTrace("HTTP 2xx"))
+	assert.False(t, sampleTrace("Error"))
+	assert.False(t, sampleTrace("")) // no result
+}
+
+func TestTraceGroupsTransactionType(t *testing.T) {
+	policies := []Policy{
+		{PolicyCriteria: PolicyCriteria{ServiceName: "service", TransactionType: "messag*"}, SampleRate: 1},
+		{SampleRate: 0},
+	}
+	groups := newTraceGroups(policies, 1000, 1.0, nil)
+	sampleTrace := func(serviceName, transactionType string) bool {
+		admitted, err := groups.sampleTrace(&modelpb.APMEvent{
+			Service: &modelpb.Service{Name: serviceName},
+			Trace:   &modelpb.Trace{Id: uuid.Must(uuid.NewV4()).String()},
+			Transaction: &modelpb.Transaction{
+				Type: transactionType,
+				Id:   uuid.Must(uuid.NewV4()).String(),
+			},
+		}, nil)
+		require.NoError(t, err)
+		return admitted
+	}
+	assert.True(t, sampleTrace("service", "messaging"))
+	assert.False(t, sampleTrace("service", "request"))
+	assert.False(t, sampleTrace("other", "messaging"))
+	assert.False(t, sampleTrace("service", "")) // no type
+}
+
+func TestTraceGroupsConditions(t *testing.T) {
+	// service "foo" AND (failure OR (slow database AND NOT "GET /health"))
+	policies := []Policy{{
+		Conditions: &Condition{
+			PolicyCriteria: PolicyCriteria{ServiceName: "foo"},
+			Or: []Condition{
+				{PolicyCriteria: PolicyCriteria{TraceOutcome: "failure"}},
+				{
+					PolicyCriteria: PolicyCriteria{SpanTotalDurationType: "db", SpanTotalDurationMin: time.Second},
+					Not:            &Condition{PolicyCriteria: PolicyCriteria{TraceName: "GET /health"}},
+				},
+			},
+		},
+		SampleRate: 1,
+	}, {
+		SampleRate: 0,
+	}}
+	groups := newTraceGroups(policies, 1000, 1.0, nil)
+	assert.True(t, groups.requiresTraceSummary)
+
+	sampleTrace := func(serviceName, outcome, name string, dbTime time.Duration) bool {
+		admitted, err := groups.sampleTrace(&modelpb.APMEvent{
+			Service: &modelpb.Service{Name: serviceName},
+			Event:   &modelpb.Event{Outcome: outcome},
+			Trace:   &modelpb.Trace{Id: uuid.Must(uuid.NewV4()).String()},
+			Transaction: &modelpb.Transaction{
+				Type: "type",
+				Id:   uuid.Must(uuid.NewV4()).String(),
+				Name: name,
+			},
+		}, &traceSummary{spanDurations: map[string]time.Duration{"db": dbTime}})
+		require.NoError(t, err)
+		return admitted
+	}
+	assert.True(t, sampleTrace("foo", "failure", "GET /", 0))
+	assert.True(t, sampleTrace("foo", "success", "GET /", time.Second))
+	assert.True(t, sampleTrace("foo", "failure", "GET /health", time.Second))
+	assert.False(t, sampleTrace("foo", "success", "GET /health", time.Second))
+	assert.False(t, sampleTrace("foo", "success", "GET /", 0))
+	assert.False(t, sampleTrace("bar", "failure", "GET /", time.Second))
+
+	// Policies with conditions are grouped dynamically by service name.
+	assert.Nil(t, groups.policyGroups[0].g)
+}
+
+func TestTraceGroupsCloud(t *testing.T) {
+	policies := []Policy{
+		{PolicyCriteria: PolicyCriteria{CloudProvider: "aws", CloudRegion: "us-*"}, SampleRate: 1},
+		{SampleRate: 0},
+	}
+	groups := newTraceGroups(policies, 1000, 1.0, nil)
+	sampleTrace := func(cloud *modelpb.Cloud) bool {
+		admitted, err := groups.sampleTrace(&modelpb.APMEvent{
+			Service:     &modelpb.Service{Name: "service"},
+			Trace:       &modelpb.Trace{Id: uuid.Must(uuid.NewV4()).String()},
+			Transaction: &modelpb.Transaction{Type: "type", Id: uuid.Must(uuid.NewV4()).String()},
+			Cloud:       cloud,
+		}, nil)
+		require.NoError(t, err)
+		return admitted
+	}
+	assert.True(t, sampleTrace(&modelpb.Cloud{Provider: "aws", Region: "us-east-1"}))
+	assert.False(t, sampleTrace(&modelpb.Cloud{Provider: "aws", Region: "eu-west-1"}))
+	assert.False(t, sampleTrace(&modelpb.Cloud{Provider: "gcp", Region: "us-east1"}))
+	assert.False(t, sampleTrace(&modelpb.Cloud{Provider: "aws"}))
+	assert.False(t, sampleTrace(nil))
+}
+
+func TestTraceGroupsTimeWindows(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	require.NoError(t, err)
+	policies := []Policy{
+		{PolicyCriteria: PolicyCriteria{
+			// 22:00-06:00 and 12:00-13:00 in Berlin.
+			TimeWindows: []TimeWindow{
+				{Start: 22 * time.Hour, End: 6 * time.Hour},
+				{Start: 12 * time.Hour, End: 13 * time.Hour},
+			},
+			TimeZone: berlin,
+		}, SampleRate: 1},
+		{SampleRate: 0},
+	}
+	groups := newTraceGroups(policies, 1000, 1.0, nil)
+	sampleTrace := func(timestamp time.Time) bool {
+		var ts uint64
+		if !timestamp.IsZero() {
+			ts = uint64(timestamp.UnixNano())
+		}
+		admitted, err := groups.sampleTrace(&modelpb.APMEvent{
+			Timestamp:   ts,
+			Service:     &modelpb.Service{Name: "service"},
+			Trace:       &modelpb.Trace{Id: uuid.Must(uuid.NewV4()).String()},
+			Transaction: &modelpb.Transaction{Type: "type", Id: uuid.Must(uuid.NewV4()).String()},
+		}, nil)
+		require.NoError(t, err)
+		return admitted
+	}
+	at := func(hour, min int) time.Time {
+		return time.Date(2024, time.January, 15, hour, min, 0, 0, berlin)
+	}
+	assert.True(t, sampleTrace(at(23, 30)))
+	assert.True(t, sampleTrace(at(0, 0)))
+	assert.True(t, sampleTrace(at(5, 59)))
+	assert.False(t, sampleTrace(at(6, 0)))
+	assert.True(t, sampleTrace(at(12, 0)))
+	assert.False(t, sampleTrace(at(13, 0)))
+	assert.False(t, sampleTrace(at(21, 59)))
+	// 21:30 UTC is 22:30 in Berlin.
+	assert.True(t, sampleTrace(time.Date(2024, time.January, 15, 21, 30, 0, 0, time.UTC)))
+	assert.False(t, sampleTrace(time.Time{}))
+}
+
+func TestTraceGroupsUser(t *testing.T) {
+	policies := []Policy{
+		{PolicyCriteria: PolicyCriteria{UserID: "vip-*"}, SampleRate: 1},
+		{PolicyCriteria: PolicyCriteria{UserEmail: "*@example.com"}, SampleRate: 1},
+		{SampleRate: 0},
+	}
+	groups := newTraceGroups(policies, 1000, 1.0, nil)
+	sampleTrace := func(user *modelpb.User) bool {
+		admitted, err := groups.sampleTrace(&modelpb.APMEvent{
+			Service:     &modelpb.Service{Name: "service"},
+			Trace:       &modelpb.Trace{Id: uuid.Must(uuid.NewV4()).String()},
+			Transaction: &modelpb.Transaction{Type: "type", Id: uuid.Must(uuid.NewV4()).String()},
+			User:        user,
+		}, nil)
+		require.NoError(t, err)
+		return admitted
+	}
+	assert.True(t, sampleTrace(&modelpb.User{Id: "vip-123"}))
+	assert.True(t, sampleTrace(&modelpb.User{Id: "123", Email: "jane@example.com"}))
+	assert.False(t, sampleTrace(&modelpb.User{Id: "123", Email: "jane@example.org"}))
+	assert.False(t, sampleTrace(&modelpb.User{Name: "vip-jane"}))
+	assert.False(t, sampleTrace(nil))
+}
+
+func TestTraceGroupsUpstreamSampled(t *testing.T) {
+	sampled := true
+	policies := []Policy{
+		{PolicyCriteria: PolicyCriteria{UpstreamSampled: &sampled}, SampleRate: 1},
+		{SampleRate: 0},
+	}
+	groups := newTraceGroups(policies, 1000, 1.0, nil)
+	sampleTrace := func(upstreamSampled bool) bool {
+		admitted, err := groups.sampleTrace(&modelpb.APMEvent{
+			Service: &modelpb.Service{Name: "service"},
+			Trace:   &modelpb.Trace{Id: uuid.Must(uuid.NewV4()).String()},
+			Transaction: &modelpb.Transaction{
+				Type:    "type",
+				Id:      uuid.Must(uuid.NewV4()).String(),
+				Sampled: upstreamSampled,
+			},
+		}, nil)
+		require.NoError(t, err)
+		return admitted
+	}
+	assert.True(t, sampleTrace(true))
+	assert.False(t, sampleTrace(false))
+}
+
+func TestTraceGroupsSpanTotalDuration(t *testing.T) {
+	policies := []Policy{
+		{PolicyCriteria: PolicyCriteria{SpanTotalDurationType: "db", SpanTotalDurationMin: 100 * time.Millisecond}, SampleRate: 1},
+		{SampleRate: 0},
+	}
+	groups := newTraceGroups(policies, 1000, 1.0, nil)
+	assert.True(t, groups.requiresTraceSummary)
+	assert.False(t, groups.requiresSpanEvents)
+
+	span := func(spanType string, duration time.Duration) *modelpb.APMEvent {
+		return &modelpb.APMEvent{
+			Event: &modelpb.Event{Duration: uint64(duration)},
+			Span:  &modelpb.Span{Type: spanType},
+		}
+	}
+	sampleTrace := func(summary *traceSummary) bool {
+		admitted, err := groups.sampleTrace(&modelpb.APMEvent{
+			Service:     &modelpb.Service{Name: "service"},
+			Trace:       &modelpb.Trace{Id: uuid.Must(uuid.NewV4()).String()},
+			Transaction: &modelpb.Transaction{Type: "type", Id: uuid.Must(uuid.NewV4()).String()},
+		}, summary)
+		require.NoError(t, err)
+		return admitted
+	}
+
+	assert.True(t, sampleTrace(summarizeTrace(modelpb.Batch{
+		span("db", 60*time.Millisecond),
+		span("db", 40*time.Millisecond),
+		span("external", time.Second),
+	})))
+	assert.False(t, sampleTrace(summarizeTrace(modelpb.Batch{
+		span("db", 60*time.Millisecond),
+		span("external", time.Second),
+	})))
+	// Without a summary, e.g. if no spans have been received,
+	// the span total duration policy does not match.
+	assert.False(t, sampleTrace(nil))
+	assert.False(t, sampleTrace(summarizeTrace(nil)))
+}
+
+func TestTraceGroupsSpanDurationRatio(t *testing.T) {
+	policies := []Policy{
+		{PolicyCriteria: PolicyCriteria{SpanDurationRatio: 2}, SampleRate: 1},
+		{SampleRate: 0},
+	}
+	groups := newTraceGroups(policies, 1000, 1.0, nil)
+	assert.True(t, groups.requiresTraceSummary)
+	assert.False(t, groups.requiresSpanEvents)
+
+	span := func(spanType string, duration time.Duration) *modelpb.APMEvent {
+		return &modelpb.APMEvent{
+			Event: &modelpb.Event{Duration: uint64(duration)},
+			Span:  &modelpb.Span{Type: spanType},
+		}
+	}
+	sampleTrace := func(rootDuration time.Duration, summary *traceSummary) bool {
+		admitted, err := groups.sampleTrace(&modelpb.APMEvent{
+			Service:     &modelpb.Service{Name: "service"},
+			Event:       &modelpb.Event{Duration: uint64(rootDuration)},
+			Trace:       &modelpb.Trace{Id: uuid.Must(uuid.NewV4()).String()},
+			Transaction: &modelpb.Transaction{Type: "type", Id: uuid.Must(uuid.NewV4()).String()},
+		}, summary)
+		require.NoError(t, err)
+		return admitted
+	}
+
+	// Span durations of all types are summed, regardless of overlap.
+	fanOut := summarizeTrace(modelpb.Batch{
+		span("db", 100*time.Millisecond),
+		span("db", 100*time.Millisecond),
+		span("external", 100*time.Millisecond),
+	})
+	assert.True(t, sampleTrace(100*time.Millisecond, fanOut))
+	assert.True(t, sampleTrace(150*time.Millisecond, fanOut))
+	assert.False(t, sampleTrace(151*time.Millisecond, fanOut))
+
+	// Root transactions without a duration, and traces without
+	// a summary, do not match.
+	assert.False(t, sampleTrace(0, fanOut))
+	assert.False(t, sampleTrace(100*time.Millisecond, nil))
+	assert.False(t, sampleTrace(100*time.Millisecond, summarizeTrace(nil)))
+}
+
+func TestTraceGroupsDestinationService(t *testing.T) {
+	policies := []Policy{
+		{PolicyCriteria: PolicyCriteria{DestinationService: "payment-*"}, SampleRate: 1},
+		{SampleRate: 0},
+	}
+	groups := newTraceGroups(policies, 1000, 1.0, nil)
+	assert.True(t, groups.requiresTraceSummary)
+
+	span := func(resource string) *modelpb.APMEvent {
+		event := &modelpb.APMEvent{Span: &modelpb.Span{Type: "external"}}
+		if resource != "" {
+			event.Span.DestinationService = &modelpb.DestinationService{Resource: resource}
+		}
+		return event
+	}
+	sampleTrace := func(summary *traceSummary) bool {
+		admitted, err := groups.sampleTrace(&modelpb.APMEvent{
+			Service:     &modelpb.Service{Name: "service"},
+			Trace:       &modelpb.Trace{Id: uuid.Must(uuid.NewV4()).String()},
+			Transaction: &modelpb.Transaction{Type: "type", Id: uuid.Must(uuid.NewV4()).String()},
+		}, summary)
+		require.NoError(t, err)
+		return admitted
+	}
+
+	assert.True(t, sampleTrace(summarizeTrace(modelpb.Batch{
+		span("postgresql"),
+		span("payment-gateway:443"),
+	})))
+	assert.False(t, sampleTrace(summarizeTrace(modelpb.Batch{
+		span("postgresql"),
+		span("inventory:443"),
+	})))
+	// Traces without spans with a destination do not match.
+	assert.False(t, sampleTrace(summarizeTrace(modelpb.Batch{span("")})))
+	assert.False(t, sampleTrace(nil))
+}
+
+func TestTraceGroupsSpanLabels(t *testing.T) {
+	policies := []Policy{
+		{PolicyCriteria: PolicyCriteria{SpanLabels: map[string]string{
+			"feature_flag": "new_checkout",
+			"region":       "eu",
+		}}, SampleRate: 1},
+		{SampleRate: 0},
+	}
+	groups := newTraceGroups(policies, 1000, 1.0, nil)
+	assert.True(t, groups.requiresTraceSummary)
+	assert.True(t, groups.requiresSpanEvents)
+
+	event := func(labels map[string]string) *modelpb.APMEvent {
+		event := &modelpb.APMEvent{Span: &modelpb.Span{Type: "app"}}
+		for k, v := range labels {
+			if event.Labels == nil {
+				event.Labels = make(map[string]*modelpb.LabelValue)
+			}
+			event.Labels[k] = &modelpb.LabelValue{Value: v}
+		}
+		return event
+	}
+	sampleTrace := func(summary *traceSummary) bool {
+		admitted, err := groups.sampleTrace(&modelpb.APMEvent{
+			Service:     &modelpb.Service{Name: "service"},
+			Trace:       &modelpb.Trace{Id: uuid.Must(uuid.NewV4()).String()},
+			Transaction: &modelpb.Transaction{Type: "type", Id: uuid.Must(uuid.NewV4()).String()},
+		}, summary)
+		require.NoError(t, err)
+		return admitted
+	}
+
+	assert.True(t, sampleTrace(summarizeTrace(modelpb.Batch{
+		event(nil),
+		event(map[string]string{"feature_flag": "new_checkout", "region": "eu", "other": "x"}),
+	})))
+	// All labels must be carried by the same span.
+	assert.False(t, sampleTrace(summarizeTrace(modelpb.Batch{
+		event(map[string]string{"feature_flag": "new_checkout"}),
+		event(map[string]string{"region": "eu"}),
+	})))
+	assert.False(t, sampleTrace(summarizeTrace(modelpb.Batch{
+		event(map[string]string{"feature_flag": "old_checkout", "region": "eu"}),
+	})))
+	// Labels of transactions are not considered.
+	transaction := event(map[string]string{"feature_flag": "new_checkout", "region": "eu"})
+	transaction.Span = nil
+	transaction.Transaction = &modelpb.Transaction{Type: "type"}
+	assert.False(t, sampleTrace(summarizeTrace(modelpb.Batch{transaction})))
+	assert.False(t, sampleTrace(nil))
+}
+
 func TestTraceGroupsRemoval(t *testing.T) {
 	const (
 		maxDynamicServices    = 2
@@ -208,25 +875,25 @@ func TestTraceGroupsRemoval(t *testing.T) {
 		{SampleRate: 0.5},
 		{PolicyCriteria: PolicyCriteria{ServiceName: "defined_later"}, SampleRate: 0.5},
 	}
-	groups := newTraceGroups(policies, maxDynamicServices, ingestRateCoefficient)
+	groups := newTraceGroups(policies, maxDynamicServices, ingestRateCoefficient, nil)
 
 	for i := 0; i < 10000; i++ {
 		_, err := groups.sampleTrace(&modelpb.APMEvent{
 			Service:     &modelpb.Service{Name: "many"},
 			Transaction: &modelpb.Transaction{Type: "type"},
-		})
+		}, nil)
 		assert.NoError(t, err)
 	}
 	_, err := groups.sampleTrace(&modelpb.APMEvent{
 		Service:     &modelpb.Service{Name: "few"},
 		Transaction: &modelpb.Transaction{Type: "type"},
-	})
+	}, nil)
 	assert.NoError(t, err)
 
 	_, err = groups.sampleTrace(&modelpb.APMEvent{
 		Service:     &modelpb.Service{Name: "another"},
 		Transaction: &modelpb.Transaction{Type: "type"},
-	})
+	}, nil)
 	assert.Equal(t, errTooManyTraceGroups, err)
 
 	// When there is a policy with an explicitly defined service name, that
@@ -234,7 +901,7 @@ func TestTraceGroupsRemoval(t *testing.T) {
 	_, err = groups.sampleTrace(&modelpb.APMEvent{
 		Service:     &modelpb.Service{Name: "defined"},
 		Transaction: &modelpb.Transaction{Type: "type"},
-	})
+	}, nil)
 	assert.NoError(t, err)
 
 	// ...unless the policy with an explicitly defined service name comes after
@@ -242,7 +909,7 @@ func TestTraceGroupsRemoval(t *testing.T) {
 	_, err = groups.sampleTrace(&modelpb.APMEvent{
 		Service:     &modelpb.Service{Name: "defined_later"},
 		Transaction: &modelpb.Transaction{Type: "type"},
-	})
+	}, nil)
 	assert.Equal(t, errTooManyTraceGroups, err)
 
 	// Finalizing should remove the "few" trace group, since its reservoir
@@ -253,7 +920,7 @@ func TestTraceGroupsRemoval(t *testing.T) {
 	_, err = groups.sampleTrace(&modelpb.APMEvent{
 		Service:     &modelpb.Service{Name: "another"},
 		Transaction: &modelpb.Transaction{Type: "type"},
-	})
+	}, nil)
 	assert.NoError(t, err)
 }
 
@@ -263,7 +930,7 @@ func BenchmarkTraceGroups(b *testing.B) {
 		ingestRateCoefficient = 1.0
 	)
 	policies := []Policy{{SampleRate: 1.0}}
-	groups := newTraceGroups(policies, maxDynamicServices, ingestRateCoefficient)
+	groups := newTraceGroups(policies, maxDynamicServices, ingestRateCoefficient, nil)
 
 	b.RunParallel(func(pb *testing.PB) {
 		// Transaction identifiers are different for each goroutine, simulating
@@ -279,8 +946,126 @@ func BenchmarkTraceGroups(b *testing.B) {
 			},
 		}
 		for pb.Next() {
-			groups.sampleTrace(&tx)
+			groups.sampleTrace(&tx, nil)
 			tx.Event.Duration = tx.Event.Duration + uint64(time.Second)
 		}
 	})
 }
+
+func BenchmarkTraceGroupsDefaultPolicy(b *testing.B) {
+	// Root transactions from a service without a specific policy are
+	// matched by the default policy, after any service-agnostic policies.
+	for _, numPolicies := range []int{1, 10, 100} {
+		policies := make([]Policy, 0, numPolicies+2)
+		for i := 0; i < numPolicies; i++ {
+			policies = append(policies, Policy{
+				PolicyCriteria: PolicyCriteria{ServiceName: fmt.Sprintf("service_%d", i)},
+				SampleRate:     0.5,
+			})
+		}
+		policies = append(policies,
+			Policy{PolicyCriteria: PolicyCriteria{TraceOutcome: "failure"}, SampleRate: 1},
+			Policy{SampleRate: 0.1},
+		)
+		b.Run(fmt.Sprintf("policies=%d", len(policies)), func(b *testing.B) {
+			groups := newTraceGroups(policies, 1000, 1.0, nil)
+			tx := modelpb.APMEvent{
+				Service:     &modelpb.Service{Name: "other"},
+				Event:       &modelpb.Event{Outcome: "success", Duration: uint64(time.Second)},
+				Transaction: &modelpb.Transaction{Type: "type", Name: "name"},
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := groups.sampleTrace(&tx, nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestTraceGroupsRestoreState(t *testing.T) {
+	policies := []Policy{
+		{PolicyCriteria: PolicyCriteria{ServiceName: "static"}, SampleRate: 0.2},
+		{SampleRate: 0.5},
+	}
+	groups := newTraceGroups(policies, 2, 1.0, nil)
+	for _, serviceName := range []string{"static", "static", "dynamic1", "dynamic2"} {
+		for i := 0; i < 5000; i++ {
+			_, err := groups.sampleTrace(&modelpb.APMEvent{
+				Service:     &modelpb.Service{Name: serviceName},
+				Trace:       &modelpb.Trace{Id: uuid.Must(uuid.NewV4()).String()},
+				Transaction: &modelpb.Transaction{Type: "type"},
+			}, nil)
+			require.NoError(t, err)
+		}
+	}
+	groups.finalizeSampledTraces(nil)
+	state := groups.state()
+	assert.Equal(t, samplerStateVersion, state.Version)
+	assert.Len(t, state.Groups, 3)
+
+	// State is restored into groups with the same policies, creating
+	// dynamic service groups up to the limit, and sizing reservoirs for
+	// the restored ingest rates.
+	restoredGroups := newTraceGroups(policies, 1, 1.0, nil)
+	assert.Equal(t, 2, restoredGroups.restoreState(state))
+	assert.Equal(t, 1, restoredGroups.numDynamicServiceGroups)
+	assert.Equal(t, 10000.0, restoredGroups.policyGroups[0].g.ingestRate)
+	assert.Equal(t, 2000, restoredGroups.policyGroups[0].g.reservoir.Size())
+	assert.Equal(t, state.Groups[0], restoredGroups.state().Groups[0])
+
+	// State is not restored into policies which have changed.
+	policies[0].SampleRate = 0.1
+	restoredGroups = newTraceGroups(policies, 2, 1.0, nil)
+	assert.Equal(t, 2, restoredGroups.restoreState(state))
+	assert.Zero(t, restoredGroups.policyGroups[0].g.ingestRate)
+
+	state.Version++
+	assert.Zero(t, newTraceGroups(policies, 2, 1.0, nil).restoreState(state))
+}
+
+func TestTraceGroupsDBStatement(t *testing.T) {
+	policies := []Policy{
+		{PolicyCriteria: PolicyCriteria{DBStatement: "SELECT * FROM orders*"}, SampleRate: 1},
+		{SampleRate: 0},
+	}
+	groups := newTraceGroups(policies, 1000, 1.0, nil)
+	assert.True(t, groups.requiresTraceSummary)
+	assert.True(t, groups.requiresSpanEvents)
+
+	span := func(statement string) *modelpb.APMEvent {
+		event := &modelpb.APMEvent{Span: &modelpb.Span{Type: "db"}}
+		if statement != "" {
+			event.Span.Db = &modelpb.DB{Statement: statement}
+		}
+		return event
+	}
+	sampleTrace := func(summary *traceSummary) bool {
+		admitted, err := groups.sampleTrace(&modelpb.APMEvent{
+			Service:     &modelpb.Service{Name: "service"},
+			Trace:       &modelpb.Trace{Id: uuid.Must(uuid.NewV4()).String()},
+			Transaction: &modelpb.Transaction{Type: "type", Id: uuid.Must(uuid.NewV4()).String()},
+		}, summary)
+		require.NoError(t, err)
+		return admitted
+	}
+
+	assert.True(t, sampleTrace(summarizeTrace(modelpb.Batch{
+		span("SELECT id FROM customers"),
+		span("SELECT id, total FROM orders WHERE customer_id = ?"),
+	})))
+	assert.False(t, sampleTrace(summarizeTrace(modelpb.Batch{
+		span("select id, total from orders"),
+		span("UPDATE orders SET total = ?"),
+	})))
+	// Statements longer than maxDBStatementLength are truncated, but
+	// may still match by their prefix.
+	long := "SELECT * FROM orders WHERE id IN (" + strings.Repeat("?, ", maxDBStatementLength) + "?)"
+	summary := summarizeTrace(modelpb.Batch{span(long)})
+	assert.Len(t, summary.dbStatements[0], maxDBStatementLength)
+	assert.True(t, sampleTrace(summary))
+	// Traces without spans with a statement do not match.
+	assert.False(t, sampleTrace(summarizeTrace(modelpb.Batch{span("")})))
+	assert.False(t, sampleTrace(nil))
+}
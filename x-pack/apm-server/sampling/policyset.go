@@ -0,0 +1,108 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package sampling
+
+import (
+	"github.com/pkg/errors"
+)
+
+// policySet holds a set of tail-sampling policies along with the state
+// derived from them. A policySet is never modified after creation, other
+// than the sampling state held by its traceGroups, so that readers holding
+// a policySet always observe a consistent set of policies; see SetPolicies.
+type policySet struct {
+	policies []Policy
+	groups   *traceGroups
+
+	// defaultSampleRate holds the sample rate of the first default policy,
+	// for deciding traces which exceed MaxConcurrentTraces.
+	defaultSampleRate float64
+}
+
+func newPolicySet(config LocalSamplingConfig) *policySet {
+	set := &policySet{
+		policies: config.Policies,
+		groups: newTraceGroups(
+			config.Policies, config.MaxDynamicServices,
+			config.IngestRateDecayFactor, config.AllowedSampleRates,
+		),
+	}
+	if config.MaxConcurrentTraces > 0 {
+		set.groups.trackDroppedTraces()
+	}
+	for _, policy := range config.Policies {
+		if policy.isDefault() {
+			set.defaultSampleRate = policy.SampleRate
+			break
+		}
+	}
+	return set
+}
+
+// SetPolicies validates policies, as for LocalSamplingConfig.Policies, and
+// replaces the processor's policies with them. If policies are invalid,
+// SetPolicies returns an error and the processor's policies are unchanged.
+// SetPolicies may be called concurrently with processing.
+//
+// The policies, and the trace groups derived from them, are swapped
+// together under a lock: each root transaction is matched against either
+// the old or the new policies, never a mix of both. Sampling state, such
+// as ingest rates and dynamic service groups, starts afresh with the new
+// policies. Root transactions already admitted to the reservoirs of the
+// old policies are still finalized at the next flush, after which the old
+// policies are discarded.
+func (p *Processor) SetPolicies(policies []Policy) error {
+	config := p.config.LocalSamplingConfig
+	config.Policies = append([]Policy(nil), policies...)
+	if err := config.validate(); err != nil {
+		return errors.Wrap(err, "invalid tail-sampling policies")
+	}
+	set := newPolicySet(config)
+
+	p.policiesMu.Lock()
+	defer p.policiesMu.Unlock()
+	p.retiredGroups = append(p.retiredGroups, p.policies.groups)
+	p.policies = set
+	return nil
+}
+
+// currentPolicies returns the policies in effect. The result must not be
+// modified.
+func (p *Processor) currentPolicies() *policySet {
+	p.policiesMu.RLock()
+	defer p.policiesMu.RUnlock()
+	return p.policies
+}
+
+// finalizeSampledTraces finalizes the reservoirs of the policies in effect,
+// and of any policies replaced by SetPolicies since the last call, appending
+// the sampled trace IDs to traceIDs and returning the result. Traces dropped
+// from the reservoirs are no longer tracked as buffered.
+func (p *Processor) finalizeSampledTraces(traceIDs []string) []string {
+	p.policiesMu.Lock()
+	groups, retired := p.policies.groups, p.retiredGroups
+	p.retiredGroups = nil
+	p.policiesMu.Unlock()
+
+	for _, g := range retired {
+		traceIDs = g.finalizeSampledTraces(traceIDs)
+		p.droppedTraces(g)
+	}
+	traceIDs = groups.finalizeSampledTraces(traceIDs)
+	p.droppedTraces(groups)
+	return traceIDs
+}
+
+// droppedTraces stops tracking the traces dropped from the reservoirs of
+// groups as buffered. Their root transactions will not be sampled, so they
+// would otherwise count towards MaxConcurrentTraces until they expire.
+func (p *Processor) droppedTraces(groups *traceGroups) {
+	if p.bufferedTraces == nil {
+		return
+	}
+	for _, traceID := range groups.takeDroppedTraces(nil) {
+		p.traceDecided(traceID)
+	}
+}
@@ -8,8 +8,10 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"math/rand"
 	"os"
 	"path/filepath"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -38,6 +40,16 @@ const (
 	// shutdownGracePeriod is the time that the processor has to gracefully
 	// terminate after the stop method is called.
 	shutdownGracePeriod = 5 * time.Second
+
+	// storageGCUtilizationDebounce is the minimum time after a storage
+	// garbage collection run before a run is triggered by utilization.
+	// Badger refreshes the database size once a minute.
+	storageGCUtilizationDebounce = time.Minute
+
+	// noTenantMetricName is the name under which the storage usage of
+	// events without a tenant is reported, as metric names must not be
+	// empty. See eventstorage.WithTenantKey.
+	noTenantMetricName = "_none"
 )
 
 // Processor is a tail-sampling event processor.
@@ -45,11 +57,21 @@ type Processor struct {
 	config            Config
 	logger            *logp.Logger
 	rateLimitedLogger *logp.Logger
-	groups            *traceGroups
+
+	// policiesMu guards policies and retiredGroups. See SetPolicies.
+	policiesMu sync.RWMutex
+	policies   *policySet
+	// retiredGroups holds the trace groups of policies replaced by
+	// SetPolicies, whose reservoirs have yet to be finalized.
+	retiredGroups []*traceGroups
 
 	eventStore   *wrappedRW
 	eventMetrics *eventMetrics // heap-allocated for 64-bit alignment
 
+	// bufferedTraces, if non-nil, tracks the traces with buffered events
+	// for enforcing MaxConcurrentTraces.
+	bufferedTraces *bufferedTraces
+
 	stopMu   sync.Mutex
 	stopping chan struct{}
 	stopped  chan struct{}
@@ -64,6 +86,10 @@ type eventMetrics struct {
 	sampled       int64
 	headUnsampled int64
 	failedWrites  int64
+	expiredTraces int64
+	// overflowTraces counts traces decided immediately due to
+	// MaxConcurrentTraces.
+	overflowTraces int64
 }
 
 // NewProcessor returns a new Processor, for tail-sampling trace events.
@@ -73,12 +99,17 @@ func NewProcessor(config Config) (*Processor, error) {
 	}
 
 	logger := logp.NewLogger(logs.Sampling)
+	eventStore := newWrappedRW(
+		config.Storage, config.TTL, int64(config.StorageLimit), config.EnvironmentStorageLimits,
+		config.SlidingTTLEvents, config.StorageLimitStrategy, config.DecisionConflict,
+		config.DeltaEncoding,
+	)
 	p := &Processor{
 		config:            config,
 		logger:            logger,
 		rateLimitedLogger: logger.WithOptions(logs.WithRateLimit(loggerRateLimit)),
-		groups:            newTraceGroups(config.Policies, config.MaxDynamicServices, config.IngestRateDecayFactor),
-		eventStore:        newWrappedRW(config.Storage, config.TTL, int64(config.StorageLimit)),
+		policies:          newPolicySet(config.LocalSamplingConfig),
+		eventStore:        eventStore,
 		eventMetrics:      &eventMetrics{},
 		stopping:          make(chan struct{}),
 		stopped:           make(chan struct{}),
@@ -88,6 +119,18 @@ func NewProcessor(config Config) (*Processor, error) {
 		// Index all traces when the storage limit is reached.
 		indexOnWriteFailure: true,
 	}
+	if config.MaxConcurrentTraces > 0 {
+		p.bufferedTraces = newBufferedTraces(config.MaxConcurrentTraces, config.TTL)
+	}
+	if config.PersistSamplerState {
+		restored, err := p.readSamplerState()
+		switch {
+		case err == nil:
+			logger.Infof("restored sampler state of %d trace groups", restored)
+		case !errors.Is(err, eventstorage.ErrNotFound):
+			logger.With(logp.Error(err)).Warn("failed to restore sampler state")
+		}
+	}
 	return p, nil
 }
 
@@ -107,15 +150,47 @@ func (p *Processor) CollectMonitoring(_ monitoring.Mode, V monitoring.Visitor) {
 	//     final metric would ideally be a distribution, which is not
 	//     currently an option in libbeat/monitoring.
 
-	p.groups.mu.RLock()
-	numDynamicGroups := p.groups.numDynamicServiceGroups
-	p.groups.mu.RUnlock()
+	policies := p.currentPolicies()
+	policies.groups.mu.RLock()
+	numDynamicGroups := policies.groups.numDynamicServiceGroups
+	policies.groups.mu.RUnlock()
 	monitoring.ReportInt(V, "dynamic_service_groups", int64(numDynamicGroups))
 
+	monitoring.ReportNamespace(V, "policies", func() {
+		for i, policy := range policies.policies {
+			monitoring.ReportNamespace(V, strconv.Itoa(i), func() {
+				stats := policies.groups.policyStats(i)
+				monitoring.ReportInt(V, "matched", stats.Matched)
+				monitoring.ReportInt(V, "sampled", stats.Sampled)
+				monitoring.ReportInt(V, "dropped", stats.Dropped)
+				if policy.ErrorRateScaling {
+					monitoring.ReportFloat(V, "effective_sample_rate", policies.groups.effectiveSampleRate(i))
+				}
+			})
+		}
+	})
+
 	monitoring.ReportNamespace(V, "storage", func() {
 		lsmSize, valueLogSize := p.config.DB.Size()
 		monitoring.ReportInt(V, "lsm_size", int64(lsmSize))
 		monitoring.ReportInt(V, "value_log_size", int64(valueLogSize))
+		if p.config.ExpirySweepInterval > 0 {
+			monitoring.ReportInt(V, "expired_traces", atomic.LoadInt64(&p.eventMetrics.expiredTraces))
+		}
+		if p.bufferedTraces != nil {
+			monitoring.ReportInt(V, "buffered_traces", int64(p.bufferedTraces.len()))
+			monitoring.ReportInt(V, "overflow_traces", atomic.LoadInt64(&p.eventMetrics.overflowTraces))
+		}
+		if usage := p.config.Storage.TenantUsage(); len(usage) > 0 {
+			monitoring.ReportNamespace(V, "tenant_usage", func() {
+				for tenant, size := range usage {
+					if tenant == "" {
+						tenant = noTenantMetricName
+					}
+					monitoring.ReportInt(V, tenant, size)
+				}
+			})
+		}
 	})
 	monitoring.ReportNamespace(V, "events", func() {
 		monitoring.ReportInt(V, "processed", atomic.LoadInt64(&p.eventMetrics.processed))
@@ -140,6 +215,7 @@ func (p *Processor) CollectMonitoring(_ monitoring.Mode, V monitoring.Visitor) {
 // be tail-sampled), or stored for possible later publication.
 func (p *Processor) ProcessBatch(ctx context.Context, batch *modelpb.Batch) error {
 	events := *batch
+	writer := p.eventStore.batchWriter()
 	for i := 0; i < len(events); i++ {
 		event := events[i]
 		var report, stored, failed bool
@@ -147,10 +223,10 @@ func (p *Processor) ProcessBatch(ctx context.Context, batch *modelpb.Batch) erro
 		switch event.Type() {
 		case modelpb.TransactionEventType:
 			atomic.AddInt64(&p.eventMetrics.processed, 1)
-			report, stored, err = p.processTransaction(event)
+			report, stored, err = p.processTransaction(event, writer)
 		case modelpb.SpanEventType:
 			atomic.AddInt64(&p.eventMetrics.processed, 1)
-			report, stored, err = p.processSpan(event)
+			report, stored, err = p.processSpan(event, writer)
 		default:
 			continue
 		}
@@ -203,7 +279,7 @@ func (p *Processor) updateProcessorMetrics(report, stored, failedWrite bool) {
 	}
 }
 
-func (p *Processor) processTransaction(event *modelpb.APMEvent) (report, stored bool, _ error) {
+func (p *Processor) processTransaction(event *modelpb.APMEvent, writer *batchWriter) (report, stored bool, _ error) {
 	if !event.Transaction.Sampled {
 		// (Head-based) unsampled transactions are passed through
 		// by the tail sampler.
@@ -228,10 +304,15 @@ func (p *Processor) processTransaction(event *modelpb.APMEvent) (report, stored
 		return false, false, err
 	}
 
+	if !p.admitTrace(event.Trace.Id) {
+		report, err := p.decideOverflowTrace(event.Trace.Id)
+		return report, false, err
+	}
+
 	if event.GetParentId() != "" {
 		// Non-root transaction: write to local storage while we wait
 		// for a sampling decision.
-		return false, true, p.eventStore.WriteTraceEvent(
+		return false, true, writer.WriteTraceEvent(
 			event.Trace.Id, event.Transaction.Id, event,
 		)
 	}
@@ -241,7 +322,7 @@ func (p *Processor) processTransaction(event *modelpb.APMEvent) (report, stored
 	// TODO(axw) we should skip reservoir sampling when the matching
 	// policy's sampling rate is 100%, immediately index the event
 	// and record the trace sampling decision.
-	reservoirSampled, err := p.groups.sampleTrace(event)
+	reservoirSampled, err := p.sampleRootTransaction(event)
 	if err == errTooManyTraceGroups {
 		// Too many trace groups, drop the transaction.
 		p.rateLimitedLogger.Warn(`
@@ -261,21 +342,96 @@ sampling policies without service name specified.
 		// This is a local optimisation only. To avoid creating network
 		// traffic and load on Elasticsearch for uninteresting root
 		// transactions, we do not propagate this to other APM Servers.
+		p.traceDecided(event.Trace.Id)
 		return false, false, p.eventStore.WriteTraceSampled(event.Trace.Id, false)
 	}
 
 	// The root transaction was admitted to the sampling reservoir, so we
 	// can proceed to write the transaction to storage; we may index it later,
 	// after finalising the sampling decision.
-	return false, true, p.eventStore.WriteTraceEvent(event.Trace.Id, event.Transaction.Id, event)
+	return false, true, writer.WriteTraceEvent(event.Trace.Id, event.Transaction.Id, event)
 }
 
-func (p *Processor) processSpan(event *modelpb.APMEvent) (report, stored bool, _ error) {
+// sampleRootTransaction applies reservoir sampling to the root transaction
+// event with the policies in effect, reporting whether it was admitted to
+// a reservoir.
+//
+// The policies lock is held throughout, so that the policies cannot be
+// replaced by SetPolicies, and their reservoirs then finalized and
+// discarded, before the transaction is admitted to one of them, which
+// would leave its trace without a decision.
+func (p *Processor) sampleRootTransaction(event *modelpb.APMEvent) (bool, error) {
+	p.policiesMu.RLock()
+	defer p.policiesMu.RUnlock()
+	groups := p.policies.groups
+	var summary *traceSummary
+	if groups.requiresTraceSummary && p.config.TraceEventSummaries && !groups.requiresSpanEvents {
+		// Some policies match on trace-level criteria, which are held
+		// in the stored summary of the trace events received so far.
+		stored, err := p.eventStore.ReadTraceEventSummary(event.Trace.Id)
+		if err != nil && !errors.Is(err, eventstorage.ErrNotFound) {
+			return false, err
+		}
+		summary = storedTraceSummary(stored)
+	} else if groups.requiresTraceSummary {
+		// Some policies match on trace-level criteria, computed from the
+		// trace events received so far.
+		var events modelpb.Batch
+		err := p.eventStore.ReadTraceEvents(event.Trace.Id, &events)
+		if err != nil && !errors.Is(err, eventstorage.ErrDecodeFailed) {
+			return false, err
+		}
+		summary = summarizeTrace(events)
+	}
+	return groups.sampleTrace(event, summary)
+}
+
+// admitTrace reports whether events of the undecided trace with the given ID
+// may be buffered in storage, tracking the trace as buffered if so. If not,
+// MaxConcurrentTraces has been reached, and the trace must be decided
+// immediately with decideOverflowTrace.
+func (p *Processor) admitTrace(traceID string) bool {
+	return p.bufferedTraces == nil || p.bufferedTraces.add(traceID, time.Now())
+}
+
+// traceDecided records that a sampling decision has been made for the trace
+// with the given ID, so its events are no longer buffered.
+func (p *Processor) traceDecided(traceID string) {
+	if p.bufferedTraces != nil {
+		p.bufferedTraces.remove(traceID)
+	}
+}
+
+// decideOverflowTrace decides whether to sample the trace with the given ID,
+// which could not be buffered due to MaxConcurrentTraces, with the sample
+// rate of the default policy, and records the decision locally. It reports
+// whether the trace was sampled.
+//
+// Overflow decisions are not published to other APM Servers, and policies
+// other than the default policy are not considered, as the root transaction
+// may not yet have been received.
+func (p *Processor) decideOverflowTrace(traceID string) (bool, error) {
+	atomic.AddInt64(&p.eventMetrics.overflowTraces, 1)
+	sampled := rand.Float64() < p.currentPolicies().defaultSampleRate
+	if err := p.eventStore.WriteTraceSampled(traceID, sampled); err != nil {
+		return false, err
+	}
+	if sampled {
+		atomic.AddInt64(&p.eventMetrics.sampled, 1)
+	}
+	return sampled, nil
+}
+
+func (p *Processor) processSpan(event *modelpb.APMEvent, writer *batchWriter) (report, stored bool, _ error) {
 	traceSampled, err := p.eventStore.IsTraceSampled(event.Trace.Id)
 	if err != nil {
 		if err == eventstorage.ErrNotFound {
+			if !p.admitTrace(event.Trace.Id) {
+				report, err := p.decideOverflowTrace(event.Trace.Id)
+				return report, false, err
+			}
 			// Tail-sampling decision has not yet been made, write event to local storage.
-			return false, true, p.eventStore.WriteTraceEvent(event.Trace.Id, event.Span.Id, event)
+			return false, true, writer.WriteTraceEvent(event.Trace.Id, event.Span.Id, event)
 		}
 		return false, false, err
 	}
@@ -388,27 +544,115 @@ func (p *Processor) Run() error {
 	g.Go(func() error {
 		// This goroutine is responsible for periodically garbage
 		// collecting the Badger value log, using the recommended
-		// discard ratio of 0.5.
+		// discard ratio of 0.5. Scheduled runs are skipped while GC
+		// is paused, and caught up on when it is resumed. If
+		// StorageGCUtilizationTrigger is set, GC is also run when
+		// storage utilization reaches it.
 		ticker := time.NewTicker(p.config.StorageGCInterval)
 		defer ticker.Stop()
+		var utilizationTicks <-chan time.Time
+		if p.config.StorageGCUtilizationTrigger > 0 {
+			utilizationTicker := time.NewTicker(p.config.StorageGCUtilizationCheckInterval)
+			defer utilizationTicker.Stop()
+			utilizationTicks = utilizationTicker.C
+		}
+		var lastGC time.Time
+		runGC := func() error {
+			defer func() { lastGC = time.Now() }()
+			const discardRatio = 0.5
+			var err error
+			for err == nil {
+				// Keep garbage collecting until there are no more rewrites,
+				// or garbage collection fails.
+				err = p.config.DB.RunValueLogGC(discardRatio)
+			}
+			if err != nil && err != badger.ErrNoRewrite {
+				return err
+			}
+			return nil
+		}
 		for {
 			select {
 			case <-p.stopping:
 				return nil
 			case <-ticker.C:
-				const discardRatio = 0.5
-				var err error
-				for err == nil {
-					// Keep garbage collecting until there are no more rewrites,
-					// or garbage collection fails.
-					err = p.config.DB.RunValueLogGC(discardRatio)
+				if p.config.Storage.SkipGC() {
+					continue
 				}
-				if err != nil && err != badger.ErrNoRewrite {
+				if err := runGC(); err != nil {
+					return err
+				}
+			case <-p.config.Storage.GCCatchUp():
+				if err := runGC(); err != nil {
+					return err
+				}
+			case <-utilizationTicks:
+				// The database's size is only refreshed once a minute,
+				// so utilization cannot reflect a run until then.
+				if time.Since(lastGC) < storageGCUtilizationDebounce {
+					continue
+				}
+				utilization := p.config.Storage.UtilizationRatio()
+				if utilization < p.config.StorageGCUtilizationTrigger {
+					continue
+				}
+				if p.config.Storage.SkipGC() {
+					continue
+				}
+				p.logger.Infof("storage utilization %.2f reached trigger, running garbage collection", utilization)
+				if err := runGC(); err != nil {
 					return err
 				}
 			}
 		}
 	})
+	if p.config.ExpirySweepInterval > 0 {
+		g.Go(func() error {
+			// This goroutine is responsible for periodically detecting
+			// traces whose events expired before a decision was made.
+			sweeper := p.config.Storage.NewExpirySweeper(func(traceID string) {
+				atomic.AddInt64(&p.eventMetrics.expiredTraces, 1)
+				if p.config.OnTraceExpired != nil {
+					p.config.OnTraceExpired(traceID)
+				}
+			})
+			ticker := time.NewTicker(p.config.ExpirySweepInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-p.stopping:
+					return nil
+				case <-ticker.C:
+					if _, err := sweeper.Sweep(); err != nil {
+						p.rateLimitedLogger.With(logp.Error(err)).Warn("failed to sweep expired traces")
+					}
+				}
+			}
+		})
+	}
+	if p.config.DecisionFilterRebuildInterval > 0 {
+		g.Go(func() error {
+			// This goroutine is responsible for periodically rebuilding
+			// the storage's decision filter, to forget expired decisions.
+			// Until it is first rebuilt, the filter is not used.
+			rebuild := func() {
+				if err := p.config.Storage.RebuildDecisionFilter(); err != nil {
+					p.rateLimitedLogger.With(logp.Error(err)).Warn("failed to rebuild decision filter")
+				}
+			}
+			rebuild()
+			ticker := time.NewTicker(p.config.DecisionFilterRebuildInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-p.stopping:
+					return nil
+				case <-ticker.C:
+					rebuild()
+				}
+			}
+		})
+	}
 	g.Go(func() error {
 		// Subscribe to remotely sampled trace IDs. This is cancelled immediately when
 		// Stop is called. The next subscriber will pick up from the previous position.
@@ -447,7 +691,12 @@ func (p *Processor) Run() error {
 
 		publishDecisions := func() error {
 			p.logger.Debug("finalizing local sampling reservoirs")
-			traceIDs = p.groups.finalizeSampledTraces(traceIDs)
+			traceIDs = p.finalizeSampledTraces(traceIDs)
+			if p.config.PersistSamplerState {
+				if err := p.writeSamplerState(); err != nil {
+					p.rateLimitedLogger.With(logp.Error(err)).Warn("failed to persist sampler state")
+				}
+			}
 			if len(traceIDs) == 0 {
 				return nil
 			}
@@ -510,12 +759,16 @@ func (p *Processor) Run() error {
 					"received error writing sampled trace: %s", err,
 				)
 			}
+			p.traceDecided(traceID)
 			var events modelpb.Batch
 			if err := p.eventStore.ReadTraceEvents(traceID, &events); err != nil {
 				p.rateLimitedLogger.Warnf(
 					"received error reading trace events: %s", err,
 				)
-				continue
+				if !errors.Is(err, eventstorage.ErrDecodeFailed) {
+					continue
+				}
+				// Undecodable events have been skipped: report the rest.
 			}
 			if n := len(events); n > 0 {
 				p.logger.Debugf("reporting %d events", n)
@@ -526,18 +779,18 @@ func (p *Processor) Run() error {
 					// deleted. We delete events from local storage so
 					// we don't publish duplicates; delivery is therefore
 					// at-most-once, not guaranteed.
+					ids := make([]string, 0, len(events))
 					for _, event := range events {
 						switch event.Type() {
 						case modelpb.TransactionEventType:
-							if err := p.eventStore.DeleteTraceEvent(event.Trace.Id, event.Transaction.Id); err != nil {
-								p.logger.With(logp.Error(err)).Warn("failed to delete transaction from local storage")
-							}
+							ids = append(ids, event.Transaction.Id)
 						case modelpb.SpanEventType:
-							if err := p.eventStore.DeleteTraceEvent(event.Trace.Id, event.Span.Id); err != nil {
-								p.logger.With(logp.Error(err)).Warn("failed to delete span from local storage")
-							}
+							ids = append(ids, event.Span.Id)
 						}
 					}
+					if err := p.eventStore.DeleteTraceEvents(traceID, ids); err != nil {
+						p.logger.With(logp.Error(err)).Warn("failed to delete events from local storage")
+					}
 				}
 				atomic.AddInt64(&p.eventMetrics.sampled, int64(len(events)))
 				if err := p.config.BatchProcessor.ProcessBatch(gracefulContext, &events); err != nil {
@@ -593,8 +846,9 @@ const (
 
 // wrappedRW wraps configurable write options for global ShardedReadWriter
 type wrappedRW struct {
-	rw         *eventstorage.ShardedReadWriter
-	writerOpts eventstorage.WriterOpts
+	rw            *eventstorage.ShardedReadWriter
+	writerOpts    eventstorage.WriterOpts
+	deltaEncoding bool
 }
 
 // Stored entries expire after ttl.
@@ -602,16 +856,52 @@ type wrappedRW struct {
 // limit value greater than zero. The hard limit on storage is set to 90% of
 // the limit to account for delay in the size reporting by badger.
 // https://github.com/dgraph-io/badger/blob/82b00f27e3827022082225221ae05c03f0d37620/db.go#L1302-L1319.
-func newWrappedRW(rw *eventstorage.ShardedReadWriter, ttl time.Duration, limit int64) *wrappedRW {
+//
+// envLimits optionally holds limits on the storage used by trace events of
+// each service environment. These are tracked by the storage rather than
+// reported by badger, so are applied exactly.
+//
+// If slidingTTLEvents is true, the expiry of a trace's events is extended each
+// time an event is written for the trace.
+//
+// onLimit determines how writes which would exceed the hard limit are handled.
+//
+// decisionConflict determines how sampling decisions for traces which already
+// have one recorded are handled.
+//
+// If deltaEncoding is true, events of a trace written by a batchWriter are
+// delta-encoded against the first event of the trace written by it.
+func newWrappedRW(
+	rw *eventstorage.ShardedReadWriter,
+	ttl time.Duration,
+	limit int64,
+	envLimits map[string]uint64,
+	slidingTTLEvents bool,
+	onLimit eventstorage.LimitStrategy,
+	decisionConflict eventstorage.DecisionConflict,
+	deltaEncoding bool,
+) *wrappedRW {
 	if limit > 1 {
 		limit = int64(float64(limit) * storageLimitThreshold)
 	}
+	var envStorageLimits map[string]int64
+	if len(envLimits) > 0 {
+		envStorageLimits = make(map[string]int64, len(envLimits))
+		for env, envLimit := range envLimits {
+			envStorageLimits[env] = int64(envLimit)
+		}
+	}
 	return &wrappedRW{
 		rw: rw,
 		writerOpts: eventstorage.WriterOpts{
-			TTL:                 ttl,
-			StorageLimitInBytes: limit,
+			TTL:                      ttl,
+			StorageLimitInBytes:      limit,
+			SlidingTTLEvents:         slidingTTLEvents,
+			OnLimit:                  onLimit,
+			OnDecisionConflict:       decisionConflict,
+			EnvironmentStorageLimits: envStorageLimits,
 		},
+		deltaEncoding: deltaEncoding,
 	}
 }
 
@@ -620,11 +910,22 @@ func (s *wrappedRW) ReadTraceEvents(traceID string, out *modelpb.Batch) error {
 	return s.rw.ReadTraceEvents(traceID, out)
 }
 
+// ReadTraceEventSummary calls ShardedReadWriter.ReadTraceEventSummary
+func (s *wrappedRW) ReadTraceEventSummary(traceID string) (eventstorage.TraceEventSummary, error) {
+	return s.rw.ReadTraceEventSummary(traceID)
+}
+
 // WriteTraceEvents calls ShardedReadWriter.WriteTraceEvents using the configured WriterOpts
 func (s *wrappedRW) WriteTraceEvent(traceID, id string, event *modelpb.APMEvent) error {
 	return s.rw.WriteTraceEvent(traceID, id, event, s.writerOpts)
 }
 
+// batchWriter returns a new batchWriter for writing the trace events of
+// a single batch.
+func (s *wrappedRW) batchWriter() *batchWriter {
+	return &batchWriter{rw: s}
+}
+
 // WriteTraceSampled calls ShardedReadWriter.WriteTraceSampled using the configured WriterOpts
 func (s *wrappedRW) WriteTraceSampled(traceID string, sampled bool) error {
 	return s.rw.WriteTraceSampled(traceID, sampled, s.writerOpts)
@@ -635,12 +936,37 @@ func (s *wrappedRW) IsTraceSampled(traceID string) (bool, error) {
 	return s.rw.IsTraceSampled(traceID)
 }
 
-// DeleteTraceEvent calls ShardedReadWriter.DeleteTraceEvent
-func (s *wrappedRW) DeleteTraceEvent(traceID, id string) error {
-	return s.rw.DeleteTraceEvent(traceID, id)
+// DeleteTraceEvents calls ShardedReadWriter.DeleteTraceEvents
+func (s *wrappedRW) DeleteTraceEvents(traceID string, ids []string) error {
+	return s.rw.DeleteTraceEvents(traceID, ids)
 }
 
 // Flush calls ShardedReadWriter.Flush
 func (s *wrappedRW) Flush() error {
 	return s.rw.Flush()
 }
+
+// batchWriter writes the trace events of a single batch. If delta encoding
+// is enabled, the events of each trace are written with a TraceWriter, so
+// that they are delta-encoded against the first event of the trace in the
+// batch.
+type batchWriter struct {
+	rw     *wrappedRW
+	traces map[string]*eventstorage.TraceWriter
+}
+
+// WriteTraceEvent writes a trace event using the configured WriterOpts.
+func (w *batchWriter) WriteTraceEvent(traceID, id string, event *modelpb.APMEvent) error {
+	if !w.rw.deltaEncoding {
+		return w.rw.WriteTraceEvent(traceID, id, event)
+	}
+	tw, ok := w.traces[traceID]
+	if !ok {
+		if w.traces == nil {
+			w.traces = make(map[string]*eventstorage.TraceWriter)
+		}
+		tw = w.rw.rw.NewTraceWriter(traceID, w.rw.writerOpts)
+		w.traces[traceID] = tw
+	}
+	return tw.WriteTraceEvent(id, event)
+}
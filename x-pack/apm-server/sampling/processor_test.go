@@ -14,6 +14,7 @@ import (
 	"runtime"
 	"sort"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -413,6 +414,425 @@ func TestProcessLocalTailSamplingPolicyOrder(t *testing.T) {
 	}
 }
 
+func TestProcessLocalTailSamplingSpanTotalDuration(t *testing.T) {
+	for _, summaries := range []bool{false, true} {
+		t.Run(fmt.Sprintf("summaries=%v", summaries), func(t *testing.T) {
+			testProcessLocalTailSamplingSpanTotalDuration(t, summaries)
+		})
+	}
+}
+
+func testProcessLocalTailSamplingSpanTotalDuration(t *testing.T, summaries bool) {
+	config := newTempdirConfig(t)
+	if summaries {
+		// Match using the stored trace event summaries rather than
+		// by reading the trace events.
+		storage := eventstorage.New(
+			config.DB, eventstorage.ProtobufCodec{},
+			eventstorage.WithTraceEventSummaries(true),
+		).NewShardedReadWriter()
+		t.Cleanup(func() { storage.Close() })
+		config.Storage = storage
+		config.TraceEventSummaries = true
+	}
+	config.Policies = []sampling.Policy{{
+		PolicyCriteria: sampling.PolicyCriteria{SpanTotalDurationType: "db", SpanTotalDurationMin: 100 * time.Millisecond},
+		SampleRate:     1,
+	}, {
+		PolicyCriteria: sampling.PolicyCriteria{},
+		SampleRate:     0,
+	}}
+	config.FlushInterval = 10 * time.Millisecond
+	published := make(chan string)
+	config.Elasticsearch = pubsubtest.Client(pubsubtest.PublisherChan(published), nil)
+
+	processor, err := sampling.NewProcessor(config)
+	require.NoError(t, err)
+
+	traceEvents := func(traceID string, dbDuration time.Duration) modelpb.Batch {
+		return modelpb.Batch{{
+			Trace:    &modelpb.Trace{Id: traceID},
+			Event:    &modelpb.Event{Duration: uint64(dbDuration)},
+			Span:     &modelpb.Span{Type: "db", Id: traceID + "_span"},
+			ParentId: traceID + "_tx",
+		}, {
+			Service: &modelpb.Service{Name: "service_name"},
+			Trace:   &modelpb.Trace{Id: traceID},
+			Event:   &modelpb.Event{Duration: uint64(time.Second)},
+			Transaction: &modelpb.Transaction{
+				Type:    "type",
+				Id:      traceID + "_tx",
+				Sampled: true,
+			},
+		}}
+	}
+	for _, batch := range []modelpb.Batch{
+		traceEvents("slow_db", 200*time.Millisecond),
+		traceEvents("fast_db", 10*time.Millisecond),
+	} {
+		// Process each event in its own batch, so the span is stored
+		// before the root transaction is processed.
+		for _, event := range batch {
+			events := modelpb.Batch{event}
+			require.NoError(t, processor.ProcessBatch(context.Background(), &events))
+			assert.Empty(t, events)
+		}
+	}
+
+	go processor.Run()
+	defer processor.Stop(context.Background())
+
+	select {
+	case traceID := <-published:
+		assert.Equal(t, "slow_db", traceID)
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for publication")
+	}
+	select {
+	case traceID := <-published:
+		t.Fatalf("unexpected publication of %q", traceID)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestProcessorSetPolicies(t *testing.T) {
+	config := newTempdirConfig(t)
+	config.Policies = []sampling.Policy{{SampleRate: 1}}
+	config.FlushInterval = 10 * time.Millisecond
+	published := make(chan string)
+	config.Elasticsearch = pubsubtest.Client(pubsubtest.PublisherChan(published), nil)
+
+	processor, err := sampling.NewProcessor(config)
+	require.NoError(t, err)
+
+	rootTransaction := func(traceID string) modelpb.Batch {
+		return modelpb.Batch{{
+			Service: &modelpb.Service{Name: "service_name"},
+			Trace:   &modelpb.Trace{Id: traceID},
+			Event:   &modelpb.Event{Duration: uint64(time.Second)},
+			Transaction: &modelpb.Transaction{
+				Type:    "type",
+				Id:      traceID + "_tx",
+				Sampled: true,
+			},
+		}}
+	}
+	batch := rootTransaction("before")
+	require.NoError(t, processor.ProcessBatch(context.Background(), &batch))
+	assert.Empty(t, batch)
+
+	// Invalid policies are rejected, leaving the policies unchanged.
+	err = processor.SetPolicies([]sampling.Policy{{PolicyCriteria: sampling.PolicyCriteria{ServiceName: "x"}, SampleRate: 1}})
+	assert.EqualError(t, err, "invalid tail-sampling policies: Policies does not contain a default (empty criteria) policy")
+
+	// Transactions processed after SetPolicies are matched against the
+	// new policies, while transactions already admitted to the reservoirs
+	// of the old policies are still sampled.
+	require.NoError(t, processor.SetPolicies([]sampling.Policy{{SampleRate: 0}}))
+	batch = rootTransaction("after")
+	require.NoError(t, processor.ProcessBatch(context.Background(), &batch))
+	assert.Empty(t, batch)
+
+	go processor.Run()
+	defer processor.Stop(context.Background())
+
+	select {
+	case traceID := <-published:
+		assert.Equal(t, "before", traceID)
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for publication")
+	}
+	select {
+	case traceID := <-published:
+		t.Fatalf("unexpected publication of %q", traceID)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestProcessorSetPoliciesConcurrent(t *testing.T) {
+	config := newTempdirConfig(t)
+	processor, err := sampling.NewProcessor(config)
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			assert.NoError(t, processor.SetPolicies([]sampling.Policy{
+				{PolicyCriteria: sampling.PolicyCriteria{ServiceName: "service_name"}, SampleRate: 0.5},
+				{SampleRate: float64(i%2) * 0.5},
+			}))
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		traceID := fmt.Sprintf("trace_%d", i)
+		batch := modelpb.Batch{{
+			Service:     &modelpb.Service{Name: "service_name"},
+			Trace:       &modelpb.Trace{Id: traceID},
+			Transaction: &modelpb.Transaction{Type: "type", Id: traceID + "_tx", Sampled: true},
+		}}
+		assert.NoError(t, processor.ProcessBatch(context.Background(), &batch))
+		collectProcessorMetrics(processor)
+	}
+	close(stop)
+	wg.Wait()
+}
+
+func TestProcessorSetPoliciesConcurrentFinalize(t *testing.T) {
+	config := newTempdirConfig(t)
+	// Matching on destination service requires reading each trace's
+	// events, widening the window between matching policies and sampling.
+	policies := []sampling.Policy{
+		{PolicyCriteria: sampling.PolicyCriteria{DestinationService: "unknown"}, SampleRate: 1},
+		{SampleRate: 1},
+	}
+	config.Policies = policies
+	config.FlushInterval = time.Millisecond
+	processor, err := sampling.NewProcessor(config)
+	require.NoError(t, err)
+	go processor.Run()
+	defer processor.Stop(context.Background())
+
+	// Replace the policies, and so retire their reservoirs, while root
+	// transactions are being admitted to them and reservoirs are being
+	// finalized. Every trace must still be sampled, rather than admitted
+	// to a reservoir which has already been finalized and discarded.
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			assert.NoError(t, processor.SetPolicies(policies))
+		}
+	}()
+	// Fewer traces are processed than fit in a reservoir, so that all
+	// are sampled.
+	const numWorkers, tracesPerWorker = 8, 100
+	var workers sync.WaitGroup
+	for i := 0; i < numWorkers; i++ {
+		workers.Add(1)
+		go func(i int) {
+			defer workers.Done()
+			for j := 0; j < tracesPerWorker; j++ {
+				traceID := fmt.Sprintf("trace_%d_%d", i, j)
+				batch := modelpb.Batch{{
+					Service:     &modelpb.Service{Name: "service_name"},
+					Trace:       &modelpb.Trace{Id: traceID},
+					Transaction: &modelpb.Transaction{Type: "type", Id: traceID + "_tx", Sampled: true},
+				}}
+				assert.NoError(t, processor.ProcessBatch(context.Background(), &batch))
+			}
+		}(i)
+	}
+	workers.Wait()
+	close(stop)
+	wg.Wait()
+
+	undecided := func() (n int) {
+		for i := 0; i < numWorkers; i++ {
+			for j := 0; j < tracesPerWorker; j++ {
+				sampled, err := config.Storage.IsTraceSampled(fmt.Sprintf("trace_%d_%d", i, j))
+				if err != nil || !sampled {
+					n++
+				}
+			}
+		}
+		return n
+	}
+	assert.Eventually(t, func() bool { return undecided() == 0 }, 10*time.Second, 10*time.Millisecond)
+	assert.Zero(t, undecided())
+}
+
+func TestProcessDeltaEncoding(t *testing.T) {
+	config := newTempdirConfig(t)
+	config.DeltaEncoding = true
+	processor, err := sampling.NewProcessor(config)
+	require.NoError(t, err)
+
+	trace := modelpb.Trace{Id: "0102030405060708090a0b0c0d0e0f10"}
+	service := modelpb.Service{Name: "service_name", Version: "1.0.0", Environment: "production"}
+	agent := modelpb.Agent{Name: "go", Version: "2.0.0"}
+	in := modelpb.Batch{{
+		Trace:    &trace,
+		Service:  &service,
+		Agent:    &agent,
+		ParentId: "0102030405060700",
+		Transaction: &modelpb.Transaction{
+			Type:    "type",
+			Id:      "0102030405060708",
+			Sampled: true,
+		},
+	}, {
+		Trace:    &trace,
+		Service:  &service,
+		Agent:    &agent,
+		ParentId: "0102030405060708",
+		Span:     &modelpb.Span{Type: "db", Id: "0102030405060709"},
+	}}
+	events := append(modelpb.Batch{}, in...)
+	require.NoError(t, processor.ProcessBatch(context.Background(), &events))
+	assert.Empty(t, events)
+	assert.NoError(t, config.Storage.Flush())
+
+	reader := eventstorage.New(config.DB, eventstorage.ProtobufCodec{}).NewReadWriter()
+	defer reader.Close()
+
+	// The span is stored as a delta against the transaction.
+	raw, err := reader.ReadTraceEventRaw(trace.Id, in[1].Span.Id)
+	require.NoError(t, err)
+	full, err := eventstorage.ProtobufCodec{}.EncodeEvent(in[1])
+	require.NoError(t, err)
+	assert.Less(t, len(raw), len(full))
+
+	var batch modelpb.Batch
+	assert.NoError(t, reader.ReadTraceEvents(trace.Id, &batch))
+	assert.Empty(t, cmp.Diff(in, batch, protocmp.Transform()))
+}
+
+func TestProcessExpirySweep(t *testing.T) {
+	config := newTempdirConfig(t)
+	config.ExpirySweepInterval = 10 * time.Millisecond
+	expired := make(chan string, 1)
+	config.OnTraceExpired = func(traceID string) { expired <- traceID }
+	processor, err := sampling.NewProcessor(config)
+	require.NoError(t, err)
+
+	traceID := "0102030405060708090a0b0c0d0e0f10"
+	batch := modelpb.Batch{{
+		Trace: &modelpb.Trace{Id: traceID},
+		Span:  &modelpb.Span{Type: "type", Id: "0102030405060709"},
+	}}
+	require.NoError(t, processor.ProcessBatch(context.Background(), &batch))
+	assert.Empty(t, batch)
+	require.NoError(t, config.Storage.Flush())
+
+	go processor.Run()
+	defer processor.Stop(context.Background())
+
+	// Wait for the trace to be observed as pending, then remove its
+	// events without a decision, as if they had expired.
+	time.Sleep(50 * time.Millisecond)
+	require.NoError(t, config.Storage.DeleteTraceEvent(traceID, "0102030405060709"))
+	require.NoError(t, config.Storage.Flush())
+
+	select {
+	case id := <-expired:
+		assert.Equal(t, traceID, id)
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for expired trace")
+	}
+	assert.NoError(t, processor.Stop(context.Background()))
+
+	expectedMonitoring := monitoring.MakeFlatSnapshot()
+	expectedMonitoring.Ints["sampling.storage.expired_traces"] = 1
+	assertMonitoring(t, processor, expectedMonitoring, `sampling.storage.expired_traces`)
+}
+
+func TestProcessMaxConcurrentTraces(t *testing.T) {
+	config := newTempdirConfig(t)
+	config.FlushInterval = time.Minute
+	config.MaxConcurrentTraces = 1
+	config.Policies = []sampling.Policy{{SampleRate: 1}}
+	processor, err := sampling.NewProcessor(config)
+	require.NoError(t, err)
+	go processor.Run()
+	defer processor.Stop(context.Background())
+
+	newSpan := func(traceID, spanID string) *modelpb.APMEvent {
+		return &modelpb.APMEvent{
+			Trace: &modelpb.Trace{Id: traceID},
+			Event: &modelpb.Event{Duration: uint64(123 * time.Millisecond)},
+			Span: &modelpb.Span{
+				Type: "type",
+				Id:   spanID,
+			},
+		}
+	}
+
+	// The first trace is buffered, up to the limit.
+	batch := modelpb.Batch{newSpan("trace1", "span1"), newSpan("trace1", "span2")}
+	require.NoError(t, processor.ProcessBatch(context.Background(), &batch))
+	assert.Empty(t, batch)
+
+	// The second trace exceeds the limit, and is decided immediately
+	// by the default policy; later events follow the decision.
+	batch = modelpb.Batch{newSpan("trace2", "span3"), newSpan("trace2", "span4")}
+	require.NoError(t, processor.ProcessBatch(context.Background(), &batch))
+	assert.Len(t, batch, 2)
+
+	expectedMonitoring := monitoring.MakeFlatSnapshot()
+	expectedMonitoring.Ints["sampling.storage.buffered_traces"] = 1
+	expectedMonitoring.Ints["sampling.storage.overflow_traces"] = 1
+	assertMonitoring(t, processor, expectedMonitoring, `sampling.storage.*_traces`)
+
+	// Stop the processor so we can access the database.
+	assert.NoError(t, processor.Stop(context.Background()))
+	assert.NoError(t, config.Storage.Flush())
+	reader := eventstorage.New(config.DB, eventstorage.ProtobufCodec{}).NewReadWriter()
+	defer reader.Close()
+
+	sampled, err := reader.IsTraceSampled("trace2")
+	assert.NoError(t, err)
+	assert.True(t, sampled)
+	_, err = reader.IsTraceSampled("trace1")
+	assert.Equal(t, eventstorage.ErrNotFound, err)
+}
+
+func TestProcessMaxConcurrentTracesDroppedFromReservoir(t *testing.T) {
+	config := newTempdirConfig(t)
+	config.FlushInterval = 10 * time.Millisecond
+	config.MaxConcurrentTraces = 10
+	config.Policies = []sampling.Policy{{SampleRate: 0.5}}
+	published := make(chan string, 2)
+	var publisher pubsubtest.PublisherFunc = func(ctx context.Context, traceID string) error {
+		published <- traceID
+		return nil
+	}
+	config.Elasticsearch = pubsubtest.Client(publisher, nil)
+	processor, err := sampling.NewProcessor(config)
+	require.NoError(t, err)
+	go processor.Run()
+	defer processor.Stop(context.Background())
+
+	// Both root transactions are admitted to the reservoir, but only one
+	// of the two traces is sampled when it is finalized.
+	batch := modelpb.Batch{}
+	for _, traceID := range []string{"trace1", "trace2"} {
+		batch = append(batch, &modelpb.APMEvent{
+			Trace:       &modelpb.Trace{Id: traceID},
+			Event:       &modelpb.Event{Duration: uint64(123 * time.Millisecond)},
+			Transaction: &modelpb.Transaction{Type: "type", Id: traceID, Sampled: true},
+		})
+	}
+	require.NoError(t, processor.ProcessBatch(context.Background(), &batch))
+	assert.Empty(t, batch)
+
+	select {
+	case <-published:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for publication")
+	}
+	// The trace dropped from the reservoir is no longer tracked as
+	// buffered, along with the sampled trace.
+	assert.Eventually(t, func() bool {
+		return collectProcessorMetrics(processor).Ints["sampling.storage.buffered_traces"] == 0
+	}, 10*time.Second, 10*time.Millisecond)
+	assert.Len(t, published, 0)
+}
+
 func TestProcessRemoteTailSampling(t *testing.T) {
 	config := newTempdirConfig(t)
 	config.Policies = []sampling.Policy{{SampleRate: 0.5}}
@@ -587,6 +1007,30 @@ func TestStorageMonitoring(t *testing.T) {
 	assert.NotZero(t, metrics.Ints, "sampling.storage.value_log_size")
 }
 
+func TestStorageMonitoringTenantUsage(t *testing.T) {
+	config := newTempdirConfig(t)
+	config.Storage = eventstorage.New(config.DB, eventstorage.ProtobufCodec{}, eventstorage.WithTenantKey(
+		eventstorage.TenantKey{ServiceNameSeparator: "-"},
+	)).NewShardedReadWriter()
+	t.Cleanup(func() { config.Storage.Close() })
+
+	processor, err := sampling.NewProcessor(config)
+	require.NoError(t, err)
+	for _, serviceName := range []string{"acme-checkout", "frontend"} {
+		traceID := uuid.Must(uuid.NewV4()).String()
+		batch := modelpb.Batch{{
+			Service: &modelpb.Service{Name: serviceName},
+			Trace:   &modelpb.Trace{Id: traceID},
+			Span:    &modelpb.Span{Type: "type", Id: traceID},
+		}}
+		require.NoError(t, processor.ProcessBatch(context.Background(), &batch))
+	}
+
+	metrics := collectProcessorMetrics(processor)
+	assert.Positive(t, metrics.Ints["sampling.storage.tenant_usage.acme"])
+	assert.Positive(t, metrics.Ints["sampling.storage.tenant_usage._none"])
+}
+
 func TestStorageGC(t *testing.T) {
 	if testing.Short() {
 		t.Skip("skipping slow test")
@@ -598,7 +1042,7 @@ func TestStorageGC(t *testing.T) {
 
 	// Create a new badger DB with smaller value log files so we can test GC.
 	config.DB.Close()
-	badgerDB, err := eventstorage.OpenBadger(config.StorageDir, 1024*1024)
+	badgerDB, err := eventstorage.OpenBadger(config.StorageDir, eventstorage.BadgerConfig{ValueLogFileSize: 1024 * 1024})
 	require.NoError(t, err)
 	t.Cleanup(func() { badgerDB.Close() })
 	config.DB = badgerDB
@@ -649,11 +1093,16 @@ func TestStorageGC(t *testing.T) {
 		writeBatch(500)
 	}
 
+	// Garbage collection is skipped while paused.
+	config.Storage.PauseGC()
 	config.StorageGCInterval = 10 * time.Millisecond
 	processor, err := sampling.NewProcessor(config)
 	require.NoError(t, err)
 	go processor.Run()
 	defer processor.Stop(context.Background())
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, "000000.vlog", vlogFilenames()[0])
+	config.Storage.ResumeGC()
 
 	// Wait for the first value log file to be garbage collected.
 	deadline := time.Now().Add(10 * time.Second)
@@ -668,6 +1117,79 @@ func TestStorageGC(t *testing.T) {
 	t.Fatal("timed out waiting for value log garbage collection")
 }
 
+func TestStorageGCUtilizationTrigger(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping slow test")
+	}
+
+	config := newTempdirConfig(t)
+	config.TTL = 10 * time.Millisecond
+	config.FlushInterval = 10 * time.Millisecond
+	config.StorageGCInterval = time.Hour // effectively disable scheduled runs
+
+	// Create a new badger DB with smaller value log files so we can test GC.
+	config.DB.Close()
+	openStorage := func() {
+		badgerDB, err := eventstorage.OpenBadger(config.StorageDir, eventstorage.BadgerConfig{ValueLogFileSize: 1024 * 1024})
+		require.NoError(t, err)
+		t.Cleanup(func() { badgerDB.Close() })
+		config.DB = badgerDB
+		config.Storage = eventstorage.
+			New(config.DB, eventstorage.ProtobufCodec{}, eventstorage.WithStorageLimit(1024*1024)).
+			NewShardedReadWriter()
+		t.Cleanup(func() { config.Storage.Close() })
+	}
+	openStorage()
+
+	vlogFilenames := func() []string {
+		entries, _ := os.ReadDir(config.StorageDir)
+		var vlogs []string
+		for _, entry := range entries {
+			if name := entry.Name(); strings.HasSuffix(name, ".vlog") {
+				vlogs = append(vlogs, name)
+			}
+		}
+		sort.Strings(vlogs)
+		return vlogs
+	}
+
+	// Process spans until value log files have been created.
+	for len(vlogFilenames()) < 3 {
+		processor, err := sampling.NewProcessor(config)
+		require.NoError(t, err)
+		go processor.Run()
+		for i := 0; i < 500; i++ {
+			traceID := uuid.Must(uuid.NewV4()).String()
+			batch := modelpb.Batch{{
+				Trace: &modelpb.Trace{Id: traceID},
+				Event: &modelpb.Event{Duration: uint64(123 * time.Millisecond)},
+				Span:  &modelpb.Span{Type: "type", Id: traceID},
+			}}
+			require.NoError(t, processor.ProcessBatch(context.Background(), &batch))
+		}
+		require.NoError(t, processor.Stop(context.Background()))
+	}
+
+	// Reopen the database so its size, and so the storage utilization, is
+	// updated without waiting a minute. The storage is well over its limit,
+	// so garbage collection is triggered.
+	config.Storage.Close()
+	require.NoError(t, config.DB.Close())
+	openStorage()
+	require.Greater(t, config.Storage.UtilizationRatio(), 0.7)
+	config.StorageGCUtilizationTrigger = 0.7
+	config.StorageGCUtilizationCheckInterval = 10 * time.Millisecond
+	processor, err := sampling.NewProcessor(config)
+	require.NoError(t, err)
+	go processor.Run()
+	defer processor.Stop(context.Background())
+
+	assert.Eventually(t, func() bool {
+		vlogs := vlogFilenames()
+		return len(vlogs) == 0 || vlogs[0] != "000000.vlog"
+	}, 10*time.Second, 10*time.Millisecond, "timed out waiting for value log garbage collection")
+}
+
 func TestStorageLimit(t *testing.T) {
 	// This test ensures that when tail sampling is configured with a hard
 	// storage limit, the limit is respected once the size is available.
@@ -713,7 +1235,7 @@ func TestStorageLimit(t *testing.T) {
 
 	// Open a new instance of the badgerDB and check the size.
 	var err error
-	config.DB, err = eventstorage.OpenBadger(config.StorageDir, 1024*1024)
+	config.DB, err = eventstorage.OpenBadger(config.StorageDir, eventstorage.BadgerConfig{ValueLogFileSize: 1024 * 1024})
 	require.NoError(t, err)
 	t.Cleanup(func() { config.DB.Close() })
 
@@ -807,7 +1329,7 @@ func newTempdirConfig(tb testing.TB) sampling.Config {
 	require.NoError(tb, err)
 	tb.Cleanup(func() { os.RemoveAll(tempdir) })
 
-	badgerDB, err := eventstorage.OpenBadger(tempdir, 0)
+	badgerDB, err := eventstorage.OpenBadger(tempdir, eventstorage.BadgerConfig{})
 	require.NoError(tb, err)
 	tb.Cleanup(func() { badgerDB.Close() })
 
@@ -932,3 +1454,58 @@ func waitFileModified(tb testing.TB, filename string, after time.Time) ([]byte,
 		}
 	}
 }
+
+func TestProcessorPersistSamplerState(t *testing.T) {
+	config := newTempdirConfig(t)
+	config.PersistSamplerState = true
+	config.Policies = []sampling.Policy{{
+		PolicyCriteria:      sampling.PolicyCriteria{ServiceName: "service"},
+		SampleRate:          0.1,
+		ErrorRateScaling:    true,
+		ErrorRateMultiplier: 9,
+	}, {
+		SampleRate: 0.1,
+	}}
+
+	effectiveSampleRate := func(p *sampling.Processor) float64 {
+		return collectProcessorMetrics(p).Floats["sampling.policies.0.effective_sample_rate"]
+	}
+
+	processor, err := sampling.NewProcessor(config)
+	require.NoError(t, err)
+	go processor.Run()
+	for i := 0; i < 100; i++ {
+		traceID := uuid.Must(uuid.NewV4()).String()
+		batch := modelpb.Batch{{
+			Service: &modelpb.Service{Name: "service"},
+			Trace:   &modelpb.Trace{Id: traceID},
+			Event:   &modelpb.Event{Duration: uint64(123 * time.Millisecond), Outcome: "failure"},
+			Transaction: &modelpb.Transaction{
+				Type:    "type",
+				Id:      traceID,
+				Sampled: true,
+			},
+		}}
+		require.NoError(t, processor.ProcessBatch(context.Background(), &batch))
+	}
+	// Stopping the processor finalizes the reservoirs, scaling up the
+	// effective sample rate for the failed transactions, and persists it.
+	require.NoError(t, processor.Stop(context.Background()))
+	assert.Equal(t, 1.0, effectiveSampleRate(processor))
+
+	// A new processor restores the effective sample rate.
+	processor, err = sampling.NewProcessor(config)
+	require.NoError(t, err)
+	assert.Equal(t, 1.0, effectiveSampleRate(processor))
+
+	// State is not restored if the policy has changed, or if not enabled.
+	config.Policies[0].ErrorRateMultiplier = 8
+	processor, err = sampling.NewProcessor(config)
+	require.NoError(t, err)
+	assert.Equal(t, 0.1, effectiveSampleRate(processor))
+	config.Policies[0].ErrorRateMultiplier = 9
+	config.PersistSamplerState = false
+	processor, err = sampling.NewProcessor(config)
+	require.NoError(t, err)
+	assert.Equal(t, 0.1, effectiveSampleRate(processor))
+}
@@ -32,20 +32,23 @@ func newWeightedRandomSample(rng *rand.Rand, reservoirSize int) *weightedRandomS
 }
 
 // Sample records a trace ID with a random probability, proportional to
-// the given weight in the range [0, math.MaxFloat64].
-func (s *weightedRandomSample) Sample(weight float64, traceID string) bool {
+// the given weight in the range [0, math.MaxFloat64]. If the trace ID is
+// recorded in place of the trace ID with the lowest weight, as the
+// reservoir is full, the replaced trace ID is returned as evicted.
+func (s *weightedRandomSample) Sample(weight float64, traceID string) (sampled bool, evicted string) {
 	k := math.Pow(s.rng.Float64(), 1/weight)
 	if len(s.values) < cap(s.values) {
 		heap.Push(&s.itemheap, item{key: k, value: traceID})
-		return true
+		return true, ""
 	}
 	if k > s.keys[0] {
+		evicted = s.values[0]
 		s.keys[0] = k
 		s.values[0] = traceID
 		heap.Fix(&s.itemheap, 0)
-		return true
+		return true, evicted
 	}
-	return false
+	return false, ""
 }
 
 // Reset clears the current values, retaining the underlying storage space.
@@ -5,6 +5,7 @@
 package sampling
 
 import (
+	"math"
 	"math/rand"
 	"testing"
 	"time"
@@ -30,3 +31,17 @@ func TestResetReservoir(t *testing.T) {
 	res.Reset()
 	assert.Len(t, res.Values(), 0)
 }
+
+func TestSampleReservoirEvicted(t *testing.T) {
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	res := newWeightedRandomSample(rng, 1)
+	sampled, evicted := res.Sample(1, "a")
+	assert.True(t, sampled)
+	assert.Empty(t, evicted)
+	// A trace with a much greater weight replaces the trace in the full
+	// reservoir, which is reported as evicted.
+	sampled, evicted = res.Sample(math.MaxFloat64, "b")
+	assert.True(t, sampled)
+	assert.Equal(t, "a", evicted)
+	assert.Equal(t, []string{"b"}, res.Values())
+}
@@ -0,0 +1,158 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package sampling
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// samplerStateVersion holds the version of the samplerState schema. State
+// written with a different version is ignored when restoring.
+const samplerStateVersion = 1
+
+// samplerState holds the learned sampling state of the trace groups, as
+// persisted to storage when StorageConfig.PersistSamplerState is true.
+type samplerState struct {
+	Version int               `json:"version"`
+	Groups  []traceGroupState `json:"groups"`
+}
+
+// traceGroupState holds the learned sampling state of a single trace group.
+type traceGroupState struct {
+	// Policy holds the index of the group's policy, and PolicyFingerprint
+	// a fingerprint of the policy, so that state is restored only into
+	// the policy which it was learned for.
+	Policy            int    `json:"policy"`
+	PolicyFingerprint string `json:"policy_fingerprint"`
+
+	// Service holds the service name of a dynamic service group, and is
+	// empty for static groups.
+	Service string `json:"service,omitempty"`
+
+	IngestRate                 float64   `json:"ingest_rate"`
+	EffectiveSampleRate        float64   `json:"effective_sample_rate"`
+	EffectiveSampleRateChanged time.Time `json:"effective_sample_rate_changed"`
+}
+
+// policyFingerprint returns a fingerprint of policy, which changes if any
+// of its criteria or sampling parameters change.
+func policyFingerprint(policy Policy) string {
+	data, err := json.Marshal(policy)
+	if err != nil {
+		return ""
+	}
+	h := fnv.New64a()
+	h.Write(data)
+	return strconv.FormatUint(h.Sum64(), 16)
+}
+
+// state returns the learned sampling state of the groups.
+func (g *traceGroups) state() samplerState {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	state := samplerState{Version: samplerStateVersion}
+	for i := range g.policyGroups {
+		pg := &g.policyGroups[i]
+		fingerprint := policyFingerprint(pg.policy)
+		if pg.g != nil {
+			state.Groups = append(state.Groups, pg.g.state(i, fingerprint, ""))
+		}
+		for serviceName, group := range pg.dynamic {
+			state.Groups = append(state.Groups, group.state(i, fingerprint, serviceName))
+		}
+	}
+	return state
+}
+
+func (g *traceGroup) state(policy int, fingerprint, serviceName string) traceGroupState {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return traceGroupState{
+		Policy:                     policy,
+		PolicyFingerprint:          fingerprint,
+		Service:                    serviceName,
+		IngestRate:                 g.ingestRate,
+		EffectiveSampleRate:        g.effectiveSamplingFraction,
+		EffectiveSampleRateChanged: g.effectiveSamplingFractionChanged,
+	}
+}
+
+// restoreState restores the learned sampling state of the groups, and
+// returns the number of groups restored. State for policies which no
+// longer exist or have changed is ignored, as are dynamic service groups
+// beyond maxDynamicServiceGroups.
+func (g *traceGroups) restoreState(state samplerState) int {
+	if state.Version != samplerStateVersion {
+		return 0
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var restored int
+	for _, gs := range state.Groups {
+		if gs.Policy < 0 || gs.Policy >= len(g.policyGroups) {
+			continue
+		}
+		pg := &g.policyGroups[gs.Policy]
+		if gs.PolicyFingerprint != policyFingerprint(pg.policy) {
+			continue
+		}
+		group := pg.g
+		if pg.dynamic != nil {
+			var ok bool
+			if group, ok = pg.dynamic[gs.Service]; !ok {
+				if g.numDynamicServiceGroups == g.maxDynamicServiceGroups {
+					continue
+				}
+				g.numDynamicServiceGroups++
+				group = newTraceGroup(pg.policy)
+				pg.dynamic[gs.Service] = group
+			}
+		}
+		if group == nil {
+			continue
+		}
+		group.restoreState(gs, g.allowedSampleRates)
+		restored++
+	}
+	return restored
+}
+
+func (g *traceGroup) restoreState(state traceGroupState, allowedSampleRates []float64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.ingestRate = state.IngestRate
+	g.effectiveSamplingFraction = state.EffectiveSampleRate
+	g.effectiveSamplingFractionChanged = state.EffectiveSampleRateChanged
+	g.reservoir.Resize(g.reservoirSize(allowedSampleRates))
+}
+
+// writeSamplerState writes the learned sampling state of the policies in
+// effect to storage, expiring after the TTL.
+func (p *Processor) writeSamplerState() error {
+	data, err := json.Marshal(p.currentPolicies().groups.state())
+	if err != nil {
+		return err
+	}
+	return p.config.Storage.WriteSamplerState(data, p.config.TTL)
+}
+
+// readSamplerState restores the learned sampling state of the policies in
+// effect from storage, returning the number of trace groups restored.
+func (p *Processor) readSamplerState() (int, error) {
+	data, err := p.config.Storage.ReadSamplerState()
+	if err != nil {
+		return 0, err
+	}
+	var state samplerState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return 0, errors.Wrap(err, "failed to decode sampler state")
+	}
+	return p.currentPolicies().groups.restoreState(state), nil
+}
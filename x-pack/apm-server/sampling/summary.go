@@ -0,0 +1,129 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License 2.0;
+// you may not use this file except in compliance with the Elastic License 2.0.
+
+package sampling
+
+import (
+	"time"
+
+	"github.com/ryanuber/go-glob"
+
+	"github.com/elastic/apm-data/model/modelpb"
+
+	"github.com/elastic/apm-server/x-pack/apm-server/sampling/eventstorage"
+)
+
+// traceSummary holds information computed from the events of a trace which
+// have been received before making a sampling decision, for matching policies
+// with trace-level criteria.
+type traceSummary struct {
+	// spanDurations holds the total duration of spans, keyed by span type.
+	spanDurations map[string]time.Duration
+
+	// destinationServices holds the distinct destination service resources
+	// of spans.
+	destinationServices map[string]struct{}
+
+	// spanLabels holds the string labels of each span with labels.
+	spanLabels []map[string]*modelpb.LabelValue
+
+	// dbStatements holds the database statements of spans, truncated to
+	// maxDBStatementLength.
+	dbStatements []string
+}
+
+// summarizeTrace returns a traceSummary for the given trace events.
+func summarizeTrace(events modelpb.Batch) *traceSummary {
+	summary := traceSummary{spanDurations: make(map[string]time.Duration)}
+	for _, event := range events {
+		if event.Type() != modelpb.SpanEventType {
+			continue
+		}
+		summary.spanDurations[event.Span.Type] += time.Duration(event.GetEvent().GetDuration())
+		if resource := event.Span.GetDestinationService().GetResource(); resource != "" {
+			if summary.destinationServices == nil {
+				summary.destinationServices = make(map[string]struct{})
+			}
+			summary.destinationServices[resource] = struct{}{}
+		}
+		if len(event.Labels) > 0 {
+			summary.spanLabels = append(summary.spanLabels, event.Labels)
+		}
+		if statement := event.Span.GetDb().GetStatement(); statement != "" {
+			if len(statement) > maxDBStatementLength {
+				statement = statement[:maxDBStatementLength]
+			}
+			summary.dbStatements = append(summary.dbStatements, statement)
+		}
+	}
+	return &summary
+}
+
+// storedTraceSummary returns a traceSummary for a trace event summary
+// maintained by storage. See eventstorage.WithTraceEventSummaries.
+//
+// Stored summaries do not hold span labels or database statements, so the
+// result must not be used for matching policies with those criteria.
+func storedTraceSummary(stored eventstorage.TraceEventSummary) *traceSummary {
+	summary := traceSummary{spanDurations: stored.SpanDurations}
+	if len(stored.DestinationServices) > 0 {
+		summary.destinationServices = make(map[string]struct{}, len(stored.DestinationServices))
+		for _, resource := range stored.DestinationServices {
+			summary.destinationServices[resource] = struct{}{}
+		}
+	}
+	return &summary
+}
+
+// totalSpanDuration returns the total duration of the trace's spans, of
+// all types.
+func (s *traceSummary) totalSpanDuration() time.Duration {
+	var total time.Duration
+	for _, d := range s.spanDurations {
+		total += d
+	}
+	return total
+}
+
+// hasDestinationService reports whether any span of the trace has a
+// destination service resource matching the glob pattern.
+func (s *traceSummary) hasDestinationService(pattern string) bool {
+	for resource := range s.destinationServices {
+		if glob.Glob(pattern, resource) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasSpanLabels reports whether any span of the trace has all of the given
+// string labels, with the given values.
+func (s *traceSummary) hasSpanLabels(labels map[string]string) bool {
+	for _, spanLabels := range s.spanLabels {
+		if hasLabels(spanLabels, labels) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasDBStatement reports whether any span of the trace has a database
+// statement matching the glob pattern.
+func (s *traceSummary) hasDBStatement(pattern string) bool {
+	for _, statement := range s.dbStatements {
+		if glob.Glob(pattern, statement) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasLabels(have map[string]*modelpb.LabelValue, want map[string]string) bool {
+	for k, v := range want {
+		if label, ok := have[k]; !ok || label.GetValue() != v {
+			return false
+		}
+	}
+	return true
+}